@@ -0,0 +1,87 @@
+package rdns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ACL is a resolver that only forwards queries from clients permitted by lists
+// of allowed and denied networks. Queries from other clients are refused, or
+// dropped, before any upstream resolver is involved.
+type ACL struct {
+	id string
+	ACLOptions
+	resolver Resolver
+	metrics  *BlocklistMetrics
+}
+
+var _ Resolver = &ACL{}
+
+type ACLOptions struct {
+	// Networks that are allowed to send queries. All clients are allowed if
+	// empty.
+	Allow []*net.IPNet
+
+	// Networks that aren't allowed to send queries.
+	Deny []*net.IPNet
+
+	// By default, a client in both lists is denied. With this set, the allow
+	// list takes precedence instead and only clients not on it are checked
+	// against the deny list.
+	AllowOverridesDeny bool
+
+	// Drop queries from denied clients rather than respond with REFUSED.
+	Drop bool
+}
+
+// NewACL returns a new instance of an access-control resolver.
+func NewACL(id string, resolver Resolver, opt ACLOptions) *ACL {
+	return &ACL{
+		id:         id,
+		ACLOptions: opt,
+		resolver:   resolver,
+		metrics:    NewBlocklistMetrics(id),
+	}
+}
+
+// Resolve a DNS query if the client is permitted to send it, refuse or drop
+// it otherwise.
+func (r *ACL) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if !r.permitted(ci.SourceIP) {
+		log := logger(r.id, q, ci)
+		r.metrics.blocked.Add(1)
+		if r.Drop {
+			log.Debug("client denied, dropping query")
+			return nil, nil
+		}
+		log.Debug("client denied, refusing query")
+		return refused(q), nil
+	}
+	r.metrics.allowed.Add(1)
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *ACL) String() string {
+	return r.id
+}
+
+func (r *ACL) permitted(ip net.IP) bool {
+	if r.AllowOverridesDeny && containsIP(r.Allow, ip) {
+		return true
+	}
+	if containsIP(r.Deny, ip) {
+		return false
+	}
+	return len(r.Allow) == 0 || containsIP(r.Allow, ip)
+}
+
+// Returns true if the IP is in any of the networks.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACL(t *testing.T) {
+	cidrs := func(s ...string) []*net.IPNet {
+		var out []*net.IPNet
+		for _, c := range s {
+			_, n, err := net.ParseCIDR(c)
+			require.NoError(t, err)
+			out = append(out, n)
+		}
+		return out
+	}
+	tests := []struct {
+		name     string
+		opt      ACLOptions
+		ip       string
+		expected bool
+	}{
+		{"empty lists v4", ACLOptions{}, "192.0.2.1", true},
+		{"empty lists v6", ACLOptions{}, "2001:db8::1", true},
+		{"allowed v4", ACLOptions{Allow: cidrs("192.0.2.0/24")}, "192.0.2.1", true},
+		{"not allowed v4", ACLOptions{Allow: cidrs("192.0.2.0/24")}, "198.51.100.1", false},
+		{"allowed v6", ACLOptions{Allow: cidrs("2001:db8::/32")}, "2001:db8::1", true},
+		{"not allowed v6", ACLOptions{Allow: cidrs("2001:db8::/32")}, "2001:db9::1", false},
+		{"v4 not in v6 allow list", ACLOptions{Allow: cidrs("2001:db8::/32")}, "192.0.2.1", false},
+		{"denied v4", ACLOptions{Deny: cidrs("192.0.2.0/24")}, "192.0.2.1", false},
+		{"not denied v4", ACLOptions{Deny: cidrs("192.0.2.0/24")}, "198.51.100.1", true},
+		{"denied v6", ACLOptions{Deny: cidrs("2001:db8::/32")}, "2001:db8::1", false},
+		{"deny overrides allow", ACLOptions{Allow: cidrs("192.0.2.0/24"), Deny: cidrs("192.0.2.128/25")}, "192.0.2.129", false},
+		{"allow overrides deny", ACLOptions{Allow: cidrs("2001:db8::1/128"), Deny: cidrs("2001:db8::/32"), AllowOverridesDeny: true}, "2001:db8::1", true},
+		{"allow overrides deny, not allowed", ACLOptions{Allow: cidrs("2001:db8::1/128"), Deny: cidrs("2001:db8::/32"), AllowOverridesDeny: true}, "2001:db8::2", false},
+		{"allow overrides deny, not listed", ACLOptions{Allow: cidrs("2001:db8::1/128"), AllowOverridesDeny: true}, "2001:db9::1", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstream := new(TestResolver)
+			r := NewACL("test-acl", upstream, test.opt)
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			a, err := r.Resolve(q, ClientInfo{SourceIP: net.ParseIP(test.ip)})
+			require.NoError(t, err)
+			if test.expected {
+				require.Equal(t, 1, upstream.HitCount())
+				require.Equal(t, dns.RcodeSuccess, a.Rcode)
+			} else {
+				require.Equal(t, 0, upstream.HitCount())
+				require.Equal(t, dns.RcodeRefused, a.Rcode)
+			}
+		})
+	}
+}
+
+func TestACLDrop(t *testing.T) {
+	upstream := new(TestResolver)
+	_, n, err := net.ParseCIDR("192.0.2.0/24")
+	require.NoError(t, err)
+	r := NewACL("test-acl", upstream, ACLOptions{Deny: []*net.IPNet{n}, Drop: true})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.0.2.1")})
+	require.NoError(t, err)
+	require.Nil(t, a)
+	require.Equal(t, 0, upstream.HitCount())
+}
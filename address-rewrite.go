@@ -0,0 +1,158 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// AddressRewrite is a resolver that rewrites the addresses of A and AAAA
+// records in responses from one network to another, similar to 1:1 NAT. Used
+// in split-horizon setups where upstream resolvers respond with public
+// addresses of internal services that clients in the network can't reach.
+// Mappings can be limited to clients in some networks.
+type AddressRewrite struct {
+	id string
+	AddressRewriteOptions
+	resolver  Resolver
+	rewritten *expvar.Int
+}
+
+var _ Resolver = &AddressRewrite{}
+
+type AddressRewriteOptions struct {
+	// Mappings of networks. If they overlap, the first matching one is used.
+	Mappings []AddressMapping
+}
+
+// AddressMapping rewrites the addresses in one network into another of the
+// same size, keeping the host part of the addresses. Single addresses are
+// networks with a /32 or /128 mask.
+type AddressMapping struct {
+	// Network of the addresses that are rewritten.
+	From *net.IPNet
+
+	// Network they're rewritten into.
+	To *net.IPNet
+
+	// Networks of the clients the mapping applies to. Applies to all clients
+	// if empty.
+	Clients []*net.IPNet
+}
+
+// NewAddressRewrite returns a new instance of an address rewriting resolver.
+func NewAddressRewrite(id string, resolver Resolver, opt AddressRewriteOptions) (*AddressRewrite, error) {
+	if len(opt.Mappings) == 0 {
+		return nil, errors.New("no address mappings")
+	}
+	for _, m := range opt.Mappings {
+		if m.From == nil || m.To == nil {
+			return nil, errors.New("address mapping without network")
+		}
+		fromOnes, fromBits := m.From.Mask.Size()
+		toOnes, toBits := m.To.Mask.Size()
+		if fromOnes != toOnes || fromBits != toBits {
+			return nil, fmt.Errorf("address mapping from %s to %s with networks of different size", m.From, m.To)
+		}
+	}
+	return &AddressRewrite{
+		id:                    id,
+		AddressRewriteOptions: opt,
+		resolver:              resolver,
+		rewritten:             getVarInt("router", id, "rewrite"),
+	}, nil
+}
+
+// Resolve a DNS query and rewrite the addresses in the response according to
+// the mappings for the client.
+func (r *AddressRewrite) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	var mappings []AddressMapping
+	for _, m := range r.Mappings {
+		if len(m.Clients) == 0 || containsIP(m.Clients, ci.SourceIP) {
+			mappings = append(mappings, m)
+		}
+	}
+	if len(mappings) == 0 {
+		return a, nil
+	}
+
+	// Rewrite the records in a copy, the response could be shared with a cache
+	out := a.Copy()
+	log := logger(r.id, q, ci)
+	var n int
+	for _, rrs := range [][]dns.RR{out.Answer, out.Extra} {
+		for _, rr := range rrs {
+			var ip *net.IP
+			switch record := rr.(type) {
+			case *dns.A:
+				ip = &record.A
+			case *dns.AAAA:
+				ip = &record.AAAA
+			default:
+				continue
+			}
+			rewritten, ok := rewriteAddress(mappings, *ip)
+			if !ok {
+				continue
+			}
+			// Keep the address in the form of the record type. IPv4-mapped
+			// addresses in AAAA records are rewritten with IPv4 mappings, but
+			// need to stay 16 bytes long. An IPv6 address can't go into an A
+			// record.
+			if _, isA := rr.(*dns.A); isA {
+				if rewritten = rewritten.To4(); rewritten == nil {
+					continue
+				}
+			} else {
+				rewritten = rewritten.To16()
+			}
+			log.WithField("from", ip.String()).WithField("to", rewritten.String()).Debug("rewriting address")
+			*ip = rewritten
+			n++
+		}
+	}
+	if n == 0 {
+		return a, nil
+	}
+	r.rewritten.Add(int64(n))
+	return out, nil
+}
+
+func (r *AddressRewrite) String() string {
+	return r.id
+}
+
+// Returns the address in the To network of the first mapping whose From
+// network contains the address.
+func rewriteAddress(mappings []AddressMapping, ip net.IP) (net.IP, bool) {
+	for _, m := range mappings {
+		if !m.From.Contains(ip) {
+			continue
+		}
+		// Bring the address to the same length as the network, 4 bytes for IPv4
+		if len(m.To.IP) == net.IPv4len {
+			ip = ip.To4()
+		} else {
+			ip = ip.To16()
+		}
+		if ip == nil || len(ip) != len(m.To.Mask) {
+			continue
+		}
+		out := make(net.IP, len(ip))
+		for i := range ip {
+			out[i] = m.To.IP[i] | ip[i]&^m.To.Mask[i]
+		}
+		return out, true
+	}
+	return nil, false
+}
@@ -0,0 +1,87 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressRewrite(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				rr("example.com. 60 IN A 203.0.113.10"),
+				rr("example.com. 60 IN A 198.51.100.1"),
+				rr("example.com. 60 IN AAAA 2001:db8:1::10"),
+			}
+			return a, nil
+		},
+	}
+	_, public4, _ := net.ParseCIDR("203.0.113.0/24")
+	_, private4, _ := net.ParseCIDR("192.168.1.0/24")
+	_, public6, _ := net.ParseCIDR("2001:db8:1::/64")
+	_, private6, _ := net.ParseCIDR("fd00::/64")
+	_, clients, _ := net.ParseCIDR("192.168.0.0/16")
+	r, err := NewAddressRewrite("test-rewrite", upstream, AddressRewriteOptions{
+		Mappings: []AddressMapping{
+			{From: public4, To: private4, Clients: []*net.IPNet{clients}},
+			{From: public6, To: private6},
+		},
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Matching addresses are rewritten for clients in the network, others
+	// are left alone
+	a, err := r.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.100")})
+	require.NoError(t, err)
+	require.Equal(t, "192.168.1.10", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, "198.51.100.1", a.Answer[1].(*dns.A).A.String())
+	require.Equal(t, "fd00::10", a.Answer[2].(*dns.AAAA).AAAA.String())
+
+	// Mappings limited to client networks don't apply to other clients
+	a, err = r.Resolve(q, ClientInfo{SourceIP: net.ParseIP("10.0.0.1")})
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.10", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, "fd00::10", a.Answer[2].(*dns.AAAA).AAAA.String())
+
+	// Networks of different size can't be mapped
+	_, err = NewAddressRewrite("test-rewrite", upstream, AddressRewriteOptions{
+		Mappings: []AddressMapping{{From: public4, To: clients}},
+	})
+	require.Error(t, err)
+}
+
+func TestAddressRewriteMappedIPv4(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{rr("example.com. 60 IN AAAA ::ffff:203.0.113.10")}
+			return a, nil
+		},
+	}
+	_, public4, _ := net.ParseCIDR("203.0.113.0/24")
+	_, private4, _ := net.ParseCIDR("192.168.1.0/24")
+	r, err := NewAddressRewrite("test-rewrite", upstream, AddressRewriteOptions{
+		Mappings: []AddressMapping{{From: public4, To: private4}},
+	})
+	require.NoError(t, err)
+
+	// IPv4-mapped addresses in AAAA records are rewritten by IPv4 mappings
+	// and have to stay in a form that can be packed
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeAAAA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer[0].(*dns.AAAA).AAAA, net.IPv6len)
+	require.Equal(t, "192.168.1.10", a.Answer[0].(*dns.AAAA).AAAA.String())
+	_, err = a.Pack()
+	require.NoError(t, err)
+}
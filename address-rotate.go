@@ -0,0 +1,120 @@
+package rdns
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// AddressRotate is a resolver that rotates the order of A and AAAA records in
+// responses by one position with every query for the same name. Clients that
+// only use the first address are spread over all of them. In sticky mode, the
+// order depends on the client IP instead, so each client always gets the same
+// order.
+type AddressRotate struct {
+	id string
+	AddressRotateOptions
+	resolver Resolver
+	mu       sync.Mutex
+	offsets  map[string]int
+}
+
+var _ Resolver = &AddressRotate{}
+
+type AddressRotateOptions struct {
+	// Max number of names to keep the rotation state for. When reached, the state
+	// of all names is reset. Default 10000.
+	MaxNames int
+
+	// Use a fixed rotation for each client, based on a hash of its IP, rather
+	// than rotating with every query. No state is kept in this mode.
+	Sticky bool
+
+	// Mixed into the hash of the client IP in sticky mode. Changing it changes
+	// the order each client gets.
+	Seed uint64
+}
+
+// NewAddressRotate returns a new instance of an address record rotator.
+func NewAddressRotate(id string, resolver Resolver, opt AddressRotateOptions) *AddressRotate {
+	if opt.MaxNames <= 0 {
+		opt.MaxNames = 10000
+	}
+	return &AddressRotate{
+		id:                   id,
+		AddressRotateOptions: opt,
+		resolver:             resolver,
+		offsets:              make(map[string]int),
+	}
+}
+
+// Resolve a DNS query with the upstream resolver and rotate the address records
+// in the response.
+func (r *AddressRotate) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	answer, err := r.resolver.Resolve(q, ci)
+	if err != nil || answer == nil || len(q.Question) < 1 {
+		return answer, err
+	}
+	// Indexes of the A and AAAA records in the answer
+	idx := make([]int, 0, len(answer.Answer))
+	for i, rr := range answer.Answer {
+		if rr.Header().Rrtype == dns.TypeA || rr.Header().Rrtype == dns.TypeAAAA {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) < 2 {
+		return answer, nil
+	}
+	var shift int
+	if r.Sticky {
+		shift = r.clientOffset(ci.SourceIP)
+	} else {
+		shift = r.nextOffset(q.Question[0].Name)
+	}
+	if shift%len(idx) == 0 {
+		return answer, nil
+	}
+	logger(r.id, q, ci).WithField("shift", shift%len(idx)).Debug("rotating address records")
+	addrs := make([]dns.RR, len(idx))
+	for i, j := range idx {
+		addrs[i] = answer.Answer[j]
+	}
+	for i, j := range idx {
+		answer.Answer[j] = addrs[(i+shift)%len(addrs)]
+	}
+	return answer, nil
+}
+
+func (r *AddressRotate) String() string {
+	return r.id
+}
+
+// Returns the number of positions to rotate the records for a name by, and
+// increments it for the next query.
+func (r *AddressRotate) nextOffset(name string) int {
+	name = strings.ToLower(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	offset, ok := r.offsets[name]
+	if !ok && len(r.offsets) >= r.MaxNames {
+		r.offsets = make(map[string]int)
+	}
+	// Wrap around well before overflowing
+	r.offsets[name] = (offset + 1) % 720720
+	return offset
+}
+
+// Returns the number of positions to rotate the records by for a client.
+func (r *AddressRotate) clientOffset(ip net.IP) int {
+	h := fnv.New32a()
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, r.Seed)
+	h.Write(b)
+	h.Write(ip.To16())
+	// Fits into an int on 32 bit platforms as well
+	return int(h.Sum32() >> 1)
+}
@@ -0,0 +1,126 @@
+package rdns
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressRotate(t *testing.T) {
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			name := q.Question[0].Name
+			a.Answer = []dns.RR{
+				&dns.CNAME{
+					Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+					Target: name,
+				},
+			}
+			if name == "single.example.com." {
+				a.Answer = append(a.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100},
+					A:   net.IP{192, 0, 2, 1},
+				})
+				return a, nil
+			}
+			for i := 1; i <= 3; i++ {
+				a.Answer = append(a.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(100 * i)},
+					A:   net.IP{192, 0, 2, byte(i)},
+				})
+			}
+			return a, nil
+		},
+	}
+	m := NewAddressRotate("test-rotate", r, AddressRotateOptions{})
+
+	// Returns the last octet of the address records in the response
+	order := func(name string) []byte {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := m.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Equal(t, dns.TypeCNAME, a.Answer[0].Header().Rrtype)
+		var out []byte
+		for _, rr := range a.Answer[1:] {
+			ip := rr.(*dns.A).A.To4()
+			require.Equal(t, uint32(100*int(ip[3])), rr.Header().Ttl) // TTL stays with its record
+			out = append(out, ip[3])
+		}
+		return out
+	}
+
+	// Consecutive queries shift the records by one position
+	require.Equal(t, []byte{1, 2, 3}, order("example.com."))
+	require.Equal(t, []byte{2, 3, 1}, order("example.com."))
+	require.Equal(t, []byte{3, 1, 2}, order("example.com."))
+	require.Equal(t, []byte{1, 2, 3}, order("example.com."))
+
+	// Rotation state is kept per name
+	require.Equal(t, []byte{1, 2, 3}, order("example.net."))
+	require.Equal(t, []byte{2, 3, 1}, order("EXAMPLE.com."))
+
+	// Nothing to rotate with a single address
+	require.Equal(t, []byte{1}, order("single.example.com."))
+	require.Equal(t, []byte{1}, order("single.example.com."))
+}
+
+func TestAddressRotateSticky(t *testing.T) {
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			for i := 1; i <= 4; i++ {
+				a.Answer = append(a.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IP{192, 0, 2, byte(i)},
+				})
+			}
+			return a, nil
+		},
+	}
+	m := NewAddressRotate("test-rotate", r, AddressRotateOptions{Sticky: true})
+
+	// Returns the last octet of the address records in the response to a client
+	order := func(client string) []byte {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		a, err := m.Resolve(q, ClientInfo{SourceIP: net.ParseIP(client)})
+		require.NoError(t, err)
+		var out []byte
+		for _, rr := range a.Answer {
+			out = append(out, rr.(*dns.A).A.To4()[3])
+		}
+		return out
+	}
+
+	// The same client gets the same order with every query
+	first := order("198.51.100.1")
+	require.Equal(t, first, order("198.51.100.1"))
+	require.Equal(t, first, order("198.51.100.1"))
+
+	// Other clients get a different, but just as stable order
+	var other string
+	for i := 2; i < 250; i++ {
+		client := net.IPv4(198, 51, 100, byte(i)).String()
+		if o := order(client); !bytes.Equal(o, first) {
+			other = client
+			require.Equal(t, o, order(client))
+			break
+		}
+	}
+	require.NotEmpty(t, other, "all clients got the same order")
+
+	// The seed changes the order of a client
+	var changed bool
+	for seed := uint64(1); seed < 100 && !changed; seed++ {
+		m = NewAddressRotate("test-rotate", r, AddressRotateOptions{Sticky: true, Seed: seed})
+		changed = !bytes.Equal(first, order("198.51.100.1"))
+	}
+	require.True(t, changed)
+}
@@ -60,6 +60,7 @@ func NewAdminListener(id, addr string, opt AdminListenerOptions) (*AdminListener
 	}
 	// Serve metrics.
 	l.mux.Handle("/routedns/vars", expvar.Handler())
+	l.mux.Handle("/metrics", NewMetricsRegistry())
 	return l, nil
 }
 
@@ -3,7 +3,9 @@ package rdns
 import (
 	"errors"
 	"expvar"
+	"fmt"
 	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -18,6 +20,7 @@ type Blocklist struct {
 	BlocklistOptions
 	resolver Resolver
 	mu       sync.RWMutex
+	reloadMu sync.Mutex // serializes reloads so an older list can't replace a newer one
 	metrics  *BlocklistMetrics
 }
 
@@ -42,6 +45,25 @@ type BlocklistOptions struct {
 
 	// Refresh period for the allowlist. Disabled if 0.
 	AllowlistRefresh time.Duration
+
+	// Response to queries matching the blocklist, unless the rule provides an
+	// IP. Can be "nxdomain", "nodata", "refused" or "spoof". Default "nxdomain".
+	BlockResponse string
+
+	// Addresses used in responses to blocked A and AAAA queries if BlockResponse
+	// is "spoof". NODATA is returned if there's no address for the query type.
+	SpoofIP4 net.IP
+	SpoofIP6 net.IP
+
+	// TTL of spoofed address records, including those of rules that provide an
+	// IP. Default 3600.
+	SpoofTTL uint32
+
+	// Local files the rules are loaded from. They are checked for changes every
+	// WatchInterval and all rules are reloaded if any of them was modified.
+	// Disabled if WatchInterval is 0.
+	WatchFiles    []string
+	WatchInterval time.Duration
 }
 
 type BlocklistMetrics struct {
@@ -49,17 +71,28 @@ type BlocklistMetrics struct {
 	blocked *expvar.Int
 	// Allowed queries count.
 	allowed *expvar.Int
+	// Blocked queries count per list.
+	match *expvar.Map
 }
 
 func NewBlocklistMetrics(id string) *BlocklistMetrics {
 	return &BlocklistMetrics{
 		allowed: getVarInt("router", id, "allow"),
 		blocked: getVarInt("router", id, "deny"),
+		match:   getVarMap("router", id, "match"),
 	}
 }
 
 // NewBlocklist returns a new instance of a blocklist resolver.
 func NewBlocklist(id string, resolver Resolver, opt BlocklistOptions) (*Blocklist, error) {
+	switch opt.BlockResponse {
+	case "", "nxdomain", "nodata", "refused", "spoof":
+	default:
+		return nil, fmt.Errorf("unsupported block-response '%s'", opt.BlockResponse)
+	}
+	if opt.SpoofTTL == 0 {
+		opt.SpoofTTL = 3600
+	}
 	blocklist := &Blocklist{
 		id:               id,
 		resolver:         resolver,
@@ -74,6 +107,9 @@ func NewBlocklist(id string, resolver Resolver, opt BlocklistOptions) (*Blocklis
 	if blocklist.AllowlistDB != nil && blocklist.AllowlistRefresh > 0 {
 		go blocklist.refreshLoopAllowlist(blocklist.AllowlistRefresh)
 	}
+	if len(blocklist.WatchFiles) > 0 && blocklist.WatchInterval > 0 {
+		go blocklist.watchLoop(blocklist.WatchInterval, fileStates(blocklist.WatchFiles))
+	}
 	return blocklist, nil
 }
 
@@ -86,6 +122,10 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	question := q.Question[0]
 	log := logger(r.id, q, ci)
 
+	// Match the normalized name so case and IDN encoding don't matter
+	matchQuestion := question
+	matchQuestion.Name = normalizeName(question.Name)
+
 	r.mu.RLock()
 	blocklistDB := r.BlocklistDB
 	allowlistDB := r.AllowlistDB
@@ -93,7 +133,7 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	// Forward to upstream or the optional allowlist-resolver immediately if there's a match in the allowlist
 	if allowlistDB != nil {
-		if _, _, match, ok := allowlistDB.Match(question); ok {
+		if _, _, match, ok := allowlistDB.Match(matchQuestion); ok {
 			log = log.WithFields(logrus.Fields{"list": match.List, "rule": match.Rule})
 			r.metrics.allowed.Add(1)
 			if r.AllowListResolver != nil {
@@ -105,7 +145,7 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		}
 	}
 
-	ip, name, match, ok := blocklistDB.Match(question)
+	ip, name, match, ok := blocklistDB.Match(matchQuestion)
 	if !ok {
 		// Didn't match anything, pass it on to the next resolver
 		log.WithField("resolver", r.resolver.String()).Debug("forwarding unmodified query to resolver")
@@ -114,6 +154,7 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 	log = log.WithFields(logrus.Fields{"list": match.List, "rule": match.Rule})
 	r.metrics.blocked.Add(1)
+	r.metrics.match.Add(match.List, 1)
 
 	// If we got a name for the PTR query, respond to it
 	if question.Qtype == dns.TypePTR && name != "" {
@@ -130,7 +171,40 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	answer := new(dns.Msg)
 	answer.SetReply(q)
 
-	// We have an IP address to return, make sure it's of the right type. If not return NXDOMAIN.
+	// We have an IP address to return, make sure it's of the right type. If not
+	// respond according to the options.
+	if spoof(answer, question, ip, r.SpoofTTL) {
+		log.Debug("spoofing response")
+		return answer, nil
+	}
+
+	switch r.BlockResponse {
+	case "nodata":
+		log.Debug("blocking request with nodata")
+	case "refused":
+		log.Debug("blocking request with refused")
+		answer.SetRcode(q, dns.RcodeRefused)
+	case "spoof":
+		ip := r.SpoofIP4
+		if question.Qtype == dns.TypeAAAA {
+			ip = r.SpoofIP6
+		}
+		if spoof(answer, question, ip, r.SpoofTTL) {
+			log.Debug("spoofing response")
+			return answer, nil
+		}
+		log.Debug("blocking request with nodata")
+	default:
+		// Block the request with NXDOMAIN if there was a match but no valid spoofed IP is given
+		log.Debug("blocking request")
+		answer.SetRcode(q, dns.RcodeNameError)
+	}
+	return answer, nil
+}
+
+// Adds an A or AAAA record with the IP to the answer if the IP matches the type
+// of the query. Returns false if it doesn't and nothing was added.
+func spoof(answer *dns.Msg, question dns.Question, ip net.IP, ttl uint32) bool {
 	if ip4 := ip.To4(); len(ip4) == net.IPv4len && question.Qtype == dns.TypeA {
 		answer.Answer = []dns.RR{
 			&dns.A{
@@ -138,13 +212,12 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 					Name:   question.Name,
 					Rrtype: dns.TypeA,
 					Class:  question.Qclass,
-					Ttl:    3600,
+					Ttl:    ttl,
 				},
 				A: ip,
 			},
 		}
-		log.Debug("spoofing response")
-		return answer, nil
+		return true
 	} else if len(ip) == net.IPv6len && question.Qtype == dns.TypeAAAA {
 		answer.Answer = []dns.RR{
 			&dns.AAAA{
@@ -152,38 +225,97 @@ func (r *Blocklist) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 					Name:   question.Name,
 					Rrtype: dns.TypeAAAA,
 					Class:  question.Qclass,
-					Ttl:    3600,
+					Ttl:    ttl,
 				},
 				AAAA: ip,
 			},
 		}
-		log.Debug("spoofing response")
-		return answer, nil
+		return true
 	}
-
-	// Block the request with NXDOMAIN if there was a match but no valid spoofed IP is given
-	log.Debug("blocking request")
-	answer.SetRcode(q, dns.RcodeNameError)
-	return answer, nil
+	return false
 }
 
 func (r *Blocklist) String() string {
 	return r.id
 }
 
+// Reload the blocklist and allowlist rules. The new rules are only used if
+// both lists can be loaded successfully, the existing rules stay active
+// otherwise.
+func (r *Blocklist) Reload() error {
+	return r.reloadLists(true, true)
+}
+
+// Reloads the blocklist, the allowlist, or both. Reloads are serialized so
+// that the rules from an older load can't replace newer ones.
+func (r *Blocklist) reloadLists(blocklist, allowlist bool) error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	r.mu.RLock()
+	blocklistDB := r.BlocklistDB
+	allowlistDB := r.AllowlistDB
+	r.mu.RUnlock()
+
+	var err error
+	if blocklist && blocklistDB != nil {
+		if blocklistDB, err = blocklistDB.Reload(); err != nil {
+			return fmt.Errorf("failed to reload blocklist: %w", err)
+		}
+	}
+	if allowlist && allowlistDB != nil {
+		if allowlistDB, err = allowlistDB.Reload(); err != nil {
+			return fmt.Errorf("failed to reload allowlist: %w", err)
+		}
+	}
+	r.mu.Lock()
+	r.BlocklistDB = blocklistDB
+	r.AllowlistDB = allowlistDB
+	r.mu.Unlock()
+	return nil
+}
+
+// Checks the modification time and size of the watched files periodically and
+// reloads the rules if any of them changed.
+func (r *Blocklist) watchLoop(interval time.Duration, last string) {
+	log := Log.WithField("id", r.id)
+	for {
+		time.Sleep(interval)
+		current := fileStates(r.WatchFiles)
+		if current == last {
+			continue
+		}
+		last = current
+		log.Debug("rule files changed, reloading")
+		if err := r.Reload(); err != nil {
+			log.WithError(err).Error("failed to load rules, keeping existing rules")
+		}
+	}
+}
+
+// Returns a string representing the modification time and size of all files.
+// Files that can't be accessed are recorded as missing.
+func fileStates(files []string) string {
+	var s string
+	for _, name := range files {
+		fi, err := os.Stat(name)
+		if err != nil {
+			s += name + ":-;"
+			continue
+		}
+		s += fmt.Sprintf("%s:%d:%d;", name, fi.ModTime().UnixNano(), fi.Size())
+	}
+	return s
+}
+
 func (r *Blocklist) refreshLoopBlocklist(refresh time.Duration) {
 	for {
 		time.Sleep(refresh)
 		log := Log.WithField("id", r.id)
 		log.Debug("reloading blocklist")
-		db, err := r.BlocklistDB.Reload()
-		if err != nil {
+		if err := r.reloadLists(true, false); err != nil {
 			log.WithError(err).Error("failed to load rules")
-			continue
 		}
-		r.mu.Lock()
-		r.BlocklistDB = db
-		r.mu.Unlock()
 	}
 }
 func (r *Blocklist) refreshLoopAllowlist(refresh time.Duration) {
@@ -191,13 +323,8 @@ func (r *Blocklist) refreshLoopAllowlist(refresh time.Duration) {
 		time.Sleep(refresh)
 		log := Log.WithField("id", r.id)
 		log.Debug("reloading allowlist")
-		db, err := r.AllowlistDB.Reload()
-		if err != nil {
+		if err := r.reloadLists(false, true); err != nil {
 			log.WithError(err).Error("failed to load rules")
-			continue
 		}
-		r.mu.Lock()
-		r.AllowlistDB = db
-		r.mu.Unlock()
 	}
 }
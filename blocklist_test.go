@@ -1,7 +1,11 @@
 package rdns
 
 import (
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -82,3 +86,226 @@ func TestBlocklistAllow(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 2, r.HitCount())
 }
+
+func TestBlocklistAllowSubdomain(t *testing.T) {
+	var ci ClientInfo
+	r := new(TestResolver)
+
+	blockDB, err := NewRegexpDB("blocklist", NewStaticLoader([]string{`(^|\.)example\.com\.$`}))
+	require.NoError(t, err)
+	allowDB, err := NewDomainDB("allowlist", NewStaticLoader([]string{".cdn.example.com"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl", r, BlocklistOptions{BlocklistDB: blockDB, AllowlistDB: allowDB})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		allowed bool
+	}{
+		{"example.com.", false},
+		{"www.example.com.", false},
+		{"cdn.example.com.", true},
+		{"img.cdn.example.com.", true},
+		{"a.b.cdn.example.com.", true},
+	}
+	for _, test := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(test.name, dns.TypeA)
+		hits := r.HitCount()
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		if test.allowed {
+			require.Equal(t, hits+1, r.HitCount(), test.name)
+		} else {
+			require.Equal(t, dns.RcodeNameError, a.Rcode, test.name)
+			require.Equal(t, hits, r.HitCount(), test.name)
+		}
+	}
+}
+
+func TestBlocklistBlockResponse(t *testing.T) {
+	var ci ClientInfo
+	r := new(TestResolver)
+	m, err := NewDomainDB("testlist", NewStaticLoader([]string{".evil.test"}))
+	require.NoError(t, err)
+
+	resolve := func(b *Blocklist, name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		return a
+	}
+
+	// NODATA
+	b, err := NewBlocklist("test-bl", r, BlocklistOptions{BlocklistDB: m, BlockResponse: "nodata"})
+	require.NoError(t, err)
+	a := resolve(b, "x.evil.test.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	// REFUSED
+	b, err = NewBlocklist("test-bl", r, BlocklistOptions{BlocklistDB: m, BlockResponse: "refused"})
+	require.NoError(t, err)
+	a = resolve(b, "evil.test.", dns.TypeA)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	// Spoofed addresses, with NODATA for types without address
+	b, err = NewBlocklist("test-bl", r, BlocklistOptions{
+		BlocklistDB:   m,
+		BlockResponse: "spoof",
+		SpoofIP4:      net.ParseIP("10.0.0.1"),
+	})
+	require.NoError(t, err)
+	a = resolve(b, "x.evil.test.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "10.0.0.1", a.Answer[0].(*dns.A).A.String())
+	a = resolve(b, "x.evil.test.", dns.TypeAAAA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	// Separate targets for A and AAAA with a custom TTL
+	b, err = NewBlocklist("test-bl", r, BlocklistOptions{
+		BlocklistDB:   m,
+		BlockResponse: "spoof",
+		SpoofIP4:      net.ParseIP("192.0.2.80"),
+		SpoofIP6:      net.ParseIP("2001:db8::80"),
+		SpoofTTL:      300,
+	})
+	require.NoError(t, err)
+	a = resolve(b, "x.evil.test.", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "192.0.2.80", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, uint32(300), a.Answer[0].Header().Ttl)
+	a = resolve(b, "x.evil.test.", dns.TypeAAAA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "2001:db8::80", a.Answer[0].(*dns.AAAA).AAAA.String())
+	require.Equal(t, uint32(300), a.Answer[0].Header().Ttl)
+	a = resolve(b, "x.evil.test.", dns.TypeMX)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	// Nothing was forwarded upstream
+	require.Equal(t, 0, r.HitCount())
+
+	// Invalid response type
+	_, err = NewBlocklist("test-bl", r, BlocklistOptions{BlocklistDB: m, BlockResponse: "invalid"})
+	require.Error(t, err)
+}
+
+func TestBlocklistFormats(t *testing.T) {
+	var ci ClientInfo
+	hostsDB, err := NewHostsDB("hosts", NewStaticLoader([]string{"0.0.0.0 ads.example"}))
+	require.NoError(t, err)
+	domainDB, err := NewDomainDB("domain", NewStaticLoader([]string{".tracker.example"}))
+	require.NoError(t, err)
+	regexpDB, err := NewRegexpDB("regexp", NewStaticLoader([]string{`^.*\.?evil\.example\.$`}))
+	require.NoError(t, err)
+	db, err := NewMultiDB(hostsDB, domainDB, regexpDB)
+	require.NoError(t, err)
+
+	r := new(TestResolver)
+	b, err := NewBlocklist("test-bl", r, BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		blocked bool
+	}{
+		{"ads.example.", true},          // hosts
+		{"tracker.example.", true},      // domain
+		{"a.b.tracker.example.", true},  // domain, subdomain
+		{"evil.example.", true},         // regexp
+		{"www.evil.example.", true},     // regexp, subdomain
+		{"good.example.", false},        // no match
+		{"tracker.example.com.", false}, // no match
+	}
+	for _, test := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(test.name, dns.TypeMX)
+		hits := r.HitCount()
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		if test.blocked {
+			require.Equal(t, dns.RcodeNameError, a.Rcode, test.name)
+			require.Equal(t, hits, r.HitCount(), test.name)
+		} else {
+			require.Equal(t, hits+1, r.HitCount(), test.name)
+		}
+	}
+}
+
+func TestBlocklistMatchMetrics(t *testing.T) {
+	var ci ClientInfo
+	ads, err := NewDomainDB("ads", NewStaticLoader([]string{".ads.example"}))
+	require.NoError(t, err)
+	malware, err := NewDomainDB("malware", NewStaticLoader([]string{".malware.example"}))
+	require.NoError(t, err)
+	db, err := NewMultiDB(ads, malware)
+	require.NoError(t, err)
+
+	b, err := NewBlocklist("test-bl-metrics", new(TestResolver), BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	for _, name := range []string{"a.ads.example.", "b.ads.example.", "x.malware.example.", "good.example."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		_, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+
+	// The matches are counted against the list that contains the rule
+	m := getVarMap("router", "test-bl-metrics", "match")
+	require.Equal(t, "2", m.Get("ads").String())
+	require.Equal(t, "1", m.Get("malware").String())
+	require.Equal(t, int64(3), getVarInt("router", "test-bl-metrics", "deny").Value())
+}
+
+func TestBlocklistWatch(t *testing.T) {
+	var ci ClientInfo
+	r := new(TestResolver)
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "list.txt")
+	require.NoError(t, os.WriteFile(filename, []byte("block.test\n"), 0644))
+
+	db, err := NewDomainDB("testlist", NewFileLoader(filename))
+	require.NoError(t, err)
+	opt := BlocklistOptions{
+		BlocklistDB:   db,
+		WatchFiles:    []string{filename},
+		WatchInterval: 10 * time.Millisecond,
+	}
+	b, err := NewBlocklist("test-bl", r, opt)
+	require.NoError(t, err)
+
+	isBlocked := func(name string) bool {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		return a.Rcode == dns.RcodeNameError
+	}
+	require.True(t, isBlocked("block.test."))
+	require.False(t, isBlocked("evil.test."))
+
+	// Update the file, the new name should be blocked within the poll interval
+	require.NoError(t, os.WriteFile(filename, []byte("block.test\nevil.test\n"), 0644))
+	require.Eventually(t, func() bool { return isBlocked("evil.test.") }, time.Second, 10*time.Millisecond)
+
+	// A malformed file must not replace the existing rules
+	require.NoError(t, os.WriteFile(filename, []byte("a*b.test\n"), 0644))
+	time.Sleep(100 * time.Millisecond)
+	require.True(t, isBlocked("evil.test."))
+	require.Error(t, b.Reload())
+	require.True(t, isBlocked("block.test."))
+
+	// Explicit reload
+	require.NoError(t, os.WriteFile(filename, []byte("other.test\n"), 0644))
+	require.NoError(t, b.Reload())
+	require.True(t, isBlocked("other.test."))
+	require.False(t, isBlocked("block.test."))
+}
@@ -0,0 +1,139 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// AdblockDB holds the domain-related rules of a list in Adblock Plus filter
+// syntax as used by EasyList and others:
+// ||domain.com^: matches domain.com and all subdomains
+// @@||domain.com^: exception, domain.com and all subdomains are not matched
+// ||domain.com^$important: matches even if there's an exception
+// Comments, cosmetic (element hiding) rules and rules for URLs or with other
+// options aren't relevant for DNS and are ignored.
+type AdblockDB struct {
+	name       string
+	blocked    map[string]struct{}
+	important  map[string]struct{}
+	exceptions map[string]struct{}
+	loader     BlocklistLoader
+}
+
+var _ BlocklistDB = &AdblockDB{}
+
+// NewAdblockDB returns a new instance of a matcher for a list in Adblock filter syntax.
+func NewAdblockDB(name string, loader BlocklistLoader) (*AdblockDB, error) {
+	rules, err := loader.Load()
+	if err != nil {
+		return nil, err
+	}
+	db := &AdblockDB{
+		name:       name,
+		blocked:    make(map[string]struct{}),
+		important:  make(map[string]struct{}),
+		exceptions: make(map[string]struct{}),
+		loader:     loader,
+	}
+	for _, r := range rules {
+		domain, exception, important, ok := parseAdblockRule(r)
+		if !ok {
+			continue
+		}
+		switch {
+		case exception:
+			db.exceptions[domain] = struct{}{}
+		case important:
+			db.important[domain] = struct{}{}
+		default:
+			db.blocked[domain] = struct{}{}
+		}
+	}
+	return db, nil
+}
+
+func (m *AdblockDB) Reload() (BlocklistDB, error) {
+	db, err := NewAdblockDB(m.name, m.loader)
+	if errors.Is(err, ErrNotModified) {
+		return m, nil
+	}
+	return db, err
+}
+
+func (m *AdblockDB) Match(q dns.Question) (net.IP, string, *BlocklistMatch, bool) {
+	name := strings.TrimSuffix(q.Name, ".")
+	if domain, ok := matchDomainSuffix(m.important, name); ok {
+		return nil, "", &BlocklistMatch{List: m.name, Rule: fmt.Sprintf("||%s^$important", domain)}, true
+	}
+	if _, ok := matchDomainSuffix(m.exceptions, name); ok {
+		return nil, "", nil, false
+	}
+	if domain, ok := matchDomainSuffix(m.blocked, name); ok {
+		return nil, "", &BlocklistMatch{List: m.name, Rule: fmt.Sprintf("||%s^", domain)}, true
+	}
+	return nil, "", nil, false
+}
+
+func (m *AdblockDB) String() string {
+	return "Adblock"
+}
+
+// Returns the name, or the closest of its parent domains, that is in the set.
+func matchDomainSuffix(domains map[string]struct{}, name string) (string, bool) {
+	if len(domains) == 0 {
+		return "", false
+	}
+	for {
+		if _, ok := domains[name]; ok {
+			return name, true
+		}
+		i := strings.Index(name, ".")
+		if i < 0 {
+			return "", false
+		}
+		name = name[i+1:]
+	}
+}
+
+// Parses a rule in Adblock filter syntax and returns the domain if it's in
+// the form ||domain^ with an optional @@ exception prefix and "important"
+// option. Returns false for all other rules.
+func parseAdblockRule(r string) (domain string, exception, important, ok bool) {
+	r = strings.TrimSpace(r)
+	// Comments and the [Adblock Plus 2.0] header
+	if r == "" || strings.HasPrefix(r, "!") || strings.HasPrefix(r, "[") {
+		return "", false, false, false
+	}
+	// Cosmetic rules like example.com##.ad, example.com#@#.ad or example.com#?#div
+	if strings.Contains(r, "#") {
+		return "", false, false, false
+	}
+	if strings.HasPrefix(r, "@@") {
+		exception = true
+		r = r[2:]
+	}
+	if i := strings.Index(r, "$"); i >= 0 {
+		for _, option := range strings.Split(r[i+1:], ",") {
+			if option != "important" {
+				return "", false, false, false
+			}
+			important = true
+		}
+		r = r[:i]
+	}
+	if !strings.HasPrefix(r, "||") {
+		return "", false, false, false
+	}
+	r = strings.TrimPrefix(r, "||")
+	r = strings.TrimSuffix(r, "|")
+	r = strings.TrimSuffix(r, "^")
+	r = normalizeName(strings.TrimSuffix(r, "."))
+	if validHostname(r) != nil {
+		return "", false, false, false
+	}
+	return r, exception, important, true
+}
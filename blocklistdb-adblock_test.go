@@ -0,0 +1,67 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdblockDB(t *testing.T) {
+	loader := NewStaticLoader([]string{
+		"[Adblock Plus 2.0]",
+		"! Title: Test list",
+		"||ads.example.com^",             // domain and subdomains
+		"||tracker.test^|",               // with end anchor
+		"||Upper.Test^",                  // case doesn't matter
+		"@@||ok.ads.example.com^",        // exception for a subdomain of a blocked domain
+		"||cdn.test^",                    // blocked, but see the exception below
+		"@@||cdn.test^",                  // exception for the same domain
+		"||analytics.test^$important",    // blocked even with an exception
+		"@@||analytics.test^",            // overridden by the important rule
+		"||script.test^$script",          // options other than important are ignored
+		"||path.test/banner.gif",         // URLs are ignored
+		"example.org##.ad-banner",        // cosmetic rules are ignored
+		"example.org#@#.ad-banner",       // cosmetic exceptions too
+		"/banner[0-9]+\\.example\\.net/", // regular expressions aren't supported
+	})
+
+	m, err := NewAdblockDB("testlist", loader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		q     string
+		match bool
+	}{
+		{"ads.example.com.", true},
+		{"sub.ads.example.com.", true},
+		{"example.com.", false},
+		{"xads.example.com.", false},
+		{"tracker.test.", true},
+		{"upper.test.", true},
+
+		// exceptions
+		{"ok.ads.example.com.", false},
+		{"sub.ok.ads.example.com.", false},
+		{"cdn.test.", false},
+		{"sub.cdn.test.", false},
+
+		// important rules win over exceptions
+		{"analytics.test.", true},
+		{"sub.analytics.test.", true},
+
+		// ignored rules
+		{"script.test.", false},
+		{"path.test.", false},
+		{"example.org.", false},
+		{"banner1.example.net.", false},
+	}
+	for _, test := range tests {
+		q := dns.Question{Name: test.q, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		_, _, match, ok := m.Match(q)
+		require.Equal(t, test.match, ok, "query: %s", test.q)
+		if ok {
+			require.Equal(t, "testlist", match.List)
+		}
+	}
+}
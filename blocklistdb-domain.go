@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -34,7 +35,7 @@ func NewDomainDB(name string, loader BlocklistLoader) (*DomainDB, error) {
 		r = strings.TrimSpace(r)
 
 		// Strip trailing . in case the list has FQDN names with . suffixes.
-		r = strings.TrimSuffix(r, ".")
+		r = normalizeName(strings.TrimSuffix(r, "."))
 
 		// Break up the domain into its parts and iterare backwards over them, building
 		// a graph of maps
@@ -60,7 +61,11 @@ func NewDomainDB(name string, loader BlocklistLoader) (*DomainDB, error) {
 }
 
 func (m *DomainDB) Reload() (BlocklistDB, error) {
-	return NewDomainDB(m.name, m.loader)
+	db, err := NewDomainDB(m.name, m.loader)
+	if errors.Is(err, ErrNotModified) {
+		return m, nil
+	}
+	return db, err
 }
 
 func (m *DomainDB) Match(q dns.Question) (net.IP, string, *BlocklistMatch, bool) {
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"errors"
 	"net"
 	"strings"
 
@@ -55,7 +56,7 @@ func NewHostsDB(name string, loader BlocklistLoader) (*HostsDB, error) {
 			ip = nil
 		}
 		for _, name := range names {
-			name = strings.TrimSuffix(name, ".")
+			name = normalizeName(strings.TrimSuffix(name, "."))
 			ips := filters[name]
 			if isIP4 {
 				ips.ip4 = ip
@@ -74,7 +75,11 @@ func NewHostsDB(name string, loader BlocklistLoader) (*HostsDB, error) {
 }
 
 func (m *HostsDB) Reload() (BlocklistDB, error) {
-	return NewHostsDB(m.name, m.loader)
+	db, err := NewHostsDB(m.name, m.loader)
+	if errors.Is(err, ErrNotModified) {
+		return m, nil
+	}
+	return db, err
 }
 
 func (m *HostsDB) Match(q dns.Question) (net.IP, string, *BlocklistMatch, bool) {
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"errors"
 	"net"
 	"regexp"
 	"strings"
@@ -40,7 +41,11 @@ func NewRegexpDB(name string, loader BlocklistLoader) (*RegexpDB, error) {
 }
 
 func (m *RegexpDB) Reload() (BlocklistDB, error) {
-	return NewRegexpDB(m.name, m.loader)
+	db, err := NewRegexpDB(m.name, m.loader)
+	if errors.Is(err, ErrNotModified) {
+		return m, nil
+	}
+	return db, err
 }
 
 func (m *RegexpDB) Match(q dns.Question) (net.IP, string, *BlocklistMatch, bool) {
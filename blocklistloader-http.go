@@ -9,14 +9,21 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
-// HTTPLoader reads blocklist rules from a server via HTTP(S).
+// HTTPLoader reads blocklist rules from a server via HTTP(S). Lists are
+// requested with If-None-Match and If-Modified-Since headers after the first
+// successful load to avoid downloading and parsing unchanged lists.
 type HTTPLoader struct {
 	url      string
 	opt      HTTPLoaderOptions
 	fromDisk bool
+
+	mu           sync.Mutex
+	etag         string
+	lastModified string
 }
 
 // HTTPLoaderOptions holds options for HTTP blocklist loaders.
@@ -29,10 +36,12 @@ var _ BlocklistLoader = &HTTPLoader{}
 const httpTimeout = 30 * time.Minute
 
 func NewHTTPLoader(url string, opt HTTPLoaderOptions) *HTTPLoader {
-	return &HTTPLoader{url, opt, opt.CacheDir != ""}
+	return &HTTPLoader{url: url, opt: opt, fromDisk: opt.CacheDir != ""}
 }
 
 func (l *HTTPLoader) Load() ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	log := Log.WithField("url", l.url)
 	log.Trace("loading blocklist")
 
@@ -55,6 +64,12 @@ func (l *HTTPLoader) Load() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	if l.etag != "" {
+		req.Header.Set("If-None-Match", l.etag)
+	}
+	if l.lastModified != "" {
+		req.Header.Set("If-Modified-Since", l.lastModified)
+	}
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -62,6 +77,10 @@ func (l *HTTPLoader) Load() ([]string, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		log.Debug("blocklist not modified, skipping")
+		return nil, ErrNotModified
+	}
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		return nil, fmt.Errorf("got unexpected status code %d from %s", resp.StatusCode, l.url)
 	}
@@ -73,15 +92,22 @@ func (l *HTTPLoader) Load() ([]string, error) {
 		rules = append(rules, scanner.Text())
 	}
 	log.WithField("load-time", time.Since(start)).Trace("completed loading blocklist")
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+
+	// Remember the validators for the next refresh
+	l.etag = resp.Header.Get("ETag")
+	l.lastModified = resp.Header.Get("Last-Modified")
 
 	// Cache the content to disk if the read from the remote server was successful
-	if scanner.Err() == nil && l.opt.CacheDir != "" {
+	if l.opt.CacheDir != "" {
 		log.Trace("writing rules to cache-dir")
 		if err := l.writeToDisk(rules); err != nil {
 			log.WithError(err).Error("failed to write rules to cache")
 		}
 	}
-	return rules, scanner.Err()
+	return rules, nil
 }
 
 // Loads a cached version of the list from disk. The filename is made by hashing the URL with SHA256
@@ -0,0 +1,73 @@
+package rdns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPLoaderNotModified(t *testing.T) {
+	var (
+		requests int32
+		fail     int32
+		etag     atomic.Value
+		content  atomic.Value
+	)
+	etag.Store(`"v1"`)
+	content.Store("block.test\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag.Load().(string) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag.Load().(string))
+		w.Write([]byte(content.Load().(string)))
+	}))
+	defer srv.Close()
+
+	loader := NewHTTPLoader(srv.URL, HTTPLoaderOptions{})
+	db, err := NewDomainDB("testlist", loader)
+	require.NoError(t, err)
+	r := new(TestResolver)
+	b, err := NewBlocklist("test-bl", r, BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	isBlocked := func(name string) bool {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := b.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a.Rcode == dns.RcodeNameError
+	}
+	require.True(t, isBlocked("block.test."))
+
+	// The list hasn't changed, the loader should report that and the DB stays the same
+	_, err = loader.Load()
+	require.ErrorIs(t, err, ErrNotModified)
+	reloaded, err := db.Reload()
+	require.NoError(t, err)
+	require.Same(t, db, reloaded)
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// A failed download keeps the existing rules
+	atomic.StoreInt32(&fail, 1)
+	require.Error(t, b.Reload())
+	require.True(t, isBlocked("block.test."))
+
+	// Update the list on the server and reload
+	atomic.StoreInt32(&fail, 0)
+	etag.Store(`"v2"`)
+	content.Store("evil.test\n")
+	require.NoError(t, b.Reload())
+	require.True(t, isBlocked("evil.test."))
+	require.False(t, isBlocked("block.test."))
+}
@@ -1,5 +1,11 @@
 package rdns
 
+import "errors"
+
+// ErrNotModified is returned by loaders if the rules haven't changed since they
+// were last loaded. Blocklist databases keep their current rules in that case.
+var ErrNotModified = errors.New("list not modified")
+
 type BlocklistLoader interface {
 	// Returns a list of rules that can then be stored into a blocklist DB.
 	Load() ([]string, error)
@@ -0,0 +1,109 @@
+package rdns
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	bootstrapMu       sync.RWMutex
+	bootstrapResolver *net.Resolver
+)
+
+// SetBootstrapResolver sets the resolver used to look up the hostnames of
+// upstream resolvers that are configured without bootstrap address. This
+// avoids using the system resolver, which typically sends queries in plain
+// text. Responses are cached for their TTL. With nil, hostnames are looked up
+// with the system resolver again. Only affects resolvers created after the
+// call.
+func SetBootstrapResolver(r Resolver) {
+	bootstrapMu.Lock()
+	defer bootstrapMu.Unlock()
+	if r == nil {
+		bootstrapResolver = nil
+		return
+	}
+	bootstrapResolver = NewNetResolver(NewCache("bootstrap", r, CacheOptions{}))
+}
+
+// Returns the resolver to look up hostnames of upstream resolvers with. A nil
+// *net.Resolver uses the system resolver.
+func getBootstrapResolver() *net.Resolver {
+	bootstrapMu.RLock()
+	defer bootstrapMu.RUnlock()
+	return bootstrapResolver
+}
+
+// Returns a dialer that looks up hostnames with the bootstrap resolver, based
+// on d which can be nil. Returns d unchanged if there is no bootstrap resolver.
+func bootstrapDialer(d *net.Dialer) *net.Dialer {
+	r := getBootstrapResolver()
+	if r == nil {
+		return d
+	}
+	if d == nil {
+		d = new(net.Dialer)
+	}
+	d.Resolver = r
+	return d
+}
+
+// Resolves a host:port address to a UDP address using the bootstrap resolver.
+func bootstrapResolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	r := getBootstrapResolver()
+	if r == nil {
+		return net.ResolveUDPAddr("udp", addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0].IP, Port: p, Zone: ips[0].Zone}, nil
+}
+
+// failoverDialer is a DNSDialer that connects to the first of several
+// addresses of an upstream resolver that can be reached, so that one address
+// that is down doesn't break the resolver. It starts with the address that
+// worked last.
+type failoverDialer struct {
+	id     string
+	dialer DNSDialer
+	addrs  []string
+	last   uint32
+}
+
+var _ DNSDialer = &failoverDialer{}
+
+func newFailoverDialer(id string, dialer DNSDialer, addrs []string) *failoverDialer {
+	return &failoverDialer{id: id, dialer: dialer, addrs: addrs}
+}
+
+// Dial connects to one of the addresses, the address argument is ignored.
+func (d *failoverDialer) Dial(string) (*dns.Conn, error) {
+	start := int(atomic.LoadUint32(&d.last))
+	var err error
+	for i := range d.addrs {
+		n := (start + i) % len(d.addrs)
+		var conn *dns.Conn
+		conn, err = d.dialer.Dial(d.addrs[n])
+		if err == nil {
+			atomic.StoreUint32(&d.last, uint32(n))
+			return conn, nil
+		}
+		Log.WithField("id", d.id).WithField("addr", d.addrs[n]).WithError(err).Warn("failed to connect, trying next address")
+	}
+	return nil, err
+}
@@ -0,0 +1,93 @@
+package rdns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrapResolverDoT(t *testing.T) {
+	// Bootstrap resolver that points a hostname at the local listener
+	var lookups int32
+	bootstrap := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			atomic.AddInt32(&lookups, 1)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			if q.Question[0].Name == "dot.example.test." && q.Question[0].Qtype == dns.TypeA {
+				a.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IP{127, 0, 0, 1},
+				}}
+			}
+			return a, nil
+		},
+	}
+	SetBootstrapResolver(bootstrap)
+	defer SetBootstrapResolver(nil)
+
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-bootstrap-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// Client using the hostname, the certificate is checked against the listener address
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoTClient("test-bootstrap-dot", net.JoinHostPort("dot.example.test", port), DoTClientOptions{
+		TLSConfig:  tlsConfig,
+		ServerName: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+
+	// The bootstrap resolver should have been used to find the listener
+	require.Equal(t, 1, upstream.HitCount())
+	require.NotZero(t, atomic.LoadInt32(&lookups))
+}
+
+func TestBootstrapResolverCache(t *testing.T) {
+	var lookups int32
+	bootstrap := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			atomic.AddInt32(&lookups, 1)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			if q.Question[0].Qtype == dns.TypeA {
+				a.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IP{192, 0, 2, 1},
+				}}
+			}
+			return a, nil
+		},
+	}
+	SetBootstrapResolver(bootstrap)
+	defer SetBootstrapResolver(nil)
+
+	addr, err := bootstrapResolveUDPAddr("doq.example.test:853")
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1:853", addr.String())
+	n := atomic.LoadInt32(&lookups)
+	require.NotZero(t, n)
+
+	// The second lookup should be answered from the cache
+	_, err = bootstrapResolveUDPAddr("doq.example.test:853")
+	require.NoError(t, err)
+	require.Equal(t, n, atomic.LoadInt32(&lookups))
+}
@@ -0,0 +1,137 @@
+package rdns
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Version of the cache file format.
+const cacheFileVersion = 1
+
+// On-disk representation of the cache. Answers are stored in wire format along
+// with the time they were cached so TTLs can be adjusted when loading them.
+type cacheFile struct {
+	Version int              `json:"version"`
+	Entries []cacheFileEntry `json:"entries"`
+}
+
+type cacheFileEntry struct {
+	Name      string    `json:"name"`
+	Type      uint16    `json:"type"`
+	Class     uint16    `json:"class"`
+	Net       string    `json:"net,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Expiry    time.Time `json:"expiry"`
+	Answer    []byte    `json:"answer"`
+}
+
+// Save writes the content of the cache to the persist file. Queries can continue
+// to be answered while the file is written.
+func (r *Cache) Save() error {
+	if r.PersistFile == "" {
+		return nil
+	}
+	f := cacheFile{Version: cacheFileVersion}
+
+	// Take a snapshot of the cache content, least recently used first in each shard
+	var err error
+	r.shards.forEach(func(key lruKey, a *cacheAnswer) {
+		b, packErr := a.Pack()
+		if packErr != nil {
+			err = packErr
+			return
+		}
+		f.Entries = append(f.Entries, cacheFileEntry{
+			Name:      key.question.Name,
+			Type:      key.question.Qtype,
+			Class:     key.question.Qclass,
+			Net:       key.net,
+			Timestamp: a.timestamp,
+			Expiry:    a.expiry,
+			Answer:    b,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, then replace the original
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.PersistFile), filepath.Base(r.PersistFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.PersistFile)
+}
+
+// Load reads cached answers from the persist file and adds them to the cache. Answers
+// that have already expired are skipped.
+func (r *Cache) Load() error {
+	if r.PersistFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(r.PersistFile)
+	if err != nil {
+		return err
+	}
+	var f cacheFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	if f.Version != cacheFileVersion {
+		return fmt.Errorf("unsupported cache file version %d", f.Version)
+	}
+	now := time.Now()
+	var loaded int
+	for _, e := range f.Entries {
+		if now.After(e.Expiry.Add(r.StaleMaxTTL)) {
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(e.Answer); err != nil {
+			return err
+		}
+		key := lruKey{
+			question: dns.Question{Name: e.Name, Qtype: e.Type, Qclass: e.Class},
+			net:      e.Net,
+		}
+		r.shards.add(key, &cacheAnswer{Msg: msg, timestamp: e.Timestamp, expiry: e.Expiry})
+		loaded++
+	}
+	r.metrics.entries.Set(int64(r.shards.size()))
+	Log.WithField("file", r.PersistFile).WithField("entries", loaded).Debug("loaded cache from file")
+	return nil
+}
+
+// Periodically writes the cache content to the persist file until the cache is closed.
+func (r *Cache) startPersist(period time.Duration) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		if err := r.Save(); err != nil {
+			Log.WithError(err).WithField("file", r.PersistFile).Error("failed to save cache")
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package rdns
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Default number of shards the cache is split into. Least-recently used items
+// are only evicted per shard, not across the whole cache.
+const defaultCacheShards = 256
+
+// cacheShards spreads the cached answers over a number of LRU caches, each with
+// its own lock, so that concurrent queries for different names don't contend.
+// Least-recently used items are evicted per shard.
+type cacheShards struct {
+	// Total number of items in all shards, updated atomically. First in the
+	// struct to be 64-bit aligned on 32-bit platforms.
+	entries int64
+
+	// Prefix lengths of client subnets answers are stored for. Only grows, it's
+	// not updated when items are removed.
+	scopes ecsScopes
+
+	shards []*cacheShard
+}
+
+type cacheShard struct {
+	mu  sync.Mutex
+	lru *lruCache
+}
+
+// Returns a new set of n shards. The capacity, if any, is divided evenly
+// between them. To give every shard room for at least one item, the number
+// of shards is reduced to the capacity if necessary.
+func newCacheShards(n, capacity int) *cacheShards {
+	if n <= 0 {
+		n = defaultCacheShards
+	}
+	if capacity > 0 && n > capacity {
+		n = capacity
+	}
+	s := &cacheShards{shards: make([]*cacheShard, n)}
+	for i := range s.shards {
+		var max int
+		if capacity > 0 {
+			max = capacity / n
+			if i < capacity%n {
+				max++
+			}
+		}
+		s.shards[i] = &cacheShard{lru: newLRUCache(max)}
+	}
+	return s
+}
+
+// Returns the shard a key is stored in.
+func (s *cacheShards) shard(key lruKey) *cacheShard {
+	// FNV-1a over the parts of the key
+	h := uint32(2166136261)
+	for _, str := range []string{key.question.Name, key.net} {
+		for i := 0; i < len(str); i++ {
+			h ^= uint32(str[i])
+			h *= 16777619
+		}
+	}
+	for _, v := range []uint16{key.question.Qtype, key.question.Qclass} {
+		h ^= uint32(v >> 8)
+		h *= 16777619
+		h ^= uint32(v & 0xff)
+		h *= 16777619
+	}
+	return s.shards[h%uint32(len(s.shards))]
+}
+
+// Adds an answer and returns the number of items evicted from its shard to
+// stay within the capacity.
+func (s *cacheShards) add(key lruKey, answer *cacheAnswer) int {
+	s.scopes.add(key)
+	shard := s.shard(key)
+	shard.mu.Lock()
+	before := shard.lru.size()
+	evicted := shard.lru.add(key, answer)
+	delta := shard.lru.size() - before
+	shard.mu.Unlock()
+	atomic.AddInt64(&s.entries, int64(delta))
+	return evicted
+}
+
+// Calls f with the answer stored under the key while holding the lock of its
+// shard. Returns false if there is no answer for the key.
+func (s *cacheShards) get(key lruKey, f func(*cacheAnswer)) bool {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	a := shard.lru.get(key)
+	if a == nil {
+		return false
+	}
+	f(a)
+	return true
+}
+
+func (s *cacheShards) delete(key lruKey) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	before := shard.lru.size()
+	shard.lru.delete(key)
+	delta := shard.lru.size() - before
+	shard.mu.Unlock()
+	atomic.AddInt64(&s.entries, int64(delta))
+}
+
+// Deletes all items for which f returns true, one shard at a time. Returns
+// the number of deleted items.
+func (s *cacheShards) deleteFunc(f func(*cacheAnswer) bool) int {
+	var removed int
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		before := shard.lru.size()
+		shard.lru.deleteFunc(f)
+		delta := before - shard.lru.size()
+		shard.mu.Unlock()
+		atomic.AddInt64(&s.entries, -int64(delta))
+		removed += delta
+	}
+	return removed
+}
+
+// Iterates over all items, one shard at a time, from the least recently used
+// to the most recently used one within each shard.
+func (s *cacheShards) forEach(f func(lruKey, *cacheAnswer)) {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		shard.lru.forEach(f)
+		shard.mu.Unlock()
+	}
+}
+
+// Clears all shards.
+func (s *cacheShards) reset() {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		n := shard.lru.size()
+		shard.lru.reset()
+		shard.mu.Unlock()
+		atomic.AddInt64(&s.entries, -int64(n))
+	}
+}
+
+// Returns the total number of items in the cache.
+func (s *cacheShards) size() int {
+	return int(atomic.LoadInt64(&s.entries))
+}
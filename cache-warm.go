@@ -0,0 +1,91 @@
+package rdns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Warm resolves the questions with the upstream resolver and stores the
+// responses in the cache, so that they can be served from the cache when
+// clients first ask for them. Questions that are already cached are skipped,
+// as are those that fail. Up to WarmConcurrency queries are sent in parallel.
+// Returns the number of questions that were answered with NOERROR or
+// NXDOMAIN. Blocks until all questions are resolved, it can be run in the
+// background while the cache is already in use.
+func (r *Cache) Warm(questions []dns.Question) int {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		answered int
+		sem      = make(chan struct{}, r.WarmConcurrency)
+	)
+	for _, question := range questions {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(question dns.Question) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			q := new(dns.Msg)
+			q.SetQuestion(dns.Fqdn(question.Name), question.Qtype)
+			if question.Qclass != 0 {
+				q.Question[0].Qclass = question.Qclass
+			}
+			a, err := r.Resolve(q, ClientInfo{})
+			if err != nil || a == nil {
+				logger(r.id, q, ClientInfo{}).WithError(err).Debug("failed to warm cache")
+				return
+			}
+			if a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError {
+				logger(r.id, q, ClientInfo{}).WithField("rcode", rCode(a)).Debug("failed to warm cache")
+				return
+			}
+			mu.Lock()
+			answered++
+			mu.Unlock()
+		}(question)
+	}
+	wg.Wait()
+	Log.WithFields(logrus.Fields{"id": r.id, "questions": len(questions), "answered": answered}).Info("warmed cache")
+	return answered
+}
+
+// ParseWarmList reads questions to warm a cache with, one per line. Each line
+// contains a name optionally followed by a query type, like "example.com AAAA".
+// Names without type result in questions for both A and AAAA. Empty lines and
+// lines starting with # are ignored.
+func ParseWarmList(r io.Reader) ([]dns.Question, error) {
+	var questions []dns.Question
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		name := dns.Fqdn(fields[0])
+		switch len(fields) {
+		case 1:
+			questions = append(questions,
+				dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET},
+				dns.Question{Name: name, Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+			)
+		case 2:
+			qtype, ok := dns.StringToType[strings.ToUpper(fields[1])]
+			if !ok {
+				return nil, fmt.Errorf("unsupported query type '%s' in line %d", fields[1], n)
+			}
+			questions = append(questions, dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET})
+		default:
+			return nil, fmt.Errorf("invalid warm list entry in line %d", n)
+		}
+	}
+	return questions, scanner.Err()
+}
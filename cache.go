@@ -5,6 +5,7 @@ import (
 	"expvar"
 	"math"
 	"math/rand"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -19,9 +20,17 @@ type Cache struct {
 	CacheOptions
 	id       string
 	resolver Resolver
-	mu       sync.Mutex
-	lru      *lruCache
+	shards   *cacheShards
 	metrics  *CacheMetrics
+
+	// Queries currently refreshed in the background
+	mu         sync.Mutex
+	refreshing map[lruKey]struct{}
+
+	// Stops the garbage collection and persistence goroutines when closed
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
 type CacheMetrics struct {
@@ -31,10 +40,17 @@ type CacheMetrics struct {
 	miss *expvar.Int
 	// Current cache entry count.
 	entries *expvar.Int
+	// Count of expired answers served from the cache.
+	stale *expvar.Int
+	// Count of entries removed to stay within the cache capacity.
+	evicted *expvar.Int
 }
 
 var _ Resolver = &Cache{}
 
+// TTL of stale answers served from the cache, as recommended in RFC8767.
+const staleTTL = 30
+
 type CacheOptions struct {
 	// Time period the cache garbage collection runs. Defaults to one minute if set to 0.
 	GCPeriod time.Duration
@@ -43,9 +59,23 @@ type CacheOptions struct {
 	// the limit is reached, the least-recently used entry is removed from the cache.
 	Capacity int
 
+	// Number of shards the cache is split into, each with its own lock. The capacity is
+	// divided evenly between them and the least-recently used entry of a shard is removed
+	// when it's full, so eviction isn't strictly LRU across the cache. Defaults to 256,
+	// or to the capacity if that is lower.
+	Shards int
+
 	// TTL to use for negative responses that do not have an SOA record, default 60
 	NegativeTTL uint32
 
+	// Maximum TTL for negative responses. The TTL of negative responses is the minimum
+	// of the SOA TTL and the SOA MINIMUM field (RFC2308), capped at this value. No limit
+	// if 0.
+	NegativeTTLMax uint32
+
+	// Don't cache negative responses like NXDOMAIN or NODATA.
+	DisableNegative bool
+
 	// Allows control over the order of answer RRs in cached responses. Default is to keep
 	// the order if nil.
 	ShuffleAnswerFunc AnswerShuffleFunc
@@ -58,6 +88,21 @@ type CacheOptions struct {
 
 	// Query name that will trigger a cache flush. Disabled if empty.
 	FlushQuery string
+
+	// Serve expired answers from the cache while refreshing them in the background,
+	// as per RFC8767. Answers are served stale for up to StaleMaxTTL past their
+	// expiry, defaults to one day.
+	ServeStale  bool
+	StaleMaxTTL time.Duration
+
+	// File to persist the cache in. If set, the cache is loaded from the file on
+	// startup and written to it every PersistInterval, one minute by default, as
+	// well as when it's closed.
+	PersistFile     string
+	PersistInterval time.Duration
+
+	// Number of queries Warm sends upstream in parallel. Default 10.
+	WarmConcurrency int
 }
 
 // NewCache returns a new instance of a Cache resolver.
@@ -66,12 +111,16 @@ func NewCache(id string, resolver Resolver, opt CacheOptions) *Cache {
 		CacheOptions: opt,
 		id:           id,
 		resolver:     resolver,
-		lru:          newLRUCache(opt.Capacity),
+		shards:       newCacheShards(opt.Shards, opt.Capacity),
 		metrics: &CacheMetrics{
 			hit:     getVarInt("cache", id, "hit"),
 			miss:    getVarInt("cache", id, "miss"),
 			entries: getVarInt("cache", id, "entries"),
+			stale:   getVarInt("cache", id, "stale"),
+			evicted: getVarInt("cache", id, "evicted"),
 		},
+		refreshing: make(map[lruKey]struct{}),
+		done:       make(chan struct{}),
 	}
 	if c.GCPeriod == 0 {
 		c.GCPeriod = time.Minute
@@ -79,10 +128,38 @@ func NewCache(id string, resolver Resolver, opt CacheOptions) *Cache {
 	if c.NegativeTTL == 0 {
 		c.NegativeTTL = 60
 	}
+	if !c.ServeStale {
+		c.StaleMaxTTL = 0
+	} else if c.StaleMaxTTL == 0 {
+		c.StaleMaxTTL = 24 * time.Hour
+	}
+	if c.WarmConcurrency <= 0 {
+		c.WarmConcurrency = 10
+	}
+	if c.PersistFile != "" {
+		if c.PersistInterval == 0 {
+			c.PersistInterval = time.Minute
+		}
+		if err := c.Load(); err != nil && !os.IsNotExist(err) {
+			Log.WithError(err).WithField("file", c.PersistFile).Error("failed to load cache")
+		}
+		c.wg.Add(1)
+		go c.startPersist(c.PersistInterval)
+	}
+	c.wg.Add(1)
 	go c.startGC(c.GCPeriod)
 	return c
 }
 
+// Close stops the garbage collection and the periodic persistence of the cache
+// in the background, then writes the cache to the persist file one last time.
+// The cache still answers queries after it's closed.
+func (r *Cache) Close() error {
+	r.closeOnce.Do(func() { close(r.done) })
+	r.wg.Wait()
+	return r.Save()
+}
+
 // Resolve a DNS query by first checking an internal cache for existing
 // results
 func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
@@ -107,10 +184,15 @@ func (r *Cache) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 
 	// Returned an answer from the cache if one exists
-	a, ok := r.answerFromCache(q)
+	a, ok, stale := r.answerFromCache(q)
 	if ok {
 		log.Debug("cache-hit")
 		r.metrics.hit.Add(1)
+		if stale {
+			log.Debug("serving stale answer, refreshing")
+			r.metrics.stale.Add(1)
+			r.refresh(q.Copy(), ci)
+		}
 		return a, nil
 	}
 	r.metrics.miss.Add(1)
@@ -139,18 +221,26 @@ func (r *Cache) String() string {
 }
 
 // Returns an answer from the cache with it's TTL updated or false in case of a cache-miss.
-func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool) {
+// The last return value is true if the answer is expired and served stale.
+func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool, bool) {
 	var answer *dns.Msg
-	var timestamp time.Time
-	r.mu.Lock()
-	if a := r.lru.get(q); a != nil {
-		if r.ShuffleAnswerFunc != nil {
-			r.ShuffleAnswerFunc(a.Msg)
+	var timestamp, expiry time.Time
+	var key lruKey
+	// Look for answers scoped to the client subnet first, then for one that's valid
+	// for any client.
+	for _, key = range lruKeysFromQuery(q, &r.shards.scopes) {
+		found := r.shards.get(key, func(a *cacheAnswer) {
+			if r.ShuffleAnswerFunc != nil {
+				r.ShuffleAnswerFunc(a.Msg)
+			}
+			answer = a.Copy()
+			timestamp = a.timestamp
+			expiry = a.expiry
+		})
+		if found {
+			break
 		}
-		answer = a.Copy()
-		timestamp = a.timestamp
 	}
-	r.mu.Unlock()
 
 	// We couldn't find it in the cache, but a parent domain may already be with NXDOMAIN.
 	// Return that instead if enabled.
@@ -158,52 +248,133 @@ func (r *Cache) answerFromCache(q *dns.Msg) (*dns.Msg, bool) {
 		name := q.Question[0].Name
 		newQ := q.Copy()
 		fragments := strings.Split(name, ".")
-		r.mu.Lock()
 		for i := 1; i < len(fragments)-1; i++ {
 			newQ.Question[0].Name = strings.Join(fragments[i:], ".")
-			if a := r.lru.get(newQ); a != nil {
-				if a.Rcode == dns.RcodeNameError {
-					r.mu.Unlock()
-					return nxdomain(q), true
+			var rcode int
+			found := r.shards.get(lruKeyFromQuery(newQ), func(a *cacheAnswer) {
+				rcode = a.Rcode
+			})
+			if found {
+				if rcode == dns.RcodeNameError {
+					return nxdomain(q), true, false
 				}
 				break
 			}
 		}
-		r.mu.Unlock()
 	}
 
 	// Return a cache-miss if there's no answer record in the map
 	if answer == nil {
-		return nil, false
+		return nil, false, false
 	}
 
 	// Make a copy of the response before returning it. Some later
 	// elements might make changes.
 	answer = answer.Copy()
 	answer.Id = q.Id
+	restoreQueryName(answer, q)
 
 	// Calculate the time the record spent in the cache. We need to
 	// subtract that from the TTL of each answer record.
 	age := uint32(time.Since(timestamp).Seconds())
 
+	// Negative answers without SOA may have no records to work out the age from,
+	// the expiry of the whole answer applies. If any record is too old, the whole
+	// answer is expired as well.
+	now := time.Now()
+	expired := now.After(expiry)
+	if !expired {
+		if min, ok := minTTL(answer); ok && age >= min {
+			expired = true
+		}
+	}
+
+	// Expired answers are either evicted from the cache, or if serve-stale is enabled
+	// and the answer is still within the stale period, returned with a short TTL.
+	if expired {
+		if !r.ServeStale || now.After(expiry.Add(r.StaleMaxTTL)) {
+			r.evictFromCache(key)
+			return nil, false, false
+		}
+		age = 0
+		setTTL(answer, staleTTL)
+	}
+
 	// Go through all the answers, NS, and Extra and adjust the TTL (subtract the time
-	// it's spent in the cache). If the record is too old, evict it from the cache
-	// and return a cache-miss. OPT records have a TTL of 0 and are ignored.
+	// it's spent in the cache). OPT records have a TTL of 0 and are ignored.
 	for _, rr := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
 		for _, a := range rr {
 			if _, ok := a.(*dns.OPT); ok {
 				continue
 			}
 			h := a.Header()
-			if age >= h.Ttl {
-				r.evictFromCache(q)
-				return nil, false
-			}
 			h.Ttl -= age
 		}
 	}
 
-	return answer, true
+	return answer, true, expired
+}
+
+// Answers are cached under the normalized query name and can be returned for a
+// query that differs in case or IDN encoding. Use the name from the query in
+// the question and in the records that are owned by it.
+func restoreQueryName(answer, q *dns.Msg) {
+	if len(answer.Question) == 0 || answer.Question[0].Name == q.Question[0].Name {
+		return
+	}
+	cached, name := answer.Question[0].Name, q.Question[0].Name
+	answer.Question[0].Name = name
+	for _, records := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
+		for _, rr := range records {
+			if rr.Header().Name == cached {
+				rr.Header().Name = name
+			}
+		}
+	}
+}
+
+// Set the TTL of all records (except OPT) in a response.
+func setTTL(answer *dns.Msg, ttl uint32) {
+	for _, rr := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
+		for _, a := range rr {
+			if _, ok := a.(*dns.OPT); ok {
+				continue
+			}
+			a.Header().Ttl = ttl
+		}
+	}
+}
+
+// Refreshes a stale cache entry in the background. Only one refresh per query is
+// running at any time. If the refresh fails, the stale entry remains in the cache.
+func (r *Cache) refresh(q *dns.Msg, ci ClientInfo) {
+	key := lruKeysFromQuery(q, &r.shards.scopes)[0]
+	r.mu.Lock()
+	if _, ok := r.refreshing[key]; ok {
+		r.mu.Unlock()
+		return
+	}
+	r.refreshing[key] = struct{}{}
+	r.mu.Unlock()
+
+	go func() {
+		defer func() {
+			r.mu.Lock()
+			delete(r.refreshing, key)
+			r.mu.Unlock()
+		}()
+		// The client already has its response, don't cancel the refresh when it's gone
+		log := logger(r.id, q, ci)
+		a, err := r.resolver.Resolve(q, ci.WithoutCancel())
+		if err != nil || a == nil {
+			log.WithError(err).Debug("failed to refresh stale cache entry")
+			return
+		}
+		if a.Truncated {
+			return
+		}
+		r.storeInCache(q, a)
+	}()
 }
 
 func (r *Cache) storeInCache(query, answer *dns.Msg) {
@@ -212,40 +383,78 @@ func (r *Cache) storeInCache(query, answer *dns.Msg) {
 	// Prepare an item for the cache, without expiry for now
 	item := &cacheAnswer{Msg: answer, timestamp: now}
 
-	// Find the lowest TTL in the response, this determines the expiry for the whole answer in the cache.
-	min, ok := minTTL(answer)
-
-	// Calculate expiry for the whole record. Negative answers may not have a SOA to use the TTL from.
+	// Calculate expiry for the whole record.
 	switch answer.Rcode {
 	case dns.RcodeSuccess, dns.RcodeNameError, dns.RcodeRefused, dns.RcodeNotImplemented, dns.RcodeFormatError:
-		if ok {
-			item.expiry = now.Add(time.Duration(min) * time.Second)
-		} else {
-			item.expiry = now.Add(time.Duration(r.NegativeTTL) * time.Second)
-		}
-	case dns.RcodeServerFailure:
-		// According to RFC2308, a SERVFAIL response must not be cached for longer than 5 minutes.
-		if r.NegativeTTL < 300 {
-			item.expiry = now.Add(time.Duration(r.NegativeTTL) * time.Second)
-		} else {
-			item.expiry = now.Add(300 * time.Second)
+		if isNegative(answer) {
+			if r.DisableNegative {
+				return
+			}
+			ttl := r.negativeTTL(answer)
+			item.expiry = now.Add(time.Duration(ttl) * time.Second)
+			break
 		}
+		// Find the lowest TTL in the response, this determines the expiry for the whole answer in the cache.
+		min, _ := minTTL(answer)
+		item.expiry = now.Add(time.Duration(min) * time.Second)
 	default:
+		// Don't cache SERVFAIL and other failures, they're most likely temporary.
 		return
 	}
 
 	// Store it in the cache
-	r.mu.Lock()
-	r.lru.add(query, item)
-	r.mu.Unlock()
+	evicted := r.shards.add(lruKeyFromAnswer(query, answer), item)
+
+	r.metrics.evicted.Add(int64(evicted))
+	r.metrics.entries.Set(int64(r.shards.size()))
 }
 
-func (r *Cache) evictFromCache(queries ...*dns.Msg) {
-	r.mu.Lock()
-	for _, query := range queries {
-		r.lru.delete(query)
+// Returns the TTL of a negative response. As per RFC2308, that's the lower of the SOA
+// TTL and the SOA MINIMUM field. The TTL of the SOA is updated to match. Falls back to
+// the configured negative TTL if there's no SOA in the response.
+func (r *Cache) negativeTTL(answer *dns.Msg) uint32 {
+	ttl := r.NegativeTTL
+	var soa *dns.SOA
+	for _, rr := range answer.Ns {
+		if s, ok := rr.(*dns.SOA); ok {
+			soa = s
+			break
+		}
 	}
-	r.mu.Unlock()
+	if soa != nil {
+		ttl = soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+	}
+	if r.NegativeTTLMax > 0 && ttl > r.NegativeTTLMax {
+		ttl = r.NegativeTTLMax
+	}
+	// None of the records in the answer should outlive the negative TTL
+	for _, rrs := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
+		for _, rr := range rrs {
+			if _, ok := rr.(*dns.OPT); ok {
+				continue
+			}
+			if h := rr.Header(); h.Ttl > ttl {
+				h.Ttl = ttl
+			}
+		}
+	}
+	return ttl
+}
+
+// Returns true if the response is negative, meaning it's not a NOERROR response with
+// answer records.
+func isNegative(answer *dns.Msg) bool {
+	return answer.Rcode != dns.RcodeSuccess || len(answer.Answer) == 0
+}
+
+func (r *Cache) evictFromCache(keys ...lruKey) {
+	for _, key := range keys {
+		r.shards.delete(key)
+	}
+	r.metrics.entries.Set(int64(r.shards.size()))
 }
 
 // Runs every period time and evicts all items from the cache that are
@@ -254,20 +463,20 @@ func (r *Cache) evictFromCache(queries ...*dns.Msg) {
 // a new query for them is made (and TTL is too old) or when they are
 // older than max.
 func (r *Cache) startGC(period time.Duration) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
 	for {
-		time.Sleep(period)
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
 		now := time.Now()
-		var total, removed int
-		r.mu.Lock()
-		r.lru.deleteFunc(func(a *cacheAnswer) bool {
-			if now.After(a.expiry) {
-				removed++
-				return true
-			}
-			return false
+		removed := r.shards.deleteFunc(func(a *cacheAnswer) bool {
+			return now.After(a.expiry.Add(r.StaleMaxTTL))
 		})
-		total = r.lru.size()
-		r.mu.Unlock()
+		total := r.shards.size()
 
 		r.metrics.entries.Set(int64(total))
 		Log.WithFields(logrus.Fields{"total": total, "removed": removed}).Trace("cache garbage collection")
@@ -276,9 +485,8 @@ func (r *Cache) startGC(period time.Duration) {
 
 // Flush the cache (reset to empty).
 func (r *Cache) flush() {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.lru.reset()
+	r.shards.reset()
+	r.metrics.entries.Set(int64(r.shards.size()))
 }
 
 // Find the lowest TTL in all resource records (except OPT).
@@ -1,7 +1,14 @@
 package rdns
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -69,6 +76,137 @@ func TestCache(t *testing.T) {
 	require.Equal(t, 3, r.HitCount())
 }
 
+func TestCacheCapacity(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    3600,
+					},
+					A: net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+	// Use a single shard, the eviction order is only exact within a shard
+	c := NewCache("test-cache-capacity", r, CacheOptions{Capacity: 5, Shards: 1})
+
+	// Fill the cache past its capacity
+	q := new(dns.Msg)
+	for i := 0; i < 8; i++ {
+		q.SetQuestion(fmt.Sprintf("test%d.com.", i), dns.TypeA)
+		_, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 8, r.HitCount())
+	require.Equal(t, int64(5), c.metrics.entries.Value())
+	require.Equal(t, int64(3), c.metrics.evicted.Value())
+
+	// The most recent entries are still cached
+	for i := 3; i < 8; i++ {
+		q.SetQuestion(fmt.Sprintf("test%d.com.", i), dns.TypeA)
+		_, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 8, r.HitCount())
+
+	// The oldest ones were evicted and have to be resolved upstream again
+	q.SetQuestion("test0.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 9, r.HitCount())
+	require.Equal(t, int64(5), c.metrics.entries.Value())
+	require.Equal(t, int64(4), c.metrics.evicted.Value())
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    3600,
+					},
+					A: net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache-concurrent", r, CacheOptions{Capacity: 500, ShuffleAnswerFunc: AnswerShuffleRoundRobin})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q := new(dns.Msg)
+			for j := 0; j < 1000; j++ {
+				name := fmt.Sprintf("test%d.com.", (i*j)%1000)
+				q.SetQuestion(name, dns.TypeA)
+				a, err := c.Resolve(q, ci)
+				require.NoError(t, err)
+				require.Equal(t, name, a.Answer[0].Header().Name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.LessOrEqual(t, c.metrics.entries.Value(), int64(500))
+	require.Equal(t, int64(c.shards.size()), c.metrics.entries.Value())
+}
+
+func BenchmarkCache(b *testing.B) {
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    3600,
+					},
+					A: net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+	for _, shards := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			c := NewCache("bench-cache", r, CacheOptions{Shards: shards})
+			var n uint64
+			b.RunParallel(func(pb *testing.PB) {
+				var ci ClientInfo
+				q := new(dns.Msg)
+				for pb.Next() {
+					i := atomic.AddUint64(&n, 1)
+					q.SetQuestion(fmt.Sprintf("test%d.com.", i%10000), dns.TypeA)
+					if _, err := c.Resolve(q, ci); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
 func TestCacheNXDOMAIN(t *testing.T) {
 	var ci ClientInfo
 	q := new(dns.Msg)
@@ -198,3 +336,427 @@ func TestCacheNoTruncated(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 2, r.HitCount())
 }
+
+func TestCacheECSScope(t *testing.T) {
+	// Upstream returning answers scoped to a /24, or unscoped for other names
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    3600,
+					},
+					A: net.IP{127, 0, 0, 1},
+				},
+			}
+			if subnet := ecsOption(q); subnet != nil && q.Question[0].Name == "scoped.example.com." {
+				a.SetEdns0(4096, false)
+				edns0 := a.IsEdns0()
+				edns0.Option = append(edns0.Option, &dns.EDNS0_SUBNET{
+					Code:          dns.EDNS0SUBNET,
+					Family:        subnet.Family,
+					SourceNetmask: subnet.SourceNetmask,
+					SourceScope:   24,
+					Address:       subnet.Address,
+				})
+			}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache", r, CacheOptions{})
+
+	query := func(name string, client net.IP) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		q.SetEdns0(4096, false)
+		edns0 := q.IsEdns0()
+		edns0.Option = append(edns0.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: 32,
+			Address:       client,
+		})
+		_, err := c.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+
+	// Queries from two different subnets should result in distinct cache entries
+	query("scoped.example.com.", net.ParseIP("192.168.1.1"))
+	require.Equal(t, 1, r.HitCount())
+	query("scoped.example.com.", net.ParseIP("192.168.2.1"))
+	require.Equal(t, 2, r.HitCount())
+
+	// Another client in the same /24 gets the cached answer
+	query("scoped.example.com.", net.ParseIP("192.168.1.2"))
+	require.Equal(t, 2, r.HitCount())
+
+	// Unscoped answers are shared by all clients
+	query("unscoped.example.com.", net.ParseIP("192.168.1.1"))
+	require.Equal(t, 3, r.HitCount())
+	query("unscoped.example.com.", net.ParseIP("10.0.0.1"))
+	require.Equal(t, 3, r.HitCount())
+
+	// Lookups only try the prefix lengths of stored answers, /24 and no subnet
+	q := new(dns.Msg)
+	q.SetQuestion("scoped.example.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	q.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("192.168.1.1")}}
+	keys := lruKeysFromQuery(q, &c.shards.scopes)
+	require.Len(t, keys, 2)
+	require.Equal(t, "192.168.1.0/24", keys[0].net)
+	require.Equal(t, "", keys[1].net)
+}
+
+func TestCacheNegativeSOA(t *testing.T) {
+	var ci ClientInfo
+	rcode := dns.RcodeNameError
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, rcode)
+			a.Ns = []dns.RR{
+				&dns.SOA{
+					Hdr: dns.RR_Header{
+						Name:   "example.com.",
+						Rrtype: dns.TypeSOA,
+						Class:  dns.ClassINET,
+						Ttl:    3600,
+					},
+					Ns:     "ns.example.com.",
+					Mbox:   "admin.example.com.",
+					Minttl: 1,
+				},
+			}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache", r, CacheOptions{})
+
+	for _, rc := range []int{dns.RcodeNameError, dns.RcodeSuccess} { // NXDOMAIN and NODATA
+		rcode = rc
+		r.hitCount = 0
+		q := new(dns.Msg)
+		q.SetQuestion(fmt.Sprintf("test%d.example.com.", rc), dns.TypeA)
+
+		// First query goes upstream, the answer is cached with the SOA MINIMUM as TTL
+		a, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, 1, r.HitCount())
+		require.Equal(t, rc, a.Rcode)
+
+		a, err = c.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, 1, r.HitCount())
+		require.Equal(t, uint32(1), a.Ns[0].Header().Ttl)
+
+		// After the SOA MINIMUM expired, the query is sent upstream again
+		time.Sleep(1100 * time.Millisecond)
+		_, err = c.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, 2, r.HitCount())
+	}
+}
+
+func TestCacheNegativeTTLMax(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeNameError)
+			a.Ns = []dns.RR{
+				&dns.SOA{
+					Hdr: dns.RR_Header{
+						Name:   "example.com.",
+						Rrtype: dns.TypeSOA,
+						Class:  dns.ClassINET,
+						Ttl:    3600,
+					},
+					Ns:     "ns.example.com.",
+					Mbox:   "admin.example.com.",
+					Minttl: 3600,
+				},
+			}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache", r, CacheOptions{NegativeTTLMax: 1})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	a, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+	require.Equal(t, uint32(1), a.Ns[0].Header().Ttl)
+
+	time.Sleep(1100 * time.Millisecond)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+}
+
+func TestCacheNegativeNoSOA(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeNameError)
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache", r, CacheOptions{NegativeTTL: 1})
+
+	// Without SOA, the default negative TTL applies
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r.HitCount())
+
+	time.Sleep(1100 * time.Millisecond)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+}
+
+func TestCacheNegativeDisabled(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeNameError)
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache", r, CacheOptions{DisableNegative: true})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+}
+
+func TestCacheNoSERVFAIL(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeServerFailure)
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache", r, CacheOptions{})
+
+	// SERVFAIL responses are not cached
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+}
+
+func TestCacheServeStale(t *testing.T) {
+	var (
+		ci      ClientInfo
+		hits    int32
+		fail    int32
+		block   = make(chan struct{})
+		blocked int32
+	)
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			atomic.AddInt32(&hits, 1)
+			if atomic.LoadInt32(&blocked) == 1 {
+				<-block
+			}
+			if atomic.LoadInt32(&fail) == 1 {
+				return nil, errors.New("failed")
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    1,
+					},
+					A: net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache", r, CacheOptions{ServeStale: true, StaleMaxTTL: 3 * time.Second})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	// Let the answer expire, then block the upstream. Multiple queries should return the
+	// stale answer immediately but only trigger one refresh.
+	time.Sleep(1100 * time.Millisecond)
+	atomic.StoreInt32(&blocked, 1)
+	for i := 0; i < 5; i++ {
+		a, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, uint32(staleTTL), a.Answer[0].Header().Ttl)
+	}
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(2), atomic.LoadInt32(&hits))
+
+	// Let the refresh fail, the stale answer should still be served
+	atomic.StoreInt32(&fail, 1)
+	atomic.StoreInt32(&blocked, 0)
+	close(block)
+	time.Sleep(100 * time.Millisecond)
+	a, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, uint32(staleTTL), a.Answer[0].Header().Ttl)
+
+	// After the stale period, the answer is no longer served from the cache
+	time.Sleep(3 * time.Second)
+	_, err = c.Resolve(q, ci)
+	require.Error(t, err)
+}
+
+func TestCachePersist(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			ttl := uint32(3600)
+			if q.Question[0].Name == "short.example.com." {
+				ttl = 1
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    ttl,
+					},
+					A: net.IP{127, 0, 0, 1},
+				},
+			}
+			return a, nil
+		},
+	}
+	opt := CacheOptions{PersistFile: filepath.Join(t.TempDir(), "cache.json")}
+
+	// Populate the cache and write it to disk
+	c := NewCache("test-cache", r, opt)
+	defer c.Close()
+	q := new(dns.Msg)
+	for _, name := range []string{"long.example.com.", "short.example.com."} {
+		q.SetQuestion(name, dns.TypeA)
+		_, err := c.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, r.HitCount())
+	require.NoError(t, c.Save())
+
+	time.Sleep(1100 * time.Millisecond)
+
+	// A new cache should be loaded from the file
+	c = NewCache("test-cache", r, opt)
+	defer c.Close()
+
+	// The long-lived answer comes from the cache, with the TTL adjusted for the time
+	// spent in the cache
+	q.SetQuestion("long.example.com.", dns.TypeA)
+	a, err := c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r.HitCount())
+	require.Less(t, a.Answer[0].Header().Ttl, uint32(3600))
+
+	// The expired answer should not have been loaded
+	q.SetQuestion("short.example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 3, r.HitCount())
+}
+
+func TestCacheClose(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache.json")
+	c := NewCache("test-cache", new(TestResolver), CacheOptions{
+		PersistFile:     file,
+		PersistInterval: 10 * time.Millisecond,
+	})
+
+	// The cache is written on close
+	require.NoError(t, c.Close())
+	_, err := os.Stat(file)
+	require.NoError(t, err)
+
+	// But not anymore after that, the background persistence is stopped
+	require.NoError(t, os.Remove(file))
+	time.Sleep(50 * time.Millisecond)
+	_, err = os.Stat(file)
+	require.True(t, os.IsNotExist(err))
+
+	// Closing more than once is fine
+	require.NoError(t, c.Close())
+}
+
+func TestCacheWarm(t *testing.T) {
+	var hits int32
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			atomic.AddInt32(&hits, 1)
+			switch q.Question[0].Name {
+			case "fail.example.com.":
+				return nil, errors.New("failed")
+			case "servfail.example.com.":
+				return servfail(q), nil
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+				A:   net.IP{192, 0, 2, 1},
+			}}
+			return a, nil
+		},
+	}
+	c := NewCache("test-cache-warm", upstream, CacheOptions{WarmConcurrency: 2})
+
+	questions, err := ParseWarmList(strings.NewReader("# top domains\nexample.com\n\nexample.net A\nfail.example.com mx\nservfail.example.com mx\n"))
+	require.NoError(t, err)
+	require.Len(t, questions, 5)
+
+	// The failing questions are skipped
+	require.Equal(t, 3, c.Warm(questions))
+	require.Equal(t, int32(5), atomic.LoadInt32(&hits))
+
+	// Warmed names are served from the cache
+	for _, question := range questions[:3] {
+		q := new(dns.Msg)
+		q.SetQuestion(question.Name, question.Qtype)
+		a, err := c.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Len(t, a.Answer, 1)
+	}
+	require.Equal(t, int32(5), atomic.LoadInt32(&hits))
+
+	_, err = ParseWarmList(strings.NewReader("example.com BOGUS\n"))
+	require.Error(t, err)
+}
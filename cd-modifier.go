@@ -0,0 +1,70 @@
+package rdns
+
+import (
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// CDModifier is a resolver that sets or clears the CD (Checking Disabled) bit
+// in queries for names on a list before forwarding them. It can be used to
+// bypass DNSSEC validation in a validating upstream resolver for zones with
+// broken signatures, without disabling validation for everything else.
+type CDModifier struct {
+	id string
+	CDModifierOptions
+	resolver Resolver
+}
+
+var _ Resolver = &CDModifier{}
+
+type CDModifierOptions struct {
+	// Names the bit is changed for. If nil, it's changed for all queries.
+	NameDB BlocklistDB
+
+	// Clear the CD bit in matching queries rather than set it.
+	Clear bool
+}
+
+// NewCDModifier returns a new instance of a CD bit modifier.
+func NewCDModifier(id string, resolver Resolver, opt CDModifierOptions) *CDModifier {
+	return &CDModifier{
+		id:                id,
+		CDModifierOptions: opt,
+		resolver:          resolver,
+	}
+}
+
+// Resolve a DNS query after setting or clearing the CD bit if the name
+// matches. The bit in the response is the same as in the original query.
+func (r *CDModifier) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	cd := !r.Clear
+	if q.CheckingDisabled == cd || !r.match(q.Question[0]) {
+		return r.resolver.Resolve(q, ci)
+	}
+	logger(r.id, q, ci).WithField("cd", cd).Debug("changing cd bit")
+	newQuery := q.Copy()
+	newQuery.CheckingDisabled = cd
+	a, err := r.resolver.Resolve(newQuery, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	a.CheckingDisabled = q.CheckingDisabled
+	return a, nil
+}
+
+func (r *CDModifier) String() string {
+	return r.id
+}
+
+func (r *CDModifier) match(question dns.Question) bool {
+	if r.NameDB == nil {
+		return true
+	}
+	question.Name = normalizeName(question.Name)
+	_, _, _, ok := r.NameDB.Match(question)
+	return ok
+}
@@ -0,0 +1,73 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCDModifier(t *testing.T) {
+	var ci ClientInfo
+	var cd bool
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			cd = q.CheckingDisabled
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	db, err := NewDomainDB("test", NewStaticLoader([]string{".broken.example."}))
+	require.NoError(t, err)
+	r := NewCDModifier("test-cd", upstream, CDModifierOptions{NameDB: db})
+
+	// CD is set for matching names, but not in the response to the client
+	q := new(dns.Msg)
+	q.SetQuestion("www.broken.example.", dns.TypeA)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.True(t, cd)
+	require.False(t, a.CheckingDisabled)
+	require.False(t, q.CheckingDisabled)
+
+	// Other names are left alone
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.False(t, cd)
+
+	q.CheckingDisabled = true
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.True(t, cd)
+}
+
+func TestCDModifierClear(t *testing.T) {
+	var ci ClientInfo
+	var cd bool
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			cd = q.CheckingDisabled
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	db, err := NewRegexpDB("test", NewStaticLoader([]string{`(^|\.)secure\.example\.$`}))
+	require.NoError(t, err)
+	r := NewCDModifier("test-cd", upstream, CDModifierOptions{NameDB: db, Clear: true})
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.secure.example.", dns.TypeA)
+	q.CheckingDisabled = true
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.False(t, cd)
+	require.True(t, a.CheckingDisabled)
+
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.True(t, cd)
+}
@@ -0,0 +1,85 @@
+package rdns
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ChaosResolver is a resolver that answers the CHAOS-class TXT queries servers
+// are commonly asked to identify themselves with, like version.bind, with
+// configured strings. They're refused if there is no string for them, to not
+// disclose anything about the upstream resolvers. All other queries are
+// forwarded upstream.
+type ChaosResolver struct {
+	id string
+	ChaosResolverOptions
+	resolver Resolver
+}
+
+var _ Resolver = &ChaosResolver{}
+
+type ChaosResolverOptions struct {
+	// Response to version.bind and version.server queries. Refused if empty.
+	Version string
+
+	// Response to hostname.bind queries. Refused if empty.
+	Hostname string
+
+	// Response to id.server queries (RFC4892). Refused if empty.
+	ID string
+}
+
+// NewChaosResolver returns a new instance of a resolver for CHAOS queries.
+func NewChaosResolver(id string, resolver Resolver, opt ChaosResolverOptions) *ChaosResolver {
+	return &ChaosResolver{
+		id:                   id,
+		ChaosResolverOptions: opt,
+		resolver:             resolver,
+	}
+}
+
+// Resolve a DNS query, answering it with a configured string if it's for one
+// of the well-known CHAOS names.
+func (r *ChaosResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	if question.Qclass != dns.ClassCHAOS {
+		return r.resolver.Resolve(q, ci)
+	}
+	var value string
+	switch strings.ToLower(question.Name) {
+	case "version.bind.", "version.server.":
+		value = r.Version
+	case "hostname.bind.":
+		value = r.Hostname
+	case "id.server.":
+		value = r.ID
+	default:
+		return r.resolver.Resolve(q, ci)
+	}
+	log := logger(r.id, q, ci)
+	if value == "" || question.Qtype != dns.TypeTXT {
+		log.Debug("refusing chaos query")
+		return refused(q), nil
+	}
+	log.Debug("answering chaos query")
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassCHAOS,
+		},
+		Txt: []string{value},
+	}}
+	return a, nil
+}
+
+func (r *ChaosResolver) String() string {
+	return r.id
+}
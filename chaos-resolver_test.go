@@ -0,0 +1,69 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaosResolver(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	r := NewChaosResolver("test-chaos", upstream, ChaosResolverOptions{
+		Version: "routedns",
+		ID:      "node-1",
+	})
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		rcode    int
+		expected string
+	}{
+		{"version.bind.", dns.TypeTXT, dns.RcodeSuccess, "routedns"},
+		{"VERSION.Bind.", dns.TypeTXT, dns.RcodeSuccess, "routedns"},
+		{"version.server.", dns.TypeTXT, dns.RcodeSuccess, "routedns"},
+		{"id.server.", dns.TypeTXT, dns.RcodeSuccess, "node-1"},
+		{"hostname.bind.", dns.TypeTXT, dns.RcodeRefused, ""}, // not configured
+		{"version.bind.", dns.TypeA, dns.RcodeRefused, ""},    // not TXT
+	}
+	for _, test := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(test.name, test.qtype)
+		q.Question[0].Qclass = dns.ClassCHAOS
+		a, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, test.rcode, a.Rcode, test.name)
+		if test.expected == "" {
+			require.Empty(t, a.Answer)
+			continue
+		}
+		require.Len(t, a.Answer, 1)
+		txt := a.Answer[0].(*dns.TXT)
+		require.Equal(t, test.name, txt.Hdr.Name)
+		require.Equal(t, uint16(dns.ClassCHAOS), txt.Hdr.Class)
+		require.Equal(t, []string{test.expected}, txt.Txt)
+	}
+	require.Equal(t, 0, upstream.HitCount())
+
+	// Queries in other classes, and for other names, are forwarded
+	q := new(dns.Msg)
+	q.SetQuestion("version.bind.", dns.TypeTXT)
+	_, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+	q.SetQuestion("example.com.", dns.TypeTXT)
+	q.Question[0].Qclass = dns.ClassCHAOS
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+
+	// Everything is refused by default
+	r = NewChaosResolver("test-chaos", upstream, ChaosResolverOptions{})
+	q.SetQuestion("version.bind.", dns.TypeTXT)
+	q.Question[0].Qclass = dns.ClassCHAOS
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+}
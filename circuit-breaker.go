@@ -0,0 +1,221 @@
+package rdns
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// CircuitBreaker is a resolver that stops sending queries to its upstream
+// resolver when too many of them fail. If the ratio of failed queries in a
+// time window reaches the limit, the circuit opens and queries fail right away
+// with ErrUnhealthy, or go to a fallback resolver, rather than waiting for the
+// upstream to time out. After a cooldown, the circuit is half-open and a single
+// query is sent upstream to test it. The circuit closes again if it succeeds,
+// or stays open for another cooldown if it fails.
+type CircuitBreaker struct {
+	id       string
+	resolver Resolver
+	opt      CircuitBreakerOptions
+
+	mu          sync.Mutex
+	state       circuitState
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	testing     bool // a query is testing the upstream while half-open
+	now         func() time.Time
+	metrics     *CircuitBreakerMetrics
+}
+
+var _ Resolver = &CircuitBreaker{}
+var _ HealthReporter = &CircuitBreaker{}
+
+type CircuitBreakerOptions struct {
+	// Ratio of failed queries, between 0 and 1, that opens the circuit. Default 0.5.
+	FailureRatio float64
+
+	// Minimum number of queries in the window before the circuit can open. Default 10.
+	MinRequests int
+
+	// Time window the ratio of failed queries is measured in. Default 10 seconds.
+	Window time.Duration
+
+	// Time the circuit stays open before a query tests the upstream again.
+	// Default 30 seconds.
+	Cooldown time.Duration
+
+	// Resolver queries are sent to while the circuit is open. Optional.
+	Fallback Resolver
+
+	// Determines if a SERVFAIL response is considered a failure.
+	ServfailError bool
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type CircuitBreakerMetrics struct {
+	// Current state, 0 = closed, 1 = open, 2 = half-open.
+	state *expvar.Int
+	// Number of times the circuit opened.
+	trip *expvar.Int
+	// Queries that weren't sent upstream because the circuit was open.
+	reject *expvar.Int
+}
+
+// NewCircuitBreaker returns a new instance of a circuit breaker for a resolver.
+func NewCircuitBreaker(id string, resolver Resolver, opt CircuitBreakerOptions) *CircuitBreaker {
+	if opt.FailureRatio <= 0 {
+		opt.FailureRatio = 0.5
+	}
+	if opt.MinRequests <= 0 {
+		opt.MinRequests = 10
+	}
+	if opt.Window <= 0 {
+		opt.Window = 10 * time.Second
+	}
+	if opt.Cooldown <= 0 {
+		opt.Cooldown = 30 * time.Second
+	}
+	return &CircuitBreaker{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		now:      time.Now,
+		metrics: &CircuitBreakerMetrics{
+			state:  getVarInt("circuitbreaker", id, "state"),
+			trip:   getVarInt("circuitbreaker", id, "trip"),
+			reject: getVarInt("circuitbreaker", id, "reject"),
+		},
+	}
+}
+
+// Resolve a DNS query with the upstream resolver unless the circuit is open.
+func (r *CircuitBreaker) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	allowed, test := r.allow()
+	if !allowed {
+		r.metrics.reject.Add(1)
+		if r.opt.Fallback != nil {
+			log.WithField("resolver", r.opt.Fallback.String()).Debug("circuit open, forwarding query to fallback")
+			return r.opt.Fallback.Resolve(q, ci)
+		}
+		log.WithField("resolver", r.resolver.String()).Debug("circuit open, failing query")
+		return nil, ErrUnhealthy
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	failed := err != nil || (r.opt.ServfailError && a != nil && a.Rcode == dns.RcodeServerFailure)
+	r.record(test, failed)
+	return a, err
+}
+
+// Healthy returns false while the circuit is open, unless there's a fallback.
+func (r *CircuitBreaker) Healthy() bool {
+	if r.opt.Fallback != nil {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state != circuitOpen || r.now().Sub(r.openedAt) >= r.opt.Cooldown
+}
+
+func (r *CircuitBreaker) String() string {
+	return r.id
+}
+
+// Returns true if a query can be sent upstream, and whether it's the query
+// that tests the upstream while the circuit is half-open.
+func (r *CircuitBreaker) allow() (allowed, test bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	switch r.state {
+	case circuitClosed:
+		if now.Sub(r.windowStart) >= r.opt.Window {
+			r.windowStart = now
+			r.requests, r.failures = 0, 0
+		}
+		return true, false
+	case circuitOpen:
+		if now.Sub(r.openedAt) < r.opt.Cooldown {
+			return false, false
+		}
+		r.setState(circuitHalfOpen)
+	}
+	if r.testing {
+		return false, false
+	}
+	r.testing = true
+	return true, true
+}
+
+// Records the result of a query and opens or closes the circuit as needed.
+func (r *CircuitBreaker) record(test, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if test {
+		r.testing = false
+		if failed {
+			r.trip()
+			return
+		}
+		r.windowStart = r.now()
+		r.requests, r.failures = 0, 0
+		r.setState(circuitClosed)
+		return
+	}
+	// Queries that were sent before the circuit opened don't count
+	if r.state != circuitClosed {
+		return
+	}
+	r.requests++
+	if failed {
+		r.failures++
+	}
+	if r.requests >= r.opt.MinRequests && float64(r.failures)/float64(r.requests) >= r.opt.FailureRatio {
+		r.trip()
+	}
+}
+
+func (r *CircuitBreaker) trip() {
+	r.openedAt = r.now()
+	r.setState(circuitOpen)
+	r.metrics.trip.Add(1)
+}
+
+func (r *CircuitBreaker) setState(state circuitState) {
+	log := Log.WithFields(logrus.Fields{
+		"id":       r.id,
+		"resolver": r.resolver.String(),
+		"from":     r.state.String(),
+		"to":       state.String(),
+	})
+	if state == circuitOpen {
+		log.Warn("opening circuit")
+	} else {
+		log.Info("circuit changed state")
+	}
+	r.state = state
+	r.metrics.state.Set(int64(state))
+}
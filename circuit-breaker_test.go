@@ -0,0 +1,126 @@
+package rdns
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var ci ClientInfo
+	var fail bool
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			if fail {
+				return nil, errors.New("failed")
+			}
+			return q, nil
+		},
+	}
+	r := NewCircuitBreaker("test-breaker", upstream, CircuitBreakerOptions{
+		FailureRatio: 0.5,
+		MinRequests:  4,
+		Window:       10 * time.Second,
+		Cooldown:     30 * time.Second,
+	})
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Some failures, but not enough to open the circuit
+	for i := 0; i < 3; i++ {
+		fail = i == 0
+		_, err := r.Resolve(q, ci)
+		require.Equal(t, fail, err != nil)
+	}
+	require.True(t, r.Healthy())
+
+	// Another failure reaches the ratio
+	fail = true
+	_, err := r.Resolve(q, ci)
+	require.Error(t, err)
+	require.Equal(t, 4, upstream.HitCount())
+	require.False(t, r.Healthy())
+
+	// Queries fail fast while the circuit is open
+	fail = false
+	for i := 0; i < 5; i++ {
+		_, err = r.Resolve(q, ci)
+		require.ErrorIs(t, err, ErrUnhealthy)
+	}
+	require.Equal(t, 4, upstream.HitCount())
+
+	// After the cooldown, a failed test query opens it again
+	now = now.Add(30 * time.Second)
+	require.True(t, r.Healthy())
+	fail = true
+	_, err = r.Resolve(q, ci)
+	require.Error(t, err)
+	require.Equal(t, 5, upstream.HitCount())
+	_, err = r.Resolve(q, ci)
+	require.ErrorIs(t, err, ErrUnhealthy)
+	require.Equal(t, 5, upstream.HitCount())
+
+	// A successful test query closes it
+	now = now.Add(30 * time.Second)
+	fail = false
+	for i := 0; i < 3; i++ {
+		_, err = r.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 8, upstream.HitCount())
+	require.Equal(t, circuitClosed, r.state)
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	var ci ClientInfo
+	// Upstream that blocks until released
+	release := make(chan struct{})
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			<-release
+			return q, nil
+		},
+	}
+	fallback := new(TestResolver)
+	r := NewCircuitBreaker("test-breaker", upstream, CircuitBreakerOptions{Fallback: fallback})
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	r.trip()
+	require.True(t, r.Healthy())
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Open circuit, queries go to the fallback
+	_, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, fallback.HitCount())
+
+	// Half-open, only one query tests the upstream, others go to the fallback
+	now = now.Add(time.Minute)
+	done := make(chan struct{})
+	go func() {
+		_, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return upstream.HitCount() == 1 }, time.Second, 10*time.Millisecond)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, fallback.HitCount())
+	release <- struct{}{}
+	<-done
+
+	// Closed again
+	go func() { release <- struct{}{} }()
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+	require.Equal(t, 2, fallback.HitCount())
+}
@@ -20,21 +20,27 @@ type config struct {
 }
 
 type listener struct {
-	Address    string
-	Protocol   string
-	Transport  string
-	Resolver   string
-	CA         string
-	ServerKey  string   `toml:"server-key"`
-	ServerCrt  string   `toml:"server-crt"`
-	MutualTLS  bool     `toml:"mutual-tls"`
-	AllowedNet []string `toml:"allowed-net"`
-	Frontend   dohFrontend
+	Address       string
+	Protocol      string
+	Transport     string
+	Resolver      string
+	CA            string
+	ServerKey     string   `toml:"server-key"`
+	ServerCrt     string   `toml:"server-crt"`
+	MutualTLS     bool     `toml:"mutual-tls"`
+	AllowedNet    []string `toml:"allowed-net"`
+	ReadTimeout   int      `toml:"read-timeout"`   // Time in seconds to read a query, default 2
+	WriteTimeout  int      `toml:"write-timeout"`  // Time in seconds to write a response, default 2
+	IdleTimeout   int      `toml:"idle-timeout"`   // Time in seconds TCP connections are kept open without queries, default 8
+	MaxConcurrent int      `toml:"max-concurrent"` // Max number of queries processed at the same time, no limit if 0
+	ReusePort     bool     `toml:"reuse-port"`     // Open one UDP socket per CPU with SO_REUSEPORT
+	Frontend      dohFrontend
 }
 
 // DoH listener frontend options
 type dohFrontend struct {
 	HTTPProxyNet string `toml:"trusted-proxy"`
+	Path         string // URL path of the DoH endpoint, default "/dns-query"
 }
 
 type resolver struct {
@@ -46,13 +52,37 @@ type resolver struct {
 	ClientKey     string `toml:"client-key"`
 	ClientCrt     string `toml:"client-crt"`
 	BootstrapAddr string `toml:"bootstrap-address"`
+	ServerName    string `toml:"server-name"` // TLS server name used in the handshake, DoT only
 	LocalAddr     string `toml:"local-address"`
+	Proxy         string `toml:"proxy"`          // URL of a SOCKS5 or HTTP proxy for outbound connections, DoT, DoH and TCP only
 	EDNS0UDPSize  uint16 `toml:"edns0-udp-size"` // UDP resolver option
+	TCPFallback   bool   `toml:"tcp-fallback"`   // Retry truncated responses over TCP, UDP resolver option
+	Cookies       bool   `toml:"cookies"`        // Send and verify DNS cookies, plain DNS resolver option
+	Case0x20      bool   `toml:"case-0x20"`      // Randomize and verify the case of query names, plain DNS resolver option
+	RequestNSID   bool   `toml:"request-nsid"`   // Ask for and log the NSID of the server, plain DNS resolver option
+	PipelineDepth int    `toml:"pipeline-depth"` // Number of parallel connections for DoT resolvers
+	IdleTimeout   int    `toml:"idle-timeout"`   // Time in seconds DoT connections are kept open without queries, default 10
+	FallbackDelay int    `toml:"fallback-delay"` // Milliseconds before racing the other address family, DoT only
+	Timeout       int    `toml:"timeout"`        // Query timeout in milliseconds, DoQ and DoH only
+	ProviderName  string `toml:"provider-name"`  // DNSCrypt provider name, not needed with a stamp
+	PublicKey     string `toml:"public-key"`     // DNSCrypt provider public key (hex), not needed with a stamp
+
+	// Query padding options for DoT resolvers
+	Padding          string `toml:"padding"` // Padding strategy, "none" or "default"
+	PaddingBlockSize int    `toml:"padding-block-size"`
+
+	// Certificate pinning options for DoT resolvers
+	PinnedKeys []string `toml:"pinned-keys"` // Base64 SHA256 hashes of accepted server public keys
+	PinOnly    bool     `toml:"pin-only"`    // Skip certificate chain validation and only check pinned keys
+
+	// Bootstrap failover options for DoT resolvers
+	BootstrapAddrs []string `toml:"bootstrap-addresses"` // Additional bootstrap addresses, tried in order if one can't be reached
 }
 
 // DoH-specific resolver options
 type doh struct {
 	Method string
+	Format string // "wire" or "json", default "wire"
 }
 
 type group struct {
@@ -60,30 +90,55 @@ type group struct {
 	Type       string
 	Replace    []rdns.ReplaceOperation // only used by "replace" type
 	GCPeriod   int                     `toml:"gc-period"`   // Time-period (seconds) used to expire cached items in the "cache" type
-	ECSOp      string                  `toml:"ecs-op"`      // ECS modifier operation, "add", "delete", "privacy"
+	ECSOp      string                  `toml:"ecs-op"`      // ECS modifier operation, "add", "inject", "zero", "delete", "privacy"
 	ECSAddress net.IP                  `toml:"ecs-address"` // ECS address. If empty for "add", uses the client IP. Ignored for "privacy" and "delete"
 	ECSPrefix4 uint8                   `toml:"ecs-prefix4"` // ECS IPv4 address prefix, 0-32. Used for "add" and "privacy"
 	ECSPrefix6 uint8                   `toml:"ecs-prefix6"` // ECS IPv6 address prefix, 0-128. Used for "add" and "privacy"
 	TTLMin     uint32                  `toml:"ttl-min"`     // TTL minimum to apply to responses in the TTL-modifier
 	TTLMax     uint32                  `toml:"ttl-max"`     // TTL maximum to apply to responses in the TTL-modifier
+	TTLSOAMin  uint32                  `toml:"ttl-soa-min"` // TTL minimum to apply to SOA records in the TTL-modifier
+	TTLSOAMax  uint32                  `toml:"ttl-soa-max"` // TTL maximum to apply to SOA records in the TTL-modifier
 	EDNS0Op    string                  `toml:"edns0-op"`    // EDNS0 modifier operation, "add" or "delete"
 	EDNS0Code  uint16                  `toml:"edns0-code"`  // EDNS0 modifier option code
 	EDNS0Data  []byte                  `toml:"edns0-data"`  // EDNS0 modifier option data
+	EDNS0Allow []uint16                `toml:"edns0-allow"` // EDNS0 filter option codes to pass through, default all
+	EDNS0Deny  []uint16                `toml:"edns0-deny"`  // EDNS0 filter option codes to remove
+
+	// ECS modifier options
+	ECSOverwrite     bool `toml:"ecs-overwrite"`      // Replace ECS options already present in the query for "inject"
+	ECSStripQuery    bool `toml:"ecs-strip-query"`    // Remove ECS options from queries in "ecs-strip"
+	ECSStripResponse bool `toml:"ecs-strip-response"` // Remove ECS options from responses in "ecs-strip"
 
 	// Failover/Failback options
-	ResetAfter    int  `toml:"reset-after"`    // Time in seconds after which to reset resolvers in fail-back and random groups, default 60.
-	ServfailError bool `toml:"servfail-error"` // If true, SERVFAIL responses are considered errors and cause failover etc.
+	ResetAfter        int  `toml:"reset-after"`         // Time in seconds after which to reset resolvers in fail-rotate, fail-back, random and load-balancer groups, default 60 (fail-rotate: disabled).
+	ServfailError     bool `toml:"servfail-error"`      // If true, SERVFAIL responses are considered errors and cause failover etc.
+	PerAttemptTimeout int  `toml:"per-attempt-timeout"` // Time in milliseconds each resolver is given before trying the next, no limit if 0
+
+	// Fastest group options
+	Timeout int `toml:"timeout"` // Time in milliseconds to wait for a successful response, no limit if 0
+
+	// Load-balancer group options
+	Weights      []int   // Weights of the resolvers in the group, default 1
+	FailureRatio float64 `toml:"failure-ratio"` // Ratio of recent failures that disables a resolver, default 0.5
 
 	// Cache options
 	CacheSize                int    `toml:"cache-size"`                  // Max number of items to keep in the cache. Default 0 == unlimited
+	CacheShards              int    `toml:"cache-shards"`                // Number of independently locked parts of the cache, default 256
 	CacheNegativeTTL         uint32 `toml:"cache-negative-ttl"`          // TTL to apply to negative responses, default 60.
+	CacheNegativeTTLMax      uint32 `toml:"cache-negative-ttl-max"`      // Maximum TTL of negative responses, no limit if 0
+	CacheNegativeDisable     bool   `toml:"cache-negative-disable"`      // Don't cache negative responses
 	CacheAnswerShuffle       string `toml:"cache-answer-shuffle"`        // Algorithm to use for modifying the response order of cached items
 	CacheHardenBelowNXDOMAIN bool   `toml:"cache-harden-below-nxdomain"` // Return NXDOMAIN if an NXDOMAIN is cached for a parent domain
 	CacheFlushQuery          string `toml:"cache-flush-query"`           // Flush the cache when a query for this name is received
+	CacheServeStale          bool   `toml:"cache-serve-stale"`           // Serve expired answers while refreshing them in the background
+	CacheStaleMaxTTL         int    `toml:"cache-stale-max-ttl"`         // Time in seconds expired answers can be served for, default 1 day
+	CachePersistFile         string `toml:"cache-persist-file"`          // File to persist the cache in across restarts
+	CachePersistInterval     int    `toml:"cache-persist-interval"`      // Time in seconds between writes to the persist file, default 60
+	CacheWarmFile            string `toml:"cache-warm-file"`             // File with names to resolve into the cache on startup
 
 	// Blocklist options
 	Blocklist []string // Blocklist rules, only used by "blocklist" type
-	Format    string   // Blocklist input format: "regex", "domain", or "hosts"
+	Format    string   // Blocklist input format: "regex", "domain", "hosts" or "adblock"
 	Source    string   // Location of external blocklist, can be a local path or remote URL
 	Refresh   int      // Blocklist refresh when using an external source, in seconds
 
@@ -94,11 +149,16 @@ type group struct {
 	BlocklistFormat   string   `toml:"blocklist-format"` // only used for static blocklists in the config
 	BlocklistSource   []list   `toml:"blocklist-source"`
 	BlocklistRefresh  int      `toml:"blocklist-refresh"`
+	BlocklistWatch    int      `toml:"blocklist-watch"` // Interval in seconds to check local list files for changes
 	Allowlist         []string // Rules to override the blocklist rules
 	AllowlistFormat   string   `toml:"allowlist-format"` // only used for static allowlists in the config
 	AllowlistSource   []list   `toml:"allowlist-source"`
 	AllowlistRefresh  int      `toml:"allowlist-refresh"`
-	LocationDB        string   `toml:"location-db"` // GeoIP database file for response blocklist. Default "/usr/share/GeoIP/GeoLite2-City.mmdb"
+	LocationDB        string   `toml:"location-db"`    // GeoIP database file for response blocklist. Default "/usr/share/GeoIP/GeoLite2-City.mmdb"
+	BlockResponse     string   `toml:"block-response"` // Response to blocked queries, "nxdomain", "nodata", "refused" or "spoof"
+	SpoofIP4          net.IP   `toml:"spoof-ip4"`      // Address used in "spoof" responses to A queries
+	SpoofIP6          net.IP   `toml:"spoof-ip6"`      // Address used in "spoof" responses to AAAA queries
+	SpoofTTL          uint32   `toml:"spoof-ttl"`      // TTL of spoofed address records, default 3600
 
 	// Static responder options
 	Answer []string
@@ -106,24 +166,156 @@ type group struct {
 	Extra  []string
 	RCode  int
 	Truncate	bool	`toml:"truncate"` // When true, TC-Bit is set
+	TTL    uint32 `toml:"ttl"` // TTL of the response records, default from the records
 
 	// Rate-limiting options
-	Requests      uint   // Number of requests allowed
-	Window        uint   // Time period in seconds for the requests
-	Prefix4       uint8  // Prefix bits to identify IPv4 client
-	Prefix6       uint8  // Prefix bits to identify IPv6 client
-	LimitResolver string `toml:"limit-resolver"` // Resolver to use when rate-limit exceeded
+	Requests      uint    // Number of requests allowed
+	Window        uint    // Time period in seconds for the requests
+	Prefix4       uint8   // Prefix bits to identify IPv4 client
+	Prefix6       uint8   // Prefix bits to identify IPv6 client
+	LimitResolver string  `toml:"limit-resolver"` // Resolver to use when rate-limit exceeded
+	Rate          float64 // Queries per second per client, enables the token bucket
+	Burst         uint    // Maximum number of queries in a burst for the token bucket, default rate
 
 	// Fastest-TCP probe options
 	Port          int
 	WaitAll       bool   `toml:"wait-all"`        // Wait for all probes to return and respond with a sorted list. Generally slower
 	SuccessTTLMin uint32 `toml:"success-ttl-min"` // Set the TTL of records that were probed successfully
 
+	// Response Minimize options
+	MinimizeStripOPT bool `toml:"minimize-strip-opt"` // Remove the OPT record from minimized responses as well
+
 	// Response Collapse options
-	NullRCode int `toml:"null-rcode"` // Response code if after collapsing, no answers are left
+	NullRCode int  `toml:"null-rcode"` // Response code if after collapsing, no answers are left
+	SameZone  bool `toml:"same-zone"`  // Only collapse if the answer chain stays in the zone of the query
 
-	// Truncate-Retry options
+	// QNAME minimizer options
+	MaxLabels int `toml:"max-labels"` // Maximum number of minimised queries per name, default 10
+
+	// DNS64 options
+	DNS64Prefix  string   `toml:"dns64-prefix"`  // IPv6 prefix for synthesized addresses, default 64:ff9b::/96
+	DNS64Exclude []string `toml:"dns64-exclude"` // Networks excluded from synthesis, default ::ffff:0:0/96
+
+	// Query log options
+	QueryLogFile         string `toml:"query-log-file"`          // File to append the query log to, default stdout
+	QueryLogSample       uint64 `toml:"query-log-sample"`        // Log one in every N queries, default all
+	QueryLogFailuresOnly bool   `toml:"query-log-failures-only"` // Only log errors and responses other than NOERROR
+
+	// Tracing options
+	TraceFile    string `toml:"trace-file"`     // File to append spans to, default stdout
+	TraceOTLPURL string `toml:"trace-otlp-url"` // URL of an OTLP/HTTP collector to export spans to instead
+
+	// DNSSEC validator options
+	TrustAnchors []string `toml:"trust-anchors"` // DS or DNSKEY records of trusted keys, default root zone KSKs
+
+	// Truncate-UDP options
+	TruncateDefaultSize uint16 `toml:"truncate-default-size"` // Buffer size of clients without EDNS0, default 512
+	TruncateMaxSize     uint16 `toml:"truncate-max-size"`     // Upper limit of the buffer size advertised by clients
+
+	// Truncate-Retry and Servfail-Retry options
 	RetryResolver string `toml:"retry-resolver"`
+	Retries       int    `toml:"retries"`       // Number of times a query is retried after a SERVFAIL, default 2
+	RetryBackoff  int    `toml:"retry-backoff"` // Time in milliseconds to wait before the first servfail retry, default 100
+
+	// Address rotate options
+	RotateMaxNames int    `toml:"rotate-max-names"` // Number of names to keep the rotation state for, default 10000
+	RotateSticky   bool   `toml:"rotate-sticky"`    // Fixed order per client IP instead of rotating with every query
+	RotateSeed     uint64 `toml:"rotate-seed"`      // Mixed into the client IP hash with rotate-sticky
+
+	// Health check options
+	HealthQuery            string `toml:"health-query"`             // Name of the probe query, default "."
+	HealthQueryType        string `toml:"health-query-type"`        // Type of the probe query, default "SOA"
+	HealthInterval         int    `toml:"health-interval"`          // Time in seconds between probes, default 10
+	HealthFailThreshold    int    `toml:"health-fail-threshold"`    // Consecutive failed probes that mark the resolver down, default 3
+	HealthSuccessThreshold int    `toml:"health-success-threshold"` // Consecutive successful probes that mark the resolver up, default 2
+
+	// ACL options
+	ACLAllow              []string `toml:"acl-allow"`                // Networks allowed to query, in CIDR notation. All if empty
+	ACLDeny               []string `toml:"acl-deny"`                 // Networks not allowed to query, in CIDR notation
+	ACLAllowOverridesDeny bool     `toml:"acl-allow-overrides-deny"` // Clients in both lists are allowed rather than denied
+	ACLDrop               bool     `toml:"acl-drop"`                 // Drop queries from denied clients instead of responding with REFUSED
+
+	// Query type filter options
+	QTypeFilter map[string]string `toml:"qtype-filter"` // Action by query type, for example { ANY = "hinfo", AXFR = "refuse" }
+
+	// CD modifier options
+	CDClear bool `toml:"cd-clear"` // Clear the CD bit in matching queries instead of setting it
+
+	// Stub zone options
+	StubZones []stubZone `toml:"stub-zones"`
+
+	// PTR resolver options
+	PTRNames     map[string]string `toml:"ptr-names"`     // Names by IP address
+	PTRTemplates []ptrTemplate     `toml:"ptr-templates"` // Name templates by network
+
+	// TTL modifier jitter options
+	TTLJitter        uint32 `toml:"ttl-jitter"`         // Max random change of TTLs in seconds
+	TTLJitterPercent uint32 `toml:"ttl-jitter-percent"` // Max random change of TTLs in percent of the TTL
+
+	// Rebind protection options
+	RebindNetworks []string `toml:"rebind-networks"` // Networks not allowed in responses, in CIDR notation. Private networks by default
+	RebindDrop     bool     `toml:"rebind-drop"`     // Drop blocked responses instead of responding with NXDOMAIN
+
+	// Hosts resolver options
+	HostsFile  string `toml:"hosts-file"`  // File in /etc/hosts format
+	HostsWatch int    `toml:"hosts-watch"` // Time in seconds between checks of the file for changes, default 10
+
+	// Rcode translate options
+	TranslateFrom string `toml:"translate-from"` // Response code to translate, for example "SERVFAIL"
+	TranslateTo   string `toml:"translate-to"`   // Response code to translate into, for example "NXDOMAIN"
+
+	// Concurrency limiter options
+	MaxConcurrentPerClient uint `toml:"max-concurrent-per-client"` // Queries a client can have in flight at the same time, default 20
+
+	// Chaos resolver options
+	ChaosVersion  string `toml:"chaos-version"`  // Response to version.bind queries, refused if empty
+	ChaosHostname string `toml:"chaos-hostname"` // Response to hostname.bind queries, refused if empty
+	ChaosID       string `toml:"chaos-id"`       // Response to id.server queries, refused if empty
+
+	// Zone signer options
+	SigningZone           string `toml:"signing-zone"`             // Zone that responses are signed for
+	SigningKeyFile        string `toml:"signing-key-file"`         // File with the DNSKEY record, generated with dnssec-keygen
+	SigningPrivateKeyFile string `toml:"signing-private-key-file"` // File with the private key, generated with dnssec-keygen
+	SigningAlgorithm      string `toml:"signing-algorithm"`        // Algorithm of a generated key if there are no key files, default ECDSAP256SHA256
+	SigningValidity       int    `toml:"signing-validity"`         // Time in seconds signatures are valid for, default 1 day
+
+	// Circuit breaker options
+	CircuitFailureRatio float64 `toml:"circuit-failure-ratio"` // Ratio of failed queries that opens the circuit, default 0.5
+	CircuitMinRequests  int     `toml:"circuit-min-requests"`  // Queries in the window before the circuit can open, default 10
+	CircuitWindow       int     `toml:"circuit-window"`        // Time in seconds the failure ratio is measured in, default 10
+	CircuitCooldown     int     `toml:"circuit-cooldown"`      // Time in seconds the circuit stays open, default 30
+	FallbackResolver    string  `toml:"fallback-resolver"`     // Resolver to use while the circuit is open
+
+	// TXT limit options
+	TXTMaxLength int  `toml:"txt-max-length"` // Maximum length in bytes of the data of TXT records
+	TXTTruncate  bool `toml:"txt-truncate"`   // Truncate UDP responses with large TXT records instead of removing them
+
+	// Entropy filter options
+	EntropyMax            float64 `toml:"entropy-max"`              // Entropy in bits per character above which a label is blocked, default 3.3
+	EntropyMinLabelLength int     `toml:"entropy-min-label-length"` // Labels shorter than this aren't scored, default 16
+	EntropyMaxLabelLength int     `toml:"entropy-max-label-length"` // Labels longer than this are blocked, not limited by default
+
+	// Address rewrite options
+	AddressMappings []addressMapping `toml:"address-mappings"`
+}
+
+// Zone forwarded to a dedicated resolver in a stub-zone group
+type stubZone struct {
+	Zone     string
+	Resolver string
+}
+
+// Template for the names of IPs in a network in a ptr-resolver group
+type ptrTemplate struct {
+	Network  string // In CIDR notation
+	Template string // Name with "{ip-dashed}" as placeholder for the IP
+}
+
+// Mapping of addresses in responses in an address-rewrite group
+type addressMapping struct {
+	From    string   // Address or network in CIDR notation
+	To      string   // Address or network of the same size
+	Clients []string // Networks of the clients the mapping applies to, all if empty
 }
 
 // Block/Allowlist items for blocklist-v2
@@ -143,11 +335,19 @@ type route struct {
 	Types         []string
 	Class         string
 	Name          string
+	Domains       []string // Domains in the same format as domain blocklists, ".domain.com" includes subdomains
 	Source        string
 	Weekdays      []string // 'mon', 'tue', 'wed', 'thu', 'fri', 'sat', 'sun'
 	After, Before string   // Hour:Minute in 24h format, for example "14:30"
+	Timezone      string   // Timezone for weekdays, after and before, for example "Europe/Berlin". Local time if empty
 	Invert        bool     // Invert the result of the match
 	Resolver      string
+
+	// Client location options
+	ClientCountries   []string `toml:"client-countries"`    // ISO country codes of clients, for example "DE"
+	ClientContinents  []string `toml:"client-continents"`   // Continent codes of clients, for example "EU"
+	LocationDB        string   `toml:"location-db"`         // GeoIP database file. Default "/usr/share/GeoIP/GeoLite2-City.mmdb"
+	LocationDBRefresh int      `toml:"location-db-refresh"` // Time in seconds between checks for changes in the database file
 }
 
 // LoadConfig reads a config file and returns the decoded structure.
@@ -174,6 +374,19 @@ func loadFile(w io.Writer, name string) error {
 	return err
 }
 
+// Parses a network in CIDR notation, or a single address as network with a
+// /32 or /128 mask.
+func parseAddressOrCIDR(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
 func parseCIDRList(networks []string) ([]*net.IPNet, error) {
 	var out []*net.IPNet
 	for _, s := range networks {
@@ -1,17 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	rdns "github.com/folbricht/routedns"
 	"github.com/heimdalr/dag"
+	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 type options struct {
@@ -93,13 +105,15 @@ func start(opt options, args []string) error {
 	// rdns.Resolver)
 	resolvers := make(map[string]rdns.Resolver)
 
-	// See if a bootstrap-resolver was defined in the config. If so, instantiate it,
-	// wrap it in a net.Resolver wrapper and replace the net.DefaultResolver with it
-	// for all other entities to use.
+	// See if a bootstrap-resolver was defined in the config. If so, instantiate it
+	// and use it to look up the hostnames of all other resolvers. Also wrap it in a
+	// net.Resolver wrapper and replace the net.DefaultResolver with it for all other
+	// entities to use, like blocklist downloads.
 	if config.BootstrapResolver.Address != "" {
 		if err := instantiateResolver("bootstrap-resolver", config.BootstrapResolver, resolvers); err != nil {
 			return fmt.Errorf("failed to instantiate bootstrap-resolver: %w", err)
 		}
+		rdns.SetBootstrapResolver(resolvers["bootstrap-resolver"])
 		net.DefaultResolver = rdns.NewNetResolver(resolvers["bootstrap-resolver"])
 	}
 	// Add all types of nodes to a DAG, this is to find duplicates. Then populate the edges (dependencies).
@@ -118,7 +132,19 @@ func start(opt options, args []string) error {
 		if err != nil {
 			return err
 		}
-		edges[id] = append(v.Resolvers, v.AllowListResolver, v.BlockListResolver, v.LimitResolver, v.RetryResolver)
+		edges[id] = append(v.Resolvers, v.AllowListResolver, v.BlockListResolver, v.LimitResolver, v.RetryResolver, v.FallbackResolver)
+		// Stub zones can use the same resolvers as other zones or the group
+		// itself. Dedup them before adding to the list of edges.
+		dep := make(map[string]struct{})
+		for _, r := range edges[id] {
+			dep[r] = struct{}{}
+		}
+		for _, z := range v.StubZones {
+			if _, ok := dep[z.Resolver]; !ok {
+				dep[z.Resolver] = struct{}{}
+				edges[id] = append(edges[id], z.Resolver)
+			}
+		}
 	}
 	for id, v := range config.Routers {
 		node := &Node{id, v}
@@ -187,7 +213,14 @@ func start(opt options, args []string) error {
 			return err
 		}
 
-		opt := rdns.ListenOptions{AllowedNet: allowedNet}
+		opt := rdns.ListenOptions{
+			AllowedNet:    allowedNet,
+			ReadTimeout:   time.Duration(l.ReadTimeout) * time.Second,
+			WriteTimeout:  time.Duration(l.WriteTimeout) * time.Second,
+			IdleTimeout:   time.Duration(l.IdleTimeout) * time.Second,
+			MaxConcurrent: l.MaxConcurrent,
+			ReusePort:     l.ReusePort,
+		}
 
 		switch l.Protocol {
 		case "tcp":
@@ -249,6 +282,7 @@ func start(opt options, args []string) error {
 				ListenOptions: opt,
 				Transport:     l.Transport,
 				HTTPProxyNet:  httpProxyNet,
+				Path:          l.Frontend.Path,
 			}
 			ln, err := rdns.NewDoHListener(id, l.Address, opt, resolver)
 			if err != nil {
@@ -280,7 +314,118 @@ func start(opt options, args []string) error {
 		}(l)
 	}
 
-	select {}
+	// Wait for a signal to terminate, then write persistent caches to disk
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	// Let queries that are already in flight upstream complete before closing
+	// the connections
+	drainResolvers(resolvers, drainTimeout)
+	for _, c := range persistentCaches {
+		if err := c.Close(); err != nil {
+			rdns.Log.WithError(err).WithField("id", c.String()).Error("failed to save cache")
+		}
+	}
+	shutdownTracerProviders(drainTimeout)
+	return nil
+}
+
+// Time to wait for outstanding upstream queries on shutdown.
+const drainTimeout = 5 * time.Second
+
+// Drains all resolvers that hold upstream connections concurrently.
+func drainResolvers(resolvers map[string]rdns.Resolver, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for id, r := range resolvers {
+		d, ok := r.(rdns.Drainer)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(id string, d rdns.Drainer) {
+			defer wg.Done()
+			if err := d.Drain(ctx); err != nil {
+				rdns.Log.WithError(err).WithField("id", id).Warn("failed to drain resolver")
+			}
+		}(id, d)
+	}
+	wg.Wait()
+}
+
+// Caches that are written to disk on shutdown.
+var persistentCaches []*rdns.Cache
+
+// Tracer providers by output, shared by all tracing elements writing to the
+// same file or collector. Flushed on shutdown.
+var tracerProviders = make(map[string]*sdktrace.TracerProvider)
+
+// Returns the tracer provider that exports spans to an OTLP/HTTP collector if
+// a URL is given, or as JSON to a file or STDOUT otherwise.
+func tracerProvider(file, otlpURL string) (*sdktrace.TracerProvider, error) {
+	key := "file:" + file
+	if otlpURL != "" {
+		key = "otlp:" + otlpURL
+	}
+	if tp, ok := tracerProviders[key]; ok {
+		return tp, nil
+	}
+	var (
+		exp sdktrace.SpanExporter
+		err error
+	)
+	switch {
+	case otlpURL != "":
+		u, err := url.Parse(otlpURL)
+		if err != nil {
+			return nil, err
+		}
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(u.Host),
+			otlptracehttp.WithURLPath(u.Path),
+		}
+		switch u.Scheme {
+		case "http":
+			opts = append(opts, otlptracehttp.WithInsecure())
+		case "https":
+		default:
+			return nil, fmt.Errorf("unsupported scheme in trace-otlp-url '%s'", otlpURL)
+		}
+		if exp, err = otlptracehttp.New(context.Background(), opts...); err != nil {
+			return nil, err
+		}
+	case file != "":
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if exp, err = stdouttrace.New(stdouttrace.WithWriter(f)); err != nil {
+			return nil, err
+		}
+	default:
+		if exp, err = stdouttrace.New(); err != nil {
+			return nil, err
+		}
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "routedns"))),
+	)
+	tracerProviders[key] = tp
+	return tp, nil
+}
+
+// Exports any outstanding spans and stops all tracer providers.
+func shutdownTracerProviders(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for key, tp := range tracerProviders {
+		if err := tp.Shutdown(ctx); err != nil {
+			rdns.Log.WithError(err).WithField("output", key).Warn("failed to shut down tracer provider")
+		}
+	}
 }
 
 // Instantiate a group object based on configuration and add to the map of resolvers by ID.
@@ -299,21 +444,45 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		resolvers[id] = rdns.NewRoundRobin(id, gr...)
 	case "fail-rotate":
 		opt := rdns.FailRotateOptions{
-			ServfailError: g.ServfailError,
+			ServfailError:     g.ServfailError,
+			ResetAfter:        time.Duration(g.ResetAfter) * time.Second,
+			PerAttemptTimeout: time.Duration(g.PerAttemptTimeout) * time.Millisecond,
 		}
 		resolvers[id] = rdns.NewFailRotate(id, opt, gr...)
 	case "fail-back":
 		opt := rdns.FailBackOptions{
-			ResetAfter:    time.Duration(g.ResetAfter),
-			ServfailError: g.ServfailError,
+			ResetAfter:        time.Duration(g.ResetAfter),
+			ServfailError:     g.ServfailError,
+			PerAttemptTimeout: time.Duration(g.PerAttemptTimeout) * time.Millisecond,
 		}
 		resolvers[id] = rdns.NewFailBack(id, opt, gr...)
 	case "fastest":
-		resolvers[id] = rdns.NewFastest(id, gr...)
+		opt := rdns.FastestOptions{
+			Timeout: time.Duration(g.Timeout) * time.Millisecond,
+		}
+		resolvers[id] = rdns.NewFastest(id, opt, gr...)
+	case "combine":
+		opt := rdns.CombineOptions{
+			Timeout: time.Duration(g.Timeout) * time.Millisecond,
+		}
+		resolvers[id] = rdns.NewCombine(id, opt, gr...)
+	case "load-balancer":
+		opt := rdns.LoadBalancerOptions{
+			Weights:           g.Weights,
+			FailureRatio:      g.FailureRatio,
+			Cooldown:          time.Duration(g.ResetAfter) * time.Second,
+			ServfailError:     g.ServfailError,
+			PerAttemptTimeout: time.Duration(g.PerAttemptTimeout) * time.Millisecond,
+		}
+		resolvers[id], err = rdns.NewLoadBalancer(id, opt, gr...)
+		if err != nil {
+			return err
+		}
 	case "random":
 		opt := rdns.RandomOptions{
-			ResetAfter:    time.Duration(g.ResetAfter),
-			ServfailError: g.ServfailError,
+			ResetAfter:        time.Duration(g.ResetAfter),
+			ServfailError:     g.ServfailError,
+			PerAttemptTimeout: time.Duration(g.PerAttemptTimeout) * time.Millisecond,
 		}
 		resolvers[id] = rdns.NewRandom(id, opt, gr...)
 	case "blocklist":
@@ -367,7 +536,7 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		}
 		var allowlistDB rdns.BlocklistDB
 		if len(g.Allowlist) > 0 {
-			allowlistDB, err = newBlocklistDB(list{Format: g.BlocklistFormat}, g.Allowlist)
+			allowlistDB, err = newBlocklistDB(list{Name: id, Format: g.AllowlistFormat}, g.Allowlist)
 			if err != nil {
 				return err
 			}
@@ -392,6 +561,12 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			AllowListResolver: resolvers[g.AllowListResolver],
 			AllowlistDB:       allowlistDB,
 			AllowlistRefresh:  time.Duration(g.AllowlistRefresh) * time.Second,
+			BlockResponse:     g.BlockResponse,
+			SpoofIP4:          g.SpoofIP4,
+			SpoofIP6:          g.SpoofIP6,
+			SpoofTTL:          g.SpoofTTL,
+			WatchFiles:        localListFiles(append(g.BlocklistSource, g.AllowlistSource...)),
+			WatchInterval:     time.Duration(g.BlocklistWatch) * time.Second,
 		}
 		resolvers[id], err = rdns.NewBlocklist(id, gr[0], opt)
 		if err != nil {
@@ -410,10 +585,23 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			return fmt.Errorf("type ttl-modifier only supports one resolver in '%s'", id)
 		}
 		opt := rdns.TTLModifierOptions{
-			MinTTL: g.TTLMin,
-			MaxTTL: g.TTLMax,
+			MinTTL:        g.TTLMin,
+			MaxTTL:        g.TTLMax,
+			SOAMinTTL:     g.TTLSOAMin,
+			SOAMaxTTL:     g.TTLSOAMax,
+			JitterSeconds: g.TTLJitter,
+			JitterPercent: g.TTLJitterPercent,
 		}
 		resolvers[id] = rdns.NewTTLModifier(id, gr[0], opt)
+	case "truncate-udp":
+		if len(gr) != 1 {
+			return fmt.Errorf("type truncate-udp only supports one resolver in '%s'", id)
+		}
+		opt := rdns.TruncateUDPOptions{
+			DefaultSize: g.TruncateDefaultSize,
+			MaxSize:     g.TruncateMaxSize,
+		}
+		resolvers[id] = rdns.NewTruncateUDP(id, gr[0], opt)
 	case "truncate-retry":
 		if len(gr) != 1 {
 			return fmt.Errorf("type truncate-retry only supports one resolver in '%s'", id)
@@ -424,6 +612,16 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		}
 		opt := rdns.TruncateRetryOptions{}
 		resolvers[id] = rdns.NewTruncateRetry(id, gr[0], retryResolver, opt)
+	case "servfail-retry":
+		if len(gr) != 1 {
+			return fmt.Errorf("type servfail-retry only supports one resolver in '%s'", id)
+		}
+		opt := rdns.ServfailRetryOptions{
+			Retries:       g.Retries,
+			Backoff:       time.Duration(g.RetryBackoff) * time.Millisecond,
+			RetryResolver: resolvers[g.RetryResolver],
+		}
+		resolvers[id] = rdns.NewServfailRetry(id, gr[0], opt)
 	case "request-dedup":
 		if len(gr) != 1 {
 			return fmt.Errorf("type request-dedup only supports one resolver in '%s'", id)
@@ -447,6 +645,10 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		switch g.ECSOp {
 		case "add":
 			f = rdns.ECSModifierAdd(g.ECSAddress, g.ECSPrefix4, g.ECSPrefix6)
+		case "inject":
+			f = rdns.ECSModifierInject(g.ECSPrefix4, g.ECSPrefix6, g.ECSOverwrite)
+		case "zero":
+			f = rdns.ECSModifierZero
 		case "delete":
 			f = rdns.ECSModifierDelete
 		case "privacy":
@@ -459,6 +661,15 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if err != nil {
 			return err
 		}
+	case "ecs-strip":
+		if len(gr) != 1 {
+			return fmt.Errorf("type ecs-strip only supports one resolver in '%s'", id)
+		}
+		opt := rdns.ECSStripOptions{
+			StripQuery:    g.ECSStripQuery,
+			StripResponse: g.ECSStripResponse,
+		}
+		resolvers[id] = rdns.NewECSStrip(id, gr[0], opt)
 	case "edns0-modifier":
 		if len(gr) != 1 {
 			return fmt.Errorf("type edns0-modifier only supports one resolver in '%s'", id)
@@ -477,6 +688,15 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if err != nil {
 			return err
 		}
+	case "edns0-filter":
+		if len(gr) != 1 {
+			return fmt.Errorf("type edns0-filter only supports one resolver in '%s'", id)
+		}
+		opt := rdns.EDNS0FilterOptions{
+			Allow: g.EDNS0Allow,
+			Deny:  g.EDNS0Deny,
+		}
+		resolvers[id] = rdns.NewEDNS0Filter(id, gr[0], opt)
 	case "cache":
 		var shuffleFunc rdns.AnswerShuffleFunc
 		switch g.CacheAnswerShuffle {
@@ -491,12 +711,37 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		opt := rdns.CacheOptions{
 			GCPeriod:            time.Duration(g.GCPeriod) * time.Second,
 			Capacity:            g.CacheSize,
+			Shards:              g.CacheShards,
 			NegativeTTL:         g.CacheNegativeTTL,
+			NegativeTTLMax:      g.CacheNegativeTTLMax,
+			DisableNegative:     g.CacheNegativeDisable,
 			ShuffleAnswerFunc:   shuffleFunc,
 			HardenBelowNXDOMAIN: g.CacheHardenBelowNXDOMAIN,
 			FlushQuery:          g.CacheFlushQuery,
+			ServeStale:          g.CacheServeStale,
+			StaleMaxTTL:         time.Duration(g.CacheStaleMaxTTL) * time.Second,
+			PersistFile:         g.CachePersistFile,
+			PersistInterval:     time.Duration(g.CachePersistInterval) * time.Second,
+		}
+		cache := rdns.NewCache(id, gr[0], opt)
+		if opt.PersistFile != "" {
+			persistentCaches = append(persistentCaches, cache)
 		}
-		resolvers[id] = rdns.NewCache(id, gr[0], opt)
+		if g.CacheWarmFile != "" {
+			f, err := os.Open(g.CacheWarmFile)
+			if err != nil {
+				return err
+			}
+			questions, err := rdns.ParseWarmList(f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to read cache-warm-file in '%s': %w", id, err)
+			}
+			// Resolve the names while the listeners are started, the cache
+			// can already be used in the meantime
+			go cache.Warm(questions)
+		}
+		resolvers[id] = cache
 	case "response-blocklist-ip", "response-blocklist-cidr": // "response-blocklist-cidr" has been retired/renamed to "response-blocklist-ip"
 		if len(gr) != 1 {
 			return fmt.Errorf("type response-blocklist-ip only supports one resolver in '%s'", id)
@@ -607,6 +852,103 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			return err
 		}
 
+	case "acl":
+		if len(gr) != 1 {
+			return fmt.Errorf("type acl only supports one resolver in '%s'", id)
+		}
+		allow, err := parseCIDRList(g.ACLAllow)
+		if err != nil {
+			return fmt.Errorf("invalid acl-allow in '%s': %w", id, err)
+		}
+		deny, err := parseCIDRList(g.ACLDeny)
+		if err != nil {
+			return fmt.Errorf("invalid acl-deny in '%s': %w", id, err)
+		}
+		opt := rdns.ACLOptions{
+			Allow:              allow,
+			Deny:               deny,
+			AllowOverridesDeny: g.ACLAllowOverridesDeny,
+			Drop:               g.ACLDrop,
+		}
+		resolvers[id] = rdns.NewACL(id, gr[0], opt)
+
+	case "query-type-filter":
+		if len(gr) != 1 {
+			return fmt.Errorf("type query-type-filter only supports one resolver in '%s'", id)
+		}
+		actions := make(map[uint16]rdns.QueryTypeAction)
+		for qtype, action := range g.QTypeFilter {
+			t, ok := dns.StringToType[strings.ToUpper(qtype)]
+			if !ok {
+				return fmt.Errorf("unknown query type '%s' in '%s'", qtype, id)
+			}
+			actions[t], err = rdns.ParseQueryTypeAction(action)
+			if err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+		}
+		opt := rdns.QueryTypeFilterOptions{
+			Actions: actions,
+		}
+		resolvers[id] = rdns.NewQueryTypeFilter(id, gr[0], opt)
+
+	case "stub-zone":
+		if len(gr) != 1 {
+			return fmt.Errorf("type stub-zone only supports one resolver in '%s'", id)
+		}
+		zones := make(map[string]rdns.Resolver)
+		for _, z := range g.StubZones {
+			if z.Zone == "" {
+				return fmt.Errorf("stub zone without name in '%s'", id)
+			}
+			resolver, ok := resolvers[z.Resolver]
+			if !ok {
+				return fmt.Errorf("stub zone '%s' in '%s' references non-existant resolver or group '%s'", z.Zone, id, z.Resolver)
+			}
+			zones[z.Zone] = resolver
+		}
+		opt := rdns.StubZoneOptions{
+			Zones: zones,
+		}
+		resolvers[id] = rdns.NewStubZone(id, gr[0], opt)
+
+	case "ptr-resolver":
+		if len(gr) != 1 {
+			return fmt.Errorf("type ptr-resolver only supports one resolver in '%s'", id)
+		}
+		var templates []rdns.PTRTemplate
+		for _, t := range g.PTRTemplates {
+			_, network, err := net.ParseCIDR(t.Network)
+			if err != nil {
+				return fmt.Errorf("invalid network in ptr template in '%s': %w", id, err)
+			}
+			templates = append(templates, rdns.PTRTemplate{Network: network, Template: t.Template})
+		}
+		opt := rdns.PTRResolverOptions{
+			Names:     g.PTRNames,
+			Templates: templates,
+		}
+		resolvers[id], err = rdns.NewPTRResolver(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "hosts-resolver":
+		if len(gr) != 1 {
+			return fmt.Errorf("type hosts-resolver only supports one resolver in '%s'", id)
+		}
+		if g.HostsFile == "" {
+			return fmt.Errorf("hosts-file required in '%s'", id)
+		}
+		opt := rdns.HostsResolverOptions{
+			Filename:      g.HostsFile,
+			WatchInterval: time.Duration(g.HostsWatch) * time.Second,
+			TTL:           g.TTL,
+		}
+		resolvers[id], err = rdns.NewHostsResolver(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+
 	case "static-responder":
 		opt := rdns.StaticResolverOptions{
 			Answer: g.Answer,
@@ -614,6 +956,7 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			Extra:  g.Extra,
 			RCode:  g.RCode,
 			Truncate:	g.Truncate,
+			TTL:    g.TTL,
 		}
 		resolvers[id], err = rdns.NewStaticResolver(id, opt)
 		if err != nil {
@@ -623,15 +966,390 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 		if len(gr) != 1 {
 			return fmt.Errorf("type response-minimize only supports one resolver in '%s'", id)
 		}
-		resolvers[id] = rdns.NewResponseMinimize(id, gr[0])
+		opt := rdns.ResponseMinimizeOptions{
+			StripOPT: g.MinimizeStripOPT,
+		}
+		resolvers[id] = rdns.NewResponseMinimize(id, gr[0], opt)
+	case "dnssec-strip":
+		if len(gr) != 1 {
+			return fmt.Errorf("type dnssec-strip only supports one resolver in '%s'", id)
+		}
+		resolvers[id] = rdns.NewDNSSECStrip(id, gr[0])
+	case "cd-modifier":
+		if len(gr) != 1 {
+			return fmt.Errorf("type cd-modifier only supports one resolver in '%s'", id)
+		}
+		if len(g.Blocklist) > 0 && len(g.BlocklistSource) > 0 {
+			return fmt.Errorf("static blocklist can't be used with 'blocklist-source' in '%s'", id)
+		}
+		if len(g.Blocklist) == 0 && len(g.BlocklistSource) == 0 {
+			return fmt.Errorf("type rcode-translate requires 'blocklist' or 'blocklist-source' in '%s'", id)
+		}
+		var nameDB rdns.BlocklistDB
+		if len(g.Blocklist) > 0 {
+			nameDB, err = newBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.Blocklist)
+			if err != nil {
+				return err
+			}
+		} else if len(g.BlocklistSource) > 0 {
+			var dbs []rdns.BlocklistDB
+			for _, s := range g.BlocklistSource {
+				db, err := newBlocklistDB(s, nil)
+				if err != nil {
+					return fmt.Errorf("%s: %w", id, err)
+				}
+				dbs = append(dbs, db)
+			}
+			nameDB, err = rdns.NewMultiDB(dbs...)
+			if err != nil {
+				return err
+			}
+		}
+		opt := rdns.CDModifierOptions{
+			NameDB: nameDB,
+			Clear:  g.CDClear,
+		}
+		resolvers[id] = rdns.NewCDModifier(id, gr[0], opt)
+	case "rcode-translate":
+		if len(gr) != 1 {
+			return fmt.Errorf("type rcode-translate only supports one resolver in '%s'", id)
+		}
+		from, ok := dns.StringToRcode[strings.ToUpper(g.TranslateFrom)]
+		if !ok {
+			return fmt.Errorf("invalid translate-from '%s' in '%s'", g.TranslateFrom, id)
+		}
+		to, ok := dns.StringToRcode[strings.ToUpper(g.TranslateTo)]
+		if !ok {
+			return fmt.Errorf("invalid translate-to '%s' in '%s'", g.TranslateTo, id)
+		}
+		if len(g.Blocklist) > 0 && len(g.BlocklistSource) > 0 {
+			return fmt.Errorf("static blocklist can't be used with 'blocklist-source' in '%s'", id)
+		}
+		if len(g.Blocklist) == 0 && len(g.BlocklistSource) == 0 {
+			return fmt.Errorf("type rcode-translate requires 'blocklist' or 'blocklist-source' in '%s'", id)
+		}
+		var nameDB rdns.BlocklistDB
+		if len(g.Blocklist) > 0 {
+			nameDB, err = newBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.Blocklist)
+			if err != nil {
+				return err
+			}
+		} else if len(g.BlocklistSource) > 0 {
+			var dbs []rdns.BlocklistDB
+			for _, s := range g.BlocklistSource {
+				db, err := newBlocklistDB(s, nil)
+				if err != nil {
+					return fmt.Errorf("%s: %w", id, err)
+				}
+				dbs = append(dbs, db)
+			}
+			nameDB, err = rdns.NewMultiDB(dbs...)
+			if err != nil {
+				return err
+			}
+		}
+		opt := rdns.RcodeTranslateOptions{
+			From:   from,
+			To:     to,
+			NameDB: nameDB,
+		}
+		resolvers[id], err = rdns.NewRcodeTranslate(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "require-ad":
+		if len(gr) != 1 {
+			return fmt.Errorf("type require-ad only supports one resolver in '%s'", id)
+		}
+		if len(g.Blocklist) > 0 && len(g.BlocklistSource) > 0 {
+			return fmt.Errorf("static blocklist can't be used with 'blocklist-source' in '%s'", id)
+		}
+		var zoneDB rdns.BlocklistDB
+		if len(g.Blocklist) > 0 {
+			zoneDB, err = newBlocklistDB(list{Name: id, Format: g.BlocklistFormat}, g.Blocklist)
+			if err != nil {
+				return err
+			}
+		} else if len(g.BlocklistSource) > 0 {
+			var dbs []rdns.BlocklistDB
+			for _, s := range g.BlocklistSource {
+				db, err := newBlocklistDB(s, nil)
+				if err != nil {
+					return fmt.Errorf("%s: %w", id, err)
+				}
+				dbs = append(dbs, db)
+			}
+			zoneDB, err = rdns.NewMultiDB(dbs...)
+			if err != nil {
+				return err
+			}
+		}
+		resolvers[id], err = rdns.NewRequireAD(id, gr[0], rdns.RequireADOptions{ZoneDB: zoneDB})
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "rebind-protection":
+		if len(gr) != 1 {
+			return fmt.Errorf("type rebind-protection only supports one resolver in '%s'", id)
+		}
+		if len(g.Allowlist) > 0 && len(g.AllowlistSource) > 0 {
+			return fmt.Errorf("static allowlist can't be used with 'allowlist-source' in '%s'", id)
+		}
+		networks, err := parseCIDRList(g.RebindNetworks)
+		if err != nil {
+			return fmt.Errorf("invalid rebind-networks in '%s': %w", id, err)
+		}
+		var allowlistDB rdns.BlocklistDB
+		if len(g.Allowlist) > 0 {
+			allowlistDB, err = newBlocklistDB(list{Name: id, Format: g.AllowlistFormat}, g.Allowlist)
+			if err != nil {
+				return err
+			}
+		} else if len(g.AllowlistSource) > 0 {
+			var dbs []rdns.BlocklistDB
+			for _, s := range g.AllowlistSource {
+				db, err := newBlocklistDB(s, nil)
+				if err != nil {
+					return fmt.Errorf("%s: %w", id, err)
+				}
+				dbs = append(dbs, db)
+			}
+			allowlistDB, err = rdns.NewMultiDB(dbs...)
+			if err != nil {
+				return err
+			}
+		}
+		opt := rdns.RebindProtectionOptions{
+			Networks:    networks,
+			AllowlistDB: allowlistDB,
+			Drop:        g.RebindDrop,
+		}
+		resolvers[id] = rdns.NewRebindProtection(id, gr[0], opt)
+	case "txt-limit":
+		if len(gr) != 1 {
+			return fmt.Errorf("type txt-limit only supports one resolver in '%s'", id)
+		}
+		if len(g.Allowlist) > 0 && len(g.AllowlistSource) > 0 {
+			return fmt.Errorf("static allowlist can't be used with 'allowlist-source' in '%s'", id)
+		}
+		var allowlistDB rdns.BlocklistDB
+		if len(g.Allowlist) > 0 {
+			allowlistDB, err = newBlocklistDB(list{Name: id, Format: g.AllowlistFormat}, g.Allowlist)
+			if err != nil {
+				return err
+			}
+		} else if len(g.AllowlistSource) > 0 {
+			var dbs []rdns.BlocklistDB
+			for _, s := range g.AllowlistSource {
+				db, err := newBlocklistDB(s, nil)
+				if err != nil {
+					return fmt.Errorf("%s: %w", id, err)
+				}
+				dbs = append(dbs, db)
+			}
+			allowlistDB, err = rdns.NewMultiDB(dbs...)
+			if err != nil {
+				return err
+			}
+		}
+		opt := rdns.TXTLimitOptions{
+			MaxLength:   g.TXTMaxLength,
+			Truncate:    g.TXTTruncate,
+			AllowlistDB: allowlistDB,
+		}
+		resolvers[id], err = rdns.NewTXTLimit(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "entropy-filter":
+		if len(gr) != 1 {
+			return fmt.Errorf("type entropy-filter only supports one resolver in '%s'", id)
+		}
+		if len(g.Allowlist) > 0 && len(g.AllowlistSource) > 0 {
+			return fmt.Errorf("static allowlist can't be used with 'allowlist-source' in '%s'", id)
+		}
+		var allowlistDB rdns.BlocklistDB
+		if len(g.Allowlist) > 0 {
+			allowlistDB, err = newBlocklistDB(list{Name: id, Format: g.AllowlistFormat}, g.Allowlist)
+			if err != nil {
+				return err
+			}
+		} else if len(g.AllowlistSource) > 0 {
+			var dbs []rdns.BlocklistDB
+			for _, s := range g.AllowlistSource {
+				db, err := newBlocklistDB(s, nil)
+				if err != nil {
+					return fmt.Errorf("%s: %w", id, err)
+				}
+				dbs = append(dbs, db)
+			}
+			allowlistDB, err = rdns.NewMultiDB(dbs...)
+			if err != nil {
+				return err
+			}
+		}
+		opt := rdns.EntropyFilterOptions{
+			MaxEntropy:        g.EntropyMax,
+			MinLabelLength:    g.EntropyMinLabelLength,
+			MaxLabelLength:    g.EntropyMaxLabelLength,
+			AllowlistDB:       allowlistDB,
+			BlocklistResolver: resolvers[g.BlockListResolver],
+		}
+		resolvers[id], err = rdns.NewEntropyFilter(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "address-rewrite":
+		if len(gr) != 1 {
+			return fmt.Errorf("type address-rewrite only supports one resolver in '%s'", id)
+		}
+		var mappings []rdns.AddressMapping
+		for _, m := range g.AddressMappings {
+			from, err := parseAddressOrCIDR(m.From)
+			if err != nil {
+				return fmt.Errorf("invalid address mapping in '%s': %w", id, err)
+			}
+			to, err := parseAddressOrCIDR(m.To)
+			if err != nil {
+				return fmt.Errorf("invalid address mapping in '%s': %w", id, err)
+			}
+			clients, err := parseCIDRList(m.Clients)
+			if err != nil {
+				return fmt.Errorf("invalid clients in address mapping in '%s': %w", id, err)
+			}
+			mappings = append(mappings, rdns.AddressMapping{From: from, To: to, Clients: clients})
+		}
+		opt := rdns.AddressRewriteOptions{
+			Mappings: mappings,
+		}
+		resolvers[id], err = rdns.NewAddressRewrite(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "address-rotate":
+		if len(gr) != 1 {
+			return fmt.Errorf("type address-rotate only supports one resolver in '%s'", id)
+		}
+		opt := rdns.AddressRotateOptions{
+			MaxNames: g.RotateMaxNames,
+			Sticky:   g.RotateSticky,
+			Seed:     g.RotateSeed,
+		}
+		resolvers[id] = rdns.NewAddressRotate(id, gr[0], opt)
+	case "health-check":
+		if len(gr) != 1 {
+			return fmt.Errorf("type health-check only supports one resolver in '%s'", id)
+		}
+		var queryType uint16
+		if g.HealthQueryType != "" {
+			var ok bool
+			queryType, ok = dns.StringToType[strings.ToUpper(g.HealthQueryType)]
+			if !ok {
+				return fmt.Errorf("unknown health-query-type '%s' in '%s'", g.HealthQueryType, id)
+			}
+		}
+		opt := rdns.HealthCheckOptions{
+			QueryName:        dns.Fqdn(g.HealthQuery),
+			QueryType:        queryType,
+			Interval:         time.Duration(g.HealthInterval) * time.Second,
+			FailThreshold:    g.HealthFailThreshold,
+			SuccessThreshold: g.HealthSuccessThreshold,
+			ServfailError:    g.ServfailError,
+		}
+		resolvers[id] = rdns.NewHealthCheck(id, gr[0], opt)
+	case "circuit-breaker":
+		if len(gr) != 1 {
+			return fmt.Errorf("type circuit-breaker only supports one resolver in '%s'", id)
+		}
+		if g.CircuitFailureRatio < 0 || g.CircuitFailureRatio > 1 {
+			return fmt.Errorf("circuit-failure-ratio needs to be between 0 and 1 in '%s'", id)
+		}
+		opt := rdns.CircuitBreakerOptions{
+			FailureRatio:  g.CircuitFailureRatio,
+			MinRequests:   g.CircuitMinRequests,
+			Window:        time.Duration(g.CircuitWindow) * time.Second,
+			Cooldown:      time.Duration(g.CircuitCooldown) * time.Second,
+			Fallback:      resolvers[g.FallbackResolver],
+			ServfailError: g.ServfailError,
+		}
+		resolvers[id] = rdns.NewCircuitBreaker(id, gr[0], opt)
 	case "response-collapse":
 		if len(gr) != 1 {
 			return fmt.Errorf("type response-collapse only supports one resolver in '%s'", id)
 		}
 		opt := rdns.ResponseCollapsOptions{
 			NullRCode: g.NullRCode,
+			SameZone:  g.SameZone,
 		}
 		resolvers[id] = rdns.NewResponseCollapse(id, gr[0], opt)
+	case "qname-minimizer":
+		if len(gr) != 1 {
+			return fmt.Errorf("type qname-minimizer only supports one resolver in '%s'", id)
+		}
+		opt := rdns.QNameMinimizerOptions{
+			MaxLabels: g.MaxLabels,
+		}
+		resolvers[id] = rdns.NewQNameMinimizer(id, gr[0], opt)
+	case "dns64":
+		if len(gr) != 1 {
+			return fmt.Errorf("type dns64 only supports one resolver in '%s'", id)
+		}
+		var opt rdns.DNS64Options
+		if g.DNS64Prefix != "" {
+			_, opt.Prefix, err = net.ParseCIDR(g.DNS64Prefix)
+			if err != nil {
+				return err
+			}
+		}
+		if len(g.DNS64Exclude) > 0 {
+			opt.ExcludePrefixes, err = parseCIDRList(g.DNS64Exclude)
+			if err != nil {
+				return err
+			}
+		}
+		resolvers[id], err = rdns.NewDNS64(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
+	case "dnssec":
+		if len(gr) != 1 {
+			return fmt.Errorf("type dnssec only supports one resolver in '%s'", id)
+		}
+		opt := rdns.DNSSECValidatorOptions{
+			TrustAnchors: g.TrustAnchors,
+		}
+		resolvers[id], err = rdns.NewDNSSECValidator(id, gr[0], opt)
+		if err != nil {
+			return err
+		}
+	case "query-log":
+		if len(gr) != 1 {
+			return fmt.Errorf("type query-log only supports one resolver in '%s'", id)
+		}
+		opt := rdns.QueryLogOptions{
+			SampleRate:   g.QueryLogSample,
+			FailuresOnly: g.QueryLogFailuresOnly,
+		}
+		if g.QueryLogFile != "" {
+			f, err := os.OpenFile(g.QueryLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			opt.Output = f
+		}
+		resolvers[id] = rdns.NewQueryLog(id, gr[0], opt)
+	case "tracing":
+		if len(gr) != 1 {
+			return fmt.Errorf("type tracing only supports one resolver in '%s'", id)
+		}
+		tp, err := tracerProvider(g.TraceFile, g.TraceOTLPURL)
+		if err != nil {
+			return err
+		}
+		opt := rdns.TracingOptions{
+			TracerProvider: tp,
+		}
+		resolvers[id] = rdns.NewTracing(id, gr[0], opt)
 	case "drop":
 		resolvers[id] = rdns.NewDropResolver(id)
 	case "rate-limiter":
@@ -644,8 +1362,79 @@ func instantiateGroup(id string, g group, resolvers map[string]rdns.Resolver) er
 			Prefix4:       g.Prefix4,
 			Prefix6:       g.Prefix6,
 			LimitResolver: resolvers[g.LimitResolver],
+			Rate:          g.Rate,
+			Burst:         g.Burst,
 		}
 		resolvers[id] = rdns.NewRateLimiter(id, gr[0], opt)
+	case "chaos-resolver":
+		if len(gr) != 1 {
+			return fmt.Errorf("type chaos-resolver only supports one resolver in '%s'", id)
+		}
+		opt := rdns.ChaosResolverOptions{
+			Version:  g.ChaosVersion,
+			Hostname: g.ChaosHostname,
+			ID:       g.ChaosID,
+		}
+		resolvers[id] = rdns.NewChaosResolver(id, gr[0], opt)
+	case "zone-signer":
+		if len(gr) != 1 {
+			return fmt.Errorf("type zone-signer only supports one resolver in '%s'", id)
+		}
+		if g.SigningZone == "" {
+			return fmt.Errorf("signing-zone required in '%s'", id)
+		}
+		var (
+			key        *dns.DNSKEY
+			privateKey crypto.Signer
+		)
+		switch {
+		case g.SigningKeyFile != "" || g.SigningPrivateKeyFile != "":
+			key, privateKey, err = rdns.LoadSigningKey(g.SigningKeyFile, g.SigningPrivateKeyFile)
+			if err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+			if g.SigningAlgorithm != "" && dns.StringToAlgorithm[strings.ToUpper(g.SigningAlgorithm)] != key.Algorithm {
+				return fmt.Errorf("signing key isn't for algorithm '%s' in '%s'", g.SigningAlgorithm, id)
+			}
+		default:
+			algorithm := uint8(dns.ECDSAP256SHA256)
+			if g.SigningAlgorithm != "" {
+				var ok bool
+				algorithm, ok = dns.StringToAlgorithm[strings.ToUpper(g.SigningAlgorithm)]
+				if !ok {
+					return fmt.Errorf("invalid signing-algorithm '%s' in '%s'", g.SigningAlgorithm, id)
+				}
+			}
+			key, privateKey, err = rdns.GenerateSigningKey(g.SigningZone, algorithm)
+			if err != nil {
+				return fmt.Errorf("%s: %w", id, err)
+			}
+			rdns.Log.WithFields(logrus.Fields{
+				"id":     id,
+				"dnskey": key.String(),
+				"ds":     key.ToDS(dns.SHA256).String(),
+			}).Warn("no signing key configured, generated a new one")
+		}
+		opt := rdns.ZoneSignerOptions{
+			Zone:       g.SigningZone,
+			Key:        key,
+			PrivateKey: privateKey,
+			Validity:   time.Duration(g.SigningValidity) * time.Second,
+		}
+		resolvers[id], err = rdns.NewZoneSigner(id, gr[0], opt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+	case "concurrency-limiter":
+		if len(gr) != 1 {
+			return fmt.Errorf("type concurrency-limiter only supports one resolver in '%s'", id)
+		}
+		opt := rdns.ConcurrencyLimiterOptions{
+			MaxConcurrentPerClient: g.MaxConcurrentPerClient,
+			Prefix4:                g.Prefix4,
+			Prefix6:                g.Prefix6,
+		}
+		resolvers[id] = rdns.NewConcurrencyLimiter(id, gr[0], opt)
 
 	default:
 		return fmt.Errorf("unsupported group type '%s' for group '%s'", g.Type, id)
@@ -670,12 +1459,38 @@ func instantiateRouter(id string, r router, resolvers map[string]rdns.Resolver)
 			return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
 		}
 		r.Invert(route.Invert)
+		if err := r.SetDomains(route.Domains); err != nil {
+			return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+		}
+		if err := r.SetTimezone(route.Timezone); err != nil {
+			return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+		}
+		if len(route.ClientCountries) > 0 || len(route.ClientContinents) > 0 {
+			db, err := rdns.NewGeoLocationDB(route.LocationDB, time.Duration(route.LocationDBRefresh)*time.Second)
+			if err != nil {
+				return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+			}
+			if err := r.SetClientLocation(db, route.ClientCountries, route.ClientContinents); err != nil {
+				return fmt.Errorf("failure parsing routes for router '%s' : %s", id, err.Error())
+			}
+		}
 		router.Add(r)
 	}
 	resolvers[id] = router
 	return nil
 }
 
+// Returns the filenames of all lists that are loaded from the local filesystem.
+func localListFiles(lists []list) []string {
+	var files []string
+	for _, l := range lists {
+		if loc, err := url.Parse(l.Source); err == nil && loc.Scheme == "" {
+			files = append(files, l.Source)
+		}
+	}
+	return files
+}
+
 func newBlocklistDB(l list, rules []string) (rdns.BlocklistDB, error) {
 	loc, err := url.Parse(l.Source)
 	if err != nil {
@@ -708,6 +1523,8 @@ func newBlocklistDB(l list, rules []string) (rdns.BlocklistDB, error) {
 		return rdns.NewDomainDB(name, loader)
 	case "hosts":
 		return rdns.NewHostsDB(name, loader)
+	case "adblock":
+		return rdns.NewAdblockDB(name, loader)
 	default:
 		return nil, fmt.Errorf("unsupported format '%s'", l.Format)
 	}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"net"
+	"strings"
+	"time"
 
 	rdns "github.com/folbricht/routedns"
 )
@@ -23,24 +25,41 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 			BootstrapAddr: r.BootstrapAddr,
 			LocalAddr:     net.ParseIP(r.LocalAddr),
 			TLSConfig:     tlsConfig,
+			Timeout:       time.Duration(r.Timeout) * time.Millisecond,
 		}
 		resolvers[id], err = rdns.NewDoQClient(id, r.Address, opt)
 		if err != nil {
 			return err
 		}
 	case "dot":
-		r.Address = rdns.AddressWithDefault(r.Address, rdns.DoTPort)
+		if !isStamp(r.Address) {
+			r.Address = rdns.AddressWithDefault(r.Address, rdns.DoTPort)
+		}
 
 		tlsConfig, err := rdns.TLSClientConfig(r.CA, r.ClientCrt, r.ClientKey)
 		if err != nil {
 			return err
 		}
 		opt := rdns.DoTClientOptions{
-			BootstrapAddr: r.BootstrapAddr,
-			LocalAddr:     net.ParseIP(r.LocalAddr),
-			TLSConfig:     tlsConfig,
+			BootstrapAddr:    r.BootstrapAddr,
+			BootstrapAddrs:   r.BootstrapAddrs,
+			LocalAddr:        net.ParseIP(r.LocalAddr),
+			TLSConfig:        tlsConfig,
+			ServerName:       r.ServerName,
+			PipelineDepth:    r.PipelineDepth,
+			IdleTimeout:      time.Duration(r.IdleTimeout) * time.Second,
+			Padding:          r.Padding,
+			PaddingBlockSize: r.PaddingBlockSize,
+			PinnedKeys:       r.PinnedKeys,
+			PinOnly:          r.PinOnly,
+			FallbackDelay:    time.Duration(r.FallbackDelay) * time.Millisecond,
+			ProxyURL:         r.Proxy,
+		}
+		if isStamp(r.Address) {
+			resolvers[id], err = rdns.NewDoTClientFromStamp(id, r.Address, opt)
+		} else {
+			resolvers[id], err = rdns.NewDoTClient(id, r.Address, opt)
 		}
-		resolvers[id], err = rdns.NewDoTClient(id, r.Address, opt)
 		if err != nil {
 			return err
 		}
@@ -62,7 +81,9 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 			return err
 		}
 	case "doh":
-		r.Address = rdns.AddressWithDefault(r.Address, rdns.DoHPort)
+		if !isStamp(r.Address) {
+			r.Address = rdns.AddressWithDefault(r.Address, rdns.DoHPort)
+		}
 
 		tlsConfig, err := rdns.TLSClientConfig(r.CA, r.ClientCrt, r.ClientKey)
 		if err != nil {
@@ -70,21 +91,53 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 		}
 		opt := rdns.DoHClientOptions{
 			Method:        r.DoH.Method,
+			Format:        r.DoH.Format,
 			TLSConfig:     tlsConfig,
 			BootstrapAddr: r.BootstrapAddr,
 			Transport:     r.Transport,
 			LocalAddr:     net.ParseIP(r.LocalAddr),
+			ProxyURL:      r.Proxy,
+			Timeout:       time.Duration(r.Timeout) * time.Millisecond,
+		}
+		if isStamp(r.Address) {
+			resolvers[id], err = rdns.NewDoHClientFromStamp(id, r.Address, opt)
+		} else {
+			resolvers[id], err = rdns.NewDoHClient(id, r.Address, opt)
+		}
+		if err != nil {
+			return err
+		}
+	case "dnscrypt":
+		opt := rdns.DNSCryptClientOptions{
+			ProviderName:  r.ProviderName,
+			PublicKey:     r.PublicKey,
+			BootstrapAddr: r.BootstrapAddr,
+			LocalAddr:     net.ParseIP(r.LocalAddr),
+			Transport:     r.Transport,
+		}
+		if isStamp(r.Address) {
+			resolvers[id], err = rdns.NewDNSCryptClientFromStamp(id, r.Address, opt)
+		} else {
+			r.Address = rdns.AddressWithDefault(r.Address, rdns.DNSCryptPort)
+			resolvers[id], err = rdns.NewDNSCryptClient(id, r.Address, opt)
 		}
-		resolvers[id], err = rdns.NewDoHClient(id, r.Address, opt)
 		if err != nil {
 			return err
 		}
 	case "tcp", "udp":
-		r.Address = rdns.AddressWithDefault(r.Address, rdns.PlainDNSPort)
+		if !strings.HasPrefix(r.Address, "unix://") {
+			r.Address = rdns.AddressWithDefault(r.Address, rdns.PlainDNSPort)
+		}
 
 		opt := rdns.DNSClientOptions{
-			LocalAddr: net.ParseIP(r.LocalAddr),
-			UDPSize:   r.EDNS0UDPSize,
+			BootstrapAddr:  r.BootstrapAddr,
+			LocalAddr:      net.ParseIP(r.LocalAddr),
+			UDPSize:        r.EDNS0UDPSize,
+			TCPFallback:    r.TCPFallback,
+			Cookies:        r.Cookies,
+			EnableCase0x20: r.Case0x20,
+			RequestNSID:    r.RequestNSID,
+			ProxyURL:       r.Proxy,
 		}
 		resolvers[id], err = rdns.NewDNSClient(id, r.Address, r.Protocol, opt)
 		if err != nil {
@@ -95,3 +148,8 @@ func instantiateResolver(id string, r resolver, resolvers map[string]rdns.Resolv
 	}
 	return nil
 }
+
+// Returns true if the address is a DNS stamp (sdns://) rather than an endpoint.
+func isStamp(address string) bool {
+	return strings.HasPrefix(address, "sdns://")
+}
@@ -0,0 +1,193 @@
+package rdns
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Combine is a resolver group that queries all resolvers concurrently for the
+// same query, then merges the answers of all successful responses into one.
+// It can be used to combine different views of a zone, internal and public
+// for example.
+type Combine struct {
+	id        string
+	resolvers []Resolver
+	opt       CombineOptions
+}
+
+// CombineOptions contain group-specific options.
+type CombineOptions struct {
+	// Time to wait for responses from all resolvers. Responses still outstanding
+	// after this are abandoned and the ones received so far are combined. No
+	// limit if 0.
+	Timeout time.Duration
+}
+
+var _ Resolver = &Combine{}
+
+// NewCombine returns a new instance of a resolver group that merges the
+// responses from all its resolvers.
+func NewCombine(id string, opt CombineOptions, resolvers ...Resolver) *Combine {
+	return &Combine{
+		id:        id,
+		resolvers: resolvers,
+		opt:       opt,
+	}
+}
+
+// Resolve a DNS query by sending it to all resolvers and combining the answers
+// of the successful responses. Records that are in more than one response are
+// only included once, and all records of an RRset get the lowest TTL of the
+// set. NOERROR takes precedence over NXDOMAIN, errors and SERVFAIL responses
+// are ignored unless no resolver was successful.
+func (r *Combine) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+
+	type response struct {
+		index int
+		a     *dns.Msg
+		err   error
+	}
+
+	responseCh := make(chan response, len(r.resolvers))
+
+	// Cancel the outstanding requests once the responses are combined
+	ctx, cancel := context.WithCancel(ci.Context())
+	defer cancel()
+	ci = ci.WithContext(ctx)
+
+	// Send the query to all resolvers. The responses are collected in a buffered channel
+	for i, resolver := range r.resolvers {
+		i, resolver := i, resolver
+		go func() {
+			a, err := resolver.Resolve(q, ci)
+			responseCh <- response{i, a, err}
+		}()
+	}
+
+	// Stop waiting for outstanding requests after the timeout
+	var timeout <-chan time.Time
+	if r.opt.Timeout > 0 {
+		timer := time.NewTimer(r.opt.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// Collect the responses by resolver so they're combined in the order of the
+	// resolvers, not the order they arrived in.
+	responses := make([]*dns.Msg, len(r.resolvers))
+	var lastErr error
+wait:
+	for i := 0; i < len(r.resolvers); i++ {
+		select {
+		case resp := <-responseCh:
+			resolver := r.resolvers[resp.index]
+			if resp.err != nil {
+				log.WithField("resolver", resolver.String()).WithError(resp.err).Debug("resolver returned error")
+				lastErr = resp.err
+				continue
+			}
+			if resp.a == nil {
+				continue
+			}
+			responses[resp.index] = resp.a
+		case <-timeout:
+			log.Debug("timeout waiting for responses, combining the ones received")
+			break wait
+		}
+	}
+
+	a := combineResponses(responses)
+	if a == nil {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, QueryTimeoutError{q}
+	}
+	return a, nil
+}
+
+func (r *Combine) String() string {
+	return r.id
+}
+
+// Merges responses into the first one with the highest precedence, NOERROR, then
+// NXDOMAIN, then any other code. Only the answers of NOERROR responses are
+// merged. Returns nil if there are no responses.
+func combineResponses(responses []*dns.Msg) *dns.Msg {
+	var base *dns.Msg
+	for _, a := range responses {
+		if a != nil && (base == nil || rcodePrecedence(a.Rcode) > rcodePrecedence(base.Rcode)) {
+			base = a
+		}
+	}
+	if base == nil || base.Rcode != dns.RcodeSuccess {
+		return base
+	}
+	combined := base.Copy()
+	combined.Answer = nil
+	for _, a := range responses {
+		if a == nil || a.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		for _, rr := range a.Answer {
+			if dup := findDuplicate(combined.Answer, rr); dup != nil {
+				if rr.Header().Ttl < dup.Header().Ttl {
+					dup.Header().Ttl = rr.Header().Ttl
+				}
+				continue
+			}
+			combined.Answer = append(combined.Answer, dns.Copy(rr))
+		}
+	}
+	if len(combined.Answer) > 0 {
+		combined.Ns = nil // Drop the SOA of negative responses
+	}
+	lowestRRSetTTL(combined.Answer)
+	return combined
+}
+
+func rcodePrecedence(rcode int) int {
+	switch rcode {
+	case dns.RcodeSuccess:
+		return 2
+	case dns.RcodeNameError:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Returns the record in the list that is identical to rr, ignoring the TTL, or
+// nil if there is none.
+func findDuplicate(rrs []dns.RR, rr dns.RR) dns.RR {
+	for _, r := range rrs {
+		if dns.IsDuplicate(r, rr) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Sets the TTL of all records in an RRset to the lowest TTL in the set.
+func lowestRRSetTTL(rrs []dns.RR) {
+	type rrset struct {
+		name   string
+		rrtype uint16
+		class  uint16
+	}
+	ttls := make(map[rrset]uint32)
+	for _, rr := range rrs {
+		h := rr.Header()
+		key := rrset{normalizeName(h.Name), h.Rrtype, h.Class}
+		if ttl, ok := ttls[key]; !ok || h.Ttl < ttl {
+			ttls[key] = h.Ttl
+		}
+	}
+	for _, rr := range rrs {
+		h := rr.Header()
+		h.Ttl = ttls[rrset{normalizeName(h.Name), h.Rrtype, h.Class}]
+	}
+}
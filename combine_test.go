@@ -0,0 +1,105 @@
+package rdns
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCombine(t *testing.T) {
+	var ci ClientInfo
+
+	// Two resolvers with overlapping answers and different TTLs
+	r1 := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				rr("test.com. 300 IN A 10.0.0.1"),
+				rr("test.com. 300 IN A 192.0.2.1"),
+			}
+			return a, nil
+		},
+	}
+	r2 := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				rr("test.com. 60 IN A 192.0.2.1"),
+				rr("test.com. 120 IN A 192.0.2.2"),
+			}
+			return a, nil
+		},
+	}
+
+	g := NewCombine("test-combine", CombineOptions{}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// Expect the union of the answers, without the duplicate, and all with the lowest TTL
+	a, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, []dns.RR{
+		rr("test.com. 60 IN A 10.0.0.1"),
+		rr("test.com. 60 IN A 192.0.2.1"),
+		rr("test.com. 60 IN A 192.0.2.2"),
+	}, a.Answer)
+}
+
+func TestCombineRcode(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	nxdomain := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeNameError)
+			a.Ns = []dns.RR{rr("com. 900 IN SOA a.gtld-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 86400")}
+			return a, nil
+		},
+	}
+	noerror := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{rr("test.com. 300 IN A 10.0.0.1")}
+			return a, nil
+		},
+	}
+	servfail := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, dns.RcodeServerFailure)
+			return a, nil
+		},
+	}
+	failing := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return nil, errors.New("failed")
+		},
+	}
+
+	// NOERROR takes precedence over NXDOMAIN, regardless of the order
+	a, err := NewCombine("test-combine", CombineOptions{}, nxdomain, noerror).Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, 1, len(a.Answer))
+	require.Empty(t, a.Ns)
+
+	// NXDOMAIN takes precedence over SERVFAIL and errors
+	a, err = NewCombine("test-combine", CombineOptions{}, servfail, failing, nxdomain).Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 1, len(a.Ns))
+
+	// Errors are only returned if there's no response at all
+	_, err = NewCombine("test-combine", CombineOptions{}, failing, failing).Resolve(q, ci)
+	require.Error(t, err)
+}
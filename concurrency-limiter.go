@@ -0,0 +1,99 @@
+package rdns
+
+import (
+	"expvar"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// ConcurrencyLimiter is a resolver that limits the number of queries a client
+// (network) can have outstanding at the same time, to keep a single client from
+// using up all connections to the upstream resolvers. Queries that exceed the
+// limit are answered with REFUSED.
+type ConcurrencyLimiter struct {
+	id       string
+	resolver Resolver
+	ConcurrencyLimiterOptions
+
+	mu       sync.Mutex
+	inFlight map[string]uint
+	exceed   *expvar.Int
+}
+
+var _ Resolver = &ConcurrencyLimiter{}
+
+type ConcurrencyLimiterOptions struct {
+	// Number of queries a client can have in flight at the same time. Default 20.
+	MaxConcurrentPerClient uint
+
+	// Netmasks to identify clients. Default 32 and 128, every address is a client.
+	Prefix4 uint8
+	Prefix6 uint8
+}
+
+// NewConcurrencyLimiter returns a new instance of a per-client concurrent query limiter.
+func NewConcurrencyLimiter(id string, resolver Resolver, opt ConcurrencyLimiterOptions) *ConcurrencyLimiter {
+	if opt.MaxConcurrentPerClient == 0 {
+		opt.MaxConcurrentPerClient = 20
+	}
+	if opt.Prefix4 == 0 {
+		opt.Prefix4 = 32
+	}
+	if opt.Prefix6 == 0 {
+		opt.Prefix6 = 128
+	}
+	return &ConcurrencyLimiter{
+		id:                        id,
+		resolver:                  resolver,
+		ConcurrencyLimiterOptions: opt,
+		inFlight:                  make(map[string]uint),
+		exceed:                    getVarInt("router", id, "exceed"),
+	}
+}
+
+// Resolve a DNS query, or refuse it if the client has too many queries in flight.
+func (r *ConcurrencyLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	source := ci.SourceIP
+	if ip4 := source.To4(); len(ip4) == net.IPv4len {
+		source = source.Mask(net.CIDRMask(int(r.Prefix4), 32))
+	} else {
+		source = source.Mask(net.CIDRMask(int(r.Prefix6), 128))
+	}
+	key := source.String()
+
+	if !r.acquire(key) {
+		r.exceed.Add(1)
+		logger(r.id, q, ci).Debug("too many concurrent queries from client, refusing")
+		return refused(q), nil
+	}
+	defer r.release(key)
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *ConcurrencyLimiter) String() string {
+	return r.id
+}
+
+// Counts a query as in flight for the client. Returns false if the client
+// already has the maximum number of queries in flight.
+func (r *ConcurrencyLimiter) acquire(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.inFlight[key] >= r.MaxConcurrentPerClient {
+		return false
+	}
+	r.inFlight[key]++
+	return true
+}
+
+func (r *ConcurrencyLimiter) release(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.inFlight[key] <= 1 {
+		delete(r.inFlight, key)
+		return
+	}
+	r.inFlight[key]--
+}
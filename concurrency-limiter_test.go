@@ -0,0 +1,88 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	// Upstream that holds queries from one client until released, and fails
+	// queries for a name
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			if q.Question[0].Name == "fail.example.com." {
+				return nil, errors.New("failed")
+			}
+			if ci.SourceIP.Equal(net.ParseIP("192.168.1.1")) {
+				started <- struct{}{}
+				<-release
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	const n = 3
+	r := NewConcurrencyLimiter("test-limiter", upstream, ConcurrencyLimiterOptions{MaxConcurrentPerClient: n})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	client := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+
+	// Hold n queries from the same client
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, err := r.Resolve(q, client)
+			require.NoError(t, err)
+			require.Equal(t, dns.RcodeSuccess, a.Rcode)
+		}()
+		<-started
+	}
+
+	// The next one is refused, other clients aren't affected
+	a, err := r.Resolve(q, client)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	a, err = r.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.2")})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+
+	// Once completed, the client can send queries again
+	for i := 0; i < n; i++ {
+		release <- struct{}{}
+	}
+	wg.Wait()
+	require.Empty(t, r.inFlight)
+
+	// Failed queries aren't counted as in flight either
+	q.SetQuestion("fail.example.com.", dns.TypeA)
+	for i := 0; i < n+1; i++ {
+		_, err = r.Resolve(q, client)
+		require.Error(t, err)
+	}
+	require.Empty(t, r.inFlight)
+}
+
+func TestConcurrencyLimiterDefault(t *testing.T) {
+	// Without a limit, the default applies rather than refusing everything
+	r := NewConcurrencyLimiter("test-limiter", new(TestResolver), ConcurrencyLimiterOptions{})
+	require.Equal(t, uint(20), r.MaxConcurrentPerClient)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.168.1.1")})
+	require.NoError(t, err)
+	require.NotEqual(t, dns.RcodeRefused, a.Rcode)
+}
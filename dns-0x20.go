@@ -0,0 +1,64 @@
+package rdns
+
+import (
+	"crypto/rand"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Returns a copy of the query with the case of the letters in the name
+// randomized, as per draft-vixie-dnsext-dns0x20. Servers are expected to
+// return the name in the response exactly as it was in the query, which makes
+// spoofed responses harder to get accepted.
+func randomizeCase(q *dns.Msg) *dns.Msg {
+	q = q.Copy()
+	name := []byte(q.Question[0].Name)
+	bits := make([]byte, (len(name)+7)/8)
+	_, _ = rand.Read(bits)
+	for i, c := range name {
+		if !isLetter(c) {
+			continue
+		}
+		if bits[i/8]&(1<<(i%8)) != 0 {
+			name[i] = c &^ 0x20 // upper case
+		} else {
+			name[i] = c | 0x20 // lower case
+		}
+	}
+	q.Question[0].Name = string(name)
+	return q
+}
+
+// Checks that the name in the response has exactly the same case as in the
+// query. Returns ErrCaseMismatch otherwise.
+func verifyCase(q, a *dns.Msg) error {
+	if len(a.Question) == 0 || a.Question[0].Name != q.Question[0].Name {
+		return ErrCaseMismatch
+	}
+	return nil
+}
+
+// Puts the original name of the query back into the response, in the
+// question as well as the records that have it as owner name.
+func restoreCase(a *dns.Msg, sent, original string) {
+	if sent == original {
+		return
+	}
+	for i := range a.Question {
+		if a.Question[i].Name == sent {
+			a.Question[i].Name = original
+		}
+	}
+	for _, rrs := range [][]dns.RR{a.Answer, a.Ns, a.Extra} {
+		for _, rr := range rrs {
+			if h := rr.Header(); strings.EqualFold(h.Name, sent) {
+				h.Name = original
+			}
+		}
+	}
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
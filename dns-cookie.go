@@ -0,0 +1,111 @@
+package rdns
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Time a server cookie is used for after it was last received. Servers are
+// expected to hand out a fresh one at least every hour, see RFC9018.
+const dnsCookieLifetime = time.Hour
+
+// dnsCookies holds the cookies used with upstream servers, as per RFC7873.
+// Each server address gets its own client cookie so servers can't use it to
+// track the client across servers (section 5.1).
+type dnsCookies struct {
+	mu      sync.Mutex
+	servers map[string]*serverCookies
+}
+
+type serverCookies struct {
+	client string // hex-encoded 8 byte client cookie
+	server string // hex-encoded, empty if none was received or it expired
+	expiry time.Time
+}
+
+func newDNSCookies() *dnsCookies {
+	return &dnsCookies{
+		servers: make(map[string]*serverCookies),
+	}
+}
+
+// Returns the cookies for a server, generating a new client cookie if there
+// are none yet. Must be called with the lock held.
+func (c *dnsCookies) forServer(server string) *serverCookies {
+	s, ok := c.servers[server]
+	if !ok {
+		b := make([]byte, 8)
+		rand.Read(b)
+		s = &serverCookies{client: hex.EncodeToString(b)}
+		c.servers[server] = s
+	}
+	return s
+}
+
+// Adds a cookie option for the server to the query, replacing any cookie the
+// query may already have. Adds an OPT record if there isn't one.
+func (c *dnsCookies) set(q *dns.Msg, server string) {
+	edns0 := q.IsEdns0()
+	if edns0 == nil {
+		q.SetEdns0(dns.MinMsgSize, false)
+		edns0 = q.IsEdns0()
+	}
+	removeCookie(edns0)
+
+	c.mu.Lock()
+	s := c.forServer(server)
+	if s.server != "" && !time.Now().Before(s.expiry) {
+		s.server = ""
+	}
+	cookie := s.client + s.server
+	c.mu.Unlock()
+	edns0.Option = append(edns0.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+}
+
+// Checks the cookie in a response from the server and stores the server cookie
+// for subsequent queries. The cookie option is removed from the response.
+// Returns ErrCookieMismatch if the client cookie doesn't match.
+func (c *dnsCookies) update(server string, a *dns.Msg) error {
+	edns0 := a.IsEdns0()
+	if edns0 == nil {
+		return nil
+	}
+	cookie := removeCookie(edns0)
+	if cookie == nil { // server doesn't support cookies
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.forServer(server)
+	if len(cookie.Cookie) < len(s.client) || !strings.EqualFold(cookie.Cookie[:len(s.client)], s.client) {
+		return ErrCookieMismatch
+	}
+	if len(cookie.Cookie) == len(s.client) {
+		return nil
+	}
+	s.server = cookie.Cookie[len(s.client):]
+	s.expiry = time.Now().Add(dnsCookieLifetime)
+	return nil
+}
+
+// Removes the cookie option from an OPT record and returns it, or nil if there
+// wasn't one.
+func removeCookie(edns0 *dns.OPT) *dns.EDNS0_COOKIE {
+	var cookie *dns.EDNS0_COOKIE
+	newOpt := make([]dns.EDNS0, 0, len(edns0.Option))
+	for _, opt := range edns0.Option {
+		if c, ok := opt.(*dns.EDNS0_COOKIE); ok {
+			cookie = c
+			continue
+		}
+		newOpt = append(newOpt, opt)
+	}
+	edns0.Option = newOpt
+	edns0.Hdr.Rdlength = 0 // Recalculated when packed
+	return cookie
+}
@@ -0,0 +1,80 @@
+package rdns
+
+import (
+	"encoding/hex"
+	"unicode"
+
+	"github.com/miekg/dns"
+)
+
+// Returns a copy of the query with an empty NSID option (RFC5001) that asks the
+// server to identify itself, adding an OPT record if there isn't one. Also
+// returns whether the query already had an OPT record and an NSID option.
+func addNSID(q *dns.Msg) (out *dns.Msg, hasEDNS0, hasNSID bool) {
+	if edns0 := q.IsEdns0(); edns0 != nil {
+		hasEDNS0 = true
+		for _, opt := range edns0.Option {
+			if _, ok := opt.(*dns.EDNS0_NSID); ok {
+				return q, true, true
+			}
+		}
+	}
+	q = q.Copy()
+	edns0 := q.IsEdns0()
+	if edns0 == nil {
+		q.SetEdns0(dns.MinMsgSize, false)
+		edns0 = q.IsEdns0()
+	}
+	edns0.Option = append(edns0.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	return q, hasEDNS0, false
+}
+
+// Removes the NSID option from a response and returns the identifier of the
+// server, or an empty string if there wasn't one. The identifier is returned
+// as text if it's printable, hex-encoded otherwise.
+func removeNSID(a *dns.Msg) string {
+	edns0 := a.IsEdns0()
+	if edns0 == nil {
+		return ""
+	}
+	var nsid string
+	newOpt := make([]dns.EDNS0, 0, len(edns0.Option))
+	for _, opt := range edns0.Option {
+		if o, ok := opt.(*dns.EDNS0_NSID); ok {
+			nsid = nsidString(o)
+			continue
+		}
+		newOpt = append(newOpt, opt)
+	}
+	edns0.Option = newOpt
+	edns0.Hdr.Rdlength = 0 // Recalculated when packed
+	return nsid
+}
+
+// Returns the NSID option of a response as text, or an empty string if the
+// response doesn't have one.
+func responseNSID(a *dns.Msg) string {
+	edns0 := a.IsEdns0()
+	if edns0 == nil {
+		return ""
+	}
+	for _, opt := range edns0.Option {
+		if o, ok := opt.(*dns.EDNS0_NSID); ok {
+			return nsidString(o)
+		}
+	}
+	return ""
+}
+
+func nsidString(o *dns.EDNS0_NSID) string {
+	b, err := hex.DecodeString(o.Nsid)
+	if err != nil {
+		return o.Nsid
+	}
+	for _, r := range string(b) {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return o.Nsid
+		}
+	}
+	return string(b)
+}
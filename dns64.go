@@ -0,0 +1,152 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// DNS64 is a resolver that synthesizes AAAA records from A records for names
+// that don't have any AAAA records, as described in RFC 6147. Used in networks
+// with NAT64 to give IPv6-only clients access to IPv4-only services.
+type DNS64 struct {
+	id       string
+	resolver Resolver
+	opt      DNS64Options
+}
+
+var _ Resolver = &DNS64{}
+
+type DNS64Options struct {
+	// IPv6 prefix the IPv4 addresses are embedded in. The length must be one of
+	// 32, 40, 48, 56, 64, or 96. Default 64:ff9b::/96.
+	Prefix *net.IPNet
+
+	// Networks that are excluded from synthesis. AAAA records in IPv6 networks
+	// are treated as if they didn't exist, and A records in IPv4 networks are
+	// not used to synthesize AAAA records. Default ::ffff:0:0/96.
+	ExcludePrefixes []*net.IPNet
+}
+
+// NewDNS64 returns a new instance of a DNS64 resolver.
+func NewDNS64(id string, resolver Resolver, opt DNS64Options) (*DNS64, error) {
+	if opt.Prefix == nil {
+		_, opt.Prefix, _ = net.ParseCIDR("64:ff9b::/96")
+	}
+	if opt.Prefix.IP.To4() != nil {
+		return nil, errors.New("dns64 prefix must be an IPv6 network")
+	}
+	switch ones, _ := opt.Prefix.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("unsupported dns64 prefix length %d", ones)
+	}
+	if opt.ExcludePrefixes == nil {
+		_, mapped, _ := net.ParseCIDR("::ffff:0:0/96")
+		opt.ExcludePrefixes = []*net.IPNet{mapped}
+	}
+	return &DNS64{id: id, resolver: resolver, opt: opt}, nil
+}
+
+// Resolve a DNS query. AAAA queries that don't return any usable AAAA records
+// are followed by an A query for the same name and the response is built from
+// the synthesized records.
+func (r *DNS64) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	answer, err := r.resolver.Resolve(q, ci)
+	if err != nil || answer == nil || question.Qtype != dns.TypeAAAA || answer.Rcode != dns.RcodeSuccess {
+		return answer, err
+	}
+
+	// Clients that validate DNSSEC themselves can't use synthesized records
+	if edns0 := q.IsEdns0(); edns0 != nil && edns0.Do() && q.CheckingDisabled {
+		return answer, nil
+	}
+
+	// Leave the response alone if there are usable AAAA records
+	for _, rr := range answer.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok && !r.excluded(aaaa.AAAA, true) {
+			return answer, nil
+		}
+	}
+
+	// Query the A records of the name
+	log := logger(r.id, q, ci)
+	aQuery := q.Copy()
+	aQuery.Question[0].Qtype = dns.TypeA
+	aAnswer, err := r.resolver.Resolve(aQuery, ci)
+	if err != nil || aAnswer == nil || aAnswer.Rcode != dns.RcodeSuccess {
+		log.WithError(err).Debug("a query failed, not synthesizing")
+		return answer, nil
+	}
+
+	// Build AAAA records from the A records, keeping any CNAMEs
+	var records []dns.RR
+	var synthesized int
+	for _, rr := range aAnswer.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			records = append(records, rr)
+		case *dns.A:
+			if r.excluded(rr.A, false) {
+				continue
+			}
+			records = append(records, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   rr.Hdr.Name,
+					Rrtype: dns.TypeAAAA,
+					Class:  rr.Hdr.Class,
+					Ttl:    rr.Hdr.Ttl,
+				},
+				AAAA: embedIPv4(r.opt.Prefix, rr.A),
+			})
+			synthesized++
+		}
+	}
+	if synthesized == 0 {
+		return answer, nil
+	}
+	log.WithField("records", synthesized).Debug("synthesizing aaaa records")
+	answer.Answer = records
+	answer.Ns = nil
+	return answer, nil
+}
+
+func (r *DNS64) String() string {
+	return r.id
+}
+
+// Returns true if the IP is in one of the excluded networks of the given family.
+func (r *DNS64) excluded(ip net.IP, ip6 bool) bool {
+	for _, n := range r.opt.ExcludePrefixes {
+		if (len(n.Mask) == net.IPv6len) != ip6 {
+			continue
+		}
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Embeds an IPv4 address in an IPv6 prefix as per RFC 6052. Bits 64 to 71
+// of the address are reserved and always zero.
+func embedIPv4(prefix *net.IPNet, ip net.IP) net.IP {
+	out := make(net.IP, net.IPv6len)
+	copy(out, prefix.IP.To16())
+	ones, _ := prefix.Mask.Size()
+	pos := ones / 8
+	for _, b := range ip.To4() {
+		if pos == 8 {
+			pos++
+		}
+		out[pos] = b
+		pos++
+	}
+	return out
+}
@@ -0,0 +1,121 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a resolver that answers from a map of "name type" to records.
+func newDNS64TestResolver(records map[string][]string) *TestResolver {
+	return &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			question := q.Question[0]
+			a := new(dns.Msg)
+			a.SetReply(q)
+			for _, record := range records[question.Name+" "+dns.TypeToString[question.Qtype]] {
+				rr, _ := dns.NewRR(record)
+				a.Answer = append(a.Answer, rr)
+			}
+			return a, nil
+		},
+	}
+}
+
+func TestDNS64(t *testing.T) {
+	upstream := newDNS64TestResolver(map[string][]string{
+		"ipv4only.test. A":    {"ipv4only.test. 300 IN A 192.0.2.1"},
+		"dual.test. A":        {"dual.test. 300 IN A 192.0.2.2"},
+		"dual.test. AAAA":     {"dual.test. 300 IN AAAA 2001:db8::2"},
+		"mapped.test. A":      {"mapped.test. 300 IN A 192.0.2.3"},
+		"mapped.test. AAAA":   {"mapped.test. 300 IN AAAA ::ffff:192.0.2.3"},
+		"alias.test. A":       {"alias.test. 300 IN CNAME ipv4only.test.", "ipv4only.test. 60 IN A 192.0.2.1"},
+		"private.test. A":     {"private.test. 300 IN A 10.0.0.1"},
+		"ipv6only.test. AAAA": {"ipv6only.test. 300 IN AAAA 2001:db8::6"},
+	})
+	r, err := NewDNS64("test-dns64", upstream, DNS64Options{})
+	require.NoError(t, err)
+
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a
+	}
+	addrs := func(a *dns.Msg) []string {
+		var out []string
+		for _, rr := range a.Answer {
+			if aaaa, ok := rr.(*dns.AAAA); ok {
+				out = append(out, aaaa.AAAA.String())
+			}
+		}
+		return out
+	}
+
+	// Synthesize from A records
+	a := resolve("ipv4only.test.", dns.TypeAAAA)
+	require.Equal(t, []string{"64:ff9b::c000:201"}, addrs(a))
+	require.Equal(t, uint32(300), a.Answer[0].Header().Ttl)
+
+	// Real AAAA records are passed through
+	a = resolve("dual.test.", dns.TypeAAAA)
+	require.Equal(t, []string{"2001:db8::2"}, addrs(a))
+
+	// IPv4-mapped AAAA records are excluded by default, and synthesized instead
+	a = resolve("mapped.test.", dns.TypeAAAA)
+	require.Equal(t, []string{"64:ff9b::c000:203"}, addrs(a))
+
+	// CNAMEs are retained
+	a = resolve("alias.test.", dns.TypeAAAA)
+	require.Len(t, a.Answer, 2)
+	require.IsType(t, &dns.CNAME{}, a.Answer[0])
+	require.Equal(t, []string{"64:ff9b::c000:201"}, addrs(a))
+
+	// Queries for other types are not modified
+	a = resolve("ipv4only.test.", dns.TypeA)
+	require.Len(t, a.Answer, 1)
+	require.IsType(t, &dns.A{}, a.Answer[0])
+
+	// Names without A records stay NODATA
+	a = resolve("none.test.", dns.TypeAAAA)
+	require.Empty(t, a.Answer)
+
+	// Excluded IPv4 networks are not synthesized
+	_, exclude, _ := net.ParseCIDR("10.0.0.0/8")
+	r, err = NewDNS64("test-dns64", upstream, DNS64Options{ExcludePrefixes: []*net.IPNet{exclude}})
+	require.NoError(t, err)
+	a = resolve("private.test.", dns.TypeAAAA)
+	require.Empty(t, a.Answer)
+	a = resolve("ipv4only.test.", dns.TypeAAAA)
+	require.Equal(t, []string{"64:ff9b::c000:201"}, addrs(a))
+}
+
+func TestDNS64Prefix(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		expected string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	}
+	for _, test := range tests {
+		_, prefix, err := net.ParseCIDR(test.prefix)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, embedIPv4(prefix, net.ParseIP("192.0.2.33")).String(), test.prefix)
+	}
+
+	// Invalid prefixes
+	_, prefix, _ := net.ParseCIDR("2001:db8::/80")
+	_, err := NewDNS64("test-dns64", new(TestResolver), DNS64Options{Prefix: prefix})
+	require.Error(t, err)
+	_, prefix, _ = net.ParseCIDR("192.0.2.0/24")
+	_, err = NewDNS64("test-dns64", new(TestResolver), DNS64Options{Prefix: prefix})
+	require.Error(t, err)
+}
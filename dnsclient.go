@@ -1,35 +1,71 @@
 package rdns
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-// DNSClient represents a simple DNS resolver for UDP or TCP.
+// DNSClient represents a simple DNS resolver for UDP or TCP. With an endpoint
+// in the form unix:///path, it connects to a Unix domain socket instead, using
+// the same framing as TCP.
 type DNSClient struct {
 	id       string
 	endpoint string
 	net      string
-	pipeline *Pipeline // Pipeline also provides operation metrics.
+	pipeline *Pipeline   // Pipeline also provides operation metrics.
+	tcp      *Pipeline   // Used to retry truncated UDP responses, nil if disabled
+	cookies  *dnsCookies // nil if cookies are disabled
 	opt      DNSClientOptions
 }
 
 type DNSClientOptions struct {
+	// Bootstrap address - IP to use for the service instead of looking up
+	// the service's hostname with potentially plain DNS.
+	BootstrapAddr string
+
 	// Local IP to use for outbound connections. If nil, a local address is chosen.
 	LocalAddr net.IP
 
-	// Sets the EDNS0 UDP size for all queries sent upstream. If set to 0, queries
-	// are not changed.
+	// Retry queries over TCP if a UDP response is truncated. Only used by UDP clients.
+	TCPFallback bool
+
+	// Sets the EDNS0 UDP size for all queries sent upstream, adding an OPT record
+	// if necessary. If set to 0, UDP clients advertise 1232 in queries that have an
+	// OPT record already, other queries are not changed.
 	UDPSize uint16
 
+	// Send DNS cookies (RFC7873) to the upstream resolver, and verify the ones in its
+	// responses to protect against spoofed responses.
+	Cookies bool
+
+	// Randomize the case of the letters in query names (DNS 0x20 encoding) and
+	// reject responses that don't have the name in exactly the same case, to
+	// protect against spoofed responses. Doesn't work with servers that don't
+	// preserve the case of names.
+	EnableCase0x20 bool
+
+	// Ask the upstream resolver to identify itself by adding an NSID option
+	// (RFC5001) to queries. The returned identifier is logged, useful to tell
+	// which instance of an anycast service answered. It's only passed on in
+	// responses to queries that had an NSID option already.
+	RequestNSID bool
+
+	// URL of a proxy to connect to the upstream resolver through, for example
+	// socks5://127.0.0.1:1080 or http://proxy:3128. Only supported for TCP and
+	// can't be used with LocalAddr.
+	ProxyURL string
+
 	Timeout time.Duration
 }
 
 var _ Resolver = &DNSClient{}
+var _ Drainer = &DNSClient{}
 
 // NewDNSClient returns a new instance of DNSClient which is a plain DNS resolver
 // that supports pipelining over a single connection.
@@ -37,6 +73,22 @@ func NewDNSClient(id, endpoint, network string, opt DNSClientOptions) (*DNSClien
 	if err := validEndpoint(endpoint); err != nil {
 		return nil, err
 	}
+	if _, ok := unixSocketPath(endpoint); ok {
+		if network != "tcp" {
+			return nil, errors.New("unix socket endpoints are only supported for tcp dns client")
+		}
+		if opt.BootstrapAddr != "" || opt.LocalAddr != nil || opt.ProxyURL != "" {
+			return nil, errors.New("bootstrap address, local address and proxy can't be used with unix socket endpoint")
+		}
+	}
+	if opt.ProxyURL != "" {
+		if network != "tcp" {
+			return nil, errors.New("proxy is only supported for tcp dns client")
+		}
+		if opt.LocalAddr != nil {
+			return nil, errors.New("local address and proxy are mutually exclusive for dns client")
+		}
+	}
 	// Use a custom dialer if a local address was provided
 	var dialer *net.Dialer
 	if opt.LocalAddr != nil {
@@ -52,19 +104,59 @@ func NewDNSClient(id, endpoint, network string, opt DNSClientOptions) (*DNSClien
 		opt.Timeout = time.Second * 1
 	}
 
-	client := &dns.Client{
+	// Use the bootstrap IP instead of the hostname in the endpoint to connect
+	if opt.BootstrapAddr != "" {
+		_, port, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse endpoint '%s'", endpoint)
+		}
+		endpoint = net.JoinHostPort(opt.BootstrapAddr, port)
+	} else {
+		dialer = bootstrapDialer(dialer)
+	}
+
+	var client DNSDialer = &dns.Client{
 		Net:       network,
 		Dialer:    dialer,
 		TLSConfig: &tls.Config{},
 		UDPSize:   4096,
 	}
-	return &DNSClient{
+	if opt.ProxyURL != "" {
+		pd, err := newProxyDialer(opt.ProxyURL, bootstrapDialer(nil))
+		if err != nil {
+			return nil, err
+		}
+		client = proxyDNSDialer{dialer: pd}
+	}
+	if path, ok := unixSocketPath(endpoint); ok {
+		client = unixDNSDialer{path: path}
+	}
+	d := &DNSClient{
 		id:       id,
 		net:      network,
 		endpoint: endpoint,
-		pipeline: NewPipeline(id, endpoint, client),
+		pipeline: NewPipeline(id, endpoint, client, 0),
 		opt:      opt,
-	}, nil
+	}
+	if opt.Cookies {
+		d.cookies = newDNSCookies()
+	}
+	if network == "udp" && opt.TCPFallback {
+		var tcpDialer *net.Dialer
+		if opt.LocalAddr != nil {
+			tcpDialer = &net.Dialer{LocalAddr: &net.TCPAddr{IP: opt.LocalAddr}}
+		}
+		if opt.BootstrapAddr == "" {
+			tcpDialer = bootstrapDialer(tcpDialer)
+		}
+		tcpClient := &dns.Client{
+			Net:       "tcp",
+			Dialer:    tcpDialer,
+			TLSConfig: &tls.Config{},
+		}
+		d.tcp = NewPipeline(id, endpoint, tcpClient, 0)
+	}
+	return d, nil
 }
 
 // Resolve a DNS query.
@@ -74,11 +166,105 @@ func (d *DNSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		"protocol": d.net,
 	}).Debug("querying upstream resolver")
 
-	q = setUDPSize(q, d.opt.UDPSize)
+	switch {
+	case d.opt.UDPSize > 0:
+		q = setUDPSize(q, d.opt.UDPSize)
+	case d.net == "udp":
+		q = updateUDPSize(q, defaultUDPSize)
+	}
 
 	// Remove padding before sending over the wire in plain
-	stripPadding(q)
-	return d.pipeline.Resolve(q, d.opt.Timeout)
+	q = withoutPadding(q)
+	var hasEDNS0, hasNSID bool
+	if d.opt.RequestNSID {
+		q, hasEDNS0, hasNSID = addNSID(q)
+	}
+	original := q
+	if d.opt.EnableCase0x20 && len(q.Question) > 0 {
+		q = randomizeCase(q)
+	}
+	var (
+		a   *dns.Msg
+		err error
+	)
+	if d.cookies != nil {
+		a, err = d.resolveWithCookies(q, ci)
+	} else {
+		a, err = d.resolve(q, ci)
+	}
+	if err == nil && a != nil && q != original {
+		if err = verifyCase(q, a); err != nil {
+			logger(d.id, q, ci).WithField("resolver", d.endpoint).Warn("response with different case of name, spoofed or the server doesn't support 0x20 encoding")
+			return nil, classifyError(err)
+		}
+		restoreCase(a, q.Question[0].Name, original.Question[0].Name)
+	}
+	if err == nil && a != nil && d.opt.RequestNSID {
+		var nsid string
+		if hasNSID {
+			nsid = responseNSID(a)
+		} else {
+			nsid = removeNSID(a)
+			// Don't return an OPT record that only exists because of the NSID option
+			if !hasEDNS0 && a.Rcode <= 0xF {
+				stripEDNS0(a)
+			}
+		}
+		if nsid != "" {
+			logger(d.id, q, ci).WithFields(logrus.Fields{
+				"resolver": d.endpoint,
+				"nsid":     nsid,
+			}).Debug("received nsid from upstream resolver")
+		}
+	}
+	return a, classifyError(err)
+}
+
+// Sends a query with a cookie and verifies the cookie in the response. If the
+// server responds with BADCOOKIE, the query is retried once with the new server
+// cookie.
+func (d *DNSClient) resolveWithCookies(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	hasEDNS0 := q.IsEdns0() != nil
+	q = q.Copy()
+	for i := 0; ; i++ {
+		d.cookies.set(q, d.endpoint)
+		a, err := d.resolve(q, ci)
+		if err != nil || a == nil {
+			return a, err
+		}
+		if err := d.cookies.update(d.endpoint, a); err != nil {
+			return nil, err
+		}
+		if a.Rcode == dns.RcodeBadCookie && i == 0 {
+			logger(d.id, q, ci).WithField("resolver", d.endpoint).Debug("bad cookie, retrying with server cookie")
+			continue
+		}
+		// Don't return an OPT record that only exists because of the cookie
+		if !hasEDNS0 && a.Rcode <= 0xF {
+			stripEDNS0(a)
+		}
+		return a, nil
+	}
+}
+
+func (d *DNSClient) resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	a, err := d.pipeline.Resolve(ci.Context(), q, d.opt.Timeout)
+	if err != nil || a == nil || !a.Truncated || d.tcp == nil {
+		return a, err
+	}
+
+	// The response was truncated, retry over TCP
+	logger(d.id, q, ci).WithField("resolver", d.endpoint).Debug("response truncated, retrying over tcp")
+	return d.tcp.Resolve(ci.Context(), q, d.opt.Timeout)
+}
+
+// Drain stops accepting new queries and closes the connections once the
+// outstanding queries are completed or ctx is done.
+func (d *DNSClient) Drain(ctx context.Context) error {
+	if d.tcp == nil {
+		return d.pipeline.Drain(ctx)
+	}
+	return drainPipelines(ctx, d.pipeline, d.tcp)
 }
 
 func (d *DNSClient) String() string {
@@ -1,7 +1,15 @@
 package rdns
 
 import (
+	"context"
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -24,3 +32,481 @@ func TestDNSClientSimpleUDP(t *testing.T) {
 	require.NoError(t, err)
 	require.NotEmpty(t, r.Answer)
 }
+
+func TestDNSClientTCPFallback(t *testing.T) {
+	// Upstream with a large response that doesn't fit into a UDP packet
+	var records int32 // Number of records in the response, read by the listener goroutines
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			for i := 0; i < int(atomic.LoadInt32(&records)); i++ {
+				a.Answer = append(a.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   q.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    3600,
+					},
+					A: net.IPv4(10, 0, byte(i/256), byte(i%256)),
+				})
+			}
+			return a, nil
+		},
+	}
+
+	// UDP and TCP listeners on the same port
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	udp := NewDNSListener("test-ln", addr, "udp", ListenOptions{}, upstream)
+	tcp := NewDNSListener("test-ln", addr, "tcp", ListenOptions{}, upstream)
+	go func() { _ = udp.Start() }()
+	go func() { _ = tcp.Start() }()
+	defer udp.Shutdown()
+	defer tcp.Shutdown()
+	time.Sleep(time.Second)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Small responses are answered over UDP
+	atomic.StoreInt32(&records, 1)
+	c, err := NewDNSClient("test-dns", addr, "udp", DNSClientOptions{TCPFallback: true})
+	require.NoError(t, err)
+	a, err := c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.False(t, a.Truncated)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Truncated responses are retried over TCP
+	atomic.StoreInt32(&records, 100)
+	a, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.False(t, a.Truncated)
+	require.Len(t, a.Answer, 100)
+	require.Equal(t, 3, upstream.HitCount())
+
+	// Without fallback, the truncated response is returned
+	c, err = NewDNSClient("test-dns", addr, "udp", DNSClientOptions{})
+	require.NoError(t, err)
+	a, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.True(t, a.Truncated)
+	require.Equal(t, 4, upstream.HitCount())
+}
+
+func TestDNSClientCancel(t *testing.T) {
+	// Upstream that never responds
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	c, err := NewDNSClient("test-dns-cancel", pc.LocalAddr().String(), "udp", DNSClientOptions{Timeout: 5 * time.Second})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	_, err = c.Resolve(q, ClientInfo{}.WithContext(ctx))
+	require.ErrorIs(t, err, context.Canceled)
+	require.WithinDuration(t, start.Add(100*time.Millisecond), time.Now(), 200*time.Millisecond)
+}
+
+func TestDNSCookiesPerServer(t *testing.T) {
+	c := newDNSCookies()
+	clientCookie := func(server string) string {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		c.set(q, server)
+		for _, opt := range q.IsEdns0().Option {
+			if cookie, ok := opt.(*dns.EDNS0_COOKIE); ok {
+				return cookie.Cookie[:16]
+			}
+		}
+		return ""
+	}
+
+	// Every server gets its own client cookie, which doesn't change
+	a := clientCookie("192.0.2.1:53")
+	b := clientCookie("192.0.2.2:53")
+	require.Len(t, a, 16)
+	require.NotEqual(t, a, b)
+	require.Equal(t, a, clientCookie("192.0.2.1:53"))
+
+	// Responses with the client cookie of another server are rejected
+	resp := new(dns.Msg)
+	resp.SetEdns0(dns.MinMsgSize, false)
+	resp.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: b + "0102030405060708"}}
+	require.ErrorIs(t, c.update("192.0.2.1:53", resp), ErrCookieMismatch)
+}
+
+func TestDNSClientCookies(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		sent        []string // cookies received by the server
+		serverValue = "0102030405060708"
+		rotate      bool // respond with BADCOOKIE and a new server cookie once
+		spoof       bool // respond with a different client cookie
+	)
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			var cookie string
+			for _, opt := range q.IsEdns0().Option {
+				if c, ok := opt.(*dns.EDNS0_COOKIE); ok {
+					cookie = c.Cookie
+				}
+			}
+			sent = append(sent, cookie)
+			client := cookie[:16]
+			if spoof {
+				client = "ffffffffffffffff"
+			}
+			a := new(dns.Msg)
+			a.SetReply(q)
+			if rotate {
+				rotate = false
+				serverValue = "1112131415161718"
+				a.Rcode = dns.RcodeBadCookie
+			}
+			a.SetEdns0(1232, false)
+			a.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: client + serverValue}}
+			return a, nil
+		},
+	}
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListener("test-ln", addr, "udp", ListenOptions{}, upstream)
+	go func() { _ = s.Start() }()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	received := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, sent...)
+	}
+
+	c, err := NewDNSClient("test-dns", addr, "udp", DNSClientOptions{Cookies: true})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The first query only has a client cookie, the cookie and OPT added for it
+	// are removed from the response
+	a, err := c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Nil(t, a.IsEdns0())
+	require.Nil(t, q.IsEdns0())
+	require.Len(t, received(), 1)
+	clientCookie := received()[0]
+	require.Len(t, clientCookie, 16)
+
+	// The server cookie is sent with the next query
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, []string{clientCookie, clientCookie + "0102030405060708"}, received())
+
+	// BADCOOKIE is retried with the new server cookie
+	mu.Lock()
+	rotate = true
+	mu.Unlock()
+	a, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, []string{clientCookie + "0102030405060708", clientCookie + "1112131415161718"}, received()[2:])
+
+	// Responses with the wrong client cookie are rejected
+	mu.Lock()
+	spoof = true
+	mu.Unlock()
+	_, err = c.Resolve(q, ClientInfo{})
+	require.ErrorIs(t, err, ErrCookieMismatch)
+}
+
+func TestDNSClientUDPSize(t *testing.T) {
+	// Upstream that reports the advertised UDP size of every query, 0 without EDNS0
+	sizes := make(chan uint16, 1)
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	s := &dns.Server{
+		Addr: addr,
+		Net:  "udp",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+			var size uint16
+			if edns0 := q.IsEdns0(); edns0 != nil {
+				size = edns0.UDPSize()
+			}
+			sizes <- size
+			a := new(dns.Msg)
+			a.SetReply(q)
+			_ = w.WriteMsg(a)
+		}),
+	}
+	go s.ListenAndServe()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	tests := []struct {
+		name     string
+		udpSize  uint16
+		edns0    uint16 // UDP size in the query, no EDNS0 if 0
+		expected uint16
+	}{
+		{"default", 0, 4096, 1232},
+		{"default without edns0", 0, 0, 0},
+		{"configured", 1400, 4096, 1400},
+		{"configured without edns0", 1400, 0, 1400},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := NewDNSClient("test-dns", addr, "udp", DNSClientOptions{UDPSize: test.udpSize})
+			require.NoError(t, err)
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			if test.edns0 > 0 {
+				q.SetEdns0(test.edns0, false)
+			}
+			_, err = d.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+			require.Equal(t, test.expected, <-sizes)
+
+			// The original query isn't modified
+			if test.edns0 > 0 {
+				require.Equal(t, test.edns0, q.IsEdns0().UDPSize())
+			} else {
+				require.Nil(t, q.IsEdns0())
+			}
+		})
+	}
+}
+
+func TestDNSClientCase0x20(t *testing.T) {
+	// Upstream that records the name of every query and answers with an A
+	// record, swapping the case of the name in the response when asked to.
+	var (
+		mu       sync.Mutex
+		names    []string
+		swapCase bool
+	)
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	s := &dns.Server{
+		Addr: addr,
+		Net:  "udp",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+			mu.Lock()
+			names = append(names, q.Question[0].Name)
+			swap := swapCase
+			mu.Unlock()
+			a := new(dns.Msg)
+			a.SetReply(q)
+			if swap {
+				name := []byte(a.Question[0].Name)
+				for i, c := range name {
+					if isLetter(c) {
+						name[i] = c ^ 0x20
+					}
+				}
+				a.Question[0].Name = string(name)
+			}
+			a.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: a.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IP{127, 0, 0, 1},
+			}}
+			_ = w.WriteMsg(a)
+		}),
+	}
+	go s.ListenAndServe()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	c, err := NewDNSClient("test-dns", addr, "udp", DNSClientOptions{EnableCase0x20: true})
+	require.NoError(t, err)
+
+	// The case of the name is randomized upstream, the response has the original
+	for i := 0; i < 10; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("www.example.com.", dns.TypeA)
+		a, err := c.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Equal(t, "www.example.com.", a.Question[0].Name)
+		require.Equal(t, "www.example.com.", a.Answer[0].Header().Name)
+		require.Equal(t, "www.example.com.", q.Question[0].Name)
+	}
+	mu.Lock()
+	distinct := make(map[string]struct{})
+	for _, name := range names {
+		require.True(t, strings.EqualFold("www.example.com.", name))
+		distinct[name] = struct{}{}
+	}
+	swapCase = true
+	mu.Unlock()
+	require.Greater(t, len(distinct), 1)
+
+	// A response with a different case is rejected
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.ErrorIs(t, err, ErrCaseMismatch)
+}
+
+func TestDNSClientUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	s := &dns.Server{
+		Listener: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IP{127, 0, 0, 1},
+			}}
+			_ = w.WriteMsg(a)
+		}),
+	}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+
+	d, err := NewDNSClient("test-dns", "unix://"+path, "tcp", DNSClientOptions{})
+	require.NoError(t, err)
+
+	// Send multiple queries over the same connection
+	for i := 0; i < 3; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		a, err := d.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(a.Answer))
+	}
+
+	// Only stream sockets are supported
+	_, err = NewDNSClient("test-dns", "unix://"+path, "udp", DNSClientOptions{})
+	require.Error(t, err)
+}
+
+func TestDNSClientEDNS0Options(t *testing.T) {
+	// Upstream that reports the option codes in queries and responds with
+	// EXPIRE and an unknown option.
+	codes := make(chan []uint16, 1)
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	s := &dns.Server{
+		Addr: addr,
+		Net:  "udp",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+			var c []uint16
+			for _, opt := range q.IsEdns0().Option {
+				c = append(c, opt.Option())
+			}
+			codes <- c
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.SetEdns0(1232, false)
+			a.IsEdns0().Option = []dns.EDNS0{
+				&dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Expire: 3600},
+				&dns.EDNS0_LOCAL{Code: 65002, Data: []byte{4, 5}},
+			}
+			_ = w.WriteMsg(a)
+		}),
+	}
+	go s.ListenAndServe()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	d, err := NewDNSClient("test-dns", addr, "udp", DNSClientOptions{})
+	require.NoError(t, err)
+
+	// Padded query, as received over DoT for example
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	q.IsEdns0().Option = []dns.EDNS0{
+		&dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Empty: true},
+		&dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1, 2, 3}},
+		&dns.EDNS0_PADDING{Padding: make([]byte, 16)},
+	}
+	a, err := d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+
+	// Only the padding is removed before sending upstream, without changing the query
+	require.Equal(t, []uint16{dns.EDNS0EXPIRE, 65001}, <-codes)
+	require.Len(t, q.IsEdns0().Option, 3)
+
+	// All options in the response are returned
+	options := a.IsEdns0().Option
+	require.Len(t, options, 2)
+	require.Equal(t, uint32(3600), options[0].(*dns.EDNS0_EXPIRE).Expire)
+	require.Equal(t, &dns.EDNS0_LOCAL{Code: 65002, Data: []byte{4, 5}}, options[1])
+}
+
+func TestDNSClientRequestNSID(t *testing.T) {
+	// Upstream that records whether queries have an NSID option and returns
+	// its identifier if they do.
+	var (
+		mu        sync.Mutex
+		requested []bool
+	)
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	s := &dns.Server{
+		Addr: addr,
+		Net:  "udp",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+			var nsid *dns.EDNS0_NSID
+			if edns0 := q.IsEdns0(); edns0 != nil {
+				for _, opt := range edns0.Option {
+					if o, ok := opt.(*dns.EDNS0_NSID); ok {
+						nsid = o
+					}
+				}
+			}
+			mu.Lock()
+			requested = append(requested, nsid != nil && nsid.Nsid == "")
+			mu.Unlock()
+			a := new(dns.Msg)
+			a.SetReply(q)
+			if nsid != nil {
+				a.SetEdns0(dns.MinMsgSize, false)
+				a.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte("anycast-1"))}}
+			}
+			_ = w.WriteMsg(a)
+		}),
+	}
+	go s.ListenAndServe()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	c, err := NewDNSClient("test-dns", addr, "udp", DNSClientOptions{RequestNSID: true})
+	require.NoError(t, err)
+
+	// NSID is requested upstream, but not returned to a client that didn't ask for it
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Nil(t, a.IsEdns0())
+	require.Nil(t, q.IsEdns0())
+
+	// The client asked for it too, the identifier is passed on
+	q = new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	q.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID}}
+	a, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.NotNil(t, a.IsEdns0())
+	require.Equal(t, "anycast-1", responseNSID(a))
+
+	mu.Lock()
+	require.Equal(t, []bool{true, true}, requested)
+	mu.Unlock()
+}
@@ -0,0 +1,531 @@
+package rdns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/poly1305"
+)
+
+// DNSCrypt encryption systems
+const (
+	dnscryptXSalsa20Poly1305  uint16 = 0x0001
+	dnscryptXChacha20Poly1305 uint16 = 0x0002
+)
+
+const (
+	dnscryptCertMagic     = "DNSC"
+	dnscryptResolverMagic = "r6fnvWj8"
+
+	// Minimum length of padded queries sent over UDP
+	dnscryptMinQueryLen = 256
+)
+
+// DNSCryptClient is a DNSCrypt (version 2) resolver. It fetches the certificate
+// of the resolver with a TXT query for the provider name, verifies it with the
+// provider's public key, and sends encrypted queries over UDP or TCP. The
+// certificate is refreshed periodically to handle key rotation.
+type DNSCryptClient struct {
+	id           string
+	endpoint     string
+	providerName string
+	providerKey  ed25519.PublicKey
+	publicKey    [32]byte
+	secretKey    [32]byte
+	opt          DNSCryptClientOptions
+	metrics      *ListenerMetrics
+
+	mu          sync.Mutex
+	cert        *dnscryptCert
+	certFetched time.Time
+}
+
+var _ Resolver = &DNSCryptClient{}
+
+// DNSCryptClientOptions contains options used by the DNSCrypt resolver.
+type DNSCryptClientOptions struct {
+	// DNS stamp (sdns://) of the resolver. If set, the address, provider name and
+	// public key are taken from the stamp.
+	Stamp string
+
+	// Name of the DNSCrypt provider, for example "2.dnscrypt-cert.example.com".
+	ProviderName string
+
+	// Hex-encoded Ed25519 public key of the provider, used to verify the
+	// certificates of the resolver.
+	PublicKey string
+
+	// Bootstrap address - IP to use for the service instead of looking up
+	// the service's hostname with potentially plain DNS.
+	BootstrapAddr string
+
+	// Local IP to use for outbound connections. If nil, a local address is chosen.
+	LocalAddr net.IP
+
+	// Transport to use for queries, "udp" or "tcp". Default "udp". Truncated UDP
+	// responses are retried over TCP.
+	Transport string
+
+	// Query timeout, default 2 seconds.
+	Timeout time.Duration
+
+	// Interval after which the certificate is fetched again, default 1 hour.
+	CertRefresh time.Duration
+}
+
+// Certificate of a DNSCrypt resolver.
+type dnscryptCert struct {
+	esVersion   uint16
+	resolverPK  [32]byte
+	clientMagic [8]byte
+	serial      uint32
+	notBefore   time.Time
+	notAfter    time.Time
+	sharedKey   [32]byte
+}
+
+// NewDNSCryptClient instantiates a new DNSCrypt resolver. The endpoint can be
+// empty if a stamp is provided in the options.
+func NewDNSCryptClient(id, endpoint string, opt DNSCryptClientOptions) (*DNSCryptClient, error) {
+	var providerKey []byte
+	if opt.Stamp != "" {
+		p, err := ParseStamp(opt.Stamp)
+		if err != nil {
+			return nil, err
+		}
+		if p.Protocol != StampDNSCrypt {
+			return nil, errors.New("not a dnscrypt stamp")
+		}
+		if endpoint == "" {
+			endpoint, _ = p.endpoint(DNSCryptPort)
+		}
+		providerKey = p.PublicKey
+		opt.ProviderName = p.ProviderName
+	} else {
+		var err error
+		providerKey, err = hex.DecodeString(strings.ReplaceAll(opt.PublicKey, ":", ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid dnscrypt public key: %w", err)
+		}
+	}
+	if len(providerKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid dnscrypt public key length")
+	}
+	if opt.ProviderName == "" {
+		return nil, errors.New("no dnscrypt provider name")
+	}
+	if err := validEndpoint(endpoint); err != nil {
+		return nil, err
+	}
+	if opt.BootstrapAddr != "" {
+		_, port, _ := net.SplitHostPort(endpoint)
+		endpoint = net.JoinHostPort(opt.BootstrapAddr, port)
+	}
+	switch opt.Transport {
+	case "":
+		opt.Transport = "udp"
+	case "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported dnscrypt transport '%s'", opt.Transport)
+	}
+	if opt.Timeout == 0 {
+		opt.Timeout = 2 * time.Second
+	}
+	if opt.CertRefresh == 0 {
+		opt.CertRefresh = time.Hour
+	}
+
+	// Key pair of this client, used for all queries
+	var secretKey [32]byte
+	if _, err := rand.Read(secretKey[:]); err != nil {
+		return nil, err
+	}
+	publicKey, err := curve25519.X25519(secretKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &DNSCryptClient{
+		id:           id,
+		endpoint:     endpoint,
+		providerName: dns.Fqdn(opt.ProviderName),
+		providerKey:  providerKey,
+		secretKey:    secretKey,
+		opt:          opt,
+		metrics:      NewListenerMetrics("client", id),
+	}
+	copy(c.publicKey[:], publicKey)
+	return c, nil
+}
+
+// Resolve a DNS query.
+func (d *DNSCryptClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	logger(d.id, q, ci).WithFields(logrus.Fields{
+		"resolver": d.endpoint,
+		"protocol": "dnscrypt",
+	}).Debug("querying upstream resolver")
+
+	d.metrics.query.Add(1)
+
+	cert, err := d.certificate()
+	if err != nil {
+		d.metrics.err.Add("cert", 1)
+		return nil, err
+	}
+	b, err := q.Pack()
+	if err != nil {
+		d.metrics.err.Add("pack", 1)
+		return nil, err
+	}
+	a, err := d.exchange(ci.Context(), d.opt.Transport, cert, b)
+	if err == nil && a.Truncated && d.opt.Transport == "udp" {
+		Log.WithField("resolver", d.endpoint).Debug("received truncated response, retrying over tcp")
+		a, err = d.exchange(ci.Context(), "tcp", cert, b)
+	}
+	if err != nil {
+		d.metrics.err.Add("exchange", 1)
+		return nil, err
+	}
+	d.metrics.response.Add(rCode(a), 1)
+	return a, nil
+}
+
+func (d *DNSCryptClient) String() string {
+	return d.id
+}
+
+// Send an encrypted query and decrypt the response.
+func (d *DNSCryptClient) exchange(ctx context.Context, network string, cert *dnscryptCert, query []byte) (*dns.Msg, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:12]); err != nil {
+		return nil, err
+	}
+	minLen := dnscryptMinQueryLen
+	if network == "tcp" {
+		minLen = 0
+	}
+	packet := make([]byte, 0, 8+32+12+len(query)+128)
+	packet = append(packet, cert.clientMagic[:]...)
+	packet = append(packet, d.publicKey[:]...)
+	packet = append(packet, nonce[:12]...)
+	packet = append(packet, dnscryptSeal(cert, &nonce, dnscryptPad(query, minLen))...)
+
+	var lAddr net.Addr
+	if d.opt.LocalAddr != nil {
+		if network == "tcp" {
+			lAddr = &net.TCPAddr{IP: d.opt.LocalAddr}
+		} else {
+			lAddr = &net.UDPAddr{IP: d.opt.LocalAddr}
+		}
+	}
+	dialer := net.Dialer{LocalAddr: lAddr, Timeout: d.opt.Timeout, Resolver: getBootstrapResolver()}
+	conn, err := dialer.DialContext(ctx, network, d.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(d.opt.Timeout))
+
+	// Unblock reads and writes if the query is canceled
+	defer onCancel(ctx, func() { _ = conn.SetDeadline(time.Now()) })()
+
+	var resp []byte
+	if network == "tcp" {
+		// Messages over TCP are prefixed with their length
+		packet = append(make([]byte, 2, 2+len(packet)), packet...)
+		binary.BigEndian.PutUint16(packet, uint16(len(packet)-2))
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		resp = resp[:n]
+	}
+
+	// The response starts with the resolver magic and the nonce, of which the
+	// first half has to match the nonce of the query
+	if len(resp) < 8+24+poly1305.TagSize || string(resp[:8]) != dnscryptResolverMagic {
+		return nil, errors.New("invalid dnscrypt response")
+	}
+	if !bytes.Equal(resp[8:20], nonce[:12]) {
+		return nil, errors.New("unexpected nonce in dnscrypt response")
+	}
+	copy(nonce[:], resp[8:32])
+	plain, err := dnscryptOpen(cert, &nonce, resp[32:])
+	if err != nil {
+		return nil, err
+	}
+	plain, err = dnscryptUnpad(plain)
+	if err != nil {
+		return nil, err
+	}
+	a := new(dns.Msg)
+	err = a.Unpack(plain)
+	return a, err
+}
+
+// Returns the current certificate of the resolver, fetching it if it's
+// expired or due to be refreshed.
+func (d *DNSCryptClient) certificate() (*dnscryptCert, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if d.cert != nil && now.Sub(d.certFetched) < d.opt.CertRefresh && now.Before(d.cert.notAfter) {
+		return d.cert, nil
+	}
+	cert, err := d.fetchCert(now)
+	if err != nil {
+		// Keep using the old certificate while it's still valid
+		if d.cert != nil && now.Before(d.cert.notAfter) {
+			Log.WithFields(logrus.Fields{"id": d.id, "resolver": d.endpoint}).WithError(err).Warn("failed to refresh dnscrypt certificate")
+			return d.cert, nil
+		}
+		return nil, err
+	}
+	d.cert, d.certFetched = cert, now
+	return cert, nil
+}
+
+// Query the certificates of the resolver and return the valid one with the
+// highest serial.
+func (d *DNSCryptClient) fetchCert(now time.Time) (*dnscryptCert, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(d.providerName, dns.TypeTXT)
+	var lAddr net.Addr
+	if d.opt.LocalAddr != nil {
+		lAddr = &net.UDPAddr{IP: d.opt.LocalAddr}
+	}
+	client := &dns.Client{
+		Net:     "udp",
+		Timeout: d.opt.Timeout,
+		Dialer:  &net.Dialer{LocalAddr: lAddr, Timeout: d.opt.Timeout, Resolver: getBootstrapResolver()},
+	}
+	a, _, err := client.Exchange(q, d.endpoint)
+	if err == nil && a.Truncated {
+		client.Net = "tcp"
+		if d.opt.LocalAddr != nil {
+			client.Dialer.LocalAddr = &net.TCPAddr{IP: d.opt.LocalAddr}
+		}
+		a, _, err = client.Exchange(q, d.endpoint)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dnscrypt certificate: %w", err)
+	}
+
+	var cert *dnscryptCert
+	for _, rr := range a.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		var b []byte
+		for _, s := range txt.Txt {
+			b = append(b, unescapeTXT(s)...)
+		}
+		c, err := parseDNSCryptCert(b, d.providerKey)
+		if err != nil {
+			Log.WithFields(logrus.Fields{"id": d.id, "resolver": d.endpoint}).WithError(err).Debug("skipping dnscrypt certificate")
+			continue
+		}
+		if now.Before(c.notBefore) || now.After(c.notAfter) {
+			continue
+		}
+		if cert == nil || c.serial > cert.serial {
+			cert = c
+		}
+	}
+	if cert == nil {
+		return nil, fmt.Errorf("no valid dnscrypt certificate for %s", d.providerName)
+	}
+
+	// Derive the key shared with the resolver
+	switch cert.esVersion {
+	case dnscryptXSalsa20Poly1305:
+		box.Precompute(&cert.sharedKey, &cert.resolverPK, &d.secretKey)
+	case dnscryptXChacha20Poly1305:
+		dh, err := curve25519.X25519(d.secretKey[:], cert.resolverPK[:])
+		if err != nil {
+			return nil, err
+		}
+		key, err := chacha20.HChaCha20(dh, make([]byte, 16))
+		if err != nil {
+			return nil, err
+		}
+		copy(cert.sharedKey[:], key)
+	}
+	return cert, nil
+}
+
+// Decode and verify a DNSCrypt certificate.
+func parseDNSCryptCert(b []byte, providerKey ed25519.PublicKey) (*dnscryptCert, error) {
+	if len(b) < 124 {
+		return nil, errors.New("dnscrypt certificate too short")
+	}
+	if string(b[:4]) != dnscryptCertMagic {
+		return nil, errors.New("invalid dnscrypt certificate magic")
+	}
+	c := &dnscryptCert{esVersion: binary.BigEndian.Uint16(b[4:6])}
+	if c.esVersion != dnscryptXSalsa20Poly1305 && c.esVersion != dnscryptXChacha20Poly1305 {
+		return nil, fmt.Errorf("unsupported dnscrypt encryption system %d", c.esVersion)
+	}
+	if !ed25519.Verify(providerKey, b[72:], b[8:72]) {
+		return nil, errors.New("invalid dnscrypt certificate signature")
+	}
+	copy(c.resolverPK[:], b[72:104])
+	copy(c.clientMagic[:], b[104:112])
+	c.serial = binary.BigEndian.Uint32(b[112:116])
+	c.notBefore = time.Unix(int64(binary.BigEndian.Uint32(b[116:120])), 0)
+	c.notAfter = time.Unix(int64(binary.BigEndian.Uint32(b[120:124])), 0)
+	return c, nil
+}
+
+// Pads a message as per ISO/IEC 7816-4, to a multiple of 64 bytes and at least
+// minLen bytes.
+func dnscryptPad(msg []byte, minLen int) []byte {
+	l := len(msg) + 1
+	if l < minLen {
+		l = minLen
+	}
+	l = (l + 63) / 64 * 64
+	out := make([]byte, l)
+	copy(out, msg)
+	out[len(msg)] = 0x80
+	return out
+}
+
+// Removes the padding of a message.
+func dnscryptUnpad(msg []byte) ([]byte, error) {
+	// Scan bytes rather than runes, the message isn't UTF-8
+	i := len(msg) - 1
+	for i >= 0 && msg[i] == 0 {
+		i--
+	}
+	if i < 0 || msg[i] != 0x80 {
+		return nil, errors.New("invalid dnscrypt padding")
+	}
+	return msg[:i], nil
+}
+
+// Encrypt a message with the shared key.
+func dnscryptSeal(cert *dnscryptCert, nonce *[24]byte, msg []byte) []byte {
+	if cert.esVersion == dnscryptXSalsa20Poly1305 {
+		return box.SealAfterPrecomputation(nil, msg, nonce, &cert.sharedKey)
+	}
+	return xsecretboxSeal(&cert.sharedKey, nonce, msg)
+}
+
+// Decrypt a message with the shared key.
+func dnscryptOpen(cert *dnscryptCert, nonce *[24]byte, msg []byte) ([]byte, error) {
+	if cert.esVersion == dnscryptXSalsa20Poly1305 {
+		out, ok := box.OpenAfterPrecomputation(nil, msg, nonce, &cert.sharedKey)
+		if !ok {
+			return nil, errors.New("failed to decrypt dnscrypt response")
+		}
+		return out, nil
+	}
+	return xsecretboxOpen(&cert.sharedKey, nonce, msg)
+}
+
+// Keystream of XChaCha20 for the nonce, with the first 32 bytes used as
+// Poly1305 key and the remainder to encrypt the message, like secretbox does
+// with XSalsa20.
+func xchachaKeystream(key *[32]byte, nonce *[24]byte, l int) []byte {
+	c, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	stream := make([]byte, 32+l)
+	c.XORKeyStream(stream, stream)
+	return stream
+}
+
+// Encrypt a message with XChaCha20-Poly1305 in the secretbox construction
+// used by DNSCrypt. The output is the tag followed by the ciphertext.
+func xsecretboxSeal(key *[32]byte, nonce *[24]byte, msg []byte) []byte {
+	stream := xchachaKeystream(key, nonce, len(msg))
+	out := make([]byte, poly1305.TagSize+len(msg))
+	ct := out[poly1305.TagSize:]
+	for i := range msg {
+		ct[i] = msg[i] ^ stream[32+i]
+	}
+	var polyKey [32]byte
+	var tag [poly1305.TagSize]byte
+	copy(polyKey[:], stream[:32])
+	poly1305.Sum(&tag, ct, &polyKey)
+	copy(out, tag[:])
+	return out
+}
+
+// Verify and decrypt a message encrypted with xsecretboxSeal.
+func xsecretboxOpen(key *[32]byte, nonce *[24]byte, box []byte) ([]byte, error) {
+	if len(box) < poly1305.TagSize {
+		return nil, errors.New("dnscrypt message too short")
+	}
+	ct := box[poly1305.TagSize:]
+	stream := xchachaKeystream(key, nonce, len(ct))
+	var polyKey [32]byte
+	var tag [poly1305.TagSize]byte
+	copy(polyKey[:], stream[:32])
+	copy(tag[:], box)
+	if !poly1305.Verify(&tag, ct, &polyKey) {
+		return nil, errors.New("failed to decrypt dnscrypt message")
+	}
+	out := make([]byte, len(ct))
+	for i := range ct {
+		out[i] = ct[i] ^ stream[32+i]
+	}
+	return out, nil
+}
+
+// Decode the escape sequences in a TXT string as returned by the dns library.
+func unescapeTXT(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			out = append(out, s[i])
+			continue
+		}
+		i++
+		if i+2 < len(s) && isDigit(s[i]) && isDigit(s[i+1]) && isDigit(s[i+2]) {
+			n, _ := strconv.Atoi(s[i : i+3])
+			out = append(out, byte(n))
+			i += 2
+			continue
+		}
+		out = append(out, s[i])
+	}
+	return out
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
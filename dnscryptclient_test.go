@@ -0,0 +1,223 @@
+package rdns
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Minimal DNSCrypt server for testing, answering TXT queries for the
+// certificates in plain DNS and A queries over DNSCrypt.
+type testDNSCryptServer struct {
+	conn         net.PacketConn
+	providerName string
+	providerKey  ed25519.PrivateKey
+
+	mu        sync.Mutex
+	certs     [][]byte
+	certMagic [8]byte
+	esVersion uint16
+	secretKey [32]byte
+}
+
+func newTestDNSCryptServer(t *testing.T) *testDNSCryptServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	s := &testDNSCryptServer{
+		conn:         conn,
+		providerName: "2.dnscrypt-cert.example.com.",
+		providerKey:  priv,
+	}
+	go s.serve()
+	return s
+}
+
+// Replaces the certificates with a new one using a fresh key.
+func (s *testDNSCryptServer) rotate(t *testing.T, esVersion uint16, serial uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := rand.Read(s.secretKey[:])
+	require.NoError(t, err)
+	pk, err := curve25519.X25519(s.secretKey[:], curve25519.Basepoint)
+	require.NoError(t, err)
+	_, err = rand.Read(s.certMagic[:])
+	require.NoError(t, err)
+	s.esVersion = esVersion
+
+	signed := make([]byte, 52)
+	copy(signed, pk)
+	copy(signed[32:], s.certMagic[:])
+	binary.BigEndian.PutUint32(signed[40:], serial)
+	binary.BigEndian.PutUint32(signed[44:], uint32(time.Now().Add(-time.Hour).Unix()))
+	binary.BigEndian.PutUint32(signed[48:], uint32(time.Now().Add(time.Hour).Unix()))
+	cert := []byte(dnscryptCertMagic)
+	cert = append(cert, byte(esVersion>>8), byte(esVersion), 0, 0)
+	cert = append(cert, ed25519.Sign(s.providerKey, signed)...)
+	cert = append(cert, signed...)
+
+	// Add a certificate with a higher serial and a bad signature that should be ignored
+	bad := append([]byte{}, cert...)
+	binary.BigEndian.PutUint32(bad[112:], serial+100)
+	s.certs = [][]byte{cert, bad}
+}
+
+func (s *testDNSCryptServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *testDNSCryptServer) serve() {
+	b := make([]byte, 65535)
+	for {
+		n, addr, err := s.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if resp := s.handle(b[:n]); resp != nil {
+			_, _ = s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *testDNSCryptServer) handle(b []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Encrypted query
+	if len(b) > 52 && string(b[:8]) == string(s.certMagic[:]) {
+		cert := &dnscryptCert{esVersion: s.esVersion}
+		var clientPK [32]byte
+		copy(clientPK[:], b[8:40])
+		if s.esVersion == dnscryptXSalsa20Poly1305 {
+			box.Precompute(&cert.sharedKey, &clientPK, &s.secretKey)
+		} else {
+			dh, _ := curve25519.X25519(s.secretKey[:], clientPK[:])
+			key, _ := chacha20.HChaCha20(dh, make([]byte, 16))
+			copy(cert.sharedKey[:], key)
+		}
+		var nonce [24]byte
+		copy(nonce[:], b[40:52])
+		plain, err := dnscryptOpen(cert, &nonce, b[52:])
+		if err != nil {
+			return nil
+		}
+		if plain, err = dnscryptUnpad(plain); err != nil {
+			return nil
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(plain); err != nil {
+			return nil
+		}
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IP{192, 0, 2, 1},
+		}}
+		out, _ := a.Pack()
+		_, _ = rand.Read(nonce[12:])
+		resp := append([]byte(dnscryptResolverMagic), nonce[:]...)
+		return append(resp, dnscryptSeal(cert, &nonce, dnscryptPad(out, 0))...)
+	}
+
+	// Plain query for the certificates
+	q := new(dns.Msg)
+	if err := q.Unpack(b); err != nil {
+		return nil
+	}
+	a := new(dns.Msg)
+	a.SetReply(q)
+	if q.Question[0].Name == s.providerName && q.Question[0].Qtype == dns.TypeTXT {
+		for _, cert := range s.certs {
+			a.Answer = append(a.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: s.providerName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{escapeTXT(cert)},
+			})
+		}
+	}
+	out, _ := a.Pack()
+	return out
+}
+
+func escapeTXT(b []byte) string {
+	var s strings.Builder
+	for _, c := range b {
+		if c < ' ' || c > '~' || c == '"' || c == '\\' {
+			fmt.Fprintf(&s, "\\%03d", c)
+			continue
+		}
+		s.WriteByte(c)
+	}
+	return s.String()
+}
+
+func TestDNSCryptClient(t *testing.T) {
+	s := newTestDNSCryptServer(t)
+	defer s.conn.Close()
+	s.rotate(t, dnscryptXSalsa20Poly1305, 1)
+
+	c, err := NewDNSCryptClient("test-dnscrypt", s.addr(), DNSCryptClientOptions{
+		ProviderName: s.providerName,
+		PublicKey:    hex.EncodeToString(s.providerKey.Public().(ed25519.PublicKey)),
+		CertRefresh:  100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, q.Id, a.Id)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, uint32(1), c.cert.serial)
+
+	// Rotate the certificate, the client should pick up the new one after the
+	// refresh interval
+	s.rotate(t, dnscryptXChacha20Poly1305, 2)
+	time.Sleep(200 * time.Millisecond)
+	a, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, uint32(2), c.cert.serial)
+	require.Equal(t, dnscryptXChacha20Poly1305, c.cert.esVersion)
+
+	// A client with the wrong provider key doesn't accept any certificate
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	c, err = NewDNSCryptClient("test-dnscrypt", s.addr(), DNSCryptClientOptions{
+		ProviderName: s.providerName,
+		PublicKey:    hex.EncodeToString(otherKey.Public().(ed25519.PublicKey)),
+	})
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.Error(t, err)
+}
+
+func TestDNSCryptUnpad(t *testing.T) {
+	// A last data byte that starts a multi-byte UTF-8 sequence mustn't hide
+	// the padding marker.
+	for _, msg := range [][]byte{{1, 2, 3}, {1, 2, 0xc2}, {0xdf}, {0x80, 0}, {}} {
+		plain, err := dnscryptUnpad(dnscryptPad(msg, 0))
+		require.NoError(t, err)
+		require.Equal(t, msg, plain)
+	}
+
+	_, err := dnscryptUnpad([]byte{1, 2, 0, 0})
+	require.Error(t, err)
+	_, err = dnscryptUnpad([]byte{0, 0})
+	require.Error(t, err)
+}
@@ -1,7 +1,10 @@
 package rdns
 
 import (
+	"context"
 	"net"
+	"runtime"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -11,6 +14,9 @@ import (
 type DNSListener struct {
 	*dns.Server
 	id string
+
+	// Additional servers sharing the address with SO_REUSEPORT
+	reuse []*dns.Server
 }
 
 var _ Listener = &DNSListener{}
@@ -18,18 +24,56 @@ var _ Listener = &DNSListener{}
 type ListenOptions struct {
 	// Network allowed to query this listener.
 	AllowedNet []*net.IPNet
+
+	// Time limits for reading a query and writing a response, and for TCP
+	// connections or QUIC sessions without queries. Only used by the UDP, TCP,
+	// DoT and DoQ listeners. Default 2s for read and write, 8s idle. Queries
+	// received by the UDP, TCP, DoT, DTLS and DoQ listeners that are still
+	// being resolved after the read and write timeouts combined are canceled.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// Max number of queries that are processed at the same time. Queries over
+	// the limit are refused. Only used by the UDP, TCP, DoT and DTLS listeners.
+	// No limit if 0.
+	MaxConcurrent int
+
+	// Open one UDP socket per CPU (GOMAXPROCS) with SO_REUSEPORT and read from all of them
+	// to spread the load across cores. Only used by the UDP listener and only
+	// supported on Linux, BSD and macOS, other platforms use a single socket.
+	ReusePort bool
 }
 
 // NewDNSListener returns an instance of either a UDP or TCP DNS listener.
 func NewDNSListener(id, addr, net string, opt ListenOptions, resolver Resolver) *DNSListener {
-	return &DNSListener{
-		id: id,
-		Server: &dns.Server{
-			Addr:    addr,
-			Net:     net,
-			Handler: listenHandler(id, net, addr, resolver, opt.AllowedNet),
-		},
+	handler := listenHandler(id, net, addr, resolver, opt)
+	newServer := func() *dns.Server {
+		return &dns.Server{
+			Addr:         addr,
+			Net:          net,
+			Handler:      handler,
+			ReadTimeout:  opt.ReadTimeout,
+			WriteTimeout: opt.WriteTimeout,
+			IdleTimeout:  opt.idleTimeout(),
+			ReusePort:    opt.ReusePort && net == "udp",
+		}
+	}
+	l := &DNSListener{
+		id:     id,
+		Server: newServer(),
 	}
+	if opt.ReusePort && net == "udp" {
+		if !reusePortSupported {
+			Log.WithFields(logrus.Fields{"id": id, "addr": addr}).Warn("SO_REUSEPORT not supported on this platform, using a single socket")
+			l.Server.ReusePort = false
+			return l
+		}
+		for i := 1; i < runtime.GOMAXPROCS(0); i++ {
+			l.reuse = append(l.reuse, newServer())
+		}
+	}
+	return l
 }
 
 // Start the DNS listener.
@@ -37,8 +81,29 @@ func (s DNSListener) Start() error {
 	Log.WithFields(logrus.Fields{
 		"id":       s.id,
 		"protocol": s.Net,
-		"addr":     s.Addr}).Info("starting listener")
-	return s.ListenAndServe()
+		"addr":     s.Addr,
+		"sockets":  len(s.reuse) + 1}).Info("starting listener")
+	if len(s.reuse) == 0 {
+		return s.ListenAndServe()
+	}
+	servers := append([]*dns.Server{s.Server}, s.reuse...)
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *dns.Server) { errs <- srv.ListenAndServe() }(srv)
+	}
+	return <-errs
+}
+
+// Shutdown stops the listener, including all sockets opened with
+// SO_REUSEPORT.
+func (s *DNSListener) Shutdown() error {
+	err := s.Server.Shutdown()
+	for _, srv := range s.reuse {
+		if rerr := srv.Shutdown(); err == nil {
+			err = rerr
+		}
+	}
+	return err
 }
 
 func (s DNSListener) String() string {
@@ -46,11 +111,15 @@ func (s DNSListener) String() string {
 }
 
 // DNS handler to forward all incoming requests to a given resolver.
-func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNet) dns.HandlerFunc {
+func listenHandler(id, protocol, addr string, r Resolver, opt ListenOptions) dns.HandlerFunc {
 	metrics := NewListenerMetrics("listener", id)
+	var slots chan struct{}
+	if opt.MaxConcurrent > 0 {
+		slots = make(chan struct{}, opt.MaxConcurrent)
+	}
 	return func(w dns.ResponseWriter, req *dns.Msg) {
 		var (
-			ci  ClientInfo
+			ci  = ClientInfo{Protocol: Protocol(protocol), RequestID: newRequestID()}
 			err error
 		)
 
@@ -61,12 +130,27 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 			ci.SourceIP = addr.IP
 		}
 
-		log := Log.WithFields(logrus.Fields{"id": id, "client": ci.SourceIP, "qname": qName(req), "protocol": protocol, "addr": addr})
+		// Abandon the query upstream once the client has likely given up on it
+		ctx, cancel := context.WithTimeout(context.Background(), opt.queryTimeout())
+		defer cancel()
+		ci = ci.WithContext(ctx)
+
+		log := Log.WithFields(logrus.Fields{"id": id, "client": ci.SourceIP, "qname": qName(req), "protocol": protocol, "addr": addr, "request": ci.RequestID})
 		log.Debug("received query")
 		metrics.query.Add(1)
 
 		a := new(dns.Msg)
-		if isAllowed(allowedNet, ci.SourceIP) {
+		switch {
+		case !isAllowed(opt.AllowedNet, ci.SourceIP):
+			metrics.err.Add("acl", 1)
+			log.Debug("refusing client ip")
+			a.SetRcode(req, dns.RcodeRefused)
+		case !acquireSlot(slots):
+			metrics.err.Add("limit", 1)
+			log.Debug("too many concurrent queries, refusing")
+			a.SetRcode(req, dns.RcodeRefused)
+		default:
+			defer releaseSlot(slots)
 			log.WithField("resolver", r.String()).Trace("forwarding query to resolver")
 			a, err = r.Resolve(req, ci)
 			if err != nil {
@@ -74,10 +158,6 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 				log.WithError(err).Error("failed to resolve")
 				a = servfail(req)
 			}
-		} else {
-			metrics.err.Add("acl", 1)
-			log.Debug("refusing client ip")
-			a.SetRcode(req, dns.RcodeRefused)
 		}
 
 		// A nil response from the resolvers means "drop", close the connection
@@ -87,6 +167,14 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 			return
 		}
 
+		// Tell clients on stream connections how long they can keep them open
+		// if they asked, see rfc7828
+		if protocol == "tcp" || protocol == "dot" {
+			setTCPKeepalive(req, a, opt.tcpIdleTimeout())
+		} else {
+			removeTCPKeepalive(a)
+		}
+
 		// If the client asked via DoT and EDNS0 is enabled, the response should be padded for extra security.
 		// See rfc7830 and rfc8467.
 		if protocol == "dot" || protocol == "dtls" {
@@ -109,6 +197,56 @@ func listenHandler(id, protocol, addr string, r Resolver, allowedNet []*net.IPNe
 	}
 }
 
+// Returns the idle timeout in the form used by the DNS library, nil for the
+// default.
+func (opt ListenOptions) idleTimeout() func() time.Duration {
+	if opt.IdleTimeout == 0 {
+		return nil
+	}
+	return func() time.Duration { return opt.IdleTimeout }
+}
+
+// Returns how long a query is resolved before it's canceled, the read and
+// write timeouts combined. Both default to 2s in the DNS library.
+func (opt ListenOptions) queryTimeout() time.Duration {
+	read, write := opt.ReadTimeout, opt.WriteTimeout
+	if read == 0 {
+		read = 2 * time.Second
+	}
+	if write == 0 {
+		write = 2 * time.Second
+	}
+	return read + write
+}
+
+// Returns the time TCP connections are kept open without queries.
+func (opt ListenOptions) tcpIdleTimeout() time.Duration {
+	if opt.IdleTimeout == 0 {
+		return defaultTCPIdleTimeout
+	}
+	return opt.IdleTimeout
+}
+
+// Takes one of the slots for concurrent queries. Returns false if there's none
+// left. Always succeeds if slots is nil, meaning there's no limit.
+func acquireSlot(slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
 func isAllowed(allowedNet []*net.IPNet, ip net.IP) bool {
 	if len(allowedNet) == 0 {
 		return true
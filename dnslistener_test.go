@@ -0,0 +1,250 @@
+package rdns
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSListenerSimple(t *testing.T) {
+	received := make(chan ClientInfo, 1)
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			received <- ci
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IP{192, 0, 2, 1},
+			}}
+			return a, nil
+		},
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		addr, err := getLnAddress()
+		if network == "udp" {
+			addr, err = getUDPLnAddress()
+		}
+		require.NoError(t, err)
+		s := NewDNSListener("test-ln", addr, network, ListenOptions{}, upstream)
+		go s.Start()
+		time.Sleep(time.Second)
+
+		c := &dns.Client{Net: network}
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		a, _, err := c.Exchange(q, addr)
+		require.NoError(t, err)
+		require.Equal(t, q.Id, a.Id)
+		require.Len(t, a.Answer, 1)
+
+		ci := <-received
+		require.Equal(t, Protocol(network), ci.Protocol)
+		require.True(t, ci.SourceIP.IsLoopback())
+		require.NoError(t, s.Shutdown())
+	}
+}
+
+func TestDNSListenerTCPReuse(t *testing.T) {
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListener("test-ln", addr, "tcp", ListenOptions{IdleTimeout: 500 * time.Millisecond}, upstream)
+	go s.Start()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	conn, err := dns.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Several queries over the same connection
+	for i := 0; i < 3; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		require.NoError(t, conn.WriteMsg(q))
+		a, err := conn.ReadMsg()
+		require.NoError(t, err)
+		require.Equal(t, q.Id, a.Id)
+	}
+	require.Equal(t, 3, upstream.HitCount())
+
+	// The connection is closed by the listener once it's idle
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.ReadMsg()
+	require.Error(t, err)
+	netErr, ok := err.(net.Error)
+	require.False(t, ok && netErr.Timeout(), "connection was not closed")
+}
+
+func TestDNSListenerMaxConcurrent(t *testing.T) {
+	release := make(chan struct{})
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			<-release
+			return q, nil
+		},
+	}
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListener("test-ln", addr, "udp", ListenOptions{MaxConcurrent: 1}, upstream)
+	go s.Start()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The first query occupies the only slot
+	done := make(chan error)
+	go func() {
+		_, _, err := new(dns.Client).Exchange(q, addr)
+		done <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// All further queries are refused while it's being processed
+	a, _, err := new(dns.Client).Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	close(release)
+	require.NoError(t, <-done)
+	_, _, err = new(dns.Client).Exchange(q, addr)
+	require.NoError(t, err)
+	require.Equal(t, 2, upstream.HitCount())
+}
+
+func TestDNSListenerQueryCanceled(t *testing.T) {
+	canceled := make(chan error, 1)
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			select {
+			case <-ci.Context().Done():
+				canceled <- ci.Context().Err()
+			case <-time.After(5 * time.Second):
+				canceled <- nil
+			}
+			return servfail(q), nil
+		},
+	}
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	opt := ListenOptions{ReadTimeout: 100 * time.Millisecond, WriteTimeout: 100 * time.Millisecond}
+	s := NewDNSListener("test-ln", addr, "udp", opt, upstream)
+	go s.Start()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	// The query is canceled upstream once the timeouts have passed
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, _, _ = (&dns.Client{Timeout: time.Second}).Exchange(q, addr)
+	require.Equal(t, context.DeadlineExceeded, <-canceled)
+}
+
+func TestDNSListenerReusePort(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("SO_REUSEPORT not supported")
+	}
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	upstream := new(TestResolver)
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListener("test-ln", addr, "udp", ListenOptions{ReusePort: true}, upstream)
+	require.Len(t, s.reuse, 3)
+
+	// All sockets bind to the same address
+	started := make(chan struct{}, len(s.reuse)+1)
+	for _, srv := range append([]*dns.Server{s.Server}, s.reuse...) {
+		srv.NotifyStartedFunc = func() { started <- struct{}{} }
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- s.Start() }()
+	for i := 0; i < len(s.reuse)+1; i++ {
+		select {
+		case <-started:
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("listener not started")
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		a, _, err := new(dns.Client).Exchange(q, addr)
+		require.NoError(t, err)
+		require.Equal(t, q.Id, a.Id)
+	}
+	require.Equal(t, 10, upstream.HitCount())
+	require.NoError(t, s.Shutdown())
+}
+
+func TestDNSListenerTCPKeepalive(t *testing.T) {
+	// Upstream that responds with a keepalive option of its own
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.SetEdns0(4096, false)
+			a.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: 1234}}
+			return a, nil
+		},
+	}
+
+	keepalive := func(a *dns.Msg) *dns.EDNS0_TCP_KEEPALIVE {
+		if a.IsEdns0() == nil {
+			return nil
+		}
+		for _, opt := range a.IsEdns0().Option {
+			if o, ok := opt.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+				return o
+			}
+		}
+		return nil
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		addr, err := getLnAddress()
+		if network == "udp" {
+			addr, err = getUDPLnAddress()
+		}
+		require.NoError(t, err)
+		s := NewDNSListener("test-ln", addr, network, ListenOptions{IdleTimeout: 5 * time.Second}, upstream)
+		go s.Start()
+		time.Sleep(time.Second)
+		c := &dns.Client{Net: network}
+
+		// Client asks for the idle timeout
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.SetEdns0(4096, false)
+		q.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE}}
+		a, _, err := c.Exchange(q, addr)
+		require.NoError(t, err)
+		if network == "tcp" {
+			require.NotNil(t, keepalive(a))
+			require.Equal(t, uint16(50), keepalive(a).Timeout)
+		} else {
+			require.Nil(t, keepalive(a))
+		}
+
+		// No keepalive option if the client didn't ask
+		q = new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.SetEdns0(4096, false)
+		a, _, err = c.Exchange(q, addr)
+		require.NoError(t, err)
+		require.Nil(t, keepalive(a))
+
+		require.NoError(t, s.Shutdown())
+	}
+}
@@ -0,0 +1,60 @@
+package rdns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// DNSSECStrip is a resolver that removes DNSSEC records from responses for
+// clients that didn't set the DO bit in their query, and clears the AD bit.
+// It shields clients that can't handle unexpected DNSSEC records while still
+// allowing validation upstream. Responses to queries for DNSSEC record types
+// are passed through unchanged.
+type DNSSECStrip struct {
+	id       string
+	resolver Resolver
+}
+
+var _ Resolver = &DNSSECStrip{}
+
+// Record types removed from responses.
+var dnssecStripTypes = map[uint16]bool{
+	dns.TypeRRSIG:  true,
+	dns.TypeNSEC:   true,
+	dns.TypeNSEC3:  true,
+	dns.TypeDNSKEY: true,
+	dns.TypeDS:     true,
+}
+
+// NewDNSSECStrip returns a new instance of a DNSSEC record stripper.
+func NewDNSSECStrip(id string, resolver Resolver) *DNSSECStrip {
+	return &DNSSECStrip{id: id, resolver: resolver}
+}
+
+// Resolve a DNS query with the upstream resolver and remove DNSSEC records from
+// the response unless the client asked for them.
+func (r *DNSSECStrip) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	answer, err := r.resolver.Resolve(q, ci)
+	if err != nil || answer == nil {
+		return answer, err
+	}
+	if edns0 := q.IsEdns0(); edns0 != nil && edns0.Do() {
+		return answer, nil
+	}
+	if len(q.Question) > 0 && dnssecStripTypes[q.Question[0].Qtype] {
+		return answer, nil
+	}
+	logger(r.id, q, ci).Debug("stripping dnssec records from response")
+
+	// Strip the records in a copy, the response could be shared with a cache
+	answer = answer.Copy()
+	answer.AuthenticatedData = false
+	stripDNSSEC(q.Question[0], answer, dnssecStripTypes)
+	if edns0 := answer.IsEdns0(); edns0 != nil {
+		edns0.SetDo(false)
+	}
+	return answer, nil
+}
+
+func (r *DNSSECStrip) String() string {
+	return r.id
+}
@@ -0,0 +1,92 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a signed response with DNSSEC records in all sections.
+func newSignedResponse(q *dns.Msg) *dns.Msg {
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.AuthenticatedData = true
+	name := q.Question[0].Name
+	a.Answer = []dns.RR{
+		&dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   net.IP{192, 0, 2, 1},
+		},
+		&dns.RRSIG{
+			Hdr:         dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+			TypeCovered: dns.TypeA,
+		},
+	}
+	a.Ns = []dns.RR{
+		&dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+			NextDomain: "z." + name,
+		},
+	}
+	a.Extra = []dns.RR{
+		&dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     257,
+			Protocol:  3,
+			Algorithm: dns.RSASHA256,
+		},
+	}
+	a.SetEdns0(4096, true)
+	return a
+}
+
+func TestDNSSECStrip(t *testing.T) {
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return newSignedResponse(q), nil
+		},
+	}
+	s := NewDNSSECStrip("test-dnssec-strip", r)
+
+	// Query without DO bit, DNSSEC records are removed
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	a, err := s.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.False(t, a.AuthenticatedData)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, dns.TypeA, a.Answer[0].Header().Rrtype)
+	require.Empty(t, a.Ns)
+	require.Len(t, a.Extra, 1)
+	require.False(t, a.IsEdns0().Do())
+
+	// Query without EDNS0 at all
+	q = new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err = s.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.False(t, a.AuthenticatedData)
+	require.Len(t, a.Answer, 1)
+
+	// Query with DO bit, the response is passed through
+	q = new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, true)
+	a, err = s.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.True(t, a.AuthenticatedData)
+	require.Len(t, a.Answer, 2)
+	require.Len(t, a.Ns, 1)
+	require.Len(t, a.Extra, 2)
+
+	// Explicit queries for DNSSEC records are passed through
+	q = new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeDNSKEY)
+	a, err = s.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.True(t, a.AuthenticatedData)
+	require.Len(t, a.Answer, 2)
+}
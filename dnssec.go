@@ -0,0 +1,672 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSECValidator is a resolver that validates responses from its upstream
+// resolver with DNSSEC rather than trusting the AD bit set upstream. The chain
+// of trust is built from the configured trust anchors down to the zone of the
+// response by querying DS and DNSKEY records with the upstream resolver.
+// Responses that fail validation are answered with SERVFAIL, validated ones
+// have the AD bit set.
+type DNSSECValidator struct {
+	id       string
+	resolver Resolver
+	anchors  map[string][]dns.RR
+	mu       sync.Mutex
+	zones    map[string]dnssecZone
+	metrics  *DNSSECMetrics
+}
+
+var _ Resolver = &DNSSECValidator{}
+
+type DNSSECValidatorOptions struct {
+	// DS or DNSKEY records in zone-file format that are trusted without
+	// validation. Defaults to the KSKs of the root zone.
+	TrustAnchors []string
+}
+
+type DNSSECMetrics struct {
+	// Validation results, secure, insecure or bogus.
+	result *expvar.Map
+}
+
+// Default trust anchors, the DS records of the root zone KSKs.
+var rootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// Time for which a zone without DNSSEC is remembered as insecure.
+const dnssecInsecureTTL = 5 * time.Minute
+
+// Validated keys of a zone. Keys are nil for zones that are provably insecure.
+type dnssecZone struct {
+	keys   []*dns.DNSKEY
+	expiry time.Time
+}
+
+// Set of records with the same name, type and class, together with their
+// signatures.
+type rrset struct {
+	name   string
+	rrtype uint16
+	rrs    []dns.RR
+	sigs   []*dns.RRSIG
+}
+
+// NewDNSSECValidator returns a new instance of a DNSSEC validating resolver.
+func NewDNSSECValidator(id string, resolver Resolver, opt DNSSECValidatorOptions) (*DNSSECValidator, error) {
+	if len(opt.TrustAnchors) == 0 {
+		opt.TrustAnchors = rootTrustAnchors
+	}
+	anchors := make(map[string][]dns.RR)
+	for _, s := range opt.TrustAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor '%s': %w", s, err)
+		}
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return nil, fmt.Errorf("trust anchor '%s' is not a DS or DNSKEY record", s)
+		}
+		zone := strings.ToLower(rr.Header().Name)
+		anchors[zone] = append(anchors[zone], rr)
+	}
+	return &DNSSECValidator{
+		id:       id,
+		resolver: resolver,
+		anchors:  anchors,
+		zones:    make(map[string]dnssecZone),
+		metrics: &DNSSECMetrics{
+			result: getVarMap("dnssec", id, "result"),
+		},
+	}, nil
+}
+
+// Resolve a DNS query and validate the response.
+func (r *DNSSECValidator) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	log := logger(r.id, q, ci)
+
+	// The client asked to not validate the response
+	if q.CheckingDisabled {
+		log.WithField("resolver", r.resolver.String()).Debug("checking disabled, forwarding query")
+		return r.resolver.Resolve(q, ci)
+	}
+
+	// Make sure the upstream resolver returns signatures, even for bogus data
+	clientDO := q.IsEdns0() != nil && q.IsEdns0().Do()
+	vq := q.Copy()
+	if edns0 := vq.IsEdns0(); edns0 != nil {
+		edns0.SetDo()
+	} else {
+		vq.SetEdns0(4096, true)
+	}
+	vq.CheckingDisabled = true
+
+	log.WithField("resolver", r.resolver.String()).Debug("forwarding query to resolver")
+	a, err := r.resolver.Resolve(vq, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	if a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError {
+		return a, nil
+	}
+
+	secure, err := r.validate(q.Question[0], a, ci)
+	if err != nil {
+		log.WithError(err).Warn("dnssec validation failed")
+		r.metrics.result.Add("bogus", 1)
+		return servfail(q), nil
+	}
+	if secure {
+		log.Debug("dnssec validation succeeded")
+		r.metrics.result.Add("secure", 1)
+	} else {
+		log.Debug("response is insecure")
+		r.metrics.result.Add("insecure", 1)
+	}
+	a.AuthenticatedData = secure
+	a.CheckingDisabled = false
+	if !clientDO {
+		stripDNSSEC(q.Question[0], a, dnssecValidatorStripTypes)
+	}
+	return a, nil
+}
+
+func (r *DNSSECValidator) String() string {
+	return r.id
+}
+
+// Validates a response. Returns true if the response is secure, false if it's
+// provably insecure, and an error if it's bogus.
+func (r *DNSSECValidator) validate(question dns.Question, a *dns.Msg, ci ClientInfo) (bool, error) {
+	answers := groupRRsets(a.Answer)
+	if a.Rcode == dns.RcodeSuccess && len(answers) > 0 {
+		secure := true
+		for _, set := range answers {
+			s, err := r.verifyRRset(set, ci)
+			if err != nil {
+				return false, err
+			}
+			secure = secure && s
+		}
+		return secure, nil
+	}
+	return r.validateDenial(question, a, ci)
+}
+
+// Validates NXDOMAIN and NODATA responses. The signatures of all records in
+// the authority section are verified, and NSEC or NSEC3 records need to prove
+// that the name or type doesn't exist. A signed SOA record alone is not a
+// proof since it could be replayed from any other negative response of the
+// zone.
+func (r *DNSSECValidator) validateDenial(question dns.Question, a *dns.Msg, ci ClientInfo) (bool, error) {
+	sets := groupRRsets(a.Ns)
+	if len(sets) == 0 {
+		insecure, err := r.provablyInsecure(question.Name, ci)
+		if err != nil {
+			return false, err
+		}
+		if !insecure {
+			return false, fmt.Errorf("missing denial of existence for %s", question.Name)
+		}
+		return false, nil
+	}
+	var (
+		nsecs  []*dns.NSEC
+		nsec3s []*dns.NSEC3
+	)
+	for _, set := range sets {
+		secure, err := r.verifyRRset(set, ci)
+		if err != nil {
+			return false, err
+		}
+		if !secure {
+			return false, nil
+		}
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+	switch {
+	case len(nsecs) > 0:
+		if nsecDenies(nsecs, question, a.Rcode) {
+			return true, nil
+		}
+		return false, fmt.Errorf("nsec records don't prove denial of existence for %s", question.Name)
+	case len(nsec3s) > 0:
+		return nsec3Denies(nsec3s, question, a.Rcode)
+	}
+	return false, fmt.Errorf("missing nsec or nsec3 records for denial of existence of %s", question.Name)
+}
+
+// Returns true if the NSEC records prove that the name, or the type for NODATA
+// responses, doesn't exist. For NXDOMAIN responses, they also need to prove
+// that there is no wildcard that could have matched the name.
+func nsecDenies(nsecs []*dns.NSEC, question dns.Question, rcode int) bool {
+	name := question.Name
+	if rcode == dns.RcodeNameError {
+		for _, nsec := range nsecs {
+			if !nsecCovers(nsec, name) {
+				continue
+			}
+			wildcard := wildcardName(nsecClosestEncloser(nsec, name))
+			for _, w := range nsecs {
+				if nsecCovers(w, wildcard) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for _, nsec := range nsecs {
+		// NODATA for an existing name
+		if strings.EqualFold(nsec.Hdr.Name, name) && !hasType(nsec.TypeBitMap, question.Qtype) && !hasType(nsec.TypeBitMap, dns.TypeCNAME) {
+			return true
+		}
+		// Empty non-terminal
+		if nsecCovers(nsec, name) && dns.IsSubDomain(name, nsec.NextDomain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validates the NSEC3 proof of an NXDOMAIN or NODATA response as described in
+// RFC5155 section 8. Returns false without error if the proof relies on an
+// opt-out NSEC3 record, which makes the response insecure.
+func nsec3Denies(nsec3s []*dns.NSEC3, question dns.Question, rcode int) (bool, error) {
+	name := question.Name
+	if rcode == dns.RcodeSuccess {
+		// NODATA for an existing name
+		for _, nsec3 := range nsec3s {
+			if !nsec3.Match(name) {
+				continue
+			}
+			if hasType(nsec3.TypeBitMap, question.Qtype) || hasType(nsec3.TypeBitMap, dns.TypeCNAME) {
+				return false, fmt.Errorf("nsec3 record for %s doesn't deny type %s", name, dns.TypeToString[question.Qtype])
+			}
+			return true, nil
+		}
+	}
+	closestEncloser, nextCloser, ok := nsec3ClosestEncloser(nsec3s, name)
+	if !ok {
+		return false, fmt.Errorf("missing nsec3 closest encloser proof for %s", name)
+	}
+	optOut := nsec3Covering(nsec3s, nextCloser).Flags&0x01 != 0
+	wildcard := wildcardName(closestEncloser)
+	if rcode == dns.RcodeNameError {
+		if nsec3Covering(nsec3s, wildcard) == nil {
+			return false, fmt.Errorf("nsec3 records don't deny wildcard %s", wildcard)
+		}
+		return !optOut, nil
+	}
+	// NODATA for a name matching a wildcard
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(wildcard) && !hasType(nsec3.TypeBitMap, question.Qtype) && !hasType(nsec3.TypeBitMap, dns.TypeCNAME) {
+			return true, nil
+		}
+	}
+	// DS query for an unsigned delegation in an opt-out span
+	if question.Qtype == dns.TypeDS && optOut {
+		return false, nil
+	}
+	return false, fmt.Errorf("nsec3 records don't prove denial of existence for %s", name)
+}
+
+// Returns the closest encloser of the name, the closest ancestor that exists
+// in the zone, and the next closer name, one label longer, if the NSEC3
+// records prove them (RFC5155 section 8.3).
+func nsec3ClosestEncloser(nsec3s []*dns.NSEC3, name string) (string, string, bool) {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		candidate := dns.Fqdn(strings.Join(labels[i:], "."))
+		for _, nsec3 := range nsec3s {
+			if !nsec3.Match(candidate) {
+				continue
+			}
+			nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+			if nsec3Covering(nsec3s, nextCloser) == nil {
+				return "", "", false
+			}
+			return candidate, nextCloser, true
+		}
+	}
+	return "", "", false
+}
+
+// Returns the NSEC3 record that covers the name, or nil if there is none.
+func nsec3Covering(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// Returns the closest ancestor of the name that exists in the zone, given the
+// NSEC record that covers the name. That's the longest common ancestor of the
+// name with the owner or the next name of the record.
+func nsecClosestEncloser(nsec *dns.NSEC, name string) string {
+	n := dns.CompareDomainName(name, nsec.Hdr.Name)
+	if m := dns.CompareDomainName(name, nsec.NextDomain); m > n {
+		n = m
+	}
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// Returns the wildcard name directly below a domain.
+func wildcardName(domain string) string {
+	if domain == "." {
+		return "*."
+	}
+	return "*." + domain
+}
+
+// Verifies the signatures of an RRset. Returns true if the RRset is secure,
+// false if it's in a provably insecure zone, and an error otherwise.
+func (r *DNSSECValidator) verifyRRset(set *rrset, ci ClientInfo) (bool, error) {
+	if len(set.sigs) == 0 {
+		insecure, err := r.provablyInsecure(set.name, ci)
+		if err != nil {
+			return false, err
+		}
+		if !insecure {
+			return false, fmt.Errorf("missing signature for %s %s", set.name, dns.TypeToString[set.rrtype])
+		}
+		return false, nil
+	}
+	err := fmt.Errorf("no valid signature for %s %s", set.name, dns.TypeToString[set.rrtype])
+	for _, sig := range set.sigs {
+		// The signer has to be the zone of the record, or a parent of it. DS
+		// records are signed by the parent zone.
+		if !dns.IsSubDomain(sig.SignerName, set.name) || (set.rrtype == dns.TypeDS && strings.EqualFold(sig.SignerName, set.name)) {
+			continue
+		}
+		keys, kerr := r.zoneKeys(sig.SignerName, ci)
+		if kerr != nil {
+			err = kerr
+			continue
+		}
+		if keys == nil {
+			return false, nil
+		}
+		if verr := verifyRRSIG(sig, keys, set.rrs); verr != nil {
+			err = verr
+			continue
+		}
+		return true, nil
+	}
+	return false, err
+}
+
+// Returns true if the name is in a zone that is provably not signed.
+func (r *DNSSECValidator) provablyInsecure(name string, ci ClientInfo) (bool, error) {
+	a, err := r.query(name, dns.TypeDS, ci)
+	if err != nil {
+		return false, err
+	}
+	// A signed delegation means the name is in a secure zone
+	for _, rr := range a.Answer {
+		if _, ok := rr.(*dns.DS); ok {
+			return false, nil
+		}
+	}
+	// The name is an unsigned delegation
+	proven, err := r.noDSProof(name, a, ci)
+	if err != nil || proven {
+		return proven, err
+	}
+	// Otherwise the name is in the zone of the SOA record
+	for _, rr := range a.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			keys, err := r.zoneKeys(soa.Hdr.Name, ci)
+			return keys == nil, err
+		}
+	}
+	return false, fmt.Errorf("unable to find zone of %s", name)
+}
+
+// Looks for an NSEC or NSEC3 record in the response to a DS query that proves
+// the zone is an unsigned delegation.
+func (r *DNSSECValidator) noDSProof(zone string, a *dns.Msg, ci ClientInfo) (bool, error) {
+	for _, set := range groupRRsets(a.Ns) {
+		var proof bool
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				proof = strings.EqualFold(rr.Hdr.Name, zone) && hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeDS)
+			case *dns.NSEC3:
+				proof = rr.Match(zone) && hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeDS)
+			}
+		}
+		if !proof {
+			continue
+		}
+		if _, err := r.verifyRRset(set, ci); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Returns the validated keys of a zone, or nil if the zone is insecure.
+func (r *DNSSECValidator) zoneKeys(zone string, ci ClientInfo) ([]*dns.DNSKEY, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	r.mu.Lock()
+	z, ok := r.zones[zone]
+	r.mu.Unlock()
+	if ok && time.Now().Before(z.expiry) {
+		return z.keys, nil
+	}
+	keys, ttl, err := r.fetchZoneKeys(zone, ci)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.zones[zone] = dnssecZone{keys: keys, expiry: time.Now().Add(ttl)}
+	r.mu.Unlock()
+	return keys, nil
+}
+
+// Queries the DNSKEY records of a zone and validates them with a trust anchor
+// or the DS records in the parent zone. Returns nil keys if the zone is
+// provably insecure.
+func (r *DNSSECValidator) fetchZoneKeys(zone string, ci ClientInfo) ([]*dns.DNSKEY, time.Duration, error) {
+	anchors, ok := r.anchors[zone]
+	if !ok {
+		if zone == "." {
+			return nil, 0, errors.New("no trust anchor for the root zone")
+		}
+		a, err := r.query(zone, dns.TypeDS, ci)
+		if err != nil {
+			return nil, 0, err
+		}
+		var dsSet *rrset
+		for _, set := range groupRRsets(a.Answer) {
+			if set.rrtype == dns.TypeDS && strings.EqualFold(set.name, zone) {
+				dsSet = set
+			}
+		}
+		if dsSet == nil {
+			proven, err := r.noDSProof(zone, a, ci)
+			if err != nil {
+				return nil, 0, err
+			}
+			if !proven {
+				return nil, 0, fmt.Errorf("no ds records or proof of their absence for %s", zone)
+			}
+			return nil, dnssecInsecureTTL, nil
+		}
+		secure, err := r.verifyRRset(dsSet, ci)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !secure {
+			return nil, dnssecInsecureTTL, nil
+		}
+		anchors = dsSet.rrs
+	}
+
+	a, err := r.query(zone, dns.TypeDNSKEY, ci)
+	if err != nil {
+		return nil, 0, err
+	}
+	var keySet *rrset
+	for _, set := range groupRRsets(a.Answer) {
+		if set.rrtype == dns.TypeDNSKEY && strings.EqualFold(set.name, zone) {
+			keySet = set
+		}
+	}
+	if keySet == nil {
+		return nil, 0, fmt.Errorf("no dnskey records for %s", zone)
+	}
+
+	// Find the keys that match the anchors or DS records and use them to verify
+	// the signatures of the DNSKEY RRset
+	var trusted, keys []*dns.DNSKEY
+	for _, rr := range keySet.rrs {
+		key := rr.(*dns.DNSKEY)
+		if key.Flags&dns.ZONE == 0 {
+			continue
+		}
+		keys = append(keys, key)
+		if matchesAnchor(key, anchors) {
+			trusted = append(trusted, key)
+		}
+	}
+	for _, sig := range keySet.sigs {
+		if err = verifyRRSIG(sig, trusted, keySet.rrs); err == nil {
+			return keys, time.Duration(keySet.rrs[0].Header().Ttl) * time.Second, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no valid signature for the dnskey records of %s", zone)
+}
+
+// Sends a query for DNSSEC records upstream.
+func (r *DNSSECValidator) query(name string, qtype uint16, ci ClientInfo) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), qtype)
+	q.SetEdns0(4096, true)
+	q.CheckingDisabled = true
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return nil, fmt.Errorf("no response for %s %s", name, dns.TypeToString[qtype])
+	}
+	if a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("received %s for %s %s", dns.RcodeToString[a.Rcode], name, dns.TypeToString[qtype])
+	}
+	return a, nil
+}
+
+// Returns true if the key is equal to a DNSKEY anchor, or matches a DS anchor.
+func matchesAnchor(key *dns.DNSKEY, anchors []dns.RR) bool {
+	for _, anchor := range anchors {
+		switch anchor := anchor.(type) {
+		case *dns.DS:
+			ds := key.ToDS(anchor.DigestType)
+			if ds != nil && ds.KeyTag == anchor.KeyTag && strings.EqualFold(ds.Digest, anchor.Digest) {
+				return true
+			}
+		case *dns.DNSKEY:
+			if key.Algorithm == anchor.Algorithm && key.PublicKey == anchor.PublicKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Verifies a signature with one of the keys.
+func verifyRRSIG(sig *dns.RRSIG, keys []*dns.DNSKEY, rrs []dns.RR) error {
+	if !sig.ValidityPeriod(time.Now()) {
+		return fmt.Errorf("signature for %s is expired or not yet valid", sig.Hdr.Name)
+	}
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err := sig.Verify(key, rrs); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid signature for %s", sig.Hdr.Name)
+}
+
+// Groups records into RRsets together with their signatures.
+func groupRRsets(rrs []dns.RR) []*rrset {
+	var sets []*rrset
+	find := func(name string, rrtype uint16) *rrset {
+		for _, set := range sets {
+			if set.rrtype == rrtype && strings.EqualFold(set.name, name) {
+				return set
+			}
+		}
+		set := &rrset{name: name, rrtype: rrtype}
+		sets = append(sets, set)
+		return set
+	}
+	for _, rr := range rrs {
+		h := rr.Header()
+		switch rr := rr.(type) {
+		case *dns.OPT:
+		case *dns.RRSIG:
+			set := find(h.Name, rr.TypeCovered)
+			set.sigs = append(set.sigs, rr)
+		default:
+			set := find(h.Name, h.Rrtype)
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+	// Drop signatures without records
+	var out []*rrset
+	for _, set := range sets {
+		if len(set.rrs) > 0 {
+			out = append(out, set)
+		}
+	}
+	return out
+}
+
+// Returns true if the NSEC record covers the name, meaning the name is between
+// the owner and the next name in canonical order.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// Last NSEC in the zone, the next name is the apex
+	return canonicalCompare(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
+
+// Compares two names in canonical DNS order (RFC 4034 section 6.1).
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// Returns true if the type is in the bitmap.
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Record types the validator removes from responses to clients that didn't ask
+// for DNSSEC records.
+var dnssecValidatorStripTypes = map[uint16]bool{
+	dns.TypeRRSIG: true,
+	dns.TypeNSEC:  true,
+	dns.TypeNSEC3: true,
+}
+
+// Removes records of the given types from a response unless they were queried.
+// The record slices are replaced, not modified.
+func stripDNSSEC(question dns.Question, a *dns.Msg, types map[uint16]bool) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		var out []dns.RR
+		for _, rr := range rrs {
+			if t := rr.Header().Rrtype; types[t] && t != question.Qtype {
+				continue
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+	a.Answer = strip(a.Answer)
+	a.Ns = strip(a.Ns)
+	a.Extra = strip(a.Extra)
+}
@@ -0,0 +1,209 @@
+package rdns
+
+import (
+	"crypto"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Signed test zone with keys per zone, serving records from a map.
+type dnssecTestZone struct {
+	t       *testing.T
+	keys    map[string]*dns.DNSKEY
+	signers map[string]crypto.Signer
+	records map[string]*dns.Msg // Keyed by "name type"
+}
+
+func newDNSSECTestZone(t *testing.T, zones ...string) *dnssecTestZone {
+	z := &dnssecTestZone{
+		t:       t,
+		keys:    make(map[string]*dns.DNSKEY),
+		signers: make(map[string]crypto.Signer),
+		records: make(map[string]*dns.Msg),
+	}
+	for _, zone := range zones {
+		key := &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     dns.ZONE | dns.SEP,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := key.Generate(256)
+		require.NoError(t, err)
+		z.keys[zone] = key
+		z.signers[zone] = priv.(crypto.Signer)
+		z.add(zone, dns.TypeDNSKEY, dns.RcodeSuccess, z.sign(zone, key), nil)
+	}
+	return z
+}
+
+// Signs a set of records with the key of a zone and returns them together
+// with the signature.
+func (z *dnssecTestZone) sign(zone string, rrs ...dns.RR) []dns.RR {
+	key := z.keys[zone]
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrs[0].Header().Ttl},
+		Algorithm:  key.Algorithm,
+		SignerName: zone,
+		KeyTag:     key.KeyTag(),
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	require.NoError(z.t, sig.Sign(z.signers[zone], rrs))
+	return append(rrs, sig)
+}
+
+func (z *dnssecTestZone) add(name string, qtype uint16, rcode int, answer, ns []dns.RR) {
+	a := new(dns.Msg)
+	a.Rcode = rcode
+	a.Answer = answer
+	a.Ns = ns
+	z.records[name+" "+dns.TypeToString[qtype]] = a
+}
+
+func (z *dnssecTestZone) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	question := q.Question[0]
+	a, ok := z.records[strings.ToLower(question.Name)+" "+dns.TypeToString[question.Qtype]]
+	if !ok {
+		return refused(q), nil
+	}
+	a = a.Copy()
+	a.SetReply(q)
+	a.Rcode = z.records[strings.ToLower(question.Name)+" "+dns.TypeToString[question.Qtype]].Rcode
+	return a, nil
+}
+
+func (z *dnssecTestZone) String() string { return "test-zone" }
+
+func concatRRs(sets ...[]dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, set := range sets {
+		out = append(out, set...)
+	}
+	return out
+}
+
+func rr(s string) dns.RR {
+	r, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func TestDNSSECValidator(t *testing.T) {
+	z := newDNSSECTestZone(t, "test.", "signed.test.")
+	soaTest := rr("test. 3600 IN SOA ns.test. admin.test. 1 3600 600 86400 300")
+	soaSigned := rr("signed.test. 3600 IN SOA ns.signed.test. admin.signed.test. 1 3600 600 86400 300")
+
+	// Secure delegation to signed.test, unsigned delegation to insecure.test
+	z.add("signed.test.", dns.TypeDS, dns.RcodeSuccess, z.sign("test.", z.keys["signed.test."].ToDS(dns.SHA256)), nil)
+	z.add("insecure.test.", dns.TypeDS, dns.RcodeSuccess, nil, append(
+		z.sign("test.", soaTest),
+		z.sign("test.", rr("insecure.test. 300 IN NSEC signed.test. NS RRSIG NSEC"))...,
+	))
+
+	// Signed record
+	z.add("www.signed.test.", dns.TypeA, dns.RcodeSuccess, z.sign("signed.test.", rr("www.signed.test. 300 IN A 192.0.2.1")), nil)
+
+	// Record with a signature that doesn't match the data
+	bogus := z.sign("signed.test.", rr("bogus.signed.test. 300 IN A 192.0.2.1"))
+	bogus[0].(*dns.A).A = net.ParseIP("192.0.2.2")
+	z.add("bogus.signed.test.", dns.TypeA, dns.RcodeSuccess, bogus, nil)
+
+	// Record in a signed zone without signature
+	z.add("unsigned.signed.test.", dns.TypeA, dns.RcodeSuccess, []dns.RR{rr("unsigned.signed.test. 300 IN A 192.0.2.1")}, nil)
+	z.add("unsigned.signed.test.", dns.TypeDS, dns.RcodeSuccess, nil, z.sign("signed.test.", soaSigned))
+
+	// Record in an unsigned zone
+	z.add("www.insecure.test.", dns.TypeA, dns.RcodeSuccess, []dns.RR{rr("www.insecure.test. 300 IN A 192.0.2.1")}, nil)
+	z.add("www.insecure.test.", dns.TypeDS, dns.RcodeSuccess, nil, []dns.RR{rr("insecure.test. 3600 IN SOA ns.insecure.test. admin.insecure.test. 1 3600 600 86400 300")})
+	z.add("insecure.test.", dns.TypeDNSKEY, dns.RcodeSuccess, nil, nil)
+
+	// Non-existent names with and without valid NSEC proof
+	z.add("nope.signed.test.", dns.TypeA, dns.RcodeNameError, nil, concatRRs(
+		z.sign("signed.test.", soaSigned),
+		z.sign("signed.test.", rr("bogus.signed.test. 300 IN NSEC unsigned.signed.test. A RRSIG NSEC")),
+		z.sign("signed.test.", rr("signed.test. 300 IN NSEC bogus.signed.test. NS SOA RRSIG NSEC DNSKEY")),
+	))
+	// Missing proof that there is no wildcard
+	z.add("nowildcard.signed.test.", dns.TypeA, dns.RcodeNameError, nil, append(
+		z.sign("signed.test.", soaSigned),
+		z.sign("signed.test.", rr("bogus.signed.test. 300 IN NSEC unsigned.signed.test. A RRSIG NSEC"))...,
+	))
+
+	// Replayed negative responses with only a signed SOA record
+	z.add("soaonly.signed.test.", dns.TypeA, dns.RcodeNameError, nil, z.sign("signed.test.", soaSigned))
+	z.add("www.signed.test.", dns.TypeAAAA, dns.RcodeSuccess, nil, z.sign("signed.test.", soaSigned))
+
+	// Denial of existence with NSEC3, the zone has the apex and nodata.signed.test
+	apexHash := dns.HashName("signed.test.", dns.SHA1, 0, "")
+	nodataHash := dns.HashName("nodata.signed.test.", dns.SHA1, 0, "")
+	nsec3s := concatRRs(
+		z.sign("signed.test.", rr(apexHash+".signed.test. 300 IN NSEC3 1 0 0 - "+nodataHash+" NS SOA RRSIG DNSKEY")),
+		z.sign("signed.test.", rr(nodataHash+".signed.test. 300 IN NSEC3 1 0 0 - "+apexHash+" TXT RRSIG")),
+	)
+	z.add("nodata.signed.test.", dns.TypeA, dns.RcodeSuccess, nil, append(z.sign("signed.test.", soaSigned), nsec3s...))
+	z.add("nope3.signed.test.", dns.TypeA, dns.RcodeNameError, nil, append(z.sign("signed.test.", soaSigned), nsec3s...))
+	// NXDOMAIN contradicted by the NSEC3 records, the name exists
+	z.add("nodata.signed.test.", dns.TypeAAAA, dns.RcodeNameError, nil, append(z.sign("signed.test.", soaSigned), nsec3s...))
+	z.add("zzz.signed.test.", dns.TypeA, dns.RcodeNameError, nil, append(
+		z.sign("signed.test.", soaSigned),
+		z.sign("signed.test.", rr("bogus.signed.test. 300 IN NSEC unsigned.signed.test. A RRSIG NSEC"))...,
+	))
+
+	r, err := NewDNSSECValidator("test-dnssec", z, DNSSECValidatorOptions{
+		TrustAnchors: []string{z.keys["test."].ToDS(dns.SHA256).String()},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		rcode int
+		ad    bool
+	}{
+		{"www.signed.test.", dns.RcodeSuccess, true},
+		{"bogus.signed.test.", dns.RcodeServerFailure, false},
+		{"unsigned.signed.test.", dns.RcodeServerFailure, false},
+		{"www.insecure.test.", dns.RcodeSuccess, false},
+		{"nope.signed.test.", dns.RcodeNameError, true},
+		{"zzz.signed.test.", dns.RcodeServerFailure, false},
+		{"nowildcard.signed.test.", dns.RcodeServerFailure, false},
+		{"soaonly.signed.test.", dns.RcodeServerFailure, false},
+		{"nodata.signed.test.", dns.RcodeSuccess, true},
+		{"nope3.signed.test.", dns.RcodeNameError, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(test.name, dns.TypeA)
+			a, err := r.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+			require.Equal(t, test.rcode, a.Rcode)
+			require.Equal(t, test.ad, a.AuthenticatedData)
+
+			// DNSSEC records are removed if the client didn't ask for them
+			for _, rr := range append(a.Answer, a.Ns...) {
+				require.NotEqual(t, dns.TypeRRSIG, rr.Header().Rrtype)
+			}
+		})
+	}
+
+	// NODATA with only a signed SOA, and NXDOMAIN for a name that exists
+	for _, name := range []string{"www.signed.test.", "nodata.signed.test."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeAAAA)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeServerFailure, a.Rcode, name)
+	}
+
+	// The DNSKEY records are cached after validation
+	require.Contains(t, r.zones, "signed.test.")
+	require.NotNil(t, r.zones["signed.test."].keys)
+}
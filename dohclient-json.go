@@ -0,0 +1,155 @@
+package rdns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// Response of the JSON API of DoH providers like Google or Cloudflare.
+type dohJSONResponse struct {
+	Status     int
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Answer     []dohJSONRecord
+	Authority  []dohJSONRecord
+	Additional []dohJSONRecord
+}
+
+// Record in a JSON API response, with the data in presentation format.
+type dohJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// ResolveJSON resolves a DNS query with a GET request to the JSON API of a
+// DoH provider, with the name and type in the query string.
+func (d *DoHClient) ResolveJSON(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	// The URL could be a template. Process it without values, the parameters
+	// are added below.
+	s, err := d.template.Expand(map[string]interface{}{})
+	if err != nil {
+		d.metrics.err.Add("template", 1)
+		return nil, err
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		d.metrics.err.Add("template", 1)
+		return nil, err
+	}
+	u.RawQuery = dohJSONQuery(u.Query(), q).Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		d.metrics.err.Add("http", 1)
+		return nil, err
+	}
+	req.Header.Add("accept", "application/dns-json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		d.metrics.err.Add("get", 1)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		d.metrics.err.Add(fmt.Sprintf("http%d", resp.StatusCode), 1)
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	rb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		d.metrics.err.Add("read", 1)
+		return nil, err
+	}
+	a, err := dohJSONToMsg(q, rb)
+	if err != nil {
+		d.metrics.err.Add("json", 1)
+		return nil, err
+	}
+	d.metrics.response.Add(rCode(a), 1)
+	return a, nil
+}
+
+// Adds the name and type of the question, as well as the DNSSEC OK and
+// Checking Disabled flags, to the parameters of a JSON API request.
+func dohJSONQuery(values url.Values, q *dns.Msg) url.Values {
+	question := q.Question[0]
+	values.Set("name", question.Name)
+	if s, ok := dns.TypeToString[question.Qtype]; ok {
+		values.Set("type", s)
+	} else {
+		values.Set("type", strconv.Itoa(int(question.Qtype)))
+	}
+	if edns0 := q.IsEdns0(); edns0 != nil && edns0.Do() {
+		values.Set("do", "1")
+	}
+	if q.CheckingDisabled {
+		values.Set("cd", "1")
+	}
+	return values
+}
+
+// Converts a JSON API response into a DNS response to the query. Records of
+// types the DNS library doesn't know are expected in the RFC3597 format. The
+// response has an OPT record, with the DNSSEC OK flag of the query, if the
+// query had one.
+func dohJSONToMsg(q *dns.Msg, b []byte) (*dns.Msg, error) {
+	var resp dohJSONResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, err
+	}
+	a := new(dns.Msg)
+	a.SetReply(q)
+	a.Rcode = resp.Status
+	a.Truncated = resp.TC
+	a.RecursionDesired = resp.RD
+	a.RecursionAvailable = resp.RA
+	a.AuthenticatedData = resp.AD
+	a.CheckingDisabled = resp.CD
+	var err error
+	if a.Answer, err = dohJSONRecords(resp.Answer); err != nil {
+		return nil, err
+	}
+	if a.Ns, err = dohJSONRecords(resp.Authority); err != nil {
+		return nil, err
+	}
+	if a.Extra, err = dohJSONRecords(resp.Additional); err != nil {
+		return nil, err
+	}
+	if edns0 := q.IsEdns0(); edns0 != nil {
+		a.SetEdns0(edns0.UDPSize(), edns0.Do())
+	}
+	return a, nil
+}
+
+func dohJSONRecords(records []dohJSONRecord) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, record := range records {
+		typ, ok := dns.TypeToString[record.Type]
+		if !ok {
+			typ = fmt.Sprintf("TYPE%d", record.Type)
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(record.Name), record.TTL, typ, record.Data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s record for %s: %w", typ, record.Name, err)
+		}
+		if rr == nil {
+			return nil, fmt.Errorf("empty %s record for %s", typ, record.Name)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
@@ -27,6 +27,11 @@ type DoHClientOptions struct {
 	// Query method, either GET or POST. If empty, POST is used.
 	Method string
 
+	// Format of queries and responses, "wire" for RFC8484 DNS messages or
+	// "json" for the JSON API offered by Google and Cloudflare. Defaults to
+	// "wire". The JSON format only supports the GET method.
+	Format string
+
 	// Bootstrap address - IP to use for the service instead of looking up
 	// the service's hostname with potentially plain DNS.
 	BootstrapAddr string
@@ -37,8 +42,18 @@ type DoHClientOptions struct {
 	// Local IP to use for outbound connections. If nil, a local address is chosen.
 	LocalAddr net.IP
 
+	// URL of a proxy to connect to the upstream resolver through, for example
+	// socks5://127.0.0.1:1080 or http://proxy:3128. Overrides proxies set in the
+	// environment. Only supported with the tcp transport and can't be used with
+	// LocalAddr or BootstrapAddr.
+	ProxyURL string
+
 	TLSConfig *tls.Config
 
+	// Time limit for the whole request, including connecting and reading the response.
+	// No limit if 0.
+	Timeout time.Duration
+
 	TLSHandshakeTimeout   time.Duration
 	ResponseHeaderTimeout time.Duration
 	IdleConnTimeout       time.Duration
@@ -80,6 +95,9 @@ func NewDoHClient(id, endpoint string, opt DoHClientOptions) (*DoHClient, error)
 	case "tcp", "":
 		tr, err = dohTcpTransport(opt)
 	case "quic":
+		if opt.ProxyURL != "" {
+			return nil, errors.New("proxy is not supported with quic transport for doh client")
+		}
 		tr, err = dohQuicTransport(endpoint, opt)
 	default:
 		err = fmt.Errorf("unknown protocol: '%s'", opt.Transport)
@@ -90,6 +108,20 @@ func NewDoHClient(id, endpoint string, opt DoHClientOptions) (*DoHClient, error)
 
 	client := &http.Client{
 		Transport: tr,
+		Timeout:   opt.Timeout,
+	}
+
+	switch opt.Format {
+	case "", "wire":
+	case "json":
+		if opt.Method == "" {
+			opt.Method = "GET"
+		}
+		if opt.Method != "GET" {
+			return nil, fmt.Errorf("unsupported method '%s' for json format", opt.Method)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format '%s'", opt.Format)
 	}
 
 	if opt.Method == "" {
@@ -117,21 +149,26 @@ func (d *DoHClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		"method":   d.opt.Method,
 	}).Debug("querying upstream resolver")
 
+	if d.opt.Format == "json" {
+		d.metrics.query.Add(1)
+		return d.ResolveJSON(ci.Context(), q)
+	}
+
 	// Add padding before sending the query over HTTPS
 	padQuery(q)
 
 	d.metrics.query.Add(1)
 	switch d.opt.Method {
 	case "POST":
-		return d.ResolvePOST(q)
+		return d.ResolvePOST(ci.Context(), q)
 	case "GET":
-		return d.ResolveGET(q)
+		return d.ResolveGET(ci.Context(), q)
 	}
 	return nil, errors.New("unsupported method")
 }
 
 // ResolvePOST resolves a DNS query via DNS-over-HTTP using the POST method.
-func (d *DoHClient) ResolvePOST(q *dns.Msg) (*dns.Msg, error) {
+func (d *DoHClient) ResolvePOST(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	// Pack the DNS query into wire format
 	b, err := q.Pack()
 	if err != nil {
@@ -144,7 +181,7 @@ func (d *DoHClient) ResolvePOST(q *dns.Msg) (*dns.Msg, error) {
 		d.metrics.err.Add("template", 1)
 		return nil, err
 	}
-	req, err := http.NewRequest("POST", u, bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(b))
 	if err != nil {
 		d.metrics.err.Add("http", 1)
 		return nil, err
@@ -161,7 +198,7 @@ func (d *DoHClient) ResolvePOST(q *dns.Msg) (*dns.Msg, error) {
 }
 
 // ResolveGET resolves a DNS query via DNS-over-HTTP using the GET method.
-func (d *DoHClient) ResolveGET(q *dns.Msg) (*dns.Msg, error) {
+func (d *DoHClient) ResolveGET(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	// Pack the DNS query into wire format
 	b, err := q.Pack()
 	if err != nil {
@@ -177,7 +214,7 @@ func (d *DoHClient) ResolveGET(q *dns.Msg) (*dns.Msg, error) {
 		d.metrics.err.Add("template", 1)
 		return nil, err
 	}
-	req, err := http.NewRequest("GET", u, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
 	if err != nil {
 		d.metrics.err.Add("http", 1)
 		return nil, err
@@ -218,8 +255,19 @@ func (d *DoHClient) responseFromHTTP(resp *http.Response) (*dns.Msg, error) {
 }
 
 func dohTcpTransport(opt DoHClientOptions) (http.RoundTripper, error) {
+	proxy := http.ProxyFromEnvironment
+	if opt.ProxyURL != "" {
+		if opt.LocalAddr != nil || opt.BootstrapAddr != "" {
+			return nil, errors.New("local address and bootstrap address can't be used with a proxy for doh client")
+		}
+		u, err := url.Parse(opt.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse proxy url '%s': %w", opt.ProxyURL, err)
+		}
+		proxy = http.ProxyURL(u)
+	}
 	tr := &http.Transport{
-		Proxy:                 http.ProxyFromEnvironment,
+		Proxy:                 proxy,
 		TLSClientConfig:       opt.TLSConfig,
 		DisableCompression:    true,
 		TLSHandshakeTimeout:   opt.TLSHandshakeTimeout,
@@ -234,9 +282,10 @@ func dohTcpTransport(opt DoHClientOptions) (http.RoundTripper, error) {
 		}
 	}
 
-	// Use a custom dialer if a bootstrap address or local address was provided
-	if opt.BootstrapAddr != "" || opt.LocalAddr != nil {
-		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: opt.LocalAddr}}
+	// Use a custom dialer if a bootstrap address or local address was provided,
+	// or hostnames need to be looked up with the bootstrap resolver
+	if opt.BootstrapAddr != "" || opt.LocalAddr != nil || getBootstrapResolver() != nil {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: opt.LocalAddr}, Resolver: getBootstrapResolver()}
 		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 			if opt.BootstrapAddr != "" {
 				_, port, err := net.SplitHostPort(addr)
@@ -295,7 +344,7 @@ func dohQuicTransport(endpoint string, opt DoHClientOptions) (http.RoundTripper,
 }
 
 func quicDial(hostname, rAddr string, lAddr net.IP, tlsConfig *tls.Config, config *quic.Config, pool *udpConnPool) (quic.EarlySession, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", rAddr)
+	udpAddr, err := bootstrapResolveUDPAddr(rAddr)
 	if err != nil {
 		return nil, err
 	}
@@ -1,7 +1,12 @@
 package rdns
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -26,3 +31,139 @@ func TestDoHClientSimpleGET(t *testing.T) {
 	require.NoError(t, err)
 	require.NotEmpty(t, r.Answer)
 }
+
+func TestDoHClientTimeout(t *testing.T) {
+	// Upstream that takes too long to respond
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			time.Sleep(2 * time.Second)
+			return q, nil
+		},
+	}
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s, err := NewDoHListener("test-doh", addr, DoHListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	require.NoError(t, err)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	d, err := NewDoHClient("test-doh", "https://"+addr+"/dns-query", DoHClientOptions{
+		TLSConfig: tlsConfig,
+		Timeout:   500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("cloudflare.com.", dns.TypeA)
+	start := time.Now()
+	_, err = d.Resolve(q, ClientInfo{})
+	require.Error(t, err)
+	require.WithinDuration(t, start.Add(500*time.Millisecond), time.Now(), 200*time.Millisecond)
+}
+
+func TestDoHClientCancel(t *testing.T) {
+	// Upstream that only returns once the query is canceled
+	canceled := make(chan struct{})
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			<-ci.Context().Done()
+			close(canceled)
+			return nil, ci.Context().Err()
+		},
+	}
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s, err := NewDoHListener("test-doh", addr, DoHListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	require.NoError(t, err)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	d, err := NewDoHClient("test-doh", "https://"+addr+"/dns-query", DoHClientOptions{
+		TLSConfig: tlsConfig,
+		Timeout:   5 * time.Second,
+	})
+	require.NoError(t, err)
+
+	// Cancel the query while it's waiting for a response
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	q := new(dns.Msg)
+	q.SetQuestion("cloudflare.com.", dns.TypeA)
+	start := time.Now()
+	_, err = d.Resolve(q, ClientInfo{}.WithContext(ctx))
+	require.ErrorIs(t, err, context.Canceled)
+	require.WithinDuration(t, start.Add(100*time.Millisecond), time.Now(), 200*time.Millisecond)
+
+	// The cancellation should have been passed on to the upstream resolver
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("upstream query was not canceled")
+	}
+}
+
+func TestDoHClientJSON(t *testing.T) {
+	// Upstream with a JSON API that records the query parameters
+	var params url.Values
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params = r.URL.Query()
+		w.Header().Set("content-type", "application/dns-json")
+		w.Write([]byte(`{
+  "Status": 0, "TC": false, "RD": true, "RA": true, "AD": true, "CD": false,
+  "Question": [{"name": "www.example.com.", "type": 1}],
+  "Answer": [
+    {"name": "www.example.com.", "type": 5, "TTL": 300, "data": "example.com."},
+    {"name": "example.com", "type": 1, "TTL": 60, "data": "93.184.216.34"},
+    {"name": "example.com.", "type": 65280, "TTL": 60, "data": "\\# 2 abcd"}
+  ],
+  "Authority": [
+    {"name": "example.com.", "type": 6, "TTL": 3600, "data": "ns.example.com. admin.example.com. 1 7200 3600 1209600 3600"}
+  ]
+}`))
+	}))
+	defer s.Close()
+
+	d, err := NewDoHClient("test-doh", s.URL+"/resolve", DoHClientOptions{Format: "json"})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	q.SetEdns0(4096, true)
+	a, err := d.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+
+	// Name, type and the DNSSEC OK flag are sent as parameters
+	require.Equal(t, "www.example.com.", params.Get("name"))
+	require.Equal(t, "A", params.Get("type"))
+	require.Equal(t, "1", params.Get("do"))
+
+	require.Equal(t, q.Id, a.Id)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.True(t, a.AuthenticatedData)
+	require.True(t, a.RecursionAvailable)
+	require.Len(t, a.Answer, 3)
+	require.Equal(t, "example.com.", a.Answer[0].(*dns.CNAME).Target)
+	require.Equal(t, "example.com.", a.Answer[1].Header().Name)
+	require.Equal(t, "93.184.216.34", a.Answer[1].(*dns.A).A.String())
+	require.Equal(t, "abcd", a.Answer[2].(*dns.RFC3597).Rdata)
+	require.Len(t, a.Ns, 1)
+	require.Equal(t, uint32(3600), a.Ns[0].(*dns.SOA).Minttl)
+	require.NotNil(t, a.IsEdns0())
+	require.True(t, a.IsEdns0().Do())
+
+	// The JSON format only works with GET
+	_, err = NewDoHClient("test-doh", s.URL+"/resolve", DoHClientOptions{Format: "json", Method: "POST"})
+	require.Error(t, err)
+}
@@ -7,6 +7,7 @@ import (
 	"expvar"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
 	"strings"
@@ -49,6 +50,9 @@ type DoHListenerOptions struct {
 
 	// IP(v4/v6) subnet of known reverse proxies in front of this server.
 	HTTPProxyNet *net.IPNet
+
+	// URL path the server handles queries on. Defaults to "/dns-query".
+	Path string
 }
 
 type DoHListenerMetrics struct {
@@ -82,6 +86,9 @@ func NewDoHListener(id, addr string, opt DoHListenerOptions, resolver Resolver)
 	default:
 		return nil, fmt.Errorf("unknown protocol: '%s'", opt.Transport)
 	}
+	if opt.Path == "" {
+		opt.Path = "/dns-query"
+	}
 
 	l := &DoHListener{
 		id:      id,
@@ -91,7 +98,7 @@ func NewDoHListener(id, addr string, opt DoHListenerOptions, resolver Resolver)
 		mux:     http.NewServeMux(),
 		metrics: NewDoHListenerMetrics(id),
 	}
-	l.mux.Handle("/dns-query", http.HandlerFunc(l.dohHandler))
+	l.mux.Handle(opt.Path, http.HandlerFunc(l.dohHandler))
 	return l, nil
 }
 
@@ -183,6 +190,13 @@ func (s *DoHListener) getHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *DoHListener) postHandler(w http.ResponseWriter, r *http.Request) {
+	// Only the media type matters, clients may add parameters like a charset
+	ct := r.Header.Get("content-type")
+	if mediaType, _, err := mime.ParseMediaType(ct); err != nil || mediaType != "application/dns-message" {
+		s.metrics.err.Add("contenttype", 1)
+		http.Error(w, "unsupported content-type: "+ct, http.StatusUnsupportedMediaType)
+		return
+	}
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -240,9 +254,12 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 		return
 	}
 	ci := ClientInfo{
-		SourceIP: clientIP,
+		SourceIP:  clientIP,
+		Protocol:  ProtocolDoH,
+		RequestID: newRequestID(),
+		ctx:       r.Context(),
 	}
-	log := Log.WithFields(logrus.Fields{"id": s.id, "client": ci.SourceIP, "qname": qName(q), "protocol": "doh", "addr": s.addr})
+	log := Log.WithFields(logrus.Fields{"id": s.id, "client": ci.SourceIP, "qname": qName(q), "protocol": "doh", "addr": s.addr, "request": ci.RequestID})
 	log.Debug("received query")
 
 	var err error
@@ -278,5 +295,9 @@ func (s *DoHListener) parseAndRespond(b []byte, w http.ResponseWriter, r *http.R
 		return
 	}
 	w.Header().Set("content-type", "application/dns-message")
+	// Allow HTTP caches to store the response for the lowest TTL, RFC8484 section 5.1
+	if ttl, ok := minTTL(a); ok {
+		w.Header().Set("cache-control", fmt.Sprintf("max-age=%d", ttl))
+	}
 	_, _ = w.Write(out)
 }
@@ -1,8 +1,11 @@
 package rdns
 
 import (
+	"bytes"
+	"encoding/base64"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -256,3 +259,75 @@ func TestIPv6Proxy(t *testing.T) {
 	client = s.extractClientAddress(r)
 	require.Equal(t, net.IPv4(10, 0, 1, 5), client)
 }
+
+func TestDoHListenerHandler(t *testing.T) {
+	var ci ClientInfo
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, c ClientInfo) (*dns.Msg, error) {
+			ci = c
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IP{192, 0, 2, 1}},
+				&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IP{192, 0, 2, 2}},
+			}
+			return a, nil
+		},
+	}
+	_, proxyNet, err := net.ParseCIDR("10.0.0.0/24")
+	require.NoError(t, err)
+	s, err := NewDoHListener("test-doh", ":0", DoHListenerOptions{HTTPProxyNet: proxyNet, Path: "/custom"}, upstream)
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+
+	// POST query from a client behind the trusted proxy
+	r := httptest.NewRequest("POST", "/custom", bytes.NewReader(b))
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("content-type", "application/dns-message")
+	r.Header.Set("X-Forwarded-For", "192.168.1.5")
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/dns-message", w.Header().Get("content-type"))
+	require.Equal(t, "max-age=60", w.Header().Get("cache-control"))
+	require.Equal(t, "192.168.1.5", ci.SourceIP.String())
+	a := new(dns.Msg)
+	require.NoError(t, a.Unpack(w.Body.Bytes()))
+	require.Len(t, a.Answer, 2)
+
+	// GET query
+	r = httptest.NewRequest("GET", "/custom?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	r.RemoteAddr = "192.168.1.6:1234"
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "max-age=60", w.Header().Get("cache-control"))
+	require.Equal(t, "192.168.1.6", ci.SourceIP.String())
+
+	// POST with the wrong content type
+	r = httptest.NewRequest("POST", "/custom", bytes.NewReader(b))
+	r.RemoteAddr = "192.168.1.6:1234"
+	r.Header.Set("content-type", "text/plain")
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	require.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	// Parameters in the content type are ignored
+	r = httptest.NewRequest("POST", "/custom", bytes.NewReader(b))
+	r.RemoteAddr = "192.168.1.6:1234"
+	r.Header.Set("content-type", "Application/DNS-Message; charset=utf-8")
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// The default path isn't handled
+	r = httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, 3, upstream.HitCount())
+}
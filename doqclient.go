@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"crypto/tls"
+	"encoding/binary"
 	"io/ioutil"
 	"net"
 	"sync"
@@ -14,7 +15,8 @@ import (
 )
 
 const (
-	DOQNoError = 0x00
+	DOQNoError          = 0x00
+	DOQRequestCancelled = 0x03
 )
 
 // DoQClient is a DNS-over-QUIC resolver.
@@ -39,6 +41,9 @@ type DoQClientOptions struct {
 	LocalAddr net.IP
 
 	TLSConfig *tls.Config
+
+	// Query timeout, default 1 second.
+	Timeout time.Duration
 }
 
 var _ Resolver = &DoQClient{}
@@ -71,6 +76,9 @@ func NewDoQClient(id, endpoint string, opt DoQClientOptions) (*DoQClient, error)
 		tlsConfig.ServerName = host
 		endpoint = net.JoinHostPort(opt.BootstrapAddr, port)
 	}
+	if opt.Timeout == 0 {
+		opt.Timeout = time.Second
+	}
 	log := Log.WithFields(logrus.Fields{"protocol": "doq", "endpoint": endpoint})
 	return &DoQClient{
 		id:               id,
@@ -122,12 +130,14 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	q.Id = 0
 	defer func() { q.Id = id }()
 
-	// Encode the query
+	// Encode the query and prefix it with its length as per RFC9250 section 4.2
 	b, err := q.Pack()
 	if err != nil {
 		d.metrics.err.Add("pack", 1)
 		return nil, err
 	}
+	b = append(make([]byte, 2, 2+len(b)), b...)
+	binary.BigEndian.PutUint16(b, uint16(len(b)-2))
 
 	// Get a new stream in the session
 	stream, err := d.session.getStream()
@@ -136,8 +146,15 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		return nil, err
 	}
 
+	// Abort the stream if the query is canceled while waiting for the response
+	ctx := ci.Context()
+	defer onCancel(ctx, func() {
+		stream.CancelWrite(DOQRequestCancelled)
+		stream.CancelRead(DOQRequestCancelled)
+	})()
+
 	// Write the query into the stream and close is. Only one stream per query/response
-	_ = stream.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = stream.SetWriteDeadline(time.Now().Add(d.Timeout))
 	if _, err = stream.Write(b); err != nil {
 		d.metrics.err.Add("write", 1)
 		return nil, err
@@ -148,16 +165,27 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 
 	// Read the response
-	_ = stream.SetReadDeadline(time.Now().Add(time.Second))
+	_ = stream.SetReadDeadline(time.Now().Add(d.Timeout))
 	b, err = ioutil.ReadAll(stream)
+	if ctx.Err() != nil {
+		d.metrics.err.Add("canceled", 1)
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		d.metrics.err.Add("read", 1)
 		return nil, err
 	}
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		d.metrics.err.Add("length", 1)
+		return nil, errors.New("invalid length prefix in doq response")
+	}
 
 	// Decode the response and restore the ID
 	a := new(dns.Msg)
-	err = a.Unpack(b)
+	if err = a.Unpack(b[2:]); err != nil {
+		d.metrics.err.Add("unpack", 1)
+		return nil, err
+	}
 	a.Id = id
 
 	// Receiving a edns-tcp-keepalive EDNS(0) option is a fatal error according to the RFC
@@ -173,7 +201,7 @@ func (d *DoQClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 	d.metrics.response.Add(rCode(a), 1)
 
-	return a, err
+	return a, nil
 }
 
 func (d *DoQClient) String() string {
@@ -208,9 +236,11 @@ func (s *doqSession) getStream() (quic.Stream, error) {
 		}
 	}
 
+	// All queries share the session, with one stream per query. If the session
+	// can't open streams anymore, because it timed out or was closed by the
+	// server, make a new one.
 	stream, err := s.session.OpenStream()
-	if netErr, ok := err.(net.Error); ok && (netErr.Timeout() || netErr.Temporary()) {
-		// Try to open a new session
+	if err != nil {
 		_ = s.session.CloseWithError(DOQNoError, "")
 		s.session, err = quicDial(s.hostname, s.endpoint, s.lAddr, s.tlsConfig, s.config, s.pool)
 		if err != nil {
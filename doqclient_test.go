@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -29,3 +30,40 @@ func TestDOQError(t *testing.T) {
 	require.Error(t, err)
 	require.Equal(t, id, q.Id) // Shouldn't touch the ID in the query
 }
+
+func TestDoQClientListener(t *testing.T) {
+	upstream := new(TestResolver)
+
+	// Find a free port for the listener
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+
+	// Create the listener
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewQUICListener("test-doq-listener", addr, DoQListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go s.Start()
+	time.Sleep(time.Second)
+	defer s.Stop()
+
+	// Make a client talking to the listener
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoQClient("test-doq", addr, DoQClientOptions{TLSConfig: tlsConfig})
+	require.NoError(t, err)
+
+	// Send several queries, they should all use the same session with one
+	// stream per query
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	id := q.Id
+	for i := 0; i < 3; i++ {
+		a, err := c.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Equal(t, id, a.Id)
+		require.Equal(t, "example.com.", a.Question[0].Name)
+	}
+	require.Equal(t, 3, upstream.HitCount())
+	require.Equal(t, int64(1), s.metrics.session.Value())
+	require.Equal(t, int64(3), s.metrics.stream.Value())
+}
@@ -3,9 +3,12 @@ package rdns
 import (
 	"context"
 	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"expvar"
 	"io/ioutil"
 	"net"
+	"sync"
 	"time"
 
 	quic "github.com/lucas-clemente/quic-go"
@@ -19,6 +22,7 @@ type DoQListener struct {
 	addr    string
 	r       Resolver
 	opt     DoQListenerOptions
+	mu      sync.Mutex // Guards ln, which is set by Start and used by Stop
 	ln      quic.Listener
 	log     *logrus.Entry
 	metrics *DoQListenerMetrics
@@ -59,8 +63,19 @@ func NewDoQListenerMetrics(id string) *DoQListenerMetrics {
 func NewQUICListener(id, addr string, opt DoQListenerOptions, resolver Resolver) *DoQListener {
 	if opt.TLSConfig == nil {
 		opt.TLSConfig = new(tls.Config)
+	} else {
+		opt.TLSConfig = opt.TLSConfig.Clone()
 	}
 	opt.TLSConfig.NextProtos = []string{"doq"}
+	if opt.ReadTimeout == 0 {
+		opt.ReadTimeout = 2 * time.Second
+	}
+	if opt.WriteTimeout == 0 {
+		opt.WriteTimeout = 2 * time.Second
+	}
+	if opt.IdleTimeout == 0 {
+		opt.IdleTimeout = 8 * time.Second
+	}
 	l := &DoQListener{
 		id:      id,
 		addr:    addr,
@@ -73,19 +88,21 @@ func NewQUICListener(id, addr string, opt DoQListenerOptions, resolver Resolver)
 }
 
 // Start the QUIC server.
-func (s DoQListener) Start() error {
-	var err error
-	s.ln, err = quic.ListenAddr(s.addr, s.opt.TLSConfig, &quic.Config{})
+func (s *DoQListener) Start() error {
+	ln, err := quic.ListenAddr(s.addr, s.opt.TLSConfig, &quic.Config{})
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
 	s.log.Info("starting listener")
 
 	for {
-		session, err := s.ln.Accept(context.Background())
+		session, err := ln.Accept(context.Background())
 		if err != nil {
-			s.log.WithError(err).Warn("failed to accept")
-			continue
+			// Accept only fails once the listener is closed
+			return err
 		}
 		s.log.Trace("started session")
 
@@ -98,13 +115,18 @@ func (s DoQListener) Start() error {
 }
 
 // Stop the server.
-func (s DoQListener) Stop() error {
+func (s *DoQListener) Stop() error {
 	Log.WithFields(logrus.Fields{"protocol": "quic", "addr": s.addr}).Info("stopping listener")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
 	return s.ln.Close()
 }
 
-func (s DoQListener) handleSession(session quic.Session) {
-	var ci ClientInfo
+func (s *DoQListener) handleSession(session quic.Session) {
+	ci := ClientInfo{Protocol: ProtocolDoQ}
 	switch addr := session.RemoteAddr().(type) {
 	case *net.TCPAddr:
 		ci.SourceIP = addr.IP
@@ -122,7 +144,7 @@ func (s DoQListener) handleSession(session quic.Session) {
 	s.metrics.session.Add(1)
 
 	for {
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second) // TODO: configurable
+		ctx, cancel := context.WithTimeout(context.Background(), s.opt.IdleTimeout)
 		stream, err := session.AcceptStream(ctx)
 		if err != nil {
 			cancel()
@@ -137,13 +159,13 @@ func (s DoQListener) handleSession(session quic.Session) {
 	}
 }
 
-func (s DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci ClientInfo) {
+func (s *DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci ClientInfo) {
 	// DNS over QUIC uses one stream per query/response.
 	defer stream.Close()
 	s.metrics.stream.Add(1)
 
 	// Read the raw query
-	_ = stream.SetReadDeadline(time.Now().Add(time.Second)) // TODO: configurable timeout
+	_ = stream.SetReadDeadline(time.Now().Add(s.opt.ReadTimeout))
 	b, err := ioutil.ReadAll(stream)
 	if err != nil {
 		s.metrics.err.Add("read", 1)
@@ -151,14 +173,22 @@ func (s DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci Clie
 		return
 	}
 
+	// Messages are prefixed with their length as per RFC9250 section 4.2
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		s.metrics.err.Add("length", 1)
+		log.WithError(errors.New("invalid length prefix")).Error("failed to decode query")
+		return
+	}
+
 	// Decode the query
 	q := new(dns.Msg)
-	if err := q.Unpack(b); err != nil {
+	if err := q.Unpack(b[2:]); err != nil {
 		s.metrics.err.Add("unpack", 1)
 		log.WithError(err).Error("failed to decode query")
 		return
 	}
-	log = log.WithField("qname", qName(q))
+	ci.RequestID = newRequestID()
+	log = log.WithFields(logrus.Fields{"qname": qName(q), "request": ci.RequestID})
 	log.Debug("received query")
 	s.metrics.query.Add(1)
 
@@ -174,23 +204,35 @@ func (s DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci Clie
 		}
 	}
 
-	// Resolve the query using the next hop
-	a, err := s.r.Resolve(q, ci)
+	// Resolve the query using the next hop. It's canceled when the client
+	// resets the stream or closes the session, or after the timeouts.
+	ctx, cancel := context.WithTimeout(stream.Context(), s.opt.queryTimeout())
+	defer cancel()
+	a, err := s.r.Resolve(q, ci.WithContext(ctx))
 	if err != nil {
 		log.WithError(err).Error("failed to resolve")
 		a = new(dns.Msg)
 		a.SetRcode(q, dns.RcodeServerFailure)
 	}
 
+	// A nil response from the resolvers means "drop", reset the stream without responding
+	if a == nil {
+		s.metrics.drop.Add(1)
+		stream.CancelWrite(DOQRequestCancelled)
+		return
+	}
+
 	out, err := a.Pack()
 	if err != nil {
 		log.WithError(err).Error("failed to encode response")
 		s.metrics.err.Add("encode", 1)
 		return
 	}
+	out = append(make([]byte, 2, 2+len(out)), out...)
+	binary.BigEndian.PutUint16(out, uint16(len(out)-2))
 
 	// Send the response
-	_ = stream.SetWriteDeadline(time.Now().Add(time.Second)) // TODO: configurable timeout
+	_ = stream.SetWriteDeadline(time.Now().Add(s.opt.WriteTimeout))
 	if _, err = stream.Write(out); err != nil {
 		s.metrics.err.Add("send", 1)
 		log.WithError(err).Error("failed to send response")
@@ -198,6 +240,6 @@ func (s DoQListener) handleStream(stream quic.Stream, log *logrus.Entry, ci Clie
 	s.metrics.response.Add(rCode(a), 1)
 }
 
-func (s DoQListener) String() string {
+func (s *DoQListener) String() string {
 	return s.id
 }
@@ -0,0 +1,84 @@
+package rdns
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoQListenerFraming(t *testing.T) {
+	received := make(chan ClientInfo, 2)
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			received <- ci
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewQUICListener("test-doq-framing", addr, DoQListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	tlsConfig.NextProtos = []string{"doq"}
+	session, err := quic.DialAddr(addr, tlsConfig, nil)
+	require.NoError(t, err)
+	defer session.CloseWithError(DOQNoError, "")
+
+	// Sends the message on a new stream, closes the sending side and returns
+	// everything the listener responded with
+	exchange := func(b []byte) []byte {
+		stream, err := session.OpenStream()
+		require.NoError(t, err)
+		_, err = stream.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, stream.Close())
+		_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		out, _ := ioutil.ReadAll(stream)
+		return out
+	}
+	frame := func(name string) []byte {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		q.Id = 0
+		b, err := q.Pack()
+		require.NoError(t, err)
+		out := make([]byte, 2, 2+len(b))
+		binary.BigEndian.PutUint16(out, uint16(len(b)))
+		return append(out, b...)
+	}
+
+	// One query per stream, each answered with a length-prefixed response on
+	// its own stream
+	for _, name := range []string{"example.com.", "example.net."} {
+		b := exchange(frame(name))
+		require.GreaterOrEqual(t, len(b), 2)
+		require.Equal(t, len(b)-2, int(binary.BigEndian.Uint16(b)))
+		a := new(dns.Msg)
+		require.NoError(t, a.Unpack(b[2:]))
+		require.Equal(t, uint16(0), a.Id)
+		require.Equal(t, name, a.Question[0].Name)
+
+		ci := <-received
+		require.Equal(t, ProtocolDoQ, ci.Protocol)
+		require.True(t, ci.SourceIP.IsLoopback())
+	}
+
+	// A query with an invalid length prefix isn't answered
+	b := frame("example.org.")
+	binary.BigEndian.PutUint16(b, uint16(len(b)))
+	require.Empty(t, exchange(b))
+	require.Equal(t, 2, upstream.HitCount())
+}
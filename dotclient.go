@@ -1,8 +1,11 @@
 package rdns
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -12,10 +15,12 @@ import (
 
 // DoTClient is a DNS-over-TLS resolver.
 type DoTClient struct {
-	id       string
-	endpoint string
-	pipeline *Pipeline
-	timeout  time.Duration
+	id        string
+	endpoint  string
+	pipelines []*Pipeline
+	next      uint32
+	timeout   time.Duration
+	padding   int // Padding block size, 0 if padding is disabled
 	// Pipeline also provides operation metrics.
 }
 
@@ -25,25 +30,103 @@ type DoTClientOptions struct {
 	// the service's hostname with potentially plain DNS.
 	BootstrapAddr string
 
+	// Additional bootstrap addresses. Connections are opened to the first of
+	// the addresses, including BootstrapAddr, that can be reached, starting
+	// with the one that worked last.
+	BootstrapAddrs []string
+
 	// Local IP to use for outbound connections. If nil, a local address is chosen.
 	LocalAddr net.IP
 
+	// Server name to use in the TLS handshake and to validate the server certificate
+	// against. Overrides the hostname in the endpoint and in the bootstrap address.
+	ServerName string
+
+	// Client certificate and key files used for mutual-TLS. The key pair is loaded
+	// and added to the TLS config when the client is created.
+	ClientCertFile string
+	ClientKeyFile  string
+
 	TLSConfig *tls.Config
 	Timeout   time.Duration
+
+	// Base64-encoded SHA256 hashes of public keys (SPKI) to pin. If set, one of the
+	// certificates presented by the server must have one of these keys.
+	PinnedKeys []string
+
+	// Only check the pinned keys and skip the validation of the certificate chain.
+	// Required if the TLS config has InsecureSkipVerify set.
+	PinOnly bool
+
+	// Query padding strategy, "none" to disable padding or "default" (or empty) to pad
+	// queries to a multiple of PaddingBlockSize as per rfc8467.
+	Padding string
+
+	// Block size used to pad queries. Defaults to QueryPaddingBlockSize.
+	PaddingBlockSize int
+
+	// Number of parallel connections to open to the upstream resolver. Queries are
+	// distributed across them in round-robin order. Defaults to 1.
+	PipelineDepth int
+
+	// Time a connection is kept open without queries before it's closed.
+	// Defaults to 10s.
+	IdleTimeout time.Duration
+
+	// Time to wait for a connection to the first address of a dual-stack endpoint
+	// before racing a connection to an address of the other family, as per
+	// rfc8305 (Happy Eyeballs). Defaults to 300ms, negative disables the fallback.
+	FallbackDelay time.Duration
+
+	// URL of a proxy to connect to the upstream resolver through, for example
+	// socks5://127.0.0.1:1080 or http://proxy:3128. Can't be used with LocalAddr.
+	ProxyURL string
 }
 
 var _ Resolver = &DoTClient{}
+var _ Drainer = &DoTClient{}
 
 // NewDoTClient instantiates a new DNS-over-TLS resolver.
 func NewDoTClient(id, endpoint string, opt DoTClientOptions) (*DoTClient, error) {
 	if err := validEndpoint(endpoint); err != nil {
 		return nil, err
 	}
+	if opt.ProxyURL != "" && opt.LocalAddr != nil {
+		return nil, errors.New("local address and proxy are mutually exclusive for dot client")
+	}
 
-	// Use a custom dialer if a local address was provided
+	// Use a custom dialer if a local address or fallback delay was provided
 	var dialer *net.Dialer
-	if opt.LocalAddr != nil {
-		dialer = &net.Dialer{LocalAddr: &net.TCPAddr{IP: opt.LocalAddr}}
+	if opt.LocalAddr != nil || opt.FallbackDelay != 0 {
+		dialer = &net.Dialer{FallbackDelay: opt.FallbackDelay}
+		if opt.LocalAddr != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: opt.LocalAddr}
+		}
+	}
+	// Work on a copy of the TLS config, client certificates and the server name
+	// are added to it
+	if opt.TLSConfig == nil {
+		opt.TLSConfig = new(tls.Config)
+	} else {
+		opt.TLSConfig = opt.TLSConfig.Clone()
+	}
+	if opt.ClientCertFile != "" || opt.ClientKeyFile != "" {
+		if opt.ClientCertFile == "" || opt.ClientKeyFile == "" {
+			return nil, errors.New("both client certificate and key file are required for dot client")
+		}
+		certificate, err := tls.LoadX509KeyPair(opt.ClientCertFile, opt.ClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load client certificate '%s' with key '%s'", opt.ClientCertFile, opt.ClientKeyFile)
+		}
+		opt.TLSConfig.Certificates = append(opt.TLSConfig.Certificates, certificate)
+	}
+	if len(opt.PinnedKeys) > 0 {
+		var err error
+		if opt.TLSConfig, err = pinPublicKeys(opt.TLSConfig, opt.PinnedKeys, opt.PinOnly); err != nil {
+			return nil, err
+		}
+	} else if opt.PinOnly {
+		return nil, errors.New("pin-only requires pinned keys for dot client")
 	}
 	client := &dns.Client{
 		Net:       "tcp-tls",
@@ -54,24 +137,72 @@ func NewDoTClient(id, endpoint string, opt DoTClientOptions) (*DoTClient, error)
 	// hostname in the TLS handshake. The DNS library doesn't support custom dialers, so
 	// instead set the ServerName in the TLS config to the name in the endpoint config, and
 	// replace the name in the endpoint with the bootstrap IP.
+	var bootstrapAddrs []string
 	if opt.BootstrapAddr != "" {
+		bootstrapAddrs = append(bootstrapAddrs, opt.BootstrapAddr)
+	}
+	bootstrapAddrs = append(bootstrapAddrs, opt.BootstrapAddrs...)
+	if len(bootstrapAddrs) > 0 {
 		host, port, err := net.SplitHostPort(endpoint)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to parse dot endpoint '%s'", endpoint)
 		}
 		client.TLSConfig.ServerName = host
-		endpoint = net.JoinHostPort(opt.BootstrapAddr, port)
+		for i, addr := range bootstrapAddrs {
+			bootstrapAddrs[i] = net.JoinHostPort(addr, port)
+		}
+		endpoint = bootstrapAddrs[0]
+	} else {
+		client.Dialer = bootstrapDialer(dialer)
+	}
+	if opt.ServerName != "" {
+		client.TLSConfig.ServerName = opt.ServerName
 	}
 
 	if opt.Timeout == 0 {
 		opt.Timeout = time.Second * 1
 	}
 
+	var padding int
+	switch opt.Padding {
+	case "", "default":
+		padding = opt.PaddingBlockSize
+		if padding <= 0 {
+			padding = QueryPaddingBlockSize
+		}
+	case "none":
+	default:
+		return nil, fmt.Errorf("unsupported padding option '%s'", opt.Padding)
+	}
+
+	if opt.PipelineDepth < 1 {
+		opt.PipelineDepth = 1
+	}
+	// Connect through the proxy if one is configured, negotiating TLS over the
+	// proxied connection
+	var dnsDialer DNSDialer = client
+	if opt.ProxyURL != "" {
+		pd, err := newProxyDialer(opt.ProxyURL, bootstrapDialer(nil))
+		if err != nil {
+			return nil, err
+		}
+		dnsDialer = proxyDNSDialer{dialer: pd, tlsConfig: client.TLSConfig}
+	}
+	if len(bootstrapAddrs) > 1 {
+		dnsDialer = newFailoverDialer(id, dnsDialer, bootstrapAddrs)
+	}
+
+	pipelines := make([]*Pipeline, opt.PipelineDepth)
+	for i := range pipelines {
+		pipelines[i] = NewPipeline(id, endpoint, dnsDialer, opt.IdleTimeout)
+	}
+
 	return &DoTClient{
-		id:       id,
-		endpoint: endpoint,
-		pipeline: NewPipeline(id, endpoint, client),
-		timeout:  opt.Timeout,
+		id:        id,
+		endpoint:  endpoint,
+		pipelines: pipelines,
+		timeout:   opt.Timeout,
+		padding:   padding,
 	}, nil
 }
 
@@ -83,8 +214,23 @@ func (d *DoTClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}).Debug("querying upstream resolver")
 
 	// Add padding to the query before sending over TLS
-	padQuery(q)
-	return d.pipeline.Resolve(q, d.timeout)
+	if d.padding > 0 {
+		padQueryBlockSize(q, d.padding)
+	}
+	a, err := d.pipeline().Resolve(ci.Context(), q, d.timeout)
+	return a, classifyError(err)
+}
+
+// Drain stops accepting new queries and closes the connections once the
+// outstanding queries are completed or ctx is done.
+func (d *DoTClient) Drain(ctx context.Context) error {
+	return drainPipelines(ctx, d.pipelines...)
+}
+
+// Returns the next pipeline in round-robin order.
+func (d *DoTClient) pipeline() *Pipeline {
+	i := atomic.AddUint32(&d.next, 1)
+	return d.pipelines[i%uint32(len(d.pipelines))]
 }
 
 func (d *DoTClient) String() string {
@@ -1,11 +1,19 @@
 package rdns
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
+	"errors"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -50,3 +58,472 @@ func TestDoTClientCA(t *testing.T) {
 	_, err = d.Resolve(q, ClientInfo{})
 	require.Error(t, err)
 }
+
+func TestDoTClientPipelineDepth(t *testing.T) {
+	upstream := new(TestResolver)
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoTClient("test-dot-depth", addr, DoTClientOptions{TLSConfig: tlsConfig, PipelineDepth: 4})
+	require.NoError(t, err)
+
+	// Send several queries concurrently, they should be spread over 4 connections
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := new(dns.Msg)
+			q.SetQuestion("cloudflare.com.", dns.TypeA)
+			_, err := c.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 8, upstream.HitCount())
+	require.Equal(t, int64(4), getVarInt("client", "test-dot-depth", "connections").Value())
+}
+
+func TestDoTClientServerName(t *testing.T) {
+	upstream := new(TestResolver)
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	// Record the server name sent by the client in the handshake
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	sni := make(chan string, 10)
+	tlsServerConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		sni <- hello.ServerName
+		return nil, nil
+	}
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	q := new(dns.Msg)
+	q.SetQuestion("cloudflare.com.", dns.TypeA)
+
+	// Override the name used in the handshake for an IP endpoint
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsConfig, ServerName: "localhost"})
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "localhost", <-sni)
+
+	// The server name takes precedence over the endpoint hostname when a bootstrap address is used
+	tlsConfig, err = TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err = NewDoTClient("test-dot", net.JoinHostPort("dns.example.com", port), DoTClientOptions{
+		TLSConfig:     tlsConfig,
+		BootstrapAddr: "127.0.0.1",
+		ServerName:    "localhost",
+	})
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "localhost", <-sni)
+
+	// A name that doesn't match the server certificate fails validation
+	tlsConfig, err = TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err = NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsConfig, ServerName: "dns.example.com"})
+	require.NoError(t, err)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.Error(t, err)
+	require.Equal(t, "dns.example.com", <-sni)
+}
+
+func TestDoTClientCertFiles(t *testing.T) {
+	upstream := new(TestResolver)
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	// Listener requiring a client certificate
+	tlsServerConfig, err := TLSServerConfig("testdata/ca.crt", "testdata/server.crt", "testdata/server.key", true)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// Client loading the certificate from files, using a bootstrap address
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoTClient("test-dot", net.JoinHostPort("localhost", port), DoTClientOptions{
+		TLSConfig:      tlsConfig,
+		BootstrapAddr:  "127.0.0.1",
+		ClientCertFile: "testdata/client.crt",
+		ClientKeyFile:  "testdata/client.key",
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("cloudflare.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// The TLS config passed in isn't modified
+	require.Empty(t, tlsConfig.Certificates)
+	require.Empty(t, tlsConfig.ServerName)
+
+	// Missing key file
+	_, err = NewDoTClient("test-dot", addr, DoTClientOptions{ClientCertFile: "testdata/client.crt"})
+	require.Error(t, err)
+
+	// Non-existent files
+	_, err = NewDoTClient("test-dot", addr, DoTClientOptions{
+		ClientCertFile: "testdata/missing.crt",
+		ClientKeyFile:  "testdata/missing.key",
+	})
+	require.Error(t, err)
+
+	// Mismatched certificate and key
+	_, err = NewDoTClient("test-dot", addr, DoTClientOptions{
+		ClientCertFile: "testdata/client.crt",
+		ClientKeyFile:  "testdata/server.key",
+	})
+	require.Error(t, err)
+}
+
+func TestDoTClientPadding(t *testing.T) {
+	// Record the size of the OPT padding seen by the upstream
+	var lastQuery *dns.Msg
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			lastQuery = q
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	paddingLen := func(q *dns.Msg) int {
+		edns0 := q.IsEdns0()
+		require.NotNil(t, edns0)
+		for _, opt := range edns0.Option {
+			if p, ok := opt.(*dns.EDNS0_PADDING); ok {
+				return len(p.Padding)
+			}
+		}
+		return -1
+	}
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	newQuery := func() *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("cloudflare.com.", dns.TypeA)
+		q.SetEdns0(4096, false)
+		return q
+	}
+
+	// Padding with a custom block size
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsConfig, PaddingBlockSize: 256})
+	require.NoError(t, err)
+	q := newQuery()
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Zero(t, q.Len()%256)
+	require.Equal(t, 256-(q.Len()-paddingLen(q))%256, paddingLen(lastQuery))
+
+	// No padding
+	tlsConfig, err = TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err = NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsConfig, Padding: "none"})
+	require.NoError(t, err)
+	_, err = c.Resolve(newQuery(), ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, -1, paddingLen(lastQuery))
+
+	// Invalid option
+	_, err = NewDoTClient("test-dot", addr, DoTClientOptions{Padding: "random"})
+	require.Error(t, err)
+}
+
+func TestDoTClientPinnedKeys(t *testing.T) {
+	upstream := new(TestResolver)
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// Pin of the server's public key
+	b, err := os.ReadFile("testdata/server.crt")
+	require.NoError(t, err)
+	block, _ := pem.Decode(b)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(digest[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	q := new(dns.Msg)
+	q.SetQuestion("cloudflare.com.", dns.TypeA)
+	resolve := func(opt DoTClientOptions) error {
+		c, err := NewDoTClient("test-dot", addr, opt)
+		require.NoError(t, err)
+		_, err = c.Resolve(q, ClientInfo{})
+		return err
+	}
+	caConfig := func() *tls.Config {
+		tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+		require.NoError(t, err)
+		return tlsConfig
+	}
+
+	// Matching pin with a valid chain
+	require.NoError(t, resolve(DoTClientOptions{TLSConfig: caConfig(), PinnedKeys: []string{otherPin, pin}}))
+
+	// Valid chain, but the pin doesn't match
+	require.Error(t, resolve(DoTClientOptions{TLSConfig: caConfig(), PinnedKeys: []string{otherPin}}))
+
+	// Matching pin, but the chain can't be validated without the CA
+	require.Error(t, resolve(DoTClientOptions{PinnedKeys: []string{pin}}))
+
+	// Pin-only mode doesn't need the CA
+	require.NoError(t, resolve(DoTClientOptions{PinnedKeys: []string{pin}, PinOnly: true}))
+	require.Error(t, resolve(DoTClientOptions{PinnedKeys: []string{otherPin}, PinOnly: true}))
+
+	// In pin-only mode, only the leaf certificate is checked, so appending the
+	// genuine certificate to another one doesn't match
+	cfg, err := pinPublicKeys(nil, []string{pin}, true)
+	require.NoError(t, err)
+	b, err = os.ReadFile("testdata/ca.crt")
+	require.NoError(t, err)
+	other, _ := pem.Decode(b)
+	require.NotNil(t, other)
+	require.Error(t, cfg.VerifyPeerCertificate([][]byte{other.Bytes, block.Bytes}, nil))
+	require.NoError(t, cfg.VerifyPeerCertificate([][]byte{block.Bytes, other.Bytes}, nil))
+
+	// Chain validation and the pin are both checked if pin-only isn't set, so a
+	// matching pin doesn't help a certificate for the wrong name. A config that
+	// skips verification can't be combined with it.
+	_, err = NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: &tls.Config{InsecureSkipVerify: true}, PinnedKeys: []string{pin}})
+	require.Error(t, err)
+	cfg, err = pinPublicKeys(caConfig(), []string{pin}, false)
+	require.NoError(t, err)
+	require.False(t, cfg.InsecureSkipVerify)
+	require.NoError(t, cfg.VerifyPeerCertificate([][]byte{block.Bytes}, [][]*x509.Certificate{{cert}}))
+	require.Error(t, resolve(DoTClientOptions{TLSConfig: caConfig(), PinnedKeys: []string{pin}, ServerName: "wrong.example.com"}))
+
+	// Invalid options
+	_, err = NewDoTClient("test-dot", addr, DoTClientOptions{PinOnly: true})
+	require.Error(t, err)
+	_, err = NewDoTClient("test-dot", addr, DoTClientOptions{PinnedKeys: []string{"not-a-hash"}})
+	require.Error(t, err)
+}
+
+func TestDoTClientFallbackDelay(t *testing.T) {
+	// The hostname resolves to a blackholed IPv6 address and the IPv4 address of the listener
+	SetBootstrapResolver(&TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			hdr := dns.RR_Header{Name: q.Question[0].Name, Rrtype: q.Question[0].Qtype, Class: dns.ClassINET, Ttl: 60}
+			switch q.Question[0].Qtype {
+			case dns.TypeA:
+				a.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IP{127, 0, 0, 1}}}
+			case dns.TypeAAAA:
+				a.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("100::1")}}
+			}
+			return a, nil
+		},
+	})
+	defer SetBootstrapResolver(nil)
+
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoTClient("test-dot", net.JoinHostPort("dual.example.test", port), DoTClientOptions{
+		TLSConfig:     tlsConfig,
+		ServerName:    "127.0.0.1",
+		FallbackDelay: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	// The IPv4 connection should be used well before the IPv6 attempt times out
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	start := time.Now()
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, 1, upstream.HitCount())
+}
+
+func TestDoTClientErrorKinds(t *testing.T) {
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+
+	// TLS server that handles connections with the given function
+	serve := func(t *testing.T, handle func(net.Conn)) string {
+		addr, err := getLnAddress()
+		require.NoError(t, err)
+		ln, err := tls.Listen("tcp", addr, tlsServerConfig)
+		require.NoError(t, err)
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go handle(conn)
+			}
+		}()
+		return addr
+	}
+	resolve := func(t *testing.T, addr string, tlsConfig *tls.Config) error {
+		c, err := NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsConfig})
+		require.NoError(t, err)
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		_, err = c.Resolve(q, ClientInfo{})
+		return err
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		addr := serve(t, func(conn net.Conn) {
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn) // never respond
+		})
+		err := resolve(t, addr, tlsConfig)
+		require.ErrorIs(t, err, ErrTimeout)
+		var rerr ResolverError
+		require.ErrorAs(t, err, &rerr)
+		require.Equal(t, ErrTimeout, rerr.Kind())
+	})
+
+	t.Run("handshake", func(t *testing.T) {
+		addr := serve(t, func(conn net.Conn) {
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		})
+		// The client doesn't trust the server certificate
+		err := resolve(t, addr, &tls.Config{})
+		require.ErrorIs(t, err, ErrHandshake)
+		require.False(t, errors.Is(err, ErrTimeout))
+	})
+
+	t.Run("upstream closed", func(t *testing.T) {
+		addr := serve(t, func(conn net.Conn) {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		})
+		err := resolve(t, addr, tlsConfig)
+		require.ErrorIs(t, err, ErrUpstream)
+	})
+
+	t.Run("upstream refused", func(t *testing.T) {
+		addr, err := getLnAddress() // nothing listening
+		require.NoError(t, err)
+		err = resolve(t, addr, tlsConfig)
+		require.ErrorIs(t, err, ErrUpstream)
+	})
+}
+
+func TestDoTClientBootstrapFailover(t *testing.T) {
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// Nothing listens on the first address, the second one is used
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoTClient("test-dot", net.JoinHostPort("localhost", port), DoTClientOptions{
+		TLSConfig:      tlsConfig,
+		BootstrapAddr:  "127.0.0.2",
+		BootstrapAddrs: []string{"127.0.0.1"},
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// The address that worked is tried first for the next connection
+	d := c.pipelines[0].client.(*failoverDialer)
+	require.Equal(t, uint32(1), d.last)
+	conn, err := d.Dial("")
+	require.NoError(t, err)
+	require.Equal(t, addr, conn.RemoteAddr().String())
+	conn.Close()
+}
@@ -22,15 +22,26 @@ type DoTListenerOptions struct {
 	TLSConfig *tls.Config
 }
 
-// NewDoTListener returns an instance of a DNS-over-TLS listener.
+// NewDoTListener returns an instance of a DNS-over-TLS listener. It advertises
+// the "dot" ALPN protocol as per RFC7858.
 func NewDoTListener(id, addr string, opt DoTListenerOptions, resolver Resolver) *DoTListener {
+	var tlsConfig *tls.Config
+	if opt.TLSConfig == nil {
+		tlsConfig = new(tls.Config)
+	} else {
+		tlsConfig = opt.TLSConfig.Clone()
+	}
+	tlsConfig.NextProtos = []string{"dot"}
 	return &DoTListener{
 		id: id,
 		Server: &dns.Server{
-			Addr:      addr,
-			Net:       "tcp-tls",
-			TLSConfig: opt.TLSConfig,
-			Handler:   listenHandler(id, "dot", addr, resolver, opt.AllowedNet),
+			Addr:         addr,
+			Net:          "tcp-tls",
+			TLSConfig:    tlsConfig,
+			Handler:      listenHandler(id, "dot", addr, resolver, opt.ListenOptions),
+			ReadTimeout:  opt.ReadTimeout,
+			WriteTimeout: opt.WriteTimeout,
+			IdleTimeout:  opt.idleTimeout(),
 		},
 	}
 }
@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"crypto/tls"
 	"net"
 	"testing"
 	"time"
@@ -78,6 +79,54 @@ func TestDoTListenerMutual(t *testing.T) {
 	require.Equal(t, 1, upstream.HitCount())
 }
 
+func TestDoTListenerMutualRejected(t *testing.T) {
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+
+	// Listener that requires client certificates
+	tlsServerConfig, err := TLSServerConfig("testdata/ca.crt", "testdata/server.crt", "testdata/server.key", true)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// Client that trusts the server, but doesn't present a certificate
+	tlsClientConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsClientConfig})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("cloudflare.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.Error(t, err)
+	require.Equal(t, 0, upstream.HitCount())
+}
+
+func TestDoTListenerALPN(t *testing.T) {
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, new(TestResolver))
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	// The listener must not modify the config it was given
+	require.Empty(t, tlsServerConfig.NextProtos)
+
+	tlsClientConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	tlsClientConfig.NextProtos = []string{"dot"}
+	conn, err := tls.Dial("tcp", addr, tlsClientConfig)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "dot", conn.ConnectionState().NegotiatedProtocol)
+}
+
 func TestDoTListenerPadding(t *testing.T) {
 	// Define a listener that does not respond with padding
 	upstream, _ := NewDNSClient("test-dns", "8.8.8.8:53", "udp", DNSClientOptions{})
@@ -145,3 +194,99 @@ func getUDPLnAddress() (string, error) {
 	defer l.Close()
 	return l.LocalAddr().String(), nil
 }
+
+func TestDoTListenerEDNS0Options(t *testing.T) {
+	// Upstream that records the options in queries and responds with
+	// EXPIRE and an unknown option.
+	var queryOptions []dns.EDNS0
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			queryOptions = q.IsEdns0().Option
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.SetEdns0(4096, false)
+			a.IsEdns0().Option = []dns.EDNS0{
+				&dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Expire: 3600},
+				&dns.EDNS0_LOCAL{Code: 65002, Data: []byte{4, 5}},
+			}
+			return a, nil
+		},
+	}
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, _ := NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsConfig})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	q.IsEdns0().Option = []dns.EDNS0{
+		&dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Empty: true},
+		&dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1, 2, 3}},
+	}
+	a, err := c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+
+	// The options in the query arrive upstream, padding is added by the client
+	require.Len(t, queryOptions, 3)
+	require.Equal(t, uint16(dns.EDNS0EXPIRE), queryOptions[0].Option())
+	require.True(t, queryOptions[0].(*dns.EDNS0_EXPIRE).Empty)
+	require.Equal(t, &dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1, 2, 3}}, queryOptions[1])
+	require.Equal(t, uint16(dns.EDNS0PADDING), queryOptions[2].Option())
+
+	// The options in the response arrive at the client, padding is added by the listener
+	options := a.IsEdns0().Option
+	require.Len(t, options, 3)
+	require.Equal(t, uint16(dns.EDNS0EXPIRE), options[0].Option())
+	require.Equal(t, uint32(3600), options[0].(*dns.EDNS0_EXPIRE).Expire)
+	require.Equal(t, &dns.EDNS0_LOCAL{Code: 65002, Data: []byte{4, 5}}, options[1])
+	require.Equal(t, uint16(dns.EDNS0PADDING), options[2].Option())
+}
+
+func TestDoTListenerTCPKeepalive(t *testing.T) {
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, _ := NewDoTClient("test-dot", addr, DoTClientOptions{TLSConfig: tlsConfig})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	q.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE}}
+	a, err := c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+
+	// The response has the default idle timeout of 8 seconds, in units of 100ms
+	var keepalive *dns.EDNS0_TCP_KEEPALIVE
+	for _, opt := range a.IsEdns0().Option {
+		if o, ok := opt.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			keepalive = o
+		}
+	}
+	require.NotNil(t, keepalive)
+	require.Equal(t, uint16(80), keepalive.Timeout)
+}
@@ -0,0 +1,69 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDropResolver(t *testing.T) {
+	r := NewDropResolver("test-drop")
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Nil(t, a)
+}
+
+func TestDropUDPListener(t *testing.T) {
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListener("test-drop-udp", addr, "udp", ListenOptions{}, NewDropResolver("test-drop"))
+	go s.Start()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	// Send a query directly, no bytes should come back
+	conn, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+	_, err = conn.Write(b)
+	require.NoError(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	n, err := conn.Read(make([]byte, 512))
+	require.Equal(t, 0, n)
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	require.True(t, netErr.Timeout())
+}
+
+func TestDropDoQListener(t *testing.T) {
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewQUICListener("test-drop-doq", addr, DoQListenerOptions{TLSConfig: tlsServerConfig}, NewDropResolver("test-drop"))
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoQClient("test-drop-doq", addr, DoQClientOptions{TLSConfig: tlsConfig})
+	require.NoError(t, err)
+
+	// The stream is reset without a response
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.Error(t, err)
+	require.Equal(t, int64(1), s.metrics.drop.Value())
+}
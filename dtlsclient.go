@@ -1,6 +1,7 @@
 package rdns
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strconv"
@@ -27,14 +28,16 @@ type DTLSClientOptions struct {
 	// Local IP to use for outbound connections. If nil, a local address is chosen.
 	LocalAddr net.IP
 
-	// Sets the EDNS0 UDP size for all queries sent upstream. If set to 0, queries
-	// are not changed.
+	// Sets the EDNS0 UDP size for all queries sent upstream, adding an OPT record
+	// if necessary. If set to 0, 1232 is advertised in queries that have an OPT
+	// record already, other queries are not changed.
 	UDPSize uint16
 
 	DTLSConfig *dtls.Config
 }
 
 var _ Resolver = &DTLSClient{}
+var _ Drainer = &DTLSClient{}
 
 // NewDTLSClient instantiates a new DNS-over-TLS resolver.
 func NewDTLSClient(id, endpoint string, opt DTLSClientOptions) (*DTLSClient, error) {
@@ -83,7 +86,7 @@ func NewDTLSClient(id, endpoint string, opt DTLSClientOptions) (*DTLSClient, err
 	return &DTLSClient{
 		id:       id,
 		endpoint: endpoint,
-		pipeline: NewPipeline(id, endpoint, client),
+		pipeline: NewPipeline(id, endpoint, client, 0),
 		opt:      opt,
 	}, nil
 }
@@ -95,11 +98,22 @@ func (d *DTLSClient) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		"protocol": "dtls",
 	}).Debug("querying upstream resolver")
 
-	q = setUDPSize(q, d.opt.UDPSize)
+	if d.opt.UDPSize > 0 {
+		q = setUDPSize(q, d.opt.UDPSize)
+	} else {
+		q = updateUDPSize(q, defaultUDPSize)
+	}
 
 	// Add padding to the query before sending over TLS
 	padQuery(q)
-	return d.pipeline.Resolve(q, defaultQueryTimeout)
+	a, err := d.pipeline.Resolve(ci.Context(), q, defaultQueryTimeout)
+	return a, classifyError(err)
+}
+
+// Drain stops accepting new queries and closes the connection once the
+// outstanding queries are completed or ctx is done.
+func (d *DTLSClient) Drain(ctx context.Context) error {
+	return d.pipeline.Drain(ctx)
 }
 
 func (d *DTLSClient) String() string {
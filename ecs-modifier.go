@@ -70,7 +70,6 @@ func ECSModifierDelete(id string, q *dns.Msg, ci ClientInfo) {
 }
 
 func ECSModifierAdd(addr net.IP, prefix4, prefix6 uint8) ECSModifierFunc {
-
 	return func(id string, q *dns.Msg, ci ClientInfo) {
 		// Drop any existing ECS options
 		ECSModifierDelete("", q, ci)
@@ -80,43 +79,80 @@ func ECSModifierAdd(addr net.IP, prefix4, prefix6 uint8) ECSModifierFunc {
 		if sourceIP == nil {
 			sourceIP = ci.SourceIP
 		}
+		addECS(id, q, ci, sourceIP, prefix4, prefix6)
+	}
+}
 
-		var (
-			family uint16
-			mask   uint8
-		)
-		if ip4 := sourceIP.To4(); len(ip4) == net.IPv4len {
-			family = 1 // ip4
-			sourceIP = ip4
-			mask = prefix4
-			sourceIP = sourceIP.Mask(net.CIDRMask(int(prefix4), 32))
-		} else {
-			family = 2 // ip6
-			mask = prefix6
-			sourceIP = sourceIP.Mask(net.CIDRMask(int(prefix6), 128))
+// ECSModifierInject adds an ECS option with the address of the client, masked
+// to prefix4 or prefix6 bits, to queries. Defaults to /24 for IPv4 and /56 for
+// IPv6 if the prefix is 0. An ECS option that is already present in the query is
+// left alone unless overwrite is true.
+func ECSModifierInject(prefix4, prefix6 uint8, overwrite bool) ECSModifierFunc {
+	if prefix4 == 0 {
+		prefix4 = 24
+	}
+	if prefix6 == 0 {
+		prefix6 = 56
+	}
+	return func(id string, q *dns.Msg, ci ClientInfo) {
+		if ecsOption(q) != nil {
+			if !overwrite {
+				return
+			}
+			ECSModifierDelete("", q, ci)
 		}
-
-		// Add a new record if there's no EDNS0 at all
-		edns0 := q.IsEdns0()
-		if edns0 == nil {
-			q.SetEdns0(4096, false)
-			edns0 = q.IsEdns0()
+		if ci.SourceIP == nil {
+			return
 		}
+		addECS(id, q, ci, ci.SourceIP, prefix4, prefix6)
+	}
+}
+
+// ECSModifierZero replaces any ECS option in the query with 0.0.0.0/0 which
+// asks the upstream resolver to not use any client subnet information, not even
+// its own address, when answering the query.
+func ECSModifierZero(id string, q *dns.Msg, ci ClientInfo) {
+	ECSModifierDelete("", q, ci)
+	addECS(id, q, ci, net.IPv4zero, 0, 0)
+}
 
-		// Append the ECS option
-		ecs := new(dns.EDNS0_SUBNET)
-		ecs.Code = dns.EDNS0SUBNET
-		ecs.Family = family      // 1 for IPv4 source address, 2 for IPv6
-		ecs.SourceNetmask = mask // 32 for IPV4, 128 for IPv6
-		ecs.SourceScope = 0
-		ecs.Address = sourceIP
-		edns0.Option = append(edns0.Option, ecs)
-
-		logger(id, q, ci).WithFields(logrus.Fields{
-			"ecs":  sourceIP,
-			"mask": mask,
-		}).Debug("adding ecs option")
+// Adds an ECS option for the source IP, masked with the prefix for its family.
+func addECS(id string, q *dns.Msg, ci ClientInfo, sourceIP net.IP, prefix4, prefix6 uint8) {
+	var (
+		family uint16
+		mask   uint8
+	)
+	if ip4 := sourceIP.To4(); len(ip4) == net.IPv4len {
+		family = 1 // ip4
+		sourceIP = ip4
+		mask = prefix4
+		sourceIP = sourceIP.Mask(net.CIDRMask(int(prefix4), 32))
+	} else {
+		family = 2 // ip6
+		mask = prefix6
+		sourceIP = sourceIP.Mask(net.CIDRMask(int(prefix6), 128))
 	}
+
+	// Add a new record if there's no EDNS0 at all
+	edns0 := q.IsEdns0()
+	if edns0 == nil {
+		q.SetEdns0(4096, false)
+		edns0 = q.IsEdns0()
+	}
+
+	// Append the ECS option
+	ecs := new(dns.EDNS0_SUBNET)
+	ecs.Code = dns.EDNS0SUBNET
+	ecs.Family = family      // 1 for IPv4 source address, 2 for IPv6
+	ecs.SourceNetmask = mask // 32 for IPV4, 128 for IPv6
+	ecs.SourceScope = 0
+	ecs.Address = sourceIP
+	edns0.Option = append(edns0.Option, ecs)
+
+	logger(id, q, ci).WithFields(logrus.Fields{
+		"ecs":  sourceIP,
+		"mask": mask,
+	}).Debug("adding ecs option")
 }
 
 func ECSModifierPrivacy(prefix4, prefix6 uint8) ECSModifierFunc {
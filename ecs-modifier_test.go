@@ -0,0 +1,118 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestECSModifierInject(t *testing.T) {
+	var ecs *dns.EDNS0_SUBNET
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			ecs = ecsOption(q)
+			return new(dns.Msg), nil
+		},
+	}
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.10")}
+
+	// Default prefix for IPv4 is /24
+	m, _ := NewECSModifier("test", r, ECSModifierInject(0, 0, false))
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := m.Resolve(q, ci)
+	require.NoError(t, err)
+	require.NotNil(t, ecs)
+	require.Equal(t, uint16(1), ecs.Family)
+	require.Equal(t, uint8(24), ecs.SourceNetmask)
+	require.Equal(t, "192.168.1.0", ecs.Address.String())
+
+	// Default prefix for IPv6 is /56
+	q = new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = m.Resolve(q, ClientInfo{SourceIP: net.ParseIP("2001:db8:1:2:3::1")})
+	require.NoError(t, err)
+	require.NotNil(t, ecs)
+	require.Equal(t, uint16(2), ecs.Family)
+	require.Equal(t, uint8(56), ecs.SourceNetmask)
+	require.Equal(t, "2001:db8:1::", ecs.Address.String())
+}
+
+func TestECSModifierInjectExisting(t *testing.T) {
+	var opts []dns.EDNS0
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			opts = q.IsEdns0().Option
+			return new(dns.Msg), nil
+		},
+	}
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.10")}
+	newQuery := func() *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.SetEdns0(4096, false)
+		edns0 := q.IsEdns0()
+		edns0.Option = append(edns0.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: 16,
+			Address:       net.ParseIP("10.1.0.0").To4(),
+		})
+		return q
+	}
+
+	// The option set by the client should be passed through unchanged
+	m, _ := NewECSModifier("test", r, ECSModifierInject(24, 56, false))
+	_, err := m.Resolve(newQuery(), ci)
+	require.NoError(t, err)
+	require.Len(t, opts, 1)
+	ecs := opts[0].(*dns.EDNS0_SUBNET)
+	require.Equal(t, uint8(16), ecs.SourceNetmask)
+	require.Equal(t, "10.1.0.0", ecs.Address.String())
+
+	// With overwrite, it's replaced by the client address
+	m, _ = NewECSModifier("test", r, ECSModifierInject(24, 56, true))
+	_, err = m.Resolve(newQuery(), ci)
+	require.NoError(t, err)
+	require.Len(t, opts, 1)
+	ecs = opts[0].(*dns.EDNS0_SUBNET)
+	require.Equal(t, uint8(24), ecs.SourceNetmask)
+	require.Equal(t, "192.168.1.0", ecs.Address.String())
+}
+
+func TestECSModifierZero(t *testing.T) {
+	var opts []dns.EDNS0
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			opts = q.IsEdns0().Option
+			return new(dns.Msg), nil
+		},
+	}
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.10")}
+	m, _ := NewECSModifier("test", r, ECSModifierZero)
+
+	// Query with an existing ECS option, should be replaced with 0.0.0.0/0
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	edns0 := q.IsEdns0()
+	edns0.Option = append(edns0.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.ParseIP("192.168.1.0").To4(),
+	})
+	_, err := m.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, opts, 1)
+	ecs := opts[0].(*dns.EDNS0_SUBNET)
+	require.Equal(t, uint16(1), ecs.Family)
+	require.Equal(t, uint8(0), ecs.SourceNetmask)
+	require.Equal(t, "0.0.0.0", ecs.Address.String())
+
+	// The option survives packing the query
+	_, err = q.Pack()
+	require.NoError(t, err)
+}
@@ -0,0 +1,76 @@
+package rdns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// ECSStrip removes EDNS0 Client Subnet options from queries before they are
+// forwarded upstream, and/or from responses before they are returned to the
+// client.
+type ECSStrip struct {
+	id string
+	ECSStripOptions
+	resolver Resolver
+}
+
+var _ Resolver = &ECSStrip{}
+
+type ECSStripOptions struct {
+	// Remove ECS options from queries before passing them to the upstream resolver.
+	StripQuery bool
+
+	// Remove ECS options from responses before returning them.
+	StripResponse bool
+}
+
+// NewECSStrip returns a new instance of an ECS stripping modifier.
+func NewECSStrip(id string, resolver Resolver, opt ECSStripOptions) *ECSStrip {
+	return &ECSStrip{
+		id:              id,
+		ECSStripOptions: opt,
+		resolver:        resolver,
+	}
+}
+
+// Resolve a DNS query after removing any ECS option from it, then remove ECS
+// from the response.
+func (r *ECSStrip) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	if r.StripQuery && stripECS(q) {
+		log.Debug("removing ecs option from query")
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	if r.StripResponse && stripECS(a) {
+		log.Debug("removing ecs option from response")
+	}
+	return a, nil
+}
+
+func (r *ECSStrip) String() string {
+	return r.id
+}
+
+// Removes all ECS options from the OPT record of a message. The OPT record
+// itself is kept, even if there are no options left, since it still carries
+// the UDP size and extended flags. Returns true if anything was removed.
+func stripECS(m *dns.Msg) bool {
+	edns0 := m.IsEdns0()
+	if edns0 == nil {
+		return false
+	}
+	var removed bool
+	newOpt := make([]dns.EDNS0, 0, len(edns0.Option))
+	for _, opt := range edns0.Option {
+		if _, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			removed = true
+			continue
+		}
+		newOpt = append(newOpt, opt)
+	}
+	edns0.Option = newOpt
+	edns0.Hdr.Rdlength = 0 // Recalculated when packed
+	return removed
+}
@@ -0,0 +1,83 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a message with an OPT record that contains only an ECS option.
+func newECSMsg() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	edns0 := m.IsEdns0()
+	edns0.Option = append(edns0.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.ParseIP("192.168.1.0").To4(),
+	})
+	return m
+}
+
+func TestECSStripQuery(t *testing.T) {
+	var upstreamECS *dns.EDNS0_SUBNET
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			upstreamECS = ecsOption(q)
+			return newECSMsg(), nil
+		},
+	}
+
+	m := NewECSStrip("test", r, ECSStripOptions{StripQuery: true})
+	q := newECSMsg()
+	a, err := m.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+
+	// The query sent upstream has no ECS but still has EDNS0
+	require.Nil(t, upstreamECS)
+	require.NotNil(t, q.IsEdns0())
+	require.Equal(t, uint16(4096), q.IsEdns0().UDPSize())
+
+	// The response is untouched
+	require.NotNil(t, ecsOption(a))
+
+	// The stripped query can be packed and parsed again
+	b, err := q.Pack()
+	require.NoError(t, err)
+	q2 := new(dns.Msg)
+	require.NoError(t, q2.Unpack(b))
+	require.NotNil(t, q2.IsEdns0())
+	require.Empty(t, q2.IsEdns0().Option)
+}
+
+func TestECSStripResponse(t *testing.T) {
+	var upstreamECS *dns.EDNS0_SUBNET
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			upstreamECS = ecsOption(q)
+			a := newECSMsg()
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+
+	m := NewECSStrip("test", r, ECSStripOptions{StripResponse: true})
+	a, err := m.Resolve(newECSMsg(), ClientInfo{})
+	require.NoError(t, err)
+
+	// The query was forwarded with ECS, but it's gone from the response
+	require.NotNil(t, upstreamECS)
+	require.Nil(t, ecsOption(a))
+
+	// Stripping the only option must leave a valid OPT record
+	b, err := a.Pack()
+	require.NoError(t, err)
+	a2 := new(dns.Msg)
+	require.NoError(t, a2.Unpack(b))
+	require.NotNil(t, a2.IsEdns0())
+	require.Empty(t, a2.IsEdns0().Option)
+}
@@ -0,0 +1,120 @@
+package rdns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// EDNS0Filter removes EDNS0 options from queries before they are forwarded
+// upstream, and from responses before they are returned to the client, based
+// on lists of allowed and denied option codes.
+type EDNS0Filter struct {
+	id string
+	EDNS0FilterOptions
+	resolver Resolver
+	allow    map[uint16]bool
+	deny     map[uint16]bool
+}
+
+var _ Resolver = &EDNS0Filter{}
+
+type EDNS0FilterOptions struct {
+	// Option codes that are passed through. If empty, all options are allowed
+	// unless they're in the Deny list.
+	Allow []uint16
+
+	// Option codes that are removed. Applied after the Allow list.
+	Deny []uint16
+}
+
+// NewEDNS0Filter returns a new instance of an EDNS0 option filter.
+func NewEDNS0Filter(id string, resolver Resolver, opt EDNS0FilterOptions) *EDNS0Filter {
+	r := &EDNS0Filter{
+		id:                 id,
+		EDNS0FilterOptions: opt,
+		resolver:           resolver,
+		deny:               make(map[uint16]bool),
+	}
+	if len(opt.Allow) > 0 {
+		r.allow = make(map[uint16]bool)
+		for _, code := range opt.Allow {
+			r.allow[code] = true
+		}
+	}
+	for _, code := range opt.Deny {
+		r.deny[code] = true
+	}
+	return r
+}
+
+// Resolve a DNS query after filtering its EDNS0 options, then filter the
+// options in the response.
+func (r *EDNS0Filter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	// Filter copies of the messages, the query belongs to the caller and the
+	// response could be shared with a cache
+	if r.needsFilter(q) {
+		q = q.Copy()
+		r.filter(q)
+		log.Debug("removed edns0 options from query")
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	if r.needsFilter(a) {
+		a = a.Copy()
+		r.filter(a)
+		log.Debug("removed edns0 options from response")
+	}
+	return a, nil
+}
+
+func (r *EDNS0Filter) String() string {
+	return r.id
+}
+
+// Returns true if the message has options that aren't allowed.
+func (r *EDNS0Filter) needsFilter(m *dns.Msg) bool {
+	edns0 := m.IsEdns0()
+	if edns0 == nil {
+		return false
+	}
+	for _, opt := range edns0.Option {
+		if r.denied(opt.Option()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *EDNS0Filter) denied(code uint16) bool {
+	return (r.allow != nil && !r.allow[code]) || r.deny[code]
+}
+
+// Removes options that aren't allowed from the OPT record of a message. If
+// options were removed and the OPT record is left without anything that
+// differs from plain DNS (no options, flags, extended rcode or larger UDP
+// size), it is removed as well.
+func (r *EDNS0Filter) filter(m *dns.Msg) {
+	edns0 := m.IsEdns0()
+	if edns0 == nil {
+		return
+	}
+	var removed bool
+	newOpt := make([]dns.EDNS0, 0, len(edns0.Option))
+	for _, opt := range edns0.Option {
+		if r.denied(opt.Option()) {
+			removed = true
+			continue
+		}
+		newOpt = append(newOpt, opt)
+	}
+	if !removed {
+		return
+	}
+	edns0.Option = newOpt
+	edns0.Hdr.Rdlength = 0 // Recalculated when packed
+	if len(newOpt) == 0 && !edns0.Do() && edns0.ExtendedRcode() == 0 && edns0.Version() == 0 && edns0.UDPSize() <= dns.MinMsgSize {
+		stripEDNS0(m)
+	}
+}
@@ -0,0 +1,81 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns the option codes in the OPT record of a message, nil if there's no OPT.
+func edns0Codes(m *dns.Msg) []uint16 {
+	edns0 := m.IsEdns0()
+	if edns0 == nil {
+		return nil
+	}
+	codes := []uint16{}
+	for _, opt := range edns0.Option {
+		codes = append(codes, opt.Option())
+	}
+	return codes
+}
+
+func TestEDNS0Filter(t *testing.T) {
+	var upstreamCodes []uint16
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			upstreamCodes = edns0Codes(q)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.SetEdns0(1232, false)
+			a.IsEdns0().Option = []dns.EDNS0{
+				&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+				&dns.EDNS0_PADDING{Padding: make([]byte, 8)},
+				&dns.EDNS0_LOCAL{Code: 65001},
+			}
+			return a, nil
+		},
+	}
+	newQuery := func() *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.SetEdns0(1232, false)
+		q.IsEdns0().Option = []dns.EDNS0{
+			&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+			&dns.EDNS0_PADDING{Padding: make([]byte, 8)},
+		}
+		return q
+	}
+
+	// Deny list, cookies are removed in both directions
+	f := NewEDNS0Filter("test-filter", r, EDNS0FilterOptions{Deny: []uint16{dns.EDNS0COOKIE}})
+	a, err := f.Resolve(newQuery(), ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, []uint16{dns.EDNS0PADDING}, upstreamCodes)
+	require.Equal(t, []uint16{dns.EDNS0PADDING, 65001}, edns0Codes(a))
+
+	// Allow list, only padding is passed on
+	f = NewEDNS0Filter("test-filter", r, EDNS0FilterOptions{Allow: []uint16{dns.EDNS0PADDING}})
+	a, err = f.Resolve(newQuery(), ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, []uint16{dns.EDNS0PADDING}, upstreamCodes)
+	require.Equal(t, []uint16{dns.EDNS0PADDING}, edns0Codes(a))
+
+	// All options removed, the OPT record is kept since it advertises a larger UDP size
+	f = NewEDNS0Filter("test-filter", r, EDNS0FilterOptions{Deny: []uint16{dns.EDNS0COOKIE, dns.EDNS0PADDING, 65001}})
+	a, err = f.Resolve(newQuery(), ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, []uint16{}, upstreamCodes)
+	require.Equal(t, []uint16{}, edns0Codes(a))
+	require.Equal(t, uint16(1232), a.IsEdns0().UDPSize())
+
+	// All options removed from an OPT record that isn't otherwise used, it is dropped
+	q := newQuery()
+	q.IsEdns0().SetUDPSize(dns.MinMsgSize)
+	_, err = f.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Nil(t, upstreamCodes)
+
+	// The query of the caller isn't modified
+	require.Equal(t, []uint16{dns.EDNS0COOKIE, dns.EDNS0PADDING}, edns0Codes(q))
+}
@@ -0,0 +1,138 @@
+package rdns
+
+import (
+	"errors"
+	"math"
+
+	"github.com/miekg/dns"
+)
+
+// EntropyFilter is a resolver that blocks queries for names that look
+// machine-generated, like those used by malware with domain generation
+// algorithms (DGA) or for tunneling data over DNS. Every label of the name,
+// except the top-level domain, is scored by the Shannon entropy of its
+// characters and its length. Names with a label that exceeds the thresholds
+// are blocked with NXDOMAIN or forwarded to a sinkhole resolver. Legitimate
+// names with random-looking labels, often used by CDNs, can be allowed with
+// a list.
+type EntropyFilter struct {
+	id string
+	EntropyFilterOptions
+	resolver Resolver
+	metrics  *BlocklistMetrics
+}
+
+var _ Resolver = &EntropyFilter{}
+
+type EntropyFilterOptions struct {
+	// Entropy in bits per character above which a label is suspicious.
+	// Default 3.3.
+	MaxEntropy float64
+
+	// Labels shorter than this aren't scored by their entropy. The entropy
+	// of a label can't exceed log2 of its length, so this needs to be large
+	// enough for labels to reach MaxEntropy. Default 16.
+	MinLabelLength int
+
+	// Labels longer than this are suspicious regardless of their entropy.
+	// Not limited if 0.
+	MaxLabelLength int
+
+	// Names that are never blocked. Optional.
+	AllowlistDB BlocklistDB
+
+	// Resolver for blocked queries. Responds with NXDOMAIN if nil.
+	BlocklistResolver Resolver
+}
+
+// NewEntropyFilter returns a new instance of a filter for high-entropy names.
+func NewEntropyFilter(id string, resolver Resolver, opt EntropyFilterOptions) (*EntropyFilter, error) {
+	if opt.MaxEntropy < 0 || opt.MinLabelLength < 0 || opt.MaxLabelLength < 0 {
+		return nil, errors.New("negative entropy filter threshold")
+	}
+	if opt.MaxEntropy == 0 {
+		opt.MaxEntropy = 3.3
+	}
+	if opt.MinLabelLength == 0 {
+		opt.MinLabelLength = 16
+	}
+	return &EntropyFilter{
+		id:                   id,
+		EntropyFilterOptions: opt,
+		resolver:             resolver,
+		metrics:              NewBlocklistMetrics(id),
+	}, nil
+}
+
+// Resolve a DNS query and block it if the name has a suspicious label, unless
+// it's on the allowlist.
+func (r *EntropyFilter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	question.Name = normalizeName(question.Name)
+	label, entropy, ok := r.suspiciousLabel(question.Name)
+	if !ok {
+		r.metrics.allowed.Add(1)
+		return r.resolver.Resolve(q, ci)
+	}
+	log := logger(r.id, q, ci).WithField("label", label).WithField("entropy", entropy)
+	if r.AllowlistDB != nil {
+		if _, _, match, ok := r.AllowlistDB.Match(question); ok {
+			log.WithField("list", match.List).WithField("rule", match.Rule).Debug("suspicious name on allowlist")
+			r.metrics.allowed.Add(1)
+			return r.resolver.Resolve(q, ci)
+		}
+	}
+	r.metrics.blocked.Add(1)
+	if r.BlocklistResolver != nil {
+		log.WithField("resolver", r.BlocklistResolver.String()).Debug("suspicious name, forwarding")
+		return r.BlocklistResolver.Resolve(q, ci)
+	}
+	log.Debug("suspicious name, blocking")
+	return nxdomain(q), nil
+}
+
+func (r *EntropyFilter) String() string {
+	return r.id
+}
+
+// Returns the first label of the name, not counting the top-level domain,
+// that is longer than the limit or has more entropy than the threshold.
+func (r *EntropyFilter) suspiciousLabel(name string) (string, float64, bool) {
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 2 {
+		return "", 0, false
+	}
+	for _, label := range labels[:len(labels)-1] {
+		if r.MaxLabelLength > 0 && len(label) > r.MaxLabelLength {
+			return label, labelEntropy(label), true
+		}
+		if len(label) < r.MinLabelLength {
+			continue
+		}
+		if entropy := labelEntropy(label); entropy > r.MaxEntropy {
+			return label, entropy, true
+		}
+	}
+	return "", 0, false
+}
+
+// Returns the Shannon entropy of the characters of a label in bits per
+// character.
+func labelEntropy(label string) float64 {
+	var counts [256]int
+	for i := 0; i < len(label); i++ {
+		counts[label[i]]++
+	}
+	var entropy float64
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(len(label))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
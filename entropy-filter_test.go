@@ -0,0 +1,81 @@
+package rdns
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntropyFilter(t *testing.T) {
+	upstream := new(TestResolver)
+	allowlist, err := NewDomainDB("test-allowlist", NewStaticLoader([]string{".cloudfront.net"}))
+	require.NoError(t, err)
+	r, err := NewEntropyFilter("test-entropy", upstream, EntropyFilterOptions{
+		AllowlistDB: allowlist,
+	})
+	require.NoError(t, err)
+
+	// Normal names are forwarded
+	q := new(dns.Msg)
+	q.SetQuestion("www.stackoverflow.com.", dns.TypeA)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Random subdomains are blocked
+	q.SetQuestion("xjw3k9qz7r2mvb8t1hly.example.com.", dns.TypeA)
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Unless they're on the allowlist
+	q.SetQuestion("xjw3k9qz7r2mvb8t1hly.cloudfront.net.", dns.TypeA)
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, 2, upstream.HitCount())
+
+	// Long labels are blocked regardless of entropy, blocked queries can be
+	// sent to a sinkhole
+	sinkhole := new(TestResolver)
+	r, err = NewEntropyFilter("test-entropy", upstream, EntropyFilterOptions{
+		MaxLabelLength:    20,
+		BlocklistResolver: sinkhole,
+	})
+	require.NoError(t, err)
+	q.SetQuestion("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaa.example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, sinkhole.HitCount())
+	require.Equal(t, 2, upstream.HitCount())
+}
+
+func TestEntropyFilterDefaults(t *testing.T) {
+	r, err := NewEntropyFilter("test-entropy", new(TestResolver), EntropyFilterOptions{})
+	require.NoError(t, err)
+
+	// Random labels of the minimum length should mostly be blocked
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	rnd := rand.New(rand.NewSource(1))
+	var blocked int
+	for i := 0; i < 100; i++ {
+		label := make([]byte, 16)
+		for j := range label {
+			label[j] = chars[rnd.Intn(len(chars))]
+		}
+		if _, _, ok := r.suspiciousLabel(string(label) + ".example.com."); ok {
+			blocked++
+		}
+	}
+	require.GreaterOrEqual(t, blocked, 90)
+
+	// Long, but common names aren't
+	for _, name := range []string{"googleusercontent.com.", "connectivitycheck.gstatic.com.", "s3-website-us-east-1.amazonaws.com."} {
+		_, _, ok := r.suspiciousLabel(name)
+		require.False(t, ok, name)
+	}
+}
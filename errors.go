@@ -1,16 +1,113 @@
 package rdns
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 
 	"github.com/miekg/dns"
 )
 
+// Kinds of failures of upstream resolvers. Errors returned by resolvers can be
+// tested for these with errors.Is() to decide how to react to a failure.
+var (
+	// The query didn't get a response in time.
+	ErrTimeout = errors.New("timeout")
+
+	// The connection to the upstream resolver was established, but the
+	// handshake that follows failed, for example due to certificate
+	// validation.
+	ErrHandshake = errors.New("handshake failed")
+
+	// Any other failure in the connection or the protocol, like a connection
+	// that can't be opened or is closed by the upstream resolver, or an
+	// invalid response.
+	ErrUpstream = errors.New("upstream failure")
+)
+
+// ResolverError is implemented by errors of upstream resolvers that have been
+// classified. Kind returns one of ErrTimeout, ErrHandshake or ErrUpstream.
+type ResolverError interface {
+	error
+	Kind() error
+}
+
 // QueryTimeoutError is returned when a query times out.
 type QueryTimeoutError struct {
 	query *dns.Msg
 }
 
+var _ ResolverError = QueryTimeoutError{}
+
 func (e QueryTimeoutError) Error() string {
 	return fmt.Sprintf("query for '%s' timed out", qName(e.query))
 }
+
+func (e QueryTimeoutError) Kind() error {
+	return ErrTimeout
+}
+
+func (e QueryTimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// classifiedError wraps an error of an upstream resolver with its kind.
+type classifiedError struct {
+	kind error
+	err  error
+}
+
+var _ ResolverError = classifiedError{}
+
+func (e classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e classifiedError) Kind() error {
+	return e.kind
+}
+
+func (e classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e classifiedError) Is(target error) bool {
+	return target == e.kind
+}
+
+// Classifies an error returned when resolving a query upstream, so it can be
+// tested with errors.Is() for ErrTimeout, ErrHandshake or ErrUpstream. Errors
+// that are classified already are returned as they are, as are errors that
+// aren't failures of the upstream resolver, like a canceled query.
+func classifyError(err error) error {
+	var rerr ResolverError
+	switch {
+	case err == nil, errors.As(err, &rerr):
+		return err
+	case errors.Is(err, context.Canceled), errors.Is(err, ErrDraining):
+		return err
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return classifiedError{kind: ErrTimeout, err: err}
+	}
+	return classifiedError{kind: ErrUpstream, err: err}
+}
+
+// ErrDraining is returned for queries sent to a resolver that is being drained
+// and no longer accepts new queries.
+var ErrDraining = errors.New("resolver is draining")
+
+// ErrCookieMismatch is returned when the client cookie in a response doesn't
+// match the one sent in the query, which indicates a spoofed response.
+var ErrCookieMismatch = errors.New("client cookie mismatch in response")
+
+// ErrCaseMismatch is returned when the name in a response doesn't have the same
+// case as the randomized one in the query, which indicates a spoofed response
+// or a server that doesn't preserve the case of names.
+var ErrCaseMismatch = errors.New("case of name in response doesn't match query")
+
+// ErrUnhealthy is returned for queries sent to a resolver that failed its
+// health checks, or too many queries, and is considered down.
+var ErrUnhealthy = errors.New("resolver is unhealthy")
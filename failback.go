@@ -35,6 +35,11 @@ type FailBackOptions struct {
 	// Determines if a SERVFAIL returned by a resolver should be considered an
 	// error response and trigger a failover.
 	ServfailError bool
+
+	// Time a resolver in the group is given to respond before the query is
+	// abandoned and sent to the next one, regardless of the resolver's own
+	// timeout. No limit if 0.
+	PerAttemptTimeout time.Duration
 }
 
 var _ Resolver = &FailBack{}
@@ -81,9 +86,15 @@ func (r *FailBack) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	)
 	for i := 0; i < len(r.resolvers); i++ {
 		resolver, active := r.current()
+		if !isHealthy(resolver) { // Skip resolvers that are known to be down
+			log.WithField("resolver", resolver.String()).Debug("skipping unhealthy resolver")
+			a, err = nil, ErrUnhealthy
+			r.errorFrom(active)
+			continue
+		}
 		log.WithField("resolver", resolver.String()).Debug("forwarding query to resolver")
 		r.metrics.route.Add(resolver.String(), 1)
-		a, err = resolver.Resolve(q, ci)
+		a, err = resolveWithTimeout(resolver, q, ci, r.opt.PerAttemptTimeout)
 		if err == nil && r.isSuccessResponse(a) { // Return immediately if successful
 			return a, err
 		}
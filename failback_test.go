@@ -130,3 +130,24 @@ func TestFailBackServfailOKOption(t *testing.T) {
 	require.NotEqual(t, dns.RcodeServerFailure, a.Rcode)
 	require.Equal(t, 1, goodResolver.hitCount)
 }
+
+func TestFailBackPerAttemptTimeout(t *testing.T) {
+	var ci ClientInfo
+	r1 := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			time.Sleep(2 * time.Second)
+			return q, nil
+		},
+	}
+	r2 := new(TestResolver)
+
+	g := NewFailBack("test-failback", FailBackOptions{PerAttemptTimeout: 100 * time.Millisecond}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	start := time.Now()
+	_, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, 1, r2.HitCount())
+}
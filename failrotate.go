@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
@@ -11,14 +12,15 @@ import (
 // returns a failure in which case the request is retried on the next one for
 // up to N times (with N the number of resolvers in the group). If the last
 // resolver fails, the first one in the list becomes the active one. This
-// group does not fail back automatically.
+// group does not fail back automatically unless ResetAfter is set.
 type FailRotate struct {
-	id        string
-	resolvers []Resolver
-	mu        sync.RWMutex
-	active    int
-	metrics   *FailRouterMetrics
-	opt       FailRotateOptions
+	id         string
+	resolvers  []Resolver
+	mu         sync.RWMutex
+	active     int
+	failoverAt time.Time // time of the last failover
+	metrics    *FailRouterMetrics
+	opt        FailRotateOptions
 }
 
 // FailRotateOptions contain group-specific options.
@@ -26,6 +28,15 @@ type FailRotateOptions struct {
 	// Determines if a SERVFAIL returned by a resolver should be considered an
 	// error response and trigger a failover.
 	ServfailError bool
+
+	// Switch back to the first resolver in the group this long after the last
+	// failover. Disabled if 0.
+	ResetAfter time.Duration
+
+	// Time a resolver in the group is given to respond before the query is
+	// abandoned and sent to the next one, regardless of the resolver's own
+	// timeout. No limit if 0.
+	PerAttemptTimeout time.Duration
 }
 
 var _ Resolver = &FailRotate{}
@@ -50,9 +61,15 @@ func (r *FailRotate) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	)
 	for i := 0; i < len(r.resolvers); i++ {
 		resolver, active := r.current()
+		if !isHealthy(resolver) { // Skip resolvers that are known to be down
+			log.WithField("resolver", resolver.String()).Debug("skipping unhealthy resolver")
+			a, err = nil, ErrUnhealthy
+			r.errorFrom(active)
+			continue
+		}
 		log.WithField("resolver", resolver.String()).Trace("forwarding query to resolver")
 		r.metrics.route.Add(resolver.String(), 1)
-		a, err = resolver.Resolve(q, ci)
+		a, err = resolveWithTimeout(resolver, q, ci, r.opt.PerAttemptTimeout)
 		if err == nil && r.isSuccessResponse(a) { // Return immediately if successful
 			return a, err
 		}
@@ -71,7 +88,22 @@ func (r *FailRotate) String() string {
 // Thread-safe method to return the currently active resolver.
 func (r *FailRotate) current() (Resolver, int) {
 	r.mu.RLock()
-	defer r.mu.RUnlock()
+	if r.active == 0 || r.opt.ResetAfter == 0 || time.Since(r.failoverAt) < r.opt.ResetAfter {
+		defer r.mu.RUnlock()
+		return r.resolvers[r.active], r.active
+	}
+	r.mu.RUnlock()
+
+	// The reset time has passed since the last failover, go back to the first resolver
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active != 0 && time.Since(r.failoverAt) >= r.opt.ResetAfter {
+		r.active = 0
+		Log.WithFields(logrus.Fields{
+			"id":       r.id,
+			"resolver": r.resolvers[r.active].String(),
+		}).Debug("failing back to resolver")
+	}
 	return r.resolvers[r.active], r.active
 }
 
@@ -87,6 +119,7 @@ func (r *FailRotate) errorFrom(i int) {
 	}
 	r.metrics.failover.Add(1)
 	r.active = (r.active + 1) % len(r.resolvers)
+	r.failoverAt = time.Now()
 	Log.WithFields(logrus.Fields{
 		"id":       r.id,
 		"resolver": r.resolvers[r.active].String(),
@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -114,3 +115,91 @@ func TestFailRotateSERVFAILAll(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
 }
+
+func TestFailRotateResetAfter(t *testing.T) {
+	var ci ClientInfo
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+
+	g := NewFailRotate("test-rotate", FailRotateOptions{ResetAfter: time.Second}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// Fail the first resolver, the query should be retried on the second
+	r1.SetFail(true)
+	_, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+	r1.SetFail(false)
+
+	// The second should remain active
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 2, r2.HitCount())
+
+	// After the reset time, the first one should be used again
+	time.Sleep(1100 * time.Millisecond)
+	_, err = g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r1.HitCount())
+	require.Equal(t, 2, r2.HitCount())
+}
+
+func TestFailRotateNXDOMAIN(t *testing.T) {
+	var ci ClientInfo
+	r1 := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return nxdomain(q), nil
+		},
+	}
+	r2 := new(TestResolver)
+
+	// NXDOMAIN is a valid answer and should not cause a failover
+	g := NewFailRotate("test-rotate", FailRotateOptions{ServfailError: true}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	a, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 0, r2.HitCount())
+}
+
+func TestFailRotatePerAttemptTimeout(t *testing.T) {
+	var ci ClientInfo
+
+	// The first resolver takes much longer than the group allows, like a client
+	// with a long timeout
+	canceled := make(chan struct{})
+	r1 := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			select {
+			case <-ci.Context().Done():
+				close(canceled)
+			case <-time.After(5 * time.Second):
+			}
+			return nil, QueryTimeoutError{q}
+		},
+	}
+	r2 := new(TestResolver)
+
+	g := NewFailRotate("test-rotate", FailRotateOptions{PerAttemptTimeout: 100 * time.Millisecond}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	start := time.Now()
+	_, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+
+	// The abandoned query is canceled
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("query not canceled")
+	}
+}
@@ -1,6 +1,9 @@
 package rdns
 
 import (
+	"context"
+	"time"
+
 	"github.com/miekg/dns"
 )
 
@@ -9,16 +12,25 @@ import (
 type Fastest struct {
 	id        string
 	resolvers []Resolver
+	opt       FastestOptions
+}
+
+// FastestOptions contain group-specific options.
+type FastestOptions struct {
+	// Time to wait for a successful response from any of the resolvers. Responses
+	// still outstanding after this are abandoned. No limit if 0.
+	Timeout time.Duration
 }
 
-var _ Resolver = &FailRotate{}
+var _ Resolver = &Fastest{}
 
 // NewFastest returns a new instance of a resolver group that returns the fastest
 // response from all its resolvers.
-func NewFastest(id string, resolvers ...Resolver) *Fastest {
+func NewFastest(id string, opt FastestOptions, resolvers ...Resolver) *Fastest {
 	return &Fastest{
 		id:        id,
 		resolvers: resolvers,
+		opt:       opt,
 	}
 }
 
@@ -35,6 +47,11 @@ func (r *Fastest) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 	responseCh := make(chan response, len(r.resolvers))
 
+	// Cancel the outstanding requests once there's a response
+	ctx, cancel := context.WithCancel(ci.Context())
+	defer cancel()
+	ci = ci.WithContext(ctx)
+
 	// Send the query to all resolvers. The responses are collected in a buffered channel
 	for _, resolver := range r.resolvers {
 		resolver := resolver
@@ -44,10 +61,25 @@ func (r *Fastest) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		}()
 	}
 
+	// Abandon all outstanding requests if there's no successful response in time
+	var timeout <-chan time.Time
+	if r.opt.Timeout > 0 {
+		timer := time.NewTimer(r.opt.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
 	// Wait for responses, the first one that is successful is returned while the remaining open requests
-	// are abandoned.
+	// are abandoned. The channel is buffered so abandoned requests don't block.
 	var i int
-	for resolverResponse := range responseCh {
+	for {
+		var resolverResponse response
+		select {
+		case resolverResponse = <-responseCh:
+		case <-timeout:
+			log.Debug("no successful response before timeout")
+			return nil, QueryTimeoutError{q}
+		}
 		resolver, a, err := resolverResponse.r, resolverResponse.a, resolverResponse.err
 		if err == nil && (a == nil || a.Rcode != dns.RcodeServerFailure) { // Return immediately if successful
 			log.WithField("resolver", resolver.String()).Trace("using response from resolver")
@@ -60,7 +92,6 @@ func (r *Fastest) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 			return a, err
 		}
 	}
-	return nil, nil // should never be reached
 }
 
 func (r *Fastest) String() string {
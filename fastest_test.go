@@ -34,7 +34,7 @@ func TestFastest(t *testing.T) {
 	}
 	r2 := new(TestResolver) // fast resolver
 
-	g := NewFastest("fastest", r1, r2)
+	g := NewFastest("fastest", FastestOptions{}, r1, r2)
 	q := new(dns.Msg)
 	q.SetQuestion("test.com.", dns.TypeA)
 
@@ -80,7 +80,7 @@ func TestFastestFail(t *testing.T) {
 		},
 	}
 
-	g := NewFastest("fastest", r1, r2)
+	g := NewFastest("fastest", FastestOptions{}, r1, r2)
 	q := new(dns.Msg)
 	q.SetQuestion("test.com.", dns.TypeA)
 
@@ -112,7 +112,7 @@ func TestFastestFailAll(t *testing.T) {
 		},
 	}
 
-	g := NewFastest("fastest", r1, r2)
+	g := NewFastest("fastest", FastestOptions{}, r1, r2)
 	q := new(dns.Msg)
 	q.SetQuestion("test.com.", dns.TypeA)
 
@@ -124,3 +124,66 @@ func TestFastestFailAll(t *testing.T) {
 	require.Equal(t, 1, r2.HitCount())
 	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
 }
+
+func TestFastestTimeout(t *testing.T) {
+	var ci ClientInfo
+
+	// Two slow resolvers
+	slow := func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+		time.Sleep(time.Second)
+		return q, nil
+	}
+	r1 := &TestResolver{ResolveFunc: slow}
+	r2 := &TestResolver{ResolveFunc: slow}
+
+	g := NewFastest("fastest", FastestOptions{Timeout: 100 * time.Millisecond}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// Neither responds in time, the group should give up after the timeout
+	start := time.Now()
+	_, err := g.Resolve(q, ci)
+	require.ErrorAs(t, err, &QueryTimeoutError{})
+	require.WithinDuration(t, start.Add(100*time.Millisecond), time.Now(), 50*time.Millisecond)
+}
+
+func TestFastestAllFail(t *testing.T) {
+	var ci ClientInfo
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	r1.SetFail(true)
+	r2.SetFail(true)
+
+	// All resolvers fail, the last error is returned
+	g := NewFastest("fastest", FastestOptions{}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	_, err := g.Resolve(q, ci)
+	require.Error(t, err)
+}
+
+func TestFastestCancel(t *testing.T) {
+	// Slow resolver that waits for the query to be canceled
+	canceled := make(chan struct{})
+	r1 := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			<-ci.Context().Done()
+			close(canceled)
+			return nil, ci.Context().Err()
+		},
+	}
+	r2 := new(TestResolver) // fast resolver
+
+	g := NewFastest("fastest", FastestOptions{}, r1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// The query to the slow resolver should be canceled once the fast one responded
+	_, err := g.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("outstanding query was not canceled")
+	}
+}
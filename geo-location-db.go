@@ -0,0 +1,106 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoLocationDB looks up the location of IP addresses in a MaxMind database.
+// The database file can be reloaded while it's in use.
+type GeoLocationDB struct {
+	file    string
+	mu      sync.RWMutex
+	db      *maxminddb.Reader
+	modTime time.Time
+}
+
+// GeoLocation holds the ISO codes of the country and continent of an IP,
+// for example "DE" and "EU". Either is empty if unknown.
+type GeoLocation struct {
+	Country   string
+	Continent string
+}
+
+// NewGeoLocationDB opens a MaxMind database file. If refresh is not 0, the
+// file is checked for changes in that interval and reloaded.
+func NewGeoLocationDB(file string, refresh time.Duration) (*GeoLocationDB, error) {
+	if file == "" {
+		file = "/usr/share/GeoIP/GeoLite2-City.mmdb"
+	}
+	d := &GeoLocationDB{file: file}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+	if refresh > 0 {
+		go d.refreshLoop(refresh)
+	}
+	return d, nil
+}
+
+// Reload opens the database file again if it was modified since it was last
+// loaded. Lookups continue to use the old database until the new one is ready.
+func (d *GeoLocationDB) Reload() error {
+	fi, err := os.Stat(d.file)
+	if err != nil {
+		return fmt.Errorf("failed to open geo location database file: %w", err)
+	}
+	d.mu.RLock()
+	unchanged := d.db != nil && fi.ModTime().Equal(d.modTime)
+	d.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	db, err := maxminddb.Open(d.file)
+	if err != nil {
+		return fmt.Errorf("failed to open geo location database file: %w", err)
+	}
+	d.mu.Lock()
+	old := d.db
+	d.db = db
+	d.modTime = fi.ModTime()
+	d.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Lookup returns the location of an IP.
+func (d *GeoLocationDB) Lookup(ip net.IP) (GeoLocation, error) {
+	var record struct {
+		Continent struct {
+			Code string `maxminddb:"code"`
+		} `maxminddb:"continent"`
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if err := d.db.Lookup(ip, &record); err != nil {
+		return GeoLocation{}, err
+	}
+	return GeoLocation{Country: record.Country.ISOCode, Continent: record.Continent.Code}, nil
+}
+
+func (d *GeoLocationDB) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.db.Close()
+}
+
+func (d *GeoLocationDB) refreshLoop(refresh time.Duration) {
+	for {
+		time.Sleep(refresh)
+		log := Log.WithField("file", d.file)
+		log.Debug("checking geo location database for changes")
+		if err := d.Reload(); err != nil {
+			log.WithError(err).Error("failed to reload geo location database")
+		}
+	}
+}
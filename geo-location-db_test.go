@@ -0,0 +1,153 @@
+package rdns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Writes a minimal IPv4 MaxMind database that maps networks (CIDR) to a
+// country and continent code.
+func writeTestMMDB(t *testing.T, file string, locations map[string]GeoLocation) {
+	type node struct {
+		child [2]*node
+		leaf  [2]int // data offset + 1, 0 if there's no data
+	}
+	root := new(node)
+	var data bytes.Buffer
+
+	// Data format encoders
+	str := func(s string) { data.WriteByte(2<<5 | byte(len(s))); data.WriteString(s) }
+	mapHdr := func(n int) { data.WriteByte(7<<5 | byte(n)) }
+
+	for cidr, loc := range locations {
+		_, n, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		bits, _ := n.Mask.Size()
+		require.Greater(t, bits, 0)
+		offset := data.Len()
+		mapHdr(2)
+		str("country")
+		mapHdr(1)
+		str("iso_code")
+		str(loc.Country)
+		str("continent")
+		mapHdr(1)
+		str("code")
+		str(loc.Continent)
+
+		ip := binary.BigEndian.Uint32(n.IP.To4())
+		cur := root
+		for i := 0; i < bits; i++ {
+			bit := int(ip>>(31-i)) & 1
+			if i == bits-1 {
+				cur.leaf[bit] = offset + 1
+				break
+			}
+			if cur.child[bit] == nil {
+				cur.child[bit] = new(node)
+			}
+			cur = cur.child[bit]
+		}
+	}
+
+	// Number the nodes in breadth-first order
+	var nodes []*node
+	index := make(map[*node]int)
+	for queue := []*node{root}; len(queue) > 0; queue = queue[1:] {
+		index[queue[0]] = len(nodes)
+		nodes = append(nodes, queue[0])
+		for _, c := range queue[0].child {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+	count := len(nodes)
+
+	// Search tree with 24 bit records, followed by the data section separator
+	var out bytes.Buffer
+	for _, n := range nodes {
+		for i := 0; i < 2; i++ {
+			v := count // no data
+			if n.child[i] != nil {
+				v = index[n.child[i]]
+			} else if n.leaf[i] > 0 {
+				v = count + 16 + n.leaf[i] - 1
+			}
+			out.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+
+	// Metadata
+	data.Reset()
+	uintVal := func(typ byte, v uint64, size int) {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		if typ > 7 {
+			data.WriteByte(byte(size))
+			data.WriteByte(typ - 7)
+		} else {
+			data.WriteByte(typ<<5 | byte(size))
+		}
+		data.Write(b[8-size:])
+	}
+	mapHdr(5)
+	str("node_count")
+	uintVal(6, uint64(count), 4)
+	str("record_size")
+	uintVal(5, 24, 2)
+	str("ip_version")
+	uintVal(5, 4, 2)
+	str("binary_format_major_version")
+	uintVal(5, 2, 2)
+	str("database_type")
+	str("Test-Country")
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	out.Write(data.Bytes())
+
+	require.NoError(t, os.WriteFile(file, out.Bytes(), 0644))
+}
+
+func TestGeoLocationDB(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mmdb")
+	writeTestMMDB(t, file, map[string]GeoLocation{
+		"192.0.2.0/24":    {Country: "DE", Continent: "EU"},
+		"198.51.100.0/24": {Country: "US", Continent: "NA"},
+	})
+	db, err := NewGeoLocationDB(file, 0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	loc, err := db.Lookup(net.ParseIP("192.0.2.10"))
+	require.NoError(t, err)
+	require.Equal(t, GeoLocation{Country: "DE", Continent: "EU"}, loc)
+
+	loc, err = db.Lookup(net.ParseIP("198.51.100.1"))
+	require.NoError(t, err)
+	require.Equal(t, GeoLocation{Country: "US", Continent: "NA"}, loc)
+
+	// Unknown networks have no location
+	loc, err = db.Lookup(net.ParseIP("203.0.113.1"))
+	require.NoError(t, err)
+	require.Equal(t, GeoLocation{}, loc)
+
+	// Reloading picks up a modified file
+	writeTestMMDB(t, file, map[string]GeoLocation{
+		"192.0.2.0/24": {Country: "FR", Continent: "EU"},
+	})
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(file, future, future))
+	require.NoError(t, db.Reload())
+	loc, err = db.Lookup(net.ParseIP("192.0.2.10"))
+	require.NoError(t, err)
+	require.Equal(t, "FR", loc.Country)
+}
@@ -0,0 +1,161 @@
+package rdns
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// HealthCheck is a resolver that periodically sends a probe query to its
+// upstream resolver and tracks whether it's up or down. Queries sent to a
+// resolver that is down fail immediately with ErrUnhealthy rather than
+// waiting for the upstream to time out. Groups skip resolvers that are
+// known to be down.
+type HealthCheck struct {
+	id       string
+	resolver Resolver
+	opt      HealthCheckOptions
+	mu       sync.RWMutex
+	down     bool
+	count    int // consecutive probe results that differ from the current state
+	metrics  *HealthCheckMetrics
+}
+
+var _ Resolver = &HealthCheck{}
+var _ HealthReporter = &HealthCheck{}
+
+// HealthCheckOptions contain settings for the health checker.
+type HealthCheckOptions struct {
+	// Name and type of the probe query. Default ". SOA".
+	QueryName string
+	QueryType uint16
+
+	// Time between probes. Default 10 seconds.
+	Interval time.Duration
+
+	// Number of consecutive failed probes that mark the resolver down. Default 3.
+	FailThreshold int
+
+	// Number of consecutive successful probes that mark the resolver up again. Default 2.
+	SuccessThreshold int
+
+	// Determines if a SERVFAIL response to a probe should be considered a failure.
+	ServfailError bool
+}
+
+// HealthReporter is implemented by resolvers that know if they are currently
+// able to answer queries.
+type HealthReporter interface {
+	Healthy() bool
+}
+
+type HealthCheckMetrics struct {
+	// 1 if the resolver is up, 0 if it's down.
+	healthy *expvar.Int
+	// Probe results.
+	result *expvar.Map
+}
+
+// NewHealthCheck returns a new instance of a health checker for a resolver.
+// The resolver is considered up until the first probes fail.
+func NewHealthCheck(id string, resolver Resolver, opt HealthCheckOptions) *HealthCheck {
+	if opt.QueryName == "" {
+		opt.QueryName = "."
+	}
+	if opt.QueryType == 0 {
+		opt.QueryType = dns.TypeSOA
+	}
+	if opt.Interval <= 0 {
+		opt.Interval = 10 * time.Second
+	}
+	if opt.FailThreshold <= 0 {
+		opt.FailThreshold = 3
+	}
+	if opt.SuccessThreshold <= 0 {
+		opt.SuccessThreshold = 2
+	}
+	r := &HealthCheck{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		metrics: &HealthCheckMetrics{
+			healthy: getVarInt("healthcheck", id, "healthy"),
+			result:  getVarMap("healthcheck", id, "result"),
+		},
+	}
+	r.metrics.healthy.Set(1)
+	go r.probeLoop()
+	return r
+}
+
+// Resolve a DNS query with the upstream resolver unless it's down.
+func (r *HealthCheck) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if !r.Healthy() {
+		logger(r.id, q, ci).WithField("resolver", r.resolver.String()).Debug("resolver is down")
+		return nil, ErrUnhealthy
+	}
+	return r.resolver.Resolve(q, ci)
+}
+
+// Healthy returns false if the resolver failed enough probes to be considered down.
+func (r *HealthCheck) Healthy() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !r.down
+}
+
+func (r *HealthCheck) String() string {
+	return r.id
+}
+
+func (r *HealthCheck) probeLoop() {
+	for {
+		time.Sleep(r.opt.Interval)
+		r.probe()
+	}
+}
+
+// Send one probe query to the resolver and update the state with the result.
+func (r *HealthCheck) probe() {
+	q := new(dns.Msg)
+	q.SetQuestion(r.opt.QueryName, r.opt.QueryType)
+	a, err := r.resolver.Resolve(q, ClientInfo{})
+	failed := err != nil || a == nil || (r.opt.ServfailError && a.Rcode == dns.RcodeServerFailure)
+	log := Log.WithFields(logrus.Fields{"id": r.id, "resolver": r.resolver.String()})
+	if failed {
+		log.WithError(err).Debug("health probe failed")
+		r.metrics.result.Add("failure", 1)
+	} else {
+		r.metrics.result.Add("success", 1)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if failed != r.down {
+		r.count++
+	} else {
+		r.count = 0
+	}
+	switch {
+	case !r.down && r.count >= r.opt.FailThreshold:
+		log.Warn("marking resolver down")
+		r.down = true
+		r.count = 0
+		r.metrics.healthy.Set(0)
+	case r.down && r.count >= r.opt.SuccessThreshold:
+		log.Info("marking resolver up")
+		r.down = false
+		r.count = 0
+		r.metrics.healthy.Set(1)
+	}
+}
+
+// Returns false if the resolver reports that it's down. Resolvers that don't
+// track their health are always considered healthy.
+func isHealthy(r Resolver) bool {
+	h, ok := r.(HealthReporter)
+	return !ok || h.Healthy()
+}
@@ -0,0 +1,92 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheckThresholds(t *testing.T) {
+	var ci ClientInfo
+	var probes []string
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			probes = append(probes, q.Question[0].Name)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	// The probe loop is not expected to run during the test
+	r := NewHealthCheck("test-health", upstream, HealthCheckOptions{
+		Interval:         time.Hour,
+		FailThreshold:    3,
+		SuccessThreshold: 2,
+	})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Healthy to start with, a successful probe doesn't change that
+	require.True(t, r.Healthy())
+	r.probe()
+	require.True(t, r.Healthy())
+	require.Equal(t, []string{"."}, probes)
+
+	// Failures that don't reach the threshold don't mark the resolver down
+	upstream.SetFail(true)
+	r.probe()
+	r.probe()
+	upstream.SetFail(false)
+	r.probe()
+	upstream.SetFail(true)
+	r.probe()
+	r.probe()
+	require.True(t, r.Healthy())
+
+	// The 3rd consecutive failure does
+	r.probe()
+	require.False(t, r.Healthy())
+
+	// Queries fail without being sent upstream while it's down
+	hits := upstream.HitCount()
+	_, err := r.Resolve(q, ci)
+	require.ErrorIs(t, err, ErrUnhealthy)
+	require.Equal(t, hits, upstream.HitCount())
+
+	// A flapping resolver stays down until it succeeds enough times in a row
+	upstream.SetFail(false)
+	r.probe()
+	upstream.SetFail(true)
+	r.probe()
+	upstream.SetFail(false)
+	r.probe()
+	require.False(t, r.Healthy())
+	r.probe()
+	require.True(t, r.Healthy())
+
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+}
+
+func TestHealthCheckGroup(t *testing.T) {
+	var ci ClientInfo
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	h1 := NewHealthCheck("test-health-group", r1, HealthCheckOptions{Interval: time.Hour, FailThreshold: 1})
+	g := NewFailBack("test-failback", FailBackOptions{}, h1, r2)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Mark the first resolver down, queries should go to the second one without
+	// reaching the first
+	r1.SetFail(true)
+	h1.probe()
+	require.False(t, h1.Healthy())
+	hits := r1.HitCount()
+	_, err := g.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, hits, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+}
@@ -0,0 +1,179 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HostsResolver is a resolver that answers A and AAAA queries for the names in
+// a file in /etc/hosts format, as well as PTR queries for its addresses. All
+// other queries are forwarded to the upstream resolver. The file is watched
+// for changes and reloaded without restart.
+type HostsResolver struct {
+	id string
+	HostsResolverOptions
+	resolver Resolver
+	mu       sync.RWMutex
+	hosts    hostsEntries
+}
+
+var _ Resolver = &HostsResolver{}
+
+type HostsResolverOptions struct {
+	// File in /etc/hosts format.
+	Filename string
+
+	// Time between checks of the file for changes. Default 10 seconds.
+	WatchInterval time.Duration
+
+	// TTL of records in responses. Default 60.
+	TTL uint32
+}
+
+// Names and addresses loaded from a hosts file.
+type hostsEntries struct {
+	addrs map[string][]net.IP // by normalized name, without trailing dot
+	names map[string]string   // first name of every address, by reverse lookup name
+}
+
+// NewHostsResolver returns a new instance of a hosts-file resolver. Fails if
+// the file can't be loaded.
+func NewHostsResolver(id string, resolver Resolver, opt HostsResolverOptions) (*HostsResolver, error) {
+	if opt.WatchInterval == 0 {
+		opt.WatchInterval = 10 * time.Second
+	}
+	if opt.TTL == 0 {
+		opt.TTL = 60
+	}
+	hosts, err := loadHostsEntries(opt.Filename)
+	if err != nil {
+		return nil, err
+	}
+	r := &HostsResolver{
+		id:                   id,
+		HostsResolverOptions: opt,
+		resolver:             resolver,
+		hosts:                hosts,
+	}
+	go r.watchLoop(fileStates([]string{opt.Filename}))
+	return r, nil
+}
+
+// Resolve a DNS query with the addresses from the hosts file, or forward it
+// upstream if the name isn't in it.
+func (r *HostsResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	r.mu.RLock()
+	hosts := r.hosts
+	r.mu.RUnlock()
+
+	switch question.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		ips, ok := hosts.addrs[normalizeName(strings.TrimSuffix(question.Name, "."))]
+		if !ok {
+			break
+		}
+		logger(r.id, q, ci).Debug("answering from hosts file")
+		a := new(dns.Msg)
+		a.SetReply(q)
+		for _, ip := range ips {
+			hdr := dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: question.Qtype,
+				Class:  question.Qclass,
+				Ttl:    r.TTL,
+			}
+			ip4 := ip.To4()
+			switch {
+			case question.Qtype == dns.TypeA && ip4 != nil:
+				a.Answer = append(a.Answer, &dns.A{Hdr: hdr, A: ip4})
+			case question.Qtype == dns.TypeAAAA && ip4 == nil:
+				a.Answer = append(a.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		return a, nil
+	case dns.TypePTR:
+		name, ok := hosts.names[normalizeName(dns.Fqdn(question.Name))]
+		if !ok {
+			break
+		}
+		logger(r.id, q, ci).Debug("answering ptr query from hosts file")
+		a := ptr(q, name)
+		a.Answer[0].Header().Ttl = r.TTL
+		return a, nil
+	}
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *HostsResolver) String() string {
+	return r.id
+}
+
+// Checks the modification time and size of the file periodically and reloads
+// it if it changed. The existing entries are kept if it fails to load.
+func (r *HostsResolver) watchLoop(last string) {
+	log := Log.WithField("id", r.id).WithField("file", r.Filename)
+	for {
+		time.Sleep(r.WatchInterval)
+		current := fileStates([]string{r.Filename})
+		if current == last {
+			continue
+		}
+		last = current
+		log.Debug("hosts file changed, reloading")
+		hosts, err := loadHostsEntries(r.Filename)
+		if err != nil {
+			log.WithError(err).Error("failed to load hosts file, keeping existing entries")
+			continue
+		}
+		r.mu.Lock()
+		r.hosts = hosts
+		r.mu.Unlock()
+	}
+}
+
+// Reads a file in /etc/hosts format. Every line has an address followed by
+// one or more names, anything after a # is a comment.
+func loadHostsEntries(filename string) (hostsEntries, error) {
+	lines, err := NewFileLoader(filename).Load()
+	if err != nil {
+		return hostsEntries{}, err
+	}
+	hosts := hostsEntries{
+		addrs: make(map[string][]net.IP),
+		names: make(map[string]string),
+	}
+	for _, line := range lines {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = normalizeName(strings.TrimSuffix(name, "."))
+			hosts.addrs[name] = append(hosts.addrs[name], ip)
+		}
+		reverseAddr, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		if _, ok := hosts.names[reverseAddr]; !ok {
+			hosts.names[reverseAddr] = fields[1]
+		}
+	}
+	return hosts, nil
+}
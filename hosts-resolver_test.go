@@ -0,0 +1,83 @@
+package rdns
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostsResolver(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "hosts")
+	err := ioutil.WriteFile(filename, []byte(`
+# Local overrides
+192.168.1.50  myprinter.local printer  # with alias
+192.168.1.60  nas.local
+192.168.1.61  nas.local
+2001:db8::60  nas.local
+`), 0644)
+	require.NoError(t, err)
+
+	upstream := new(TestResolver)
+	r, err := NewHostsResolver("test-hosts", upstream, HostsResolverOptions{Filename: filename, WatchInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	// Answer records in zone-file format
+	records := func(a *dns.Msg) []string {
+		var out []string
+		for _, rr := range a.Answer {
+			out = append(out, rr.String())
+		}
+		return out
+	}
+	resolve := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		return a
+	}
+
+	// Name and alias from the file
+	a := resolve("myprinter.local.", dns.TypeA)
+	require.Equal(t, []string{rr("myprinter.local. 60 IN A 192.168.1.50").String()}, records(a))
+	a = resolve("Printer.", dns.TypeA)
+	require.Equal(t, []string{rr("Printer. 60 IN A 192.168.1.50").String()}, records(a))
+
+	// No IPv6 address for the name, NODATA
+	a = resolve("myprinter.local.", dns.TypeAAAA)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	// Multiple addresses
+	a = resolve("nas.local.", dns.TypeA)
+	require.Equal(t, []string{
+		rr("nas.local. 60 IN A 192.168.1.60").String(),
+		rr("nas.local. 60 IN A 192.168.1.61").String(),
+	}, records(a))
+	a = resolve("nas.local.", dns.TypeAAAA)
+	require.Equal(t, []string{rr("nas.local. 60 IN AAAA 2001:db8::60").String()}, records(a))
+
+	// Reverse lookup
+	a = resolve("50.1.168.192.in-addr.arpa.", dns.TypePTR)
+	require.Equal(t, []string{rr("50.1.168.192.in-addr.arpa. 60 IN PTR myprinter.local.").String()}, records(a))
+	require.Equal(t, 0, upstream.HitCount())
+
+	// Names and types not in the file are forwarded
+	resolve("example.com.", dns.TypeA)
+	resolve("nas.local.", dns.TypeMX)
+	require.Equal(t, 2, upstream.HitCount())
+
+	// Edits are picked up without restart
+	err = ioutil.WriteFile(filename, []byte("192.168.1.51 myprinter.local\n"), 0644)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		a := resolve("myprinter.local.", dns.TypeA)
+		return len(a.Answer) == 1 && a.Answer[0].(*dns.A).A.String() == "192.168.1.51"
+	}, time.Second, 10*time.Millisecond)
+	resolve("nas.local.", dns.TypeA)
+	require.Equal(t, 3, upstream.HitCount())
+}
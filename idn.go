@@ -0,0 +1,75 @@
+package rdns
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// Returns the form of a name used for matching and cache lookups: lowercase,
+// with internationalized labels converted to punycode (A-labels). Names can
+// contain Unicode characters as UTF-8 or as \DDD escapes like they appear in
+// queries. Labels that can't be converted are only lowercased.
+func normalizeName(name string) string {
+	if isASCII(name) && !strings.Contains(name, `\`) {
+		return strings.ToLower(name)
+	}
+	labels := strings.Split(unescapeNonASCII(name), ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			labels[i] = strings.ToLower(label)
+			continue
+		}
+		alabel, err := idna.Lookup.ToASCII(label)
+		if err != nil || !utf8.ValidString(label) {
+			labels[i] = strings.ToLower(escapeNonASCII(label))
+			continue
+		}
+		labels[i] = alabel
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// Replaces \DDD escapes of bytes outside the ASCII range with the raw bytes.
+// Other escapes are kept.
+func unescapeNonASCII(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			v := int(s[i+1]-'0')*100 + int(s[i+2]-'0')*10 + int(s[i+3]-'0')
+			if v >= 0x80 && v <= 0xff {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Reverse of unescapeNonASCII, used for labels that are kept as they are.
+func escapeNonASCII(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			b.WriteByte('\\')
+			b.WriteByte('0' + s[i]/100)
+			b.WriteByte('0' + s[i]/10%10)
+			b.WriteByte('0' + s[i]%10)
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
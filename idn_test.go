@@ -0,0 +1,71 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"example.com.", "example.com."},
+		{"Example.COM.", "example.com."},
+		{"example.com", "example.com"},
+		{".", "."},
+		{"bücher.example.", "xn--bcher-kva.example."},
+		{"BÜCHER.example.", "xn--bcher-kva.example."},
+		{`b\195\188cher.example.`, "xn--bcher-kva.example."}, // as it appears in a query
+		{"xn--bcher-kva.example.", "xn--bcher-kva.example."},
+		{"XN--BCHER-KVA.example.", "xn--bcher-kva.example."},
+		{`a\.b.example.`, `a\.b.example.`},
+		{"_sip._tcp.bücher.example.", "_sip._tcp.xn--bcher-kva.example."},
+		{`\255.example.`, `\255.example.`}, // not valid UTF-8
+	}
+	for _, test := range tests {
+		require.Equal(t, test.expected, normalizeName(test.name), test.name)
+	}
+}
+
+func TestNormalizeNameCacheKey(t *testing.T) {
+	// Unicode names in a query arrive with the UTF-8 bytes escaped
+	q := new(dns.Msg)
+	q.SetQuestion("bücher.example.", dns.TypeA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+	unicode := new(dns.Msg)
+	require.NoError(t, unicode.Unpack(b))
+	require.Equal(t, `b\195\188cher.example.`, unicode.Question[0].Name)
+
+	punycode := new(dns.Msg)
+	punycode.SetQuestion("XN--BCHER-KVA.example.", dns.TypeA)
+
+	require.Equal(t, lruKeyFromQuery(punycode), lruKeyFromQuery(unicode))
+}
+
+func TestNormalizeNameBlocklist(t *testing.T) {
+	var ci ClientInfo
+	db, err := NewDomainDB("test", NewStaticLoader([]string{".xn--bcher-kva.example", "münchen.example"}))
+	require.NoError(t, err)
+	b, err := NewBlocklist("test-bl", new(TestResolver), BlocklistOptions{BlocklistDB: db})
+	require.NoError(t, err)
+
+	for _, name := range []string{
+		"www.bücher.example.",
+		`www.b\195\188cher.example.`,
+		"www.xn--bcher-kva.example.",
+		"WWW.XN--BCHER-KVA.EXAMPLE.",
+		"xn--mnchen-3ya.example.",
+		"MÜNCHEN.example.",
+	} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		a, err := b.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeNameError, a.Rcode, name)
+		require.Equal(t, name, a.Question[0].Name)
+	}
+}
@@ -1,9 +1,12 @@
 package rdns
 
 import (
+	"context"
 	"expvar"
 	"fmt"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 // Listener is an interface for a DNS listener.
@@ -16,6 +19,77 @@ type Listener interface {
 // can be used to route requests.
 type ClientInfo struct {
 	SourceIP net.IP
+
+	// Protocol the query was received over, unknown if not set by the listener
+	Protocol Protocol
+
+	// Identifier of the query, unique for the life of the process. Assigned by
+	// the listener and included in log messages to correlate them. 0 if not set.
+	RequestID uint64
+
+	// Context of the query, canceled when the client stops waiting for the response
+	ctx context.Context
+}
+
+// Context returns the context of the query. Upstream resolvers abandon the
+// query when it is canceled. Never nil.
+func (ci ClientInfo) Context() context.Context {
+	if ci.ctx == nil {
+		return context.Background()
+	}
+	return ci.ctx
+}
+
+// WithContext returns a copy of the client information with ctx as context
+// of the query.
+func (ci ClientInfo) WithContext(ctx context.Context) ClientInfo {
+	ci.ctx = ctx
+	return ci
+}
+
+// WithoutCancel returns a copy of the client information with a context that
+// carries the values of the query context, like the trace span, but is never
+// canceled. Used for queries that continue after the client is gone.
+func (ci ClientInfo) WithoutCancel() ClientInfo {
+	ci.ctx = valueOnlyContext{ci.Context()}
+	return ci
+}
+
+// Context that passes on the values of its parent, but not its deadline or
+// cancellation.
+type valueOnlyContext struct{ context.Context }
+
+func (valueOnlyContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (valueOnlyContext) Done() <-chan struct{}       { return nil }
+func (valueOnlyContext) Err() error                  { return nil }
+
+// Last request ID handed out by newRequestID.
+var lastRequestID uint64
+
+// Returns a new request ID for an incoming query.
+func newRequestID() uint64 {
+	return atomic.AddUint64(&lastRequestID, 1)
+}
+
+// Protocol a listener receives queries over.
+type Protocol string
+
+// Protocols of the listeners. The zero value means the protocol is unknown.
+const (
+	ProtocolUnknown Protocol = ""
+	ProtocolUDP     Protocol = "udp"
+	ProtocolTCP     Protocol = "tcp"
+	ProtocolDoT     Protocol = "dot"
+	ProtocolDoH     Protocol = "doh"
+	ProtocolDoQ     Protocol = "doq"
+	ProtocolDTLS    Protocol = "dtls"
+)
+
+func (p Protocol) String() string {
+	if p == ProtocolUnknown {
+		return "unknown"
+	}
+	return string(p)
 }
 
 // Metrics that are available from listeners and clients.
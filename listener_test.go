@@ -0,0 +1,121 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerProtocol(t *testing.T) {
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	tlsClientConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	dtlsServerConfig, err := DTLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	dtlsClientConfig, err := DTLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+
+	tests := map[Protocol]struct {
+		udp      bool // listen on a UDP port
+		listener func(addr string, r Resolver) (start func() error, stop func() error)
+		client   func(addr string) (Resolver, error)
+	}{
+		ProtocolUDP: {
+			udp: true,
+			listener: func(addr string, r Resolver) (func() error, func() error) {
+				s := NewDNSListener("test-protocol-udp", addr, "udp", ListenOptions{}, r)
+				return s.Start, s.Shutdown
+			},
+			client: func(addr string) (Resolver, error) {
+				return NewDNSClient("test-protocol-udp", addr, "udp", DNSClientOptions{})
+			},
+		},
+		ProtocolTCP: {
+			listener: func(addr string, r Resolver) (func() error, func() error) {
+				s := NewDNSListener("test-protocol-tcp", addr, "tcp", ListenOptions{}, r)
+				return s.Start, s.Shutdown
+			},
+			client: func(addr string) (Resolver, error) {
+				return NewDNSClient("test-protocol-tcp", addr, "tcp", DNSClientOptions{})
+			},
+		},
+		ProtocolDoT: {
+			listener: func(addr string, r Resolver) (func() error, func() error) {
+				s := NewDoTListener("test-protocol-dot", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, r)
+				return s.Start, s.Stop
+			},
+			client: func(addr string) (Resolver, error) {
+				return NewDoTClient("test-protocol-dot", addr, DoTClientOptions{TLSConfig: tlsClientConfig})
+			},
+		},
+		ProtocolDoH: {
+			listener: func(addr string, r Resolver) (func() error, func() error) {
+				s, err := NewDoHListener("test-protocol-doh", addr, DoHListenerOptions{TLSConfig: tlsServerConfig}, r)
+				require.NoError(t, err)
+				return s.Start, s.Stop
+			},
+			client: func(addr string) (Resolver, error) {
+				return NewDoHClient("test-protocol-doh", "https://"+addr+"/dns-query", DoHClientOptions{TLSConfig: tlsClientConfig})
+			},
+		},
+		ProtocolDoQ: {
+			udp: true,
+			listener: func(addr string, r Resolver) (func() error, func() error) {
+				s := NewQUICListener("test-protocol-doq", addr, DoQListenerOptions{TLSConfig: tlsServerConfig}, r)
+				return s.Start, s.Stop
+			},
+			client: func(addr string) (Resolver, error) {
+				return NewDoQClient("test-protocol-doq", addr, DoQClientOptions{TLSConfig: tlsClientConfig})
+			},
+		},
+		ProtocolDTLS: {
+			udp: true,
+			listener: func(addr string, r Resolver) (func() error, func() error) {
+				s := NewDTLSListener("test-protocol-dtls", addr, DTLSListenerOptions{DTLSConfig: dtlsServerConfig}, r)
+				return s.Start, s.Stop
+			},
+			client: func(addr string) (Resolver, error) {
+				return NewDTLSClient("test-protocol-dtls", addr, DTLSClientOptions{DTLSConfig: dtlsClientConfig})
+			},
+		},
+	}
+	for protocol, test := range tests {
+		test := test
+		t.Run(protocol.String(), func(t *testing.T) {
+			// Protocol seen by the handler, which runs in the goroutine of the listener
+			seen := make(chan Protocol, 1)
+			upstream := &TestResolver{
+				ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+					select {
+					case seen <- ci.Protocol:
+					default:
+					}
+					a := new(dns.Msg)
+					a.SetReply(q)
+					return a, nil
+				},
+			}
+
+			addr, err := getLnAddress()
+			if test.udp {
+				addr, err = getUDPLnAddress()
+			}
+			require.NoError(t, err)
+			start, stop := test.listener(addr, upstream)
+			go start()
+			defer stop()
+			time.Sleep(time.Second)
+
+			c, err := test.client(addr)
+			require.NoError(t, err)
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			_, err = c.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+			require.Equal(t, protocol, <-seen)
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package rdns
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// LoadBalancer is a resolver group that distributes queries over its resolvers
+// in proportion to their weights. Resolvers with a high ratio of failures among
+// their recent responses are taken out of rotation for a cooldown period. Failed
+// queries are retried on the remaining resolvers.
+type LoadBalancer struct {
+	id        string
+	resolvers []Resolver
+	weights   []int
+	health    []*lbHealth
+	mu        sync.Mutex
+	rand      *rand.Rand
+	opt       LoadBalancerOptions
+	metrics   *FailRouterMetrics
+}
+
+var _ Resolver = &LoadBalancer{}
+
+// LoadBalancerOptions contain settings for the load balancer group.
+type LoadBalancerOptions struct {
+	// Weights of the resolvers, in the same order as the resolvers. Resolvers
+	// without weight default to 1.
+	Weights []int
+
+	// Number of recent responses of a resolver used to calculate its failure ratio.
+	// Default 10.
+	Window int
+
+	// Ratio of failures among recent responses (0.0 - 1.0) that marks a resolver as
+	// unhealthy. Default 0.5.
+	FailureRatio float64
+
+	// Time an unhealthy resolver is taken out of rotation. Default 1 minute.
+	Cooldown time.Duration
+
+	// Determines if a SERVFAIL returned by a resolver should be considered a failure.
+	ServfailError bool
+
+	// Seed for the random number generator. Uses the current time if 0.
+	Seed int64
+
+	// Time a resolver in the group is given to respond before the query is
+	// abandoned and sent to the next one, regardless of the resolver's own
+	// timeout. No limit if 0.
+	PerAttemptTimeout time.Duration
+}
+
+// Recent results of one resolver in the group.
+type lbHealth struct {
+	results       []bool // ring buffer of recent results, true for failures
+	next          int
+	count         int
+	failures      int
+	disabledUntil time.Time
+}
+
+// NewLoadBalancer returns a new instance of a weighted load balancer group.
+func NewLoadBalancer(id string, opt LoadBalancerOptions, resolvers ...Resolver) (*LoadBalancer, error) {
+	if len(opt.Weights) > len(resolvers) {
+		return nil, errors.New("more weights than resolvers in load balancer")
+	}
+	weights := make([]int, len(resolvers))
+	for i := range weights {
+		weights[i] = 1
+		if i < len(opt.Weights) {
+			if opt.Weights[i] < 0 {
+				return nil, errors.New("negative weight in load balancer")
+			}
+			weights[i] = opt.Weights[i]
+		}
+	}
+	if opt.Window <= 0 {
+		opt.Window = 10
+	}
+	if opt.FailureRatio <= 0 {
+		opt.FailureRatio = 0.5
+	}
+	if opt.Cooldown == 0 {
+		opt.Cooldown = time.Minute
+	}
+	if opt.Seed == 0 {
+		opt.Seed = time.Now().UnixNano()
+	}
+	health := make([]*lbHealth, len(resolvers))
+	for i := range health {
+		health[i] = &lbHealth{results: make([]bool, opt.Window)}
+	}
+	return &LoadBalancer{
+		id:        id,
+		resolvers: resolvers,
+		weights:   weights,
+		health:    health,
+		rand:      rand.New(rand.NewSource(opt.Seed)),
+		opt:       opt,
+		metrics:   NewFailRouterMetrics(id, len(resolvers)),
+	}, nil
+}
+
+// Resolve a DNS query using a resolver picked by weight.
+func (r *LoadBalancer) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	tried := make([]bool, len(r.resolvers))
+	var (
+		a   *dns.Msg
+		err error
+	)
+	for attempt := 0; ; attempt++ {
+		i := r.pick(tried)
+		if i < 0 && attempt == 0 {
+			log.Warn("all resolvers in the group are down")
+			return nil, ErrUnhealthy
+		}
+		if i < 0 { // All available resolvers failed, return the last failure
+			log.Debug("no active resolvers left")
+			return a, err
+		}
+		tried[i] = true
+		resolver := r.resolvers[i]
+
+		r.metrics.route.Add(resolver.String(), 1)
+		log.WithField("resolver", resolver.String()).Debug("forwarding query to resolver")
+		a, err = resolveWithTimeout(resolver, q, ci, r.opt.PerAttemptTimeout)
+		if err == nil && r.isSuccessResponse(a) { // Return immediately if successful
+			r.record(i, false)
+			return a, err
+		}
+		log.WithField("resolver", resolver.String()).WithError(err).Debug("resolver returned failure")
+		r.metrics.failure.Add(resolver.String(), 1)
+		r.metrics.failover.Add(1)
+		r.record(i, true)
+	}
+}
+
+func (r *LoadBalancer) String() string {
+	return r.id
+}
+
+// Pick a healthy resolver that hasn't been tried yet, taking into account the
+// weights of the resolvers. Returns -1 if there are none left.
+func (r *LoadBalancer) pick(tried []bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	var total, available int
+	usable := make([]bool, len(r.resolvers))
+	for i, h := range r.health {
+		if now.Before(h.disabledUntil) || !isHealthy(r.resolvers[i]) {
+			continue
+		}
+		usable[i] = true
+		available++
+		if !tried[i] {
+			total += r.weights[i]
+		}
+	}
+	r.metrics.available.Set(int64(available))
+	if total == 0 {
+		return -1
+	}
+	n := r.rand.Intn(total)
+	for i := range r.health {
+		if tried[i] || !usable[i] {
+			continue
+		}
+		if n < r.weights[i] {
+			return i
+		}
+		n -= r.weights[i]
+	}
+	return -1 // should never be reached
+}
+
+// Record the result of a query sent to resolver i and take the resolver out of
+// rotation if the failure ratio is too high.
+func (r *LoadBalancer) record(i int, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := r.health[i]
+	if h.count == len(h.results) { // drop the oldest result when the window is full
+		if h.results[h.next] {
+			h.failures--
+		}
+	} else {
+		h.count++
+	}
+	h.results[h.next] = failed
+	h.next = (h.next + 1) % len(h.results)
+	if failed {
+		h.failures++
+	}
+
+	// Require at least half the window before judging the health of a resolver
+	minCount := (len(h.results) + 1) / 2
+	if h.count < minCount || float64(h.failures)/float64(h.count) < r.opt.FailureRatio {
+		return
+	}
+	Log.WithFields(logrus.Fields{"id": r.id, "resolver": r.resolvers[i]}).Debug("de-activating resolver")
+	h.disabledUntil = time.Now().Add(r.opt.Cooldown)
+	h.count, h.failures, h.next = 0, 0, 0
+}
+
+// Returns true is the response is considered successful given the options.
+func (r *LoadBalancer) isSuccessResponse(a *dns.Msg) bool {
+	return a == nil || !(r.opt.ServfailError && a.Rcode == dns.RcodeServerFailure)
+}
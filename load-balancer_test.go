@@ -0,0 +1,81 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadBalancerWeights(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+
+	g, err := NewLoadBalancer("test-lb", LoadBalancerOptions{Weights: []int{80, 20}, Seed: 1}, r1, r2)
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	const n = 10000
+	for i := 0; i < n; i++ {
+		_, err := g.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+
+	// The queries should be split according to the weights
+	require.Equal(t, n, r1.HitCount()+r2.HitCount())
+	require.InDelta(t, 0.8*n, r1.HitCount(), 0.02*n)
+	require.InDelta(t, 0.2*n, r2.HitCount(), 0.02*n)
+}
+
+func TestLoadBalancerUnhealthy(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+
+	g, err := NewLoadBalancer("test-lb", LoadBalancerOptions{Seed: 1, Cooldown: time.Second}, r1, r2)
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+
+	// Break the first resolver, queries should still succeed on the second
+	r1.SetFail(true)
+	for i := 0; i < 20; i++ {
+		_, err := g.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+
+	// The failed resolver should have been taken out after a few failures
+	failures := r1.HitCount()
+	require.Less(t, failures, 10)
+	for i := 0; i < 20; i++ {
+		_, err := g.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+	require.Equal(t, failures, r1.HitCount())
+
+	// After the cooldown, it should be used again
+	r1.SetFail(false)
+	time.Sleep(1100 * time.Millisecond)
+	for i := 0; i < 20; i++ {
+		_, err := g.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+	require.Greater(t, r1.HitCount(), failures)
+
+	// With all resolvers failing, the query fails
+	r1.SetFail(true)
+	r2.SetFail(true)
+	_, err = g.Resolve(q, ClientInfo{})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrUnhealthy)
+
+	// Once all resolvers are taken out, queries fail without trying any
+	for i := 0; i < 20; i++ {
+		_, _ = g.Resolve(q, ClientInfo{})
+	}
+	hits := r1.HitCount() + r2.HitCount()
+	_, err = g.Resolve(q, ClientInfo{})
+	require.ErrorIs(t, err, ErrUnhealthy)
+	require.Equal(t, hits, r1.HitCount()+r2.HitCount())
+}
@@ -1,6 +1,8 @@
 package rdns
 
 import (
+	"io/ioutil"
+
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
@@ -9,11 +11,118 @@ import (
 // changed directly on this instance or the instance replaced.
 var Log = logrus.New()
 
+// Logger receives the log messages of the library when set with SetLogger,
+// for applications that embed the library and use a different logging
+// package. The fields carry the structured data of the messages, like the id
+// of the resolver, the query name or the error, and must not be modified.
+//
+// The library itself always logs with Log. SetLogger configures Log to pass
+// every message on to the Logger, which is the only way messages reach it.
+type Logger interface {
+	Log(level LogLevel, msg string, fields map[string]interface{})
+}
+
+// LevelLogger is a Logger that reports the most verbose level it wants to
+// receive. Messages of lower severity are then discarded without building
+// them, which avoids the cost of debug logging if the logger filters it anyway.
+type LevelLogger interface {
+	Logger
+	Level() LogLevel
+}
+
+// LogLevel is the severity of a message passed to a Logger.
+type LogLevel int
+
+const (
+	LogLevelError LogLevel = iota
+	LogLevelWarn
+	LogLevelInfo
+	LogLevelDebug
+)
+
+// SetLogger sends all log messages of the library to the logger instead of
+// writing them with Log, replacing any hooks added to Log. Messages of all
+// levels are passed on unless the logger implements LevelLogger, otherwise
+// the logger is expected to filter them. Logging is disabled entirely if the
+// logger is nil. Should be called before any resolvers or listeners are
+// started.
+func SetLogger(l Logger) {
+	Log.SetOutput(ioutil.Discard)
+	Log.SetFormatter(discardFormatter{})
+	hooks := make(logrus.LevelHooks)
+	switch l := l.(type) {
+	case nil:
+		Log.SetLevel(logrus.PanicLevel)
+	case LevelLogger:
+		Log.SetLevel(logrusLevel(l.Level()))
+		hooks.Add(loggerHook{l})
+	default:
+		Log.SetLevel(logrus.TraceLevel)
+		hooks.Add(loggerHook{l})
+	}
+	Log.ReplaceHooks(hooks)
+}
+
+// Returns the most verbose logrus level that is passed on as the given level.
+func logrusLevel(level LogLevel) logrus.Level {
+	switch level {
+	case LogLevelError:
+		return logrus.ErrorLevel
+	case LogLevelWarn:
+		return logrus.WarnLevel
+	case LogLevelInfo:
+		return logrus.InfoLevel
+	default:
+		return logrus.TraceLevel
+	}
+}
+
+// Formatter for Log while the messages go to a Logger. The output is discarded,
+// so there's no need to format the entries.
+type discardFormatter struct{}
+
+func (discardFormatter) Format(*logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+// Hook that forwards the entries of Log to a Logger.
+type loggerHook struct {
+	logger Logger
+}
+
+var _ logrus.Hook = loggerHook{}
+
+func (h loggerHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h loggerHook) Fire(e *logrus.Entry) error {
+	level := LogLevelDebug
+	switch e.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		level = LogLevelError
+	case logrus.WarnLevel:
+		level = LogLevelWarn
+	case logrus.InfoLevel:
+		level = LogLevelInfo
+	}
+	fields := make(map[string]interface{}, len(e.Data))
+	for k, v := range e.Data {
+		fields[k] = v
+	}
+	h.logger.Log(level, e.Message, fields)
+	return nil
+}
+
 func logger(id string, q *dns.Msg, ci ClientInfo) *logrus.Entry {
-	return Log.WithFields(logrus.Fields{
+	fields := logrus.Fields{
 		"id":     id,
 		"client": ci.SourceIP,
 		"qtype":  dns.Type(q.Question[0].Qtype).String(),
 		"qname":  qName(q),
-	})
+	}
+	if ci.RequestID != 0 {
+		fields["request"] = ci.RequestID
+	}
+	return Log.WithFields(fields)
 }
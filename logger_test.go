@@ -0,0 +1,171 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggerRequestID(t *testing.T) {
+	hook := test.NewLocal(Log)
+	defer hook.Reset()
+	level := Log.GetLevel()
+	Log.SetLevel(logrus.DebugLevel)
+	defer Log.SetLevel(level)
+
+	// Two chained resolvers that both log the query
+	r2 := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			logger("r2", q, ci).Debug("resolving")
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	r1 := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			logger("r1", q, ci).Debug("forwarding")
+			return r2.Resolve(q, ci)
+		},
+	}
+
+	addr, err := getUDPLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListener("test-request-id", addr, "udp", ListenOptions{}, r1)
+	go s.Start()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	c, err := NewDNSClient("test-request-id", addr, "udp", DNSClientOptions{})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		_, err = c.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+
+	// Both resolvers should log the same ID for a query, and the queries should
+	// have different IDs
+	ids := make(map[string][]interface{})
+	for _, e := range hook.AllEntries() {
+		if id, ok := e.Data["id"].(string); ok && (id == "r1" || id == "r2") {
+			ids[id] = append(ids[id], e.Data["request"])
+		}
+	}
+	require.Len(t, ids["r1"], 2)
+	require.Equal(t, ids["r1"], ids["r2"])
+	require.NotEqual(t, ids["r1"][0], ids["r1"][1])
+	require.NotZero(t, ids["r1"][0])
+}
+
+func TestLoggerNoRequestID(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	e := logger("test", q, ClientInfo{SourceIP: net.IP{127, 0, 0, 1}})
+	require.NotContains(t, e.Data, "request")
+}
+
+// Logger that records all messages
+type testLogger struct {
+	mu       sync.Mutex
+	messages []testLogMessage
+}
+
+type testLogMessage struct {
+	level  LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+func (l *testLogger) Log(level LogLevel, msg string, fields map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, testLogMessage{level, msg, fields})
+}
+
+// Logger that only receives messages up to a level
+type testLevelLogger struct {
+	testLogger
+	level LogLevel
+}
+
+func (l *testLevelLogger) Level() LogLevel {
+	return l.level
+}
+
+// Resets Log to its initial state after a test replaced the logger.
+func restoreLog() func() {
+	level := Log.GetLevel()
+	formatter := Log.Formatter
+	hooks := Log.ReplaceHooks(make(logrus.LevelHooks))
+	return func() {
+		Log.SetLevel(level)
+		Log.SetFormatter(formatter)
+		Log.ReplaceHooks(hooks)
+		Log.SetOutput(os.Stderr)
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	defer restoreLog()()
+	l := new(testLogger)
+	SetLogger(l)
+
+	// Resolver that logs a debug message with the fields of the query
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{rr("example.com. 60 IN A 192.168.1.1")}
+			return a, nil
+		},
+	}
+	r := NewRebindProtection("test-rebind", upstream, RebindProtectionOptions{})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := r.Resolve(q, ClientInfo{SourceIP: net.IP{127, 0, 0, 1}, RequestID: 1})
+	require.NoError(t, err)
+	Log.WithError(errors.New("failed")).Error("test error")
+
+	require.Len(t, l.messages, 2)
+	require.Equal(t, LogLevelDebug, l.messages[0].level)
+	require.Equal(t, "private address in response, blocking", l.messages[0].msg)
+	require.Equal(t, "test-rebind", l.messages[0].fields["id"])
+	require.Equal(t, "example.com.", l.messages[0].fields["qname"])
+	require.Equal(t, "A", l.messages[0].fields["qtype"])
+	require.Equal(t, "192.168.1.1", l.messages[0].fields["ip"])
+	require.Equal(t, uint64(1), l.messages[0].fields["request"])
+	require.Equal(t, LogLevelError, l.messages[1].level)
+	require.EqualError(t, l.messages[1].fields["error"].(error), "failed")
+
+	// Nothing is logged once logging is disabled
+	SetLogger(nil)
+	_, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, l.messages, 2)
+}
+
+func TestSetLevelLogger(t *testing.T) {
+	defer restoreLog()()
+	l := &testLevelLogger{level: LogLevelInfo}
+	SetLogger(l)
+
+	// Debug messages aren't even built
+	require.False(t, Log.IsLevelEnabled(logrus.DebugLevel))
+	Log.Debug("test debug")
+	Log.Info("test info")
+	Log.Warn("test warning")
+
+	require.Len(t, l.messages, 2)
+	require.Equal(t, LogLevelInfo, l.messages[0].level)
+	require.Equal(t, LogLevelWarn, l.messages[1].level)
+}
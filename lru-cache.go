@@ -1,6 +1,8 @@
 package rdns
 
 import (
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -43,11 +45,13 @@ func newLRUCache(capacity int) *lruCache {
 	}
 }
 
-func (c *lruCache) add(query *dns.Msg, answer *cacheAnswer) {
-	key := lruKeyFromQuery(query)
+// Adds an answer to the cache and returns the number of least-recently used items
+// that were evicted to stay within the maximum size.
+func (c *lruCache) add(key lruKey, answer *cacheAnswer) int {
 	item := c.touch(key)
 	if item != nil {
-		return
+		item.cacheAnswer = answer // replace an existing answer, for example when refreshed
+		return 0
 	}
 	// Add new item to the top of the linked list
 	item = &cacheItem{
@@ -59,7 +63,7 @@ func (c *lruCache) add(query *dns.Msg, answer *cacheAnswer) {
 	c.head.next.prev = item
 	c.head.next = item
 	c.items[key] = item
-	c.resize()
+	return c.resize()
 }
 
 // Loads a cache item and puts it to the top of the queue (most recent).
@@ -78,8 +82,7 @@ func (c *lruCache) touch(key lruKey) *cacheItem {
 	return item
 }
 
-func (c *lruCache) delete(q *dns.Msg) {
-	key := lruKeyFromQuery(q)
+func (c *lruCache) delete(key lruKey) {
 	item := c.items[key]
 	if item == nil {
 		return
@@ -89,8 +92,7 @@ func (c *lruCache) delete(q *dns.Msg) {
 	delete(c.items, key)
 }
 
-func (c *lruCache) get(query *dns.Msg) *cacheAnswer {
-	key := lruKeyFromQuery(query)
+func (c *lruCache) get(key lruKey) *cacheAnswer {
 	item := c.touch(key)
 	if item != nil {
 		return item.cacheAnswer
@@ -98,10 +100,11 @@ func (c *lruCache) get(query *dns.Msg) *cacheAnswer {
 	return nil
 }
 
-// Shrink the cache down to the maximum number of items.
-func (c *lruCache) resize() {
+// Shrink the cache down to the maximum number of items. Returns the number of
+// items removed.
+func (c *lruCache) resize() int {
 	if c.maxItems <= 0 { // no size limit
-		return
+		return 0
 	}
 	drop := len(c.items) - c.maxItems
 	for i := 0; i < drop; i++ {
@@ -110,6 +113,10 @@ func (c *lruCache) resize() {
 		c.tail.prev = item.prev
 		delete(c.items, item.key)
 	}
+	if drop < 0 {
+		return 0
+	}
+	return drop
 }
 
 // Clear the cache.
@@ -138,21 +145,139 @@ func (c *lruCache) deleteFunc(f func(*cacheAnswer) bool) {
 	}
 }
 
+// Iterate over all items in the cache, from the least recently used to the most
+// recently used one.
+func (c *lruCache) forEach(f func(lruKey, *cacheAnswer)) {
+	for item := c.tail.prev; item != c.head; item = item.prev {
+		f(item.key, item.cacheAnswer)
+	}
+}
+
 func (c *lruCache) size() int {
 	return len(c.items)
 }
 
 func lruKeyFromQuery(q *dns.Msg) lruKey {
-	key := lruKey{question: q.Question[0]}
-
-	edns0 := q.IsEdns0()
-	if edns0 != nil {
-		// See if we have a subnet option
-		for _, opt := range edns0.Option {
-			if subnet, ok := opt.(*dns.EDNS0_SUBNET); ok {
-				key.net = subnet.Address.String()
-			}
-		}
+	question := q.Question[0]
+	question.Name = normalizeName(question.Name)
+	return lruKey{question: question}
+}
+
+// Returns the key to store an answer under. If the answer carries an ECS option with
+// a non-zero scope, the key includes the client subnet of the query masked to the
+// scope prefix length. Otherwise the answer is valid for all clients.
+func lruKeyFromAnswer(q, a *dns.Msg) lruKey {
+	key := lruKeyFromQuery(q)
+	qSubnet, aSubnet := ecsOption(q), ecsOption(a)
+	if qSubnet == nil || aSubnet == nil || aSubnet.SourceScope == 0 {
+		return key
+	}
+	// As per rfc7871, a scope longer than the source prefix length is capped at the
+	// source prefix length.
+	scope := aSubnet.SourceScope
+	if scope > qSubnet.SourceNetmask {
+		scope = qSubnet.SourceNetmask
+	}
+	if scope > 0 {
+		key.net = ecsNet(qSubnet, scope)
 	}
 	return key
 }
+
+// Returns all keys an answer for the query could be stored under, the most specific
+// subnet first and the key without subnet last. Only subnets with a prefix length of
+// answers in the cache are included.
+func lruKeysFromQuery(q *dns.Msg, scopes *ecsScopes) []lruKey {
+	key := lruKeyFromQuery(q)
+	subnet := ecsOption(q)
+	if subnet == nil || subnet.SourceNetmask == 0 {
+		return []lruKey{key}
+	}
+	var keys []lruKey
+	for bits := subnet.SourceNetmask; bits > 0; bits-- {
+		if !scopes.has(subnet.Family, bits) {
+			continue
+		}
+		keys = append(keys, lruKey{question: key.question, net: ecsNet(subnet, bits)})
+	}
+	return append(keys, key)
+}
+
+// ecsScopes records the prefix lengths of the subnets answers in the cache are
+// stored under, per address family. Lookups only try those instead of every
+// possible prefix length. Updated atomically.
+type ecsScopes struct {
+	v4 uint64    // bits 0..32
+	v6 [3]uint64 // bits 0..128
+}
+
+// Records the prefix length of the subnet in a key, if it has one.
+func (s *ecsScopes) add(key lruKey) {
+	if key.net == "" {
+		return
+	}
+	ip, n, err := net.ParseCIDR(key.net)
+	if err != nil {
+		return
+	}
+	bits, _ := n.Mask.Size()
+	family := uint16(2)
+	if ip.To4() != nil {
+		family = 1
+	}
+	word, mask := s.word(family, uint8(bits))
+	for {
+		old := atomic.LoadUint64(word)
+		if old&mask != 0 || atomic.CompareAndSwapUint64(word, old, old|mask) {
+			return
+		}
+	}
+}
+
+// Returns true if answers may be stored for subnets with the prefix length.
+func (s *ecsScopes) has(family uint16, bits uint8) bool {
+	word, mask := s.word(family, bits)
+	return atomic.LoadUint64(word)&mask != 0
+}
+
+func (s *ecsScopes) word(family uint16, bits uint8) (*uint64, uint64) {
+	if family == 2 {
+		if bits > 128 {
+			bits = 128
+		}
+		return &s.v6[bits/64], 1 << (bits % 64)
+	}
+	if bits > 32 {
+		bits = 32
+	}
+	return &s.v4, 1 << bits
+}
+
+// Returns the ECS option of a message or nil if there isn't one.
+func ecsOption(m *dns.Msg) *dns.EDNS0_SUBNET {
+	edns0 := m.IsEdns0()
+	if edns0 == nil {
+		return nil
+	}
+	for _, opt := range edns0.Option {
+		if subnet, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// Returns the subnet address of an ECS option masked to the given number of bits,
+// in CIDR notation.
+func ecsNet(subnet *dns.EDNS0_SUBNET, bits uint8) string {
+	size := net.IPv4len * 8
+	if subnet.Family == 2 {
+		size = net.IPv6len * 8
+	}
+	if int(bits) > size {
+		bits = uint8(size)
+	}
+	mask := net.CIDRMask(int(bits), size)
+	n := net.IPNet{IP: subnet.Address.Mask(mask), Mask: mask}
+	return n.String()
+}
@@ -38,7 +38,7 @@ func TestLRUAddGet(t *testing.T) {
 			answer: answer,
 		})
 		// Load into the cache
-		c.add(msg, answer)
+		c.add(lruKeyFromQuery(msg), answer)
 	}
 
 	// Since the capacity is only 5 and we loaded 10, only the last 5 should be in there
@@ -46,17 +46,17 @@ func TestLRUAddGet(t *testing.T) {
 
 	// Check it's the right items in the cache
 	for _, item := range items[:5] {
-		answer := c.get(item.query)
+		answer := c.get(lruKeyFromQuery(item.query))
 		require.Nil(t, answer)
 	}
 	for _, item := range items[5:] {
-		answer := c.get(item.query)
+		answer := c.get(lruKeyFromQuery(item.query))
 		require.NotNil(t, answer)
 		require.Equal(t, item.answer, answer)
 	}
 
 	// Delete one of the items directly
-	c.delete(items[5].query)
+	c.delete(lruKeyFromQuery(items[5].query))
 	require.Equal(t, 4, c.size())
 
 	// Use an iterator to delete two more
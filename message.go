@@ -62,6 +62,10 @@ func ptr(q *dns.Msg, name string) *dns.Msg {
 	return a
 }
 
+// EDNS0 UDP size advertised upstream by UDP and DTLS clients unless configured
+// otherwise, as recommended by DNS Flag Day 2020.
+const defaultUDPSize = 1232
+
 // Changes the UDP size in the EDNS0 record and returns a
 // copy of the query. Adds an OPT record if there isn't one
 // already. If size is 0, the original query is returned.
@@ -76,7 +80,27 @@ func setUDPSize(q *dns.Msg, size uint16) *dns.Msg {
 	if edns0 != nil {
 		edns0.SetUDPSize(size)
 	} else {
-		q.SetEdns0(size, false)
+		copy.SetEdns0(size, false)
 	}
 	return copy
 }
+
+// Like setUDPSize but only changes an existing OPT record, queries without
+// EDNS0 are returned as they are.
+func updateUDPSize(q *dns.Msg, size uint16) *dns.Msg {
+	if edns0 := q.IsEdns0(); edns0 == nil || edns0.UDPSize() == size {
+		return q
+	}
+	return setUDPSize(q, size)
+}
+
+// Removes the OPT record from a message.
+func stripEDNS0(m *dns.Msg) {
+	extra := make([]dns.RR, 0, len(m.Extra))
+	for _, rr := range m.Extra {
+		if _, ok := rr.(*dns.OPT); !ok {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
@@ -0,0 +1,221 @@
+package rdns
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Upper bounds of the buckets in latency histograms, in seconds.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Integer metrics that represent a current value rather than a count.
+var gaugeMetrics = map[string]bool{
+	"entries":     true,
+	"connections": true,
+	"available":   true,
+	"maxqueue":    true,
+	"healthy":     true,
+}
+
+// Label names used for the keys of map metrics. Maps not listed here use "key".
+var mapMetricLabels = map[string]string{
+	"response": "rcode",
+	"error":    "error",
+	"route":    "resolver",
+	"failure":  "resolver",
+	"result":   "result",
+	"match":    "list",
+	"qtype":    "qtype",
+}
+
+// MetricsRegistry exposes the metrics of all pipeline elements in the
+// Prometheus text format. Elements register their metrics as expvar variables
+// named routedns.<type>.<id>.<name>, which are turned into metrics called
+// routedns_<type>_<name> with the element identifier in the "id" label.
+// Counters get the suffix "_total", and latency histograms "_seconds".
+type MetricsRegistry struct{}
+
+var _ http.Handler = &MetricsRegistry{}
+
+// MetricSample is a single value of a metric.
+type MetricSample struct {
+	Name   string
+	Type   string // "counter", "gauge" or "histogram"
+	Labels map[string]string
+	Value  float64
+}
+
+// NewMetricsRegistry returns a registry for the metrics of all elements.
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{}
+}
+
+// Gather returns the current values of all metrics, sorted by name.
+func (r *MetricsRegistry) Gather() []MetricSample {
+	var samples []MetricSample
+	expvar.Do(func(kv expvar.KeyValue) {
+		parts := strings.Split(kv.Key, ".")
+		if len(parts) < 4 || parts[0] != "routedns" {
+			return
+		}
+		base, name := parts[1], parts[len(parts)-1]
+		id := strings.Join(parts[2:len(parts)-1], ".")
+		metric := sanitizeMetricName("routedns_" + base + "_" + name)
+
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			s := MetricSample{Name: metric + "_total", Type: "counter", Labels: map[string]string{"id": id}, Value: float64(v.Value())}
+			if gaugeMetrics[name] {
+				s.Name, s.Type = metric, "gauge"
+			}
+			samples = append(samples, s)
+		case *expvar.Map:
+			label, ok := mapMetricLabels[name]
+			if !ok {
+				label = "key"
+			}
+			v.Do(func(kv expvar.KeyValue) {
+				n, ok := kv.Value.(*expvar.Int)
+				if !ok {
+					return
+				}
+				samples = append(samples, MetricSample{
+					Name:   metric + "_total",
+					Type:   "counter",
+					Labels: map[string]string{"id": id, label: kv.Key},
+					Value:  float64(n.Value()),
+				})
+			})
+		case *histogram:
+			samples = append(samples, v.samples(metric+"_seconds", id)...)
+		}
+	})
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Name < samples[j].Name })
+	return samples
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format.
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	var family string
+	for _, s := range r.Gather() {
+		// Histogram samples share the type line of the histogram
+		name := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(s.Name, "_bucket"), "_sum"), "_count")
+		if s.Type != "histogram" {
+			name = s.Name
+		}
+		if name != family {
+			family = name
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, s.Type)
+		}
+		fmt.Fprintf(w, "%s%s %s\n", s.Name, formatLabels(s.Labels), strconv.FormatFloat(s.Value, 'g', -1, 64))
+	}
+}
+
+// Returns the labels in the Prometheus format, sorted by name.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", name, labels[name])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Replaces characters that aren't allowed in Prometheus metric names.
+func sanitizeMetricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Histogram of observed values, exposed as expvar and to Prometheus.
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // Per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+var _ expvar.Var = &histogram{}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe records a value.
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// String returns the histogram as JSON, implementing expvar.Var.
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var b strings.Builder
+	b.WriteString(`{"buckets": {`)
+	var cumulative uint64
+	for i, le := range h.buckets {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		cumulative += h.counts[i]
+		fmt.Fprintf(&b, `"%s": %d`, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(&b, `}, "sum": %s, "count": %d}`, strconv.FormatFloat(h.sum, 'g', -1, 64), h.count)
+	return b.String()
+}
+
+// Returns the Prometheus samples of the histogram with cumulative buckets.
+func (h *histogram) samples(name, id string) []MetricSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]MetricSample, 0, len(h.buckets)+3)
+	bucket := func(le float64, count uint64) MetricSample {
+		return MetricSample{
+			Name:   name + "_bucket",
+			Type:   "histogram",
+			Labels: map[string]string{"id": id, "le": strconv.FormatFloat(le, 'g', -1, 64)},
+			Value:  float64(count),
+		}
+	}
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		out = append(out, bucket(le, cumulative))
+	}
+	out = append(out,
+		bucket(math.Inf(1), h.count),
+		MetricSample{Name: name + "_sum", Type: "histogram", Labels: map[string]string{"id": id}, Value: h.sum},
+		MetricSample{Name: name + "_count", Type: "histogram", Labels: map[string]string{"id": id}, Value: float64(h.count)},
+	)
+	return out
+}
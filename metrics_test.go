@@ -0,0 +1,102 @@
+package rdns
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns the value of the sample with the given name and labels, or -1 if
+// there is none.
+func sampleValue(samples []MetricSample, name string, labels map[string]string) float64 {
+	for _, s := range samples {
+		if s.Name != name || len(s.Labels) != len(labels) {
+			continue
+		}
+		match := true
+		for k, v := range labels {
+			if s.Labels[k] != v {
+				match = false
+			}
+		}
+		if match {
+			return s.Value
+		}
+	}
+	return -1
+}
+
+func TestMetricsRegistryDoTClient(t *testing.T) {
+	upstream := new(TestResolver)
+
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-metrics-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go func() {
+		err := s.Start()
+		require.NoError(t, err)
+	}()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoTClient("test-metrics-dot", addr, DoTClientOptions{TLSConfig: tlsConfig})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		_, err = c.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+
+	samples := NewMetricsRegistry().Gather()
+	id := map[string]string{"id": "test-metrics-dot"}
+	require.Equal(t, float64(3), sampleValue(samples, "routedns_client_query_total", id))
+	require.Equal(t, float64(3), sampleValue(samples, "routedns_client_response_total", map[string]string{"id": "test-metrics-dot", "rcode": "NOERROR"}))
+	require.Equal(t, float64(3), sampleValue(samples, "routedns_client_latency_seconds_count", id))
+	require.Equal(t, float64(3), sampleValue(samples, "routedns_client_latency_seconds_bucket", map[string]string{"id": "test-metrics-dot", "le": "+Inf"}))
+	require.Equal(t, float64(3), sampleValue(samples, "routedns_listener_query_total", map[string]string{"id": "test-metrics-ln"}))
+}
+
+func TestMetricsRegistryCache(t *testing.T) {
+	r := NewCache("test-metrics-cache", new(TestResolver), CacheOptions{})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		_, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+	}
+
+	samples := NewMetricsRegistry().Gather()
+	id := map[string]string{"id": "test-metrics-cache"}
+	require.Equal(t, float64(1), sampleValue(samples, "routedns_cache_miss_total", id))
+	require.Equal(t, float64(2), sampleValue(samples, "routedns_cache_hit_total", id))
+}
+
+func TestMetricsRegistryHandler(t *testing.T) {
+	h := getVarHistogram("test", "test-metrics-handler", "latency")
+	h.Observe(0.002)
+	h.Observe(0.3)
+	getVarInt("test", "test-metrics-handler", "query").Add(2)
+
+	w := httptest.NewRecorder()
+	NewMetricsRegistry().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	require.Contains(t, body, "# TYPE routedns_test_query_total counter\n")
+	require.Contains(t, body, `routedns_test_query_total{id="test-metrics-handler"} 2`+"\n")
+	require.Contains(t, body, "# TYPE routedns_test_latency_seconds histogram\n")
+	require.Contains(t, body, `routedns_test_latency_seconds_bucket{id="test-metrics-handler",le="0.001"} 0`+"\n")
+	require.Contains(t, body, `routedns_test_latency_seconds_bucket{id="test-metrics-handler",le="0.005"} 1`+"\n")
+	require.Contains(t, body, `routedns_test_latency_seconds_bucket{id="test-metrics-handler",le="0.5"} 2`+"\n")
+	require.Contains(t, body, `routedns_test_latency_seconds_bucket{id="test-metrics-handler",le="+Inf"} 2`+"\n")
+	require.Contains(t, body, `routedns_test_latency_seconds_count{id="test-metrics-handler"} 2`+"\n")
+}
@@ -60,6 +60,12 @@ func padAnswer(q, a *dns.Msg) {
 // Adds padding to a query that is to be sent over DoH or DoT. Padding length is according to rfc8467.
 // This should not be used for plain (unencrypted) DNS.
 func padQuery(q *dns.Msg) {
+	padQueryBlockSize(q, QueryPaddingBlockSize)
+}
+
+// Adds padding to a query, making its length a multiple of the given block size.
+// Only the padding option is added or changed, all other options are kept.
+func padQueryBlockSize(q *dns.Msg, blockSize int) {
 	edns0q := q.IsEdns0()
 	if edns0q == nil { // Don't pad if the client does not support EDNS0
 		return
@@ -82,10 +88,32 @@ func padQuery(q *dns.Msg) {
 
 	// Calculate the desired padding length
 	len := q.Len()
-	padLen := QueryPaddingBlockSize - len%QueryPaddingBlockSize
+	padLen := blockSize - len%blockSize
+	if padLen > QueryPaddingBlockSize {
+		paddingOpt.Padding = make([]byte, padLen)
+		return
+	}
 	paddingOpt.Padding = queryPadBuf[0:padLen]
 }
 
+// Returns a copy of the message without padding, all other EDNS0 options are
+// kept. The original, which may be shared with other resolvers, is left
+// unchanged. Messages without padding are returned as they are.
+func withoutPadding(m *dns.Msg) *dns.Msg {
+	edns0 := m.IsEdns0()
+	if edns0 == nil {
+		return m
+	}
+	for _, opt := range edns0.Option {
+		if opt.Option() == dns.EDNS0PADDING {
+			m = m.Copy()
+			stripPadding(m)
+			return m
+		}
+	}
+	return m
+}
+
 // Remove padding from a query or response. Typically needed when sending a response that was received
 // via TLS over a plain connection.
 func stripPadding(m *dns.Msg) {
@@ -120,3 +120,74 @@ func TestStripPaddingMulti(t *testing.T) {
 		require.Len(t, edns0.Option, test.lenAfterStrip)
 	}
 }
+
+func TestQueryPaddingBlockSize(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("google.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+
+	// Pad to a block size larger than the default
+	padQueryBlockSize(q, 256)
+	require.Zero(t, q.Len()%256, "query not padded to the correct length")
+
+	// Re-padding with a smaller block size should replace the existing padding
+	padQueryBlockSize(q, 64)
+	require.Zero(t, q.Len()%64, "query not padded to the correct length")
+	require.Less(t, q.Len(), 128)
+}
+
+func TestPaddingKeepsOptions(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("google.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	edns0 := q.IsEdns0()
+	edns0.Option = []dns.EDNS0{
+		&dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Empty: true},
+		&dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1, 2, 3}},
+	}
+
+	// The padded query has all the options plus padding
+	padded := q.Copy()
+	padQuery(padded)
+	require.Zero(t, padded.Len()%QueryPaddingBlockSize, "query not padded to the correct length")
+	require.Len(t, padded.IsEdns0().Option, 3)
+	require.Equal(t, edns0.Option, padded.IsEdns0().Option[:2])
+
+	// Stripping the padding keeps the other options and doesn't change the padded query
+	stripped := withoutPadding(padded)
+	require.Equal(t, edns0.Option, stripped.IsEdns0().Option)
+	require.Len(t, padded.IsEdns0().Option, 3)
+
+	// Nothing to strip, no copy
+	require.True(t, withoutPadding(q) == q)
+}
+
+func TestQueryPaddingKeepsCookie(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("google.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	cookie := &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "24a5ac1c1f1e4d3e"}
+	nsid := &dns.EDNS0_NSID{Code: dns.EDNS0NSID}
+	keepalive := &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE}
+	q.IsEdns0().Option = []dns.EDNS0{cookie, nsid, keepalive}
+
+	padQuery(q)
+	require.Zero(t, q.Len()%QueryPaddingBlockSize, "query not padded to the correct length")
+	options := q.IsEdns0().Option
+	require.Len(t, options, 4)
+	require.Equal(t, []dns.EDNS0{cookie, nsid, keepalive}, options[:3])
+	require.Equal(t, uint16(dns.EDNS0PADDING), options[3].Option())
+
+	// Padding again replaces the existing padding, the other options stay
+	padQueryBlockSize(q, 64)
+	require.Zero(t, q.Len()%64, "query not padded to the correct length")
+	require.Len(t, q.IsEdns0().Option, 4)
+	require.Equal(t, []dns.EDNS0{cookie, nsid, keepalive}, q.IsEdns0().Option[:3])
+
+	// The query still packs and unpacks with the cookie intact
+	b, err := q.Pack()
+	require.NoError(t, err)
+	unpacked := new(dns.Msg)
+	require.NoError(t, unpacked.Unpack(b))
+	require.Equal(t, cookie.Cookie, unpacked.IsEdns0().Option[0].(*dns.EDNS0_COOKIE).Cookie)
+}
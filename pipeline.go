@@ -1,9 +1,13 @@
 package rdns
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,18 +17,40 @@ import (
 // Defines how long to wait for a response from the resolver.
 var defaultQueryTimeout = time.Second
 
-// Tear down an upstream connection if nothing has been received for this long.
-const idleTimeout = 10 * time.Second
+// Tear down an upstream connection if nothing has been received for this long,
+// unless the pipeline is created with an idle timeout of its own.
+const defaultIdleTimeout = 10 * time.Second
 
 // Pipeline is a DNS client that is able to use pipelining for multiple requests over
 // one connection, handle out-of-order responses and deals with disconnects
 // gracefully. It opens a single connection on demand and uses it for all queries.
+// If nothing is received on a connection with queries in flight for half the query
+// timeout, the connection is considered dead and the queries are re-sent once on a
+// new connection.
 // It can manage UDP, TCP, DNS-over-TLS, and DNS-over-DTLS connections.
 type Pipeline struct {
 	addr     string
 	client   DNSDialer
 	requests chan *request
 	metrics  *ListenerMetrics
+
+	// Time a connection without queries is kept open
+	idleTimeout time.Duration
+
+	// Number of currently open upstream connections.
+	connections *expvar.Int
+
+	// Time in seconds it took to receive responses.
+	latency *histogram
+
+	// Queries currently being resolved, and whether new ones are still accepted
+	mu       sync.RWMutex
+	active   sync.WaitGroup
+	draining bool
+
+	// Closed to tear down the connection once drained
+	quit     chan struct{}
+	quitOnce sync.Once
 }
 
 // DNSDialer is an abstraction for a dns.Client that returns a *dns.Conn.
@@ -32,25 +58,47 @@ type DNSDialer interface {
 	Dial(address string) (*dns.Conn, error)
 }
 
-// NewPipeline returns an initialized (and running) DNS connection manager.
-func NewPipeline(id string, addr string, client DNSDialer) *Pipeline {
+// NewPipeline returns an initialized (and running) DNS connection manager. The
+// connection is closed once nothing was received on it for the idle timeout,
+// 10s if 0.
+func NewPipeline(id string, addr string, client DNSDialer, idleTimeout time.Duration) *Pipeline {
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
 	c := &Pipeline{
 		addr:     addr,
 		client:   client,
 		requests: make(chan *request),
 		metrics:  NewListenerMetrics("client", id),
+		quit:     make(chan struct{}),
+
+		idleTimeout: idleTimeout,
+
+		connections: getVarInt("client", id, "connections"),
+		latency:     getVarHistogram("client", id, "latency"),
 	}
 	go c.start()
 	return c
 }
 
 // Resolve a single query using this connection.
-func (c *Pipeline) Resolve(q *dns.Msg, queryTimeout time.Duration) (*dns.Msg, error) {
+func (c *Pipeline) Resolve(ctx context.Context, q *dns.Msg, queryTimeout time.Duration) (*dns.Msg, error) {
+	c.mu.RLock()
+	if c.draining {
+		c.mu.RUnlock()
+		c.metrics.err.Add("draining", 1)
+		return nil, ErrDraining
+	}
+	c.active.Add(1)
+	c.mu.RUnlock()
+	defer c.active.Done()
+
 	r := newRequest(q)
 
 	if queryTimeout < defaultQueryTimeout {
 		queryTimeout = defaultQueryTimeout
 	}
+	r.timeout = queryTimeout
 
 	timeout := time.NewTimer(queryTimeout)
 	defer timeout.Stop()
@@ -58,20 +106,57 @@ func (c *Pipeline) Resolve(q *dns.Msg, queryTimeout time.Duration) (*dns.Msg, er
 	// Queue up the request or time out
 	select {
 	case c.requests <- r:
+	case <-c.quit:
+		return nil, ErrDraining
 	case <-timeout.C:
 		c.metrics.err.Add("querytimeout", 1)
 		return nil, QueryTimeoutError{q}
+	case <-ctx.Done():
+		c.metrics.err.Add("canceled", 1)
+		return nil, ctx.Err()
 	}
 
 	// Wait for the request to complete or time out
+	start := time.Now()
 	select {
 	case <-r.done:
 	case <-timeout.C:
 		c.metrics.err.Add("querytimeout", 1)
 		return nil, QueryTimeoutError{q}
+	case <-ctx.Done():
+		c.metrics.err.Add("canceled", 1)
+		return nil, ctx.Err()
 	}
 
-	return r.waitFor()
+	a, err := r.waitFor()
+	if err == nil {
+		c.latency.Observe(time.Since(start).Seconds())
+	}
+	return a, err
+}
+
+// Drain stops accepting new queries and waits for the ones already sent to
+// complete, or for ctx to be done, whichever comes first. The connection is
+// then closed and any remaining queries fail. Returns ctx.Err() if queries were
+// still outstanding.
+func (c *Pipeline) Drain(ctx context.Context) error {
+	c.mu.Lock()
+	c.draining = true
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.active.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.quitOnce.Do(func() { close(c.quit) })
+	return err
 }
 
 // Starts a loop that will wait for queries and open an upstream connection on-demand, writing queries
@@ -81,41 +166,84 @@ func (c *Pipeline) start() {
 	var (
 		wg       sync.WaitGroup
 		inFlight inFlightQueue
+		deadline sync.Mutex
 	)
 	log := Log.WithField("addr", c.addr)
-	for req := range c.requests { // Lazy connection. Only open a real connection if there's a request
-		done := make(chan struct{})
+	for { // Lazy connection. Only open a real connection if there's a request
+		var req *request
+		select {
+		case req = <-c.requests:
+		case <-c.quit:
+			return
+		}
+		var (
+			done    = make(chan struct{})
+			stalled []*request // queries in flight when the connection failed
+			readErr error
+		)
 		log.Trace("opening connection")
 		conn, err := c.client.Dial(c.addr)
 		if err != nil {
+			// "open" counts all failures to connect, handshake failures are
+			// additionally counted on their own
+			errType := dialErrorType(err)
 			c.metrics.err.Add("open", 1)
+			if errType != "open" {
+				c.metrics.err.Add(errType, 1)
+			}
 			log.WithError(err).Error("failed to open connection")
-			req.markDone(nil, err)
+			kind := ErrUpstream
+			if errType == "handshake_error" {
+				kind = ErrHandshake
+			}
+			req.markDone(nil, classifiedError{kind: kind, err: err})
 			continue
 		}
+		c.connections.Add(1)
 		wg.Add(2)
 
-		go func() { c.requests <- req }() // re-queue the request that triggered the upstream connection
+		go c.requeue(req) // re-queue the request that triggered the upstream connection
+
+		// Sets the read deadline on the connection. Shorter while queries are in flight
+		// to detect stalled connections.
+		setReadDeadline := func() {
+			deadline.Lock()
+			defer deadline.Unlock()
+			timeout := c.idleTimeout
+			if stall := inFlight.stallTimeout(); stall > 0 {
+				timeout = stall
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		}
 
 		go func() { // writer
 			for {
 				select {
 				case req := <-c.requests:
 					query := inFlight.add(req)
+					if inFlight.len() == 1 { // first query in flight, start looking for stalls
+						setReadDeadline()
+					}
 					log.WithField("qname", qName(query)).Trace("sending query")
 					c.metrics.query.Add(1)
 					if err := conn.WriteMsg(query); err != nil {
-						req.markDone(nil, err) // fail the request
-						inFlight.get(query)    // clean up the in-flight queue so it doesn't keep growing
-						conn.Close()           // throw away this connection, should wake up the reader as well
+						if inFlight.get(query) != nil { // clean up the in-flight queue so it doesn't keep growing
+							req.markDone(nil, err) // fail the request
+						}
+						conn.Close() // throw away this connection, should wake up the reader as well
 						wg.Done()
 						c.metrics.err.Add("send_query", 1)
+						c.metrics.err.Add("write_error", 1)
 						log.WithField("qname", qName(query)).WithError(err).Trace("failed sending query")
 						return
 					}
 				case <-done: // the reader ran into an error and we want to stop using this connection
 					wg.Done()
 					return
+				case <-c.quit: // drained, close the connection which also stops the reader
+					conn.Close()
+					wg.Done()
+					return
 				}
 			}
 		}()
@@ -125,17 +253,24 @@ func (c *Pipeline) start() {
 				// a network topology change wouldn't be noticed. Putting the idle timeout here ensures
 				// a reconnect in that case as well. This does create a very slight race however if the
 				// sender is using the connection right at the time of the timeout in the receiver.
-				_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+				setReadDeadline()
 				a, err := conn.ReadMsg()
 				if err != nil {
 					switch e := err.(type) {
 					case net.Error:
 						if e.Timeout() {
-							log.Trace("connection terminated by idle timeout")
+							if inFlight.len() > 0 {
+								c.metrics.err.Add("stall", 1)
+								c.metrics.err.Add("read_timeout", 1)
+								log.Trace("connection terminated by stall timeout")
+							} else {
+								log.Trace("connection terminated by idle timeout")
+							}
 						} else {
 							c.metrics.err.Add("server_term", 1)
 							log.Trace("connection terminated by server")
 						}
+						stalled, readErr = inFlight.drain(), err
 						close(done) // tell the writer to not use this connection anymore
 						wg.Done()
 						return
@@ -143,6 +278,7 @@ func (c *Pipeline) start() {
 						if err == io.EOF {
 							c.metrics.err.Add("server_eof", 1)
 							log.Trace("connection terminated by server")
+							stalled, readErr = inFlight.drain(), err
 							close(done) // tell the writer to not use this connection anymore
 							wg.Done()
 							return
@@ -153,6 +289,7 @@ func (c *Pipeline) start() {
 						if a == nil {
 							c.metrics.err.Add("read", 1)
 							log.WithError(err).Error("read failed")
+							stalled, readErr = inFlight.drain(), err
 							close(done) // tell the writer to not use this connection anymore
 							wg.Done()
 							return
@@ -177,15 +314,57 @@ func (c *Pipeline) start() {
 
 		// wait for both, sender and receiver to terminate before trying to reconnect
 		wg.Wait()
+		c.connections.Add(-1)
+		conn.Close()
+
+		// re-send any queries that didn't get a response on the failed connection
+		c.retry(stalled, readErr)
+	}
+}
+
+// Returns the metric name for an error returned by the dialer. Failures to establish
+// the network connection are "open", anything else is a failure in the handshake
+// that follows, like TLS certificate validation.
+func dialErrorType(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return "open"
+	}
+	return "handshake_error"
+}
+
+// Re-queues requests that were in flight on a failed connection so they are sent
+// again on a new connection. Requests are only retried once, after that they fail
+// with the given error.
+func (c *Pipeline) retry(requests []*request, err error) {
+	for _, req := range requests {
+		if req.retried {
+			req.markDone(nil, err)
+			continue
+		}
+		req.retried = true
+		c.metrics.err.Add("retry", 1)
+		go c.requeue(req)
+	}
+}
+
+// Queues a request again, or fails it if the pipeline was drained.
+func (c *Pipeline) requeue(req *request) {
+	select {
+	case c.requests <- req:
+	case <-c.quit:
+		req.markDone(nil, ErrDraining)
 	}
 }
 
 // Request received from a client. It also contains the response and a channel that is
 // closed when the request is done.
 type request struct {
-	q, a *dns.Msg
-	err  error
-	done chan struct{}
+	q, a    *dns.Msg
+	err     error
+	done    chan struct{}
+	timeout time.Duration
+	retried bool
 }
 
 func newRequest(q *dns.Msg) *request {
@@ -205,7 +384,7 @@ func (r *request) waitFor() (*dns.Msg, error) {
 		if len(r.a.Question) > 0 && len(r.q.Question) > 0 {
 			q := r.q.Question[0]
 			a := r.a.Question[0]
-			if a.Name != q.Name || a.Qclass != q.Qclass || a.Qtype != q.Qtype {
+			if !strings.EqualFold(a.Name, q.Name) || a.Qclass != q.Qclass || a.Qtype != q.Qtype {
 				return nil, fmt.Errorf("expected answer for %s, got %s", q.String(), a.String())
 			}
 		}
@@ -267,6 +446,39 @@ func (q *inFlightQueue) get(a *dns.Msg) *request {
 	return r
 }
 
+// Removes and returns all requests currently in the queue.
+func (q *inFlightQueue) drain() []*request {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]*request, 0, len(q.requests))
+	for id, r := range q.requests {
+		out = append(out, r)
+		delete(q.requests, id)
+	}
+	return out
+}
+
+// Number of requests currently in flight.
+func (q *inFlightQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.requests)
+}
+
+// Returns half of the shortest query timeout of all requests in flight, or 0 if
+// the queue is empty.
+func (q *inFlightQueue) stallTimeout() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var timeout time.Duration
+	for _, r := range q.requests {
+		if timeout == 0 || r.timeout < timeout {
+			timeout = r.timeout
+		}
+	}
+	return timeout / 2
+}
+
 func (q *inFlightQueue) maxQueueLen() int64 {
 	q.mu.Lock()
 	defer q.mu.Unlock()
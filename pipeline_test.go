@@ -1,7 +1,12 @@
 package rdns
 
 import (
+	"context"
+	"crypto/x509"
 	"errors"
+	"expvar"
+	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -20,20 +25,330 @@ func TestPipelineQueryTimeout(t *testing.T) {
 		time.Sleep(2 * time.Second)
 		return nil, errors.New("failed")
 	}
-	p := NewPipeline("test", "localhost:53", testDialer(df))
+	p := NewPipeline("test", "localhost:53", testDialer(df), 0)
 
 	q := new(dns.Msg)
 	q.SetQuestion("example.com.", dns.TypeA)
 
 	// Send some queries to start the pipeline
-	_, _ = p.Resolve(q, defaultQueryTimeout)
-	_, _ = p.Resolve(q, defaultQueryTimeout)
+	_, _ = p.Resolve(context.Background(), q, defaultQueryTimeout)
+	_, _ = p.Resolve(context.Background(), q, defaultQueryTimeout)
 
 	// Record when we sent the query in order to tell how long it took
 	start := time.Now()
-	_, err := p.Resolve(q, defaultQueryTimeout)
+	_, err := p.Resolve(context.Background(), q, defaultQueryTimeout)
 
 	// Make sure we get a timeout error and it took the right amount to come back
 	require.ErrorAs(t, err, &QueryTimeoutError{})
 	require.WithinDuration(t, start.Add(defaultQueryTimeout), time.Now(), 10*time.Millisecond)
 }
+
+func TestPipelineStalledConnection(t *testing.T) {
+	var dialed int32
+	df := func(address string) (*dns.Conn, error) {
+		n := atomic.AddInt32(&dialed, 1)
+		client, server := net.Pipe()
+		go func() {
+			c := &dns.Conn{Conn: server}
+			for {
+				q, err := c.ReadMsg()
+				if err != nil {
+					return
+				}
+				// The first connection stalls, never answering anything
+				if n == 1 {
+					continue
+				}
+				a := new(dns.Msg)
+				a.SetReply(q)
+				_ = c.WriteMsg(a)
+			}
+		}()
+		return &dns.Conn{Conn: client}, nil
+	}
+	p := NewPipeline("test-stall", "localhost:53", testDialer(df), 0)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The query should be re-sent on a new connection before it times out
+	timeout := 2 * time.Second
+	start := time.Now()
+	a, err := p.Resolve(context.Background(), q, timeout)
+	require.NoError(t, err)
+	require.NotNil(t, a)
+	require.Equal(t, int32(2), atomic.LoadInt32(&dialed))
+	require.WithinDuration(t, start.Add(timeout/2), time.Now(), 100*time.Millisecond)
+}
+
+func TestPipelineTerminatedConnection(t *testing.T) {
+	var dialed int32
+	df := func(address string) (*dns.Conn, error) {
+		n := atomic.AddInt32(&dialed, 1)
+		client, server := net.Pipe()
+		go func() {
+			c := &dns.Conn{Conn: server}
+			for {
+				q, err := c.ReadMsg()
+				if err != nil {
+					return
+				}
+				// The first connection is closed by the server mid-query
+				if n == 1 {
+					c.Close()
+					return
+				}
+				a := new(dns.Msg)
+				a.SetReply(q)
+				_ = c.WriteMsg(a)
+			}
+		}()
+		return &dns.Conn{Conn: client}, nil
+	}
+	p := NewPipeline("test-term", "localhost:53", testDialer(df), 0)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	a, err := p.Resolve(context.Background(), q, 2*time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, a)
+	require.Equal(t, int32(2), atomic.LoadInt32(&dialed))
+}
+
+func TestPipelineRetryOnce(t *testing.T) {
+	var dialed int32
+	df := func(address string) (*dns.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		client, server := net.Pipe()
+		go func() {
+			c := &dns.Conn{Conn: server}
+			// Every connection is closed as soon as a query is received
+			_, _ = c.ReadMsg()
+			c.Close()
+		}()
+		return &dns.Conn{Conn: client}, nil
+	}
+	p := NewPipeline("test-retry", "localhost:53", testDialer(df), 0)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The query should only be re-sent once and then fail
+	_, err := p.Resolve(context.Background(), q, 2*time.Second)
+	require.Error(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&dialed))
+}
+
+func TestPipelineErrorMetrics(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	errCount := func(id, name string) int64 {
+		v := getVarMap("client", id, "error").Get(name)
+		if v == nil {
+			return 0
+		}
+		return v.(*expvar.Int).Value()
+	}
+
+	// Failure to connect
+	p := NewPipeline("test-metrics-open", "localhost:53", testDialer(func(address string) (*dns.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	}), 0)
+	_, err := p.Resolve(context.Background(), q, time.Second)
+	require.Error(t, err)
+	require.Equal(t, int64(1), errCount("test-metrics-open", "open"))
+	require.Equal(t, int64(0), errCount("test-metrics-open", "handshake_error"))
+
+	// Failure in the handshake
+	p = NewPipeline("test-metrics-handshake", "localhost:53", testDialer(func(address string) (*dns.Conn, error) {
+		return nil, x509.UnknownAuthorityError{}
+	}), 0)
+	_, err = p.Resolve(context.Background(), q, time.Second)
+	require.Error(t, err)
+	require.Equal(t, int64(1), errCount("test-metrics-handshake", "handshake_error"))
+	require.Equal(t, int64(1), errCount("test-metrics-handshake", "open"))
+
+	// Failure to write to the connection
+	p = NewPipeline("test-metrics-write", "localhost:53", testDialer(func(address string) (*dns.Conn, error) {
+		client, server := net.Pipe()
+		server.Close()
+		return &dns.Conn{Conn: client}, nil
+	}), 0)
+	_, err = p.Resolve(context.Background(), q, time.Second)
+	require.Error(t, err)
+	require.Equal(t, int64(1), errCount("test-metrics-write", "write_error"))
+	require.Equal(t, int64(1), errCount("test-metrics-write", "send_query"))
+
+	// Connection that never answers
+	p = NewPipeline("test-metrics-timeout", "localhost:53", testDialer(func(address string) (*dns.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			c := &dns.Conn{Conn: server}
+			for {
+				if _, err := c.ReadMsg(); err != nil {
+					return
+				}
+			}
+		}()
+		return &dns.Conn{Conn: client}, nil
+	}), 0)
+	_, err = p.Resolve(context.Background(), q, 2*time.Second)
+	require.Error(t, err)
+	require.GreaterOrEqual(t, errCount("test-metrics-timeout", "read_timeout"), int64(1))
+	require.Equal(t, errCount("test-metrics-timeout", "read_timeout"), errCount("test-metrics-timeout", "stall"))
+
+	// Response codes are counted by code
+	p = NewPipeline("test-metrics-rcode", "localhost:53", testDialer(func(address string) (*dns.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			c := &dns.Conn{Conn: server}
+			for {
+				q, err := c.ReadMsg()
+				if err != nil {
+					return
+				}
+				a := new(dns.Msg)
+				a.SetRcode(q, dns.RcodeServerFailure)
+				_ = c.WriteMsg(a)
+			}
+		}()
+		return &dns.Conn{Conn: client}, nil
+	}), 0)
+	_, err = p.Resolve(context.Background(), q, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "1", getVarMap("client", "test-metrics-rcode", "response").Get("SERVFAIL").String())
+}
+
+func TestPipelineIdleTimeout(t *testing.T) {
+	// Server that answers everything and reports when the connection is closed
+	closed := make(chan struct{})
+	df := func(address string) (*dns.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer close(closed)
+			c := &dns.Conn{Conn: server}
+			for {
+				q, err := c.ReadMsg()
+				if err != nil {
+					return
+				}
+				a := new(dns.Msg)
+				a.SetReply(q)
+				_ = c.WriteMsg(a)
+			}
+		}()
+		return &dns.Conn{Conn: client}, nil
+	}
+	p := NewPipeline("test-idle", "localhost:53", testDialer(df), 200*time.Millisecond)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err := p.Resolve(context.Background(), q, time.Second)
+	require.NoError(t, err)
+
+	// The connection is closed after the configured idle timeout, not the default
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection not closed")
+	}
+}
+
+func TestPipelineDrain(t *testing.T) {
+	// Server that answers after a delay
+	var conns int32
+	df := func(address string) (*dns.Conn, error) {
+		atomic.AddInt32(&conns, 1)
+		client, server := net.Pipe()
+		go func() {
+			c := &dns.Conn{Conn: server}
+			defer func() {
+				c.Close()
+				atomic.AddInt32(&conns, -1)
+			}()
+			for {
+				q, err := c.ReadMsg()
+				if err != nil {
+					return
+				}
+				go func() {
+					time.Sleep(200 * time.Millisecond)
+					a := new(dns.Msg)
+					a.SetReply(q)
+					_ = c.WriteMsg(a)
+				}()
+			}
+		}()
+		return &dns.Conn{Conn: client}, nil
+	}
+	p := NewPipeline("test-drain", "localhost:53", testDialer(df), 0)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Start a query, then drain the pipeline while it's in flight
+	type result struct {
+		a   *dns.Msg
+		err error
+	}
+	inFlight := make(chan result)
+	go func() {
+		a, err := p.Resolve(context.Background(), q, 2*time.Second)
+		inFlight <- result{a, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	drained := make(chan error)
+	go func() { drained <- p.Drain(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// New queries are rejected while draining
+	_, err := p.Resolve(context.Background(), q, 2*time.Second)
+	require.ErrorIs(t, err, ErrDraining)
+
+	// The query in flight still completes, followed by the drain
+	r := <-inFlight
+	require.NoError(t, r.err)
+	require.NotNil(t, r.a)
+	require.NoError(t, <-drained)
+
+	// The connection is closed once drained
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&conns) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestPipelineDrainTimeout(t *testing.T) {
+	// Server that never answers
+	df := func(address string) (*dns.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			c := &dns.Conn{Conn: server}
+			for {
+				if _, err := c.ReadMsg(); err != nil {
+					return
+				}
+			}
+		}()
+		return &dns.Conn{Conn: client}, nil
+	}
+	p := NewPipeline("test-drain-timeout", "localhost:53", testDialer(df), 0)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	inFlight := make(chan error)
+	go func() {
+		_, err := p.Resolve(context.Background(), q, 5*time.Second)
+		inFlight <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The drain gives up after the deadline and fails the outstanding query
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, p.Drain(ctx), context.DeadlineExceeded)
+	select {
+	case err := <-inFlight:
+		require.ErrorIs(t, err, ErrDraining)
+	case <-time.After(time.Second):
+		t.Fatal("outstanding query was not failed")
+	}
+}
@@ -0,0 +1,143 @@
+package rdns
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+// Time limit for establishing a connection to an upstream resolver through a
+// proxy, including the TLS handshake. Same as the default of the DNS library.
+const proxyDialTimeout = 2 * time.Second
+
+// Returns a dialer that connects through the proxy given in proxyURL. Supported
+// schemes are socks5, socks5h and http (CONNECT). The connection to the proxy
+// itself is made with forward, which can be nil.
+func newProxyDialer(proxyURL string, forward *net.Dialer) (proxy.ContextDialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse proxy url '%s': %w", proxyURL, err)
+	}
+	if forward == nil {
+		forward = new(net.Dialer)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, forward)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer), nil
+	case "http":
+		d := &httpProxyDialer{forward: forward, addr: u.Host}
+		if u.Port() == "" {
+			d.addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			d.auth = base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s'", u.Scheme)
+	}
+}
+
+// httpProxyDialer opens connections through an HTTP proxy with the CONNECT
+// method.
+type httpProxyDialer struct {
+	forward *net.Dialer
+	addr    string
+	auth    string // base64-encoded basic auth credentials, if any
+}
+
+func (d *httpProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("unsupported network '%s' for http proxy", network)
+	}
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+d.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused connection to '%s': %s", addr, resp.Status)
+	}
+	// DNS servers don't talk first, anything buffered here would be lost
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, errors.New("unexpected data from proxy after connect")
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// proxyDNSDialer is a DNSDialer that connects to upstream resolvers through a
+// proxy. If a TLS config is set, TLS is negotiated over the proxied connection.
+type proxyDNSDialer struct {
+	dialer    proxy.ContextDialer
+	tlsConfig *tls.Config
+}
+
+var _ DNSDialer = proxyDNSDialer{}
+
+func (d proxyDNSDialer) Dial(address string) (*dns.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	defer cancel()
+	conn, err := d.dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if d.tlsConfig == nil {
+		return &dns.Conn{Conn: conn}, nil
+	}
+	tlsConfig := d.tlsConfig
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &dns.Conn{Conn: tlsConn}, nil
+}
@@ -0,0 +1,214 @@
+package rdns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Minimal SOCKS5 proxy without authentication that supports CONNECT. Records
+// the addresses it connects to.
+type testSOCKS5Proxy struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	targets []string
+}
+
+func newTestSOCKS5Proxy(t *testing.T) *testSOCKS5Proxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	p := &testSOCKS5Proxy{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(conn)
+		}
+	}()
+	return p
+}
+
+func (p *testSOCKS5Proxy) handle(conn net.Conn) {
+	defer conn.Close()
+	// Greeting with the list of auth methods, only "no auth" is accepted
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, b[1])); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+	// Connect request
+	b = make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return
+	}
+	var host string
+	switch b[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func (p *testSOCKS5Proxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.targets
+}
+
+func TestProxySOCKS5(t *testing.T) {
+	proxy := newTestSOCKS5Proxy(t)
+	defer proxy.ln.Close()
+
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	s := NewDNSListener("test-ln", addr, "tcp", ListenOptions{}, upstream)
+	go s.Start()
+	defer s.Shutdown()
+	time.Sleep(time.Second)
+
+	c, err := NewDNSClient("test-tcp", addr, "tcp", DNSClientOptions{ProxyURL: "socks5://" + proxy.ln.Addr().String()})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+	require.Equal(t, []string{addr}, proxy.Targets())
+}
+
+func TestProxyHTTPConnect(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		targets []string
+	)
+	proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	proxy := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodConnect {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			mu.Lock()
+			targets = append(targets, r.Host)
+			mu.Unlock()
+			upstream, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer upstream.Close()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+				return
+			}
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}),
+	}
+	go proxy.Serve(proxyLn)
+	defer proxy.Close()
+
+	upstream := new(TestResolver)
+	addr, err := getLnAddress()
+	require.NoError(t, err)
+	tlsServerConfig, err := TLSServerConfig("", "testdata/server.crt", "testdata/server.key", false)
+	require.NoError(t, err)
+	s := NewDoTListener("test-ln", addr, DoTListenerOptions{TLSConfig: tlsServerConfig}, upstream)
+	go s.Start()
+	defer s.Stop()
+	time.Sleep(time.Second)
+
+	tlsConfig, err := TLSClientConfig("testdata/ca.crt", "", "")
+	require.NoError(t, err)
+	c, err := NewDoTClient("test-dot", addr, DoTClientOptions{
+		TLSConfig: tlsConfig,
+		ProxyURL:  "http://" + proxyLn.Addr().String(),
+	})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = c.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+	mu.Lock()
+	require.Equal(t, []string{addr}, targets)
+	mu.Unlock()
+}
+
+func TestProxyLocalAddrExclusive(t *testing.T) {
+	_, err := NewDoTClient("test-dot", "127.0.0.1:853", DoTClientOptions{
+		LocalAddr: net.ParseIP("127.0.0.1"),
+		ProxyURL:  "socks5://127.0.0.1:1080",
+	})
+	require.Error(t, err)
+
+	_, err = NewDNSClient("test-tcp", "127.0.0.1:53", "tcp", DNSClientOptions{
+		LocalAddr: net.ParseIP("127.0.0.1"),
+		ProxyURL:  "socks5://127.0.0.1:1080",
+	})
+	require.Error(t, err)
+
+	_, err = NewDoHClient("test-doh", "https://127.0.0.1/dns-query", DoHClientOptions{
+		LocalAddr: net.ParseIP("127.0.0.1"),
+		ProxyURL:  "socks5://127.0.0.1:1080",
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,171 @@
+package rdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// PTRResolver is a resolver that answers reverse lookups (PTR queries in
+// in-addr.arpa and ip6.arpa) for configured addresses and networks locally.
+// Names are either configured for individual IPs, or generated from a
+// template for all IPs in a network. All other queries are forwarded to the
+// upstream resolver.
+type PTRResolver struct {
+	id string
+	PTRResolverOptions
+	resolver Resolver
+	names    map[string]string // by IP in its string form
+}
+
+var _ Resolver = &PTRResolver{}
+
+type PTRResolverOptions struct {
+	// Names of individual IPs. Take precedence over templates.
+	Names map[string]string
+
+	// Templates generating names for the IPs in networks. If networks
+	// overlap, the most specific one is used.
+	Templates []PTRTemplate
+}
+
+// PTRTemplate is used to generate the names of IPs in a network. In
+// Template, "{ip-dashed}" is replaced with the IP using dashes as separators,
+// for example "host-{ip-dashed}.internal" results in
+// "host-192-168-1-10.internal" or "host-2001-db8-0-0-0-0-0-1.internal".
+type PTRTemplate struct {
+	Network  *net.IPNet
+	Template string
+}
+
+// NewPTRResolver returns a new instance of a PTR resolver.
+func NewPTRResolver(id string, resolver Resolver, opt PTRResolverOptions) (*PTRResolver, error) {
+	names := make(map[string]string, len(opt.Names))
+	for s, name := range opt.Names {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address '%s' in ptr names", s)
+		}
+		names[ip.String()] = name
+	}
+	for _, t := range opt.Templates {
+		if t.Network == nil || t.Template == "" {
+			return nil, errors.New("ptr template requires a network and template")
+		}
+	}
+	return &PTRResolver{
+		id:                 id,
+		PTRResolverOptions: opt,
+		resolver:           resolver,
+		names:              names,
+	}, nil
+}
+
+// Resolve a DNS query by answering reverse lookups for known IPs, and
+// forwarding everything else upstream.
+func (r *PTRResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	if question.Qtype != dns.TypePTR {
+		return r.resolver.Resolve(q, ci)
+	}
+	ip := reverseAddrToIP(question.Name)
+	if ip == nil {
+		return r.resolver.Resolve(q, ci)
+	}
+	name, ok := r.lookup(ip)
+	if !ok {
+		return r.resolver.Resolve(q, ci)
+	}
+	logger(r.id, q, ci).WithField("ptr", name).Debug("answering ptr query")
+	return ptr(q, name), nil
+}
+
+func (r *PTRResolver) String() string {
+	return r.id
+}
+
+// Returns the name of an IP from the explicit names, or the template of the
+// most specific network.
+func (r *PTRResolver) lookup(ip net.IP) (string, bool) {
+	if name, ok := r.names[ip.String()]; ok {
+		return name, true
+	}
+	var (
+		match  *PTRTemplate
+		prefix int
+	)
+	for i, t := range r.Templates {
+		if !t.Network.Contains(ip) {
+			continue
+		}
+		if ones, _ := t.Network.Mask.Size(); match == nil || ones > prefix {
+			match, prefix = &r.Templates[i], ones
+		}
+	}
+	if match == nil {
+		return "", false
+	}
+	return strings.ReplaceAll(match.Template, "{ip-dashed}", ipDashed(ip)), true
+}
+
+// Returns the IP of a full reverse lookup name like 10.2.0.192.in-addr.arpa.
+// or the nibble format in ip6.arpa. Returns nil for any other name.
+func reverseAddrToIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			b, err := strconv.ParseUint(label, 10, 8)
+			if err != nil || (len(label) > 1 && label[0] == '0') {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(b)
+		}
+		return ip
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 16, 8)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			j := 2*net.IPv6len - 1 - i // nibble index, most significant first
+			if j%2 == 0 {
+				ip[j/2] |= byte(n) << 4
+			} else {
+				ip[j/2] |= byte(n)
+			}
+		}
+		return ip
+	}
+	return nil
+}
+
+// Returns the IP with dashes as separators, 192-168-1-10 for IPv4 and
+// 2001-db8-0-0-0-0-0-1 for IPv6 (without shortening zeros).
+func ipDashed(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strings.ReplaceAll(ip4.String(), ".", "-")
+	}
+	groups := make([]string, 0, net.IPv6len/2)
+	for i := 0; i < net.IPv6len; i += 2 {
+		groups = append(groups, strconv.FormatUint(uint64(ip[i])<<8|uint64(ip[i+1]), 16))
+	}
+	return strings.Join(groups, "-")
+}
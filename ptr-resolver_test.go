@@ -0,0 +1,95 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPTRResolver(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	cidr := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return n
+	}
+	r, err := NewPTRResolver("test-ptr", upstream, PTRResolverOptions{
+		Names: map[string]string{
+			"192.168.1.1": "router.internal",
+			"2001:db8::1": "router6.internal.",
+		},
+		Templates: []PTRTemplate{
+			{Network: cidr("192.168.0.0/16"), Template: "host-{ip-dashed}.internal"},
+			{Network: cidr("192.168.2.0/24"), Template: "lab-{ip-dashed}.internal"},
+			{Network: cidr("2001:db8::/32"), Template: "host-{ip-dashed}.v6.internal"},
+		},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"192.168.1.1", "router.internal."},
+		{"192.168.1.10", "host-192-168-1-10.internal."},
+		{"192.168.2.10", "lab-192-168-2-10.internal."},
+		{"2001:db8::1", "router6.internal."},
+		{"2001:db8::abcd:2", "host-2001-db8-0-0-0-0-abcd-2.v6.internal."},
+	}
+	for _, test := range tests {
+		name, err := dns.ReverseAddr(test.ip)
+		require.NoError(t, err)
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypePTR)
+		a, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Len(t, a.Answer, 1, test.ip)
+		answer, ok := a.Answer[0].(*dns.PTR)
+		require.True(t, ok)
+		require.Equal(t, name, answer.Hdr.Name)
+		require.Equal(t, test.expected, answer.Ptr)
+	}
+	require.Equal(t, 0, upstream.HitCount())
+
+	// Queries that are not for a known IP are forwarded upstream
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"10.0.0.10.in-addr.arpa.", dns.TypePTR},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.a.f.2.ip6.arpa.", dns.TypePTR},
+		{"168.192.in-addr.arpa.", dns.TypePTR},
+		{"10.1.168.192.in-addr.arpa.", dns.TypeA},
+		{"example.com.", dns.TypePTR},
+	} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(q.name, q.qtype)
+		_, err := r.Resolve(msg, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 5, upstream.HitCount())
+}
+
+func TestReverseAddrToIP(t *testing.T) {
+	for _, ip := range []string{"192.0.2.1", "0.0.0.0", "2001:db8::1", "::1", "fe80::1:2:3:4"} {
+		name, err := dns.ReverseAddr(ip)
+		require.NoError(t, err)
+		require.True(t, net.ParseIP(ip).Equal(reverseAddrToIP(name)), ip)
+	}
+	for _, name := range []string{"1.2.0.192.IN-ADDR.ARPA.", "1.2.0.192.in-addr.arpa"} {
+		require.Equal(t, "192.0.2.1", reverseAddrToIP(name).String())
+	}
+	for _, name := range []string{
+		"2.0.192.in-addr.arpa.",
+		"256.2.0.192.in-addr.arpa.",
+		"01.2.0.192.in-addr.arpa.",
+		"x.2.0.192.in-addr.arpa.",
+		"1.0.ip6.arpa.",
+		"example.com.",
+	} {
+		require.Nil(t, reverseAddrToIP(name), name)
+	}
+}
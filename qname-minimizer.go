@@ -0,0 +1,271 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// QNameMinimizer is a resolver that implements QNAME minimisation as described in
+// RFC 7816. It resolves names iteratively, starting at the upstream resolver which
+// is expected to be authoritative for the root zone or a TLD. Rather than sending
+// the full name to every server in the chain, it walks down the name label by
+// label with NS queries, follows the referrals to the servers of each child zone
+// and only sends the full query to the servers of the zone the name is in.
+type QNameMinimizer struct {
+	id       string
+	resolver Resolver
+	opt      QNameMinimizerOptions
+
+	mu      sync.Mutex
+	clients map[string]Resolver
+}
+
+var _ Resolver = &QNameMinimizer{}
+
+type QNameMinimizerOptions struct {
+	// Maximum number of minimised queries to send for a name, after which the
+	// full name is used. Default 10.
+	MaxLabels int
+
+	// Returns a resolver for the nameserver at the given address when following
+	// a referral. Defaults to a plain DNS client over UDP on port 53.
+	NewResolver func(addr string) (Resolver, error)
+}
+
+// Maximum number of CNAME records in a chain that will be followed.
+const qnameMaxCNAMEChain = 8
+
+// Maximum number of referrals that are followed for the full query name, used
+// when minimisation stopped before reaching the zone of the name.
+const qnameMaxReferrals = 8
+
+// NewQNameMinimizer returns a new instance of a QNAME minimising resolver.
+func NewQNameMinimizer(id string, resolver Resolver, opt QNameMinimizerOptions) *QNameMinimizer {
+	if opt.MaxLabels <= 0 {
+		opt.MaxLabels = 10
+	}
+	if opt.NewResolver == nil {
+		opt.NewResolver = func(addr string) (Resolver, error) {
+			return NewDNSClient(id+"-"+addr, net.JoinHostPort(addr, "53"), "udp", DNSClientOptions{})
+		}
+	}
+	return &QNameMinimizer{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		clients:  make(map[string]Resolver),
+	}
+}
+
+// Resolve a DNS query by walking down the delegations of the name with minimised
+// queries, and sending the full query to the servers of its zone.
+func (r *QNameMinimizer) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	a, err := r.resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+
+	// If the response ends in a CNAME to a name in another zone, resolve the
+	// target from the top as well.
+	for i := 0; i < qnameMaxCNAMEChain; i++ {
+		target := unresolvedCNAME(a, question)
+		if target == "" {
+			break
+		}
+		logger(r.id, q, ci).WithField("target", target).Debug("following cname")
+		tq := q.Copy()
+		tq.Question[0].Name = target
+		ta, err := r.resolve(tq, ci)
+		if err != nil || ta == nil {
+			return ta, err
+		}
+		a.Answer = append(a.Answer, ta.Answer...)
+		a.Ns = ta.Ns
+		a.Extra = ta.Extra
+		a.Rcode = ta.Rcode
+	}
+	return a, nil
+}
+
+func (r *QNameMinimizer) String() string {
+	return r.id
+}
+
+// Resolves a single name, without following CNAMEs.
+func (r *QNameMinimizer) resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	name := q.Question[0].Name
+	zone, resolver := r.minimize(q, ci, name)
+
+	// Send the full query to the servers of the closest zone found. If
+	// minimisation stopped early, they may still refer to a child zone.
+	log := logger(r.id, q, ci)
+	for i := 0; ; i++ {
+		a, err := resolver.Resolve(q, ci)
+		if err != nil || a == nil {
+			return a, err
+		}
+		child, next, ok := r.referral(a, zone, name)
+		if !ok || i >= qnameMaxReferrals {
+			return a, nil
+		}
+		log.WithField("zone", child).Debug("following referral")
+		zone, resolver = child, next
+	}
+}
+
+// Sends NS queries for all parents of the name, starting below the zone of the
+// upstream resolver, and follows any referrals. Returns the closest zone that
+// was found, and the resolver for it. Stops early if a server doesn't cooperate,
+// in which case the caller continues with the full name.
+func (r *QNameMinimizer) minimize(q *dns.Msg, ci ClientInfo, name string) (string, Resolver) {
+	log := logger(r.id, q, ci)
+	zone, resolver := ".", r.resolver
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		if i > r.opt.MaxLabels {
+			log.Debug("max labels reached, using full name")
+			break
+		}
+		sub := dns.Fqdn(strings.Join(labels[len(labels)-i:], "."))
+		m := new(dns.Msg)
+		m.SetQuestion(sub, dns.TypeNS)
+		m.RecursionDesired = q.RecursionDesired
+		m.CheckingDisabled = q.CheckingDisabled
+		log.WithField("qname", sub).WithField("zone", zone).Debug("sending minimised query")
+		a, err := resolver.Resolve(m, ci)
+		if err != nil || a == nil {
+			log.WithField("qname", sub).WithError(err).Debug("minimised query failed, using full name")
+			break
+		}
+
+		// Any response other than NOERROR, including NXDOMAIN which broken
+		// servers return for empty non-terminals, as well as an alias, means
+		// falling back to the full name.
+		if a.Rcode != dns.RcodeSuccess || hasCNAME(a, sub) {
+			log.WithField("qname", sub).Debug("unexpected response to minimised query, using full name")
+			break
+		}
+
+		// A referral means the name is the apex of a child zone. Without one,
+		// the name is either in the same zone or an empty non-terminal. In
+		// both cases carry on with the next label on the same servers.
+		if child, next, ok := r.referral(a, zone, sub); ok {
+			zone, resolver = child, next
+		}
+	}
+	return zone, resolver
+}
+
+// Returns the child zone and a resolver for its servers if the response is a
+// referral from the given zone to a zone at or above the name. Referrals that
+// can't be followed because they lack glue records are ignored.
+func (r *QNameMinimizer) referral(a *dns.Msg, zone, name string) (string, Resolver, bool) {
+	if a.Rcode != dns.RcodeSuccess || len(a.Answer) > 0 {
+		return "", nil, false
+	}
+	var (
+		child string
+		hosts = make(map[string]bool)
+	)
+	for _, rr := range a.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := ns.Hdr.Name
+		if strings.EqualFold(owner, zone) || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		child = owner
+		hosts[strings.ToLower(ns.Ns)] = true
+	}
+	if child == "" {
+		return "", nil, false
+	}
+	for _, rr := range a.Extra {
+		var ip net.IP
+		switch glue := rr.(type) {
+		case *dns.A:
+			ip = glue.A
+		case *dns.AAAA:
+			ip = glue.AAAA
+		default:
+			continue
+		}
+		if !hosts[strings.ToLower(rr.Header().Name)] {
+			continue
+		}
+		resolver, err := r.client(ip.String())
+		if err != nil {
+			continue
+		}
+		return child, resolver, true
+	}
+	return "", nil, false
+}
+
+// Returns the resolver for a nameserver, creating it on first use.
+func (r *QNameMinimizer) client(addr string) (Resolver, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if resolver, ok := r.clients[addr]; ok {
+		return resolver, nil
+	}
+	resolver, err := r.opt.NewResolver(addr)
+	if err != nil {
+		return nil, err
+	}
+	r.clients[addr] = resolver
+	return resolver, nil
+}
+
+// Returns true if the answer contains a CNAME for the name.
+func hasCNAME(a *dns.Msg, name string) bool {
+	for _, rr := range a.Answer {
+		if rr.Header().Rrtype == dns.TypeCNAME && strings.EqualFold(rr.Header().Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Follows the CNAME chain in the answer, starting at the name in the question,
+// and returns the target name if no record of the queried type exists for it.
+// Returns an empty string if the answer is complete.
+func unresolvedCNAME(a *dns.Msg, question dns.Question) string {
+	if a.Rcode != dns.RcodeSuccess || question.Qtype == dns.TypeCNAME {
+		return ""
+	}
+	name := question.Name
+	for i := 0; i <= len(a.Answer); i++ {
+		var next string
+		for _, rr := range a.Answer {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, name) {
+				continue
+			}
+			if h.Rrtype == question.Qtype {
+				return ""
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	if name == question.Name {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,219 @@
+package rdns
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Authoritative server of a zone in a tree of test servers. Names below a
+// delegation are answered with a referral, all others from the records.
+type qnameTestServer struct {
+	name        string
+	addr        string
+	zone        string
+	delegations map[string]string // zone -> address of its server
+	records     []string
+	rcodes      map[string]int // Fixed response codes by name, for servers that don't cooperate
+}
+
+// Tree of authoritative test servers that records the queries sent to them.
+type qnameTestTree struct {
+	servers map[string]*qnameTestServer // by address
+	mu      sync.Mutex
+	queries []string
+}
+
+func (t *qnameTestTree) resolver(addr string) *TestResolver {
+	s := t.servers[addr]
+	return &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			question := q.Question[0]
+			t.mu.Lock()
+			t.queries = append(t.queries, s.name+" "+question.Name+" "+dns.TypeToString[question.Qtype])
+			t.mu.Unlock()
+			a := new(dns.Msg)
+			a.SetReply(q)
+			if rcode, ok := s.rcodes[question.Name]; ok {
+				a.Rcode = rcode
+				return a, nil
+			}
+			for zone, addr := range s.delegations {
+				if dns.IsSubDomain(zone, question.Name) {
+					host := "ns." + zone
+					a.Ns = append(a.Ns, rr(zone+" 60 IN NS "+host))
+					a.Extra = append(a.Extra, rr(host+" 60 IN A "+addr))
+					return a, nil
+				}
+			}
+			var exists bool
+			for _, record := range s.records {
+				r := rr(record)
+				h := r.Header()
+				if h.Name == question.Name && (h.Rrtype == question.Qtype || h.Rrtype == dns.TypeCNAME) {
+					a.Answer = append(a.Answer, r)
+				}
+				if dns.IsSubDomain(question.Name, h.Name) {
+					exists = true
+				}
+			}
+			a.Authoritative = true
+			if len(a.Answer) == 0 {
+				if !exists && question.Name != s.zone {
+					a.Rcode = dns.RcodeNameError
+				}
+				a.Ns = append(a.Ns, rr(s.zone+" 60 IN SOA ns."+s.zone+" hostmaster."+s.zone+" 1 60 60 60 60"))
+			}
+			return a, nil
+		},
+	}
+}
+
+func newQNameTestTree(rcodes map[string]int) *qnameTestTree {
+	servers := []*qnameTestServer{
+		{
+			name:        "root",
+			addr:        "root",
+			zone:        ".",
+			delegations: map[string]string{"com.": "10.0.0.1", "net.": "10.0.0.3"},
+		},
+		{
+			name:        "com",
+			addr:        "10.0.0.1",
+			zone:        "com.",
+			delegations: map[string]string{"example.com.": "10.0.0.2"},
+		},
+		{
+			name: "example.com",
+			addr: "10.0.0.2",
+			zone: "example.com.",
+			records: []string{
+				"www.example.com. 60 IN A 1.2.3.4",
+				"a.b.example.com. 60 IN A 1.2.3.5",
+				"alias.example.com. 60 IN CNAME cdn.example.net.",
+			},
+		},
+		{
+			name:        "net",
+			addr:        "10.0.0.3",
+			zone:        "net.",
+			delegations: map[string]string{"example.net.": "10.0.0.4"},
+		},
+		{
+			name:    "example.net",
+			addr:    "10.0.0.4",
+			zone:    "example.net.",
+			records: []string{"cdn.example.net. 60 IN A 1.2.3.6"},
+		},
+	}
+	t := &qnameTestTree{servers: make(map[string]*qnameTestServer)}
+	for _, s := range servers {
+		s.rcodes = rcodes
+		t.servers[s.addr] = s
+	}
+	return t
+}
+
+func TestQNameMinimizer(t *testing.T) {
+	tests := map[string]struct {
+		name    string
+		opt     QNameMinimizerOptions
+		rcodes  map[string]int // Uncooperative responses, by name
+		queries []string
+		answers int
+		rcode   int
+	}{
+		"simple": {
+			name: "www.example.com.",
+			queries: []string{
+				"root com. NS",
+				"com example.com. NS",
+				"example.com www.example.com. A",
+			},
+			answers: 1,
+		},
+		"empty non-terminal": {
+			name: "a.b.example.com.",
+			queries: []string{
+				"root com. NS",
+				"com example.com. NS",
+				"example.com b.example.com. NS",
+				"example.com a.b.example.com. A",
+			},
+			answers: 1,
+		},
+		"nxdomain": {
+			name: "x.y.example.com.",
+			queries: []string{
+				"root com. NS",
+				"com example.com. NS",
+				"example.com y.example.com. NS",
+				"example.com x.y.example.com. A",
+			},
+			rcode: dns.RcodeNameError,
+		},
+		"refused fallback": {
+			name:   "www.example.com.",
+			rcodes: map[string]int{"example.com.": dns.RcodeRefused},
+			queries: []string{
+				"root com. NS",
+				"com example.com. NS",
+				"com www.example.com. A",
+				"example.com www.example.com. A",
+			},
+			answers: 1,
+		},
+		"max labels": {
+			name: "www.example.com.",
+			opt:  QNameMinimizerOptions{MaxLabels: 1},
+			queries: []string{
+				"root com. NS",
+				"com www.example.com. A",
+				"example.com www.example.com. A",
+			},
+			answers: 1,
+		},
+		"cname chain": {
+			name: "alias.example.com.",
+			queries: []string{
+				"root com. NS",
+				"com example.com. NS",
+				"example.com alias.example.com. A",
+				"root net. NS",
+				"net example.net. NS",
+				"example.net cdn.example.net. A",
+			},
+			answers: 2,
+		},
+		"cname at parent": {
+			name: "www.alias.example.com.",
+			queries: []string{
+				"root com. NS",
+				"com example.com. NS",
+				"example.com alias.example.com. NS",
+				"example.com www.alias.example.com. A",
+			},
+			rcode: dns.RcodeNameError,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tree := newQNameTestTree(test.rcodes)
+			opt := test.opt
+			opt.NewResolver = func(addr string) (Resolver, error) {
+				return tree.resolver(addr), nil
+			}
+			m := NewQNameMinimizer("test-qmin", tree.resolver("root"), opt)
+
+			q := new(dns.Msg)
+			q.SetQuestion(test.name, dns.TypeA)
+			a, err := m.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+			require.Equal(t, test.queries, tree.queries)
+			require.Len(t, a.Answer, test.answers)
+			require.Equal(t, test.rcode, a.Rcode)
+		})
+	}
+}
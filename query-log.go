@@ -0,0 +1,122 @@
+package rdns
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryLog is a modifier that writes a JSON record for every query passing
+// through it, containing the client, the question, the response code and the
+// time it took the upstream resolver to respond.
+type QueryLog struct {
+	// Number of queries seen, updated atomically. First in the struct to be
+	// 64-bit aligned on 32-bit platforms.
+	count uint64
+
+	id       string
+	resolver Resolver
+	opt      QueryLogOptions
+	mu       sync.Mutex
+	enc      *json.Encoder
+}
+
+var _ Resolver = &QueryLog{}
+
+// QueryLogOptions contain settings for the query logger.
+type QueryLogOptions struct {
+	// Writer the records are written to, one JSON object per line. Defaults
+	// to stdout.
+	Output io.Writer
+
+	// Only log one in every SampleRate queries. All queries are logged if 0 or 1.
+	SampleRate uint64
+
+	// Only log queries that failed with an error or returned a response code
+	// other than NOERROR, like NXDOMAIN or SERVFAIL.
+	FailuresOnly bool
+}
+
+// Record written for every query.
+type queryLogRecord struct {
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id"`
+	Request  uint64    `json:"request,omitempty"`
+	Client   string    `json:"client,omitempty"`
+	Protocol string    `json:"protocol,omitempty"`
+	Name     string    `json:"qname"`
+	Type     string    `json:"qtype"`
+	RCode    string    `json:"rcode,omitempty"`
+	Answers  int       `json:"answers"`
+	Resolver string    `json:"resolver"`
+	Latency  float64   `json:"latency_ms"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// NewQueryLog returns a new instance of a query logger.
+func NewQueryLog(id string, resolver Resolver, opt QueryLogOptions) *QueryLog {
+	if opt.Output == nil {
+		opt.Output = os.Stdout
+	}
+	return &QueryLog{
+		id:       id,
+		resolver: resolver,
+		opt:      opt,
+		enc:      json.NewEncoder(opt.Output),
+	}
+}
+
+// Resolve a DNS query with the upstream resolver and log it.
+func (r *QueryLog) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	start := time.Now()
+	a, err := r.resolver.Resolve(q, ci)
+	latency := time.Since(start)
+
+	if r.opt.FailuresOnly && err == nil && a != nil && a.Rcode == dns.RcodeSuccess {
+		return a, err
+	}
+	if r.opt.SampleRate > 1 && (atomic.AddUint64(&r.count, 1)-1)%r.opt.SampleRate != 0 {
+		return a, err
+	}
+
+	rec := queryLogRecord{
+		Time:     start,
+		ID:       r.id,
+		Request:  ci.RequestID,
+		Protocol: string(ci.Protocol),
+		Resolver: r.resolver.String(),
+		Latency:  float64(latency) / float64(time.Millisecond),
+	}
+	if ci.SourceIP != nil {
+		rec.Client = ci.SourceIP.String()
+	}
+	if len(q.Question) > 0 {
+		rec.Name = q.Question[0].Name
+		rec.Type = dns.TypeToString[q.Question[0].Qtype]
+	}
+	switch {
+	case err != nil:
+		rec.Error = err.Error()
+	case a == nil:
+		rec.RCode = "DROP"
+	default:
+		rec.RCode = dns.RcodeToString[a.Rcode]
+		rec.Answers = len(a.Answer)
+	}
+
+	r.mu.Lock()
+	if werr := r.enc.Encode(rec); werr != nil {
+		logger(r.id, q, ci).WithError(werr).Error("failed to write query log")
+	}
+	r.mu.Unlock()
+	return a, err
+}
+
+func (r *QueryLog) String() string {
+	return r.id
+}
@@ -0,0 +1,88 @@
+package rdns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog(t *testing.T) {
+	var buf bytes.Buffer
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			switch q.Question[0].Name {
+			case "nx.test.":
+				a.SetRcode(q, dns.RcodeNameError)
+			case "fail.test.":
+				return nil, errors.New("upstream failed")
+			default:
+				a.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IP{192, 0, 2, 1},
+				}}
+			}
+			return a, nil
+		},
+	}
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.10")}
+	resolve := func(r Resolver, name string) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		_, _ = r.Resolve(q, ci)
+	}
+	records := func() []map[string]interface{} {
+		var out []map[string]interface{}
+		s := bufio.NewScanner(&buf)
+		for s.Scan() {
+			var rec map[string]interface{}
+			require.NoError(t, json.Unmarshal(s.Bytes(), &rec))
+			out = append(out, rec)
+		}
+		buf.Reset()
+		return out
+	}
+
+	// Log all queries
+	r := NewQueryLog("test-log", upstream, QueryLogOptions{Output: &buf})
+	resolve(r, "ok.test.")
+	resolve(r, "nx.test.")
+	resolve(r, "fail.test.")
+	recs := records()
+	require.Len(t, recs, 3)
+	require.Equal(t, "test-log", recs[0]["id"])
+	require.Equal(t, "192.168.1.10", recs[0]["client"])
+	require.Equal(t, "ok.test.", recs[0]["qname"])
+	require.Equal(t, "A", recs[0]["qtype"])
+	require.Equal(t, "NOERROR", recs[0]["rcode"])
+	require.Equal(t, float64(1), recs[0]["answers"])
+	require.Equal(t, upstream.String(), recs[0]["resolver"])
+	require.Contains(t, recs[0], "latency_ms")
+	require.Contains(t, recs[0], "time")
+	require.Equal(t, "NXDOMAIN", recs[1]["rcode"])
+	require.Equal(t, "upstream failed", recs[2]["error"])
+
+	// Only failures
+	r = NewQueryLog("test-log", upstream, QueryLogOptions{Output: &buf, FailuresOnly: true})
+	resolve(r, "ok.test.")
+	resolve(r, "nx.test.")
+	resolve(r, "fail.test.")
+	recs = records()
+	require.Len(t, recs, 2)
+	require.Equal(t, "nx.test.", recs[0]["qname"])
+	require.Equal(t, "fail.test.", recs[1]["qname"])
+
+	// Sample 1 in 3 queries
+	r = NewQueryLog("test-log", upstream, QueryLogOptions{Output: &buf, SampleRate: 3})
+	for i := 0; i < 9; i++ {
+		resolve(r, "ok.test.")
+	}
+	require.Len(t, records(), 3)
+}
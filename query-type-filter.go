@@ -0,0 +1,124 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// QueryTypeFilter is a resolver that answers queries of some types itself
+// rather than forwarding them, for example to stop ANY queries used in
+// reflection attacks. Queries of all other types are passed on unchanged.
+type QueryTypeFilter struct {
+	id string
+	QueryTypeFilterOptions
+	resolver Resolver
+	filtered *expvar.Map
+}
+
+var _ Resolver = &QueryTypeFilter{}
+
+// QueryTypeAction defines how a filtered query is answered.
+type QueryTypeAction int
+
+const (
+	// Respond with a single synthesized HINFO record as per RFC8482.
+	QueryTypeHINFO QueryTypeAction = iota
+	// Respond with REFUSED.
+	QueryTypeRefuse
+	// Respond with NOTIMP.
+	QueryTypeNotImp
+	// Respond with NOERROR and no answer records.
+	QueryTypeEmpty
+)
+
+// TTL of the HINFO record in filtered responses.
+const queryTypeHINFOTTL = 3600
+
+type QueryTypeFilterOptions struct {
+	// Action for each filtered query type. By default ANY queries are
+	// answered with HINFO.
+	Actions map[uint16]QueryTypeAction
+}
+
+// NewQueryTypeFilter returns a new instance of a query type filter.
+func NewQueryTypeFilter(id string, resolver Resolver, opt QueryTypeFilterOptions) *QueryTypeFilter {
+	if len(opt.Actions) == 0 {
+		opt.Actions = map[uint16]QueryTypeAction{dns.TypeANY: QueryTypeHINFO}
+	}
+	return &QueryTypeFilter{
+		id:                     id,
+		QueryTypeFilterOptions: opt,
+		resolver:               resolver,
+		filtered:               getVarMap("router", id, "qtype"),
+	}
+}
+
+// Resolve a DNS query, or answer it directly if its type is filtered.
+func (r *QueryTypeFilter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	action, ok := r.Actions[question.Qtype]
+	if !ok {
+		return r.resolver.Resolve(q, ci)
+	}
+	logger(r.id, q, ci).WithField("action", action.String()).Debug("filtering query type")
+	r.filtered.Add(dns.TypeToString[question.Qtype], 1)
+
+	switch action {
+	case QueryTypeRefuse:
+		return refused(q), nil
+	case QueryTypeNotImp:
+		return responseWithCode(q, dns.RcodeNotImplemented), nil
+	case QueryTypeEmpty:
+		return responseWithCode(q, dns.RcodeSuccess), nil
+	default:
+		a := new(dns.Msg)
+		a.SetReply(q)
+		a.Answer = []dns.RR{&dns.HINFO{
+			Hdr: dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: dns.TypeHINFO,
+				Class:  question.Qclass,
+				Ttl:    queryTypeHINFOTTL,
+			},
+			Cpu: "RFC8482",
+		}}
+		return a, nil
+	}
+}
+
+func (r *QueryTypeFilter) String() string {
+	return r.id
+}
+
+func (a QueryTypeAction) String() string {
+	switch a {
+	case QueryTypeHINFO:
+		return "hinfo"
+	case QueryTypeRefuse:
+		return "refuse"
+	case QueryTypeNotImp:
+		return "notimp"
+	case QueryTypeEmpty:
+		return "empty"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(a))
+	}
+}
+
+// ParseQueryTypeAction returns the action with the given name, one of
+// "hinfo", "refuse", "notimp" or "empty".
+func ParseQueryTypeAction(s string) (QueryTypeAction, error) {
+	for _, a := range []QueryTypeAction{QueryTypeHINFO, QueryTypeRefuse, QueryTypeNotImp, QueryTypeEmpty} {
+		if strings.EqualFold(s, a.String()) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown query type action '%s'", s)
+}
@@ -0,0 +1,75 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryTypeFilter(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	r := NewQueryTypeFilter("test-qtype", upstream, QueryTypeFilterOptions{
+		Actions: map[uint16]QueryTypeAction{
+			dns.TypeANY:  QueryTypeHINFO,
+			dns.TypeAXFR: QueryTypeRefuse,
+			dns.TypeIXFR: QueryTypeNotImp,
+			dns.TypeNULL: QueryTypeEmpty,
+		},
+	})
+
+	// ANY is answered with a single HINFO record
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeANY)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 1)
+	hinfo, ok := a.Answer[0].(*dns.HINFO)
+	require.True(t, ok)
+	require.Equal(t, "example.com.", hinfo.Hdr.Name)
+	require.Equal(t, "RFC8482", hinfo.Cpu)
+	require.Equal(t, "", hinfo.Os)
+
+	q.SetQuestion("example.com.", dns.TypeAXFR)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+
+	q.SetQuestion("example.com.", dns.TypeIXFR)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNotImplemented, a.Rcode)
+
+	q.SetQuestion("example.com.", dns.TypeNULL)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Empty(t, a.Answer)
+	require.Equal(t, 0, upstream.HitCount())
+
+	// Other types are passed through
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+}
+
+func TestQueryTypeFilterDefault(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	r := NewQueryTypeFilter("test-qtype", upstream, QueryTypeFilterOptions{})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeANY)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, dns.TypeHINFO, a.Answer[0].Header().Rrtype)
+
+	q.SetQuestion("example.com.", dns.TypeAXFR)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+}
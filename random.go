@@ -31,6 +31,11 @@ type RandomOptions struct {
 	// Determines if a SERVFAIL returned by a resolver should be considered an
 	// error response and cause the resolver to be removed from the group temporarily.
 	ServfailError bool
+
+	// Time a resolver in the group is given to respond before the query is
+	// abandoned and sent to the next one, regardless of the resolver's own
+	// timeout. No limit if 0.
+	PerAttemptTimeout time.Duration
 }
 
 // NewRandom returns a new instance of a random resolver group.
@@ -59,7 +64,7 @@ func (r *Random) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 
 		r.metrics.route.Add(resolver.String(), 1)
 		log.WithField("resolver", resolver.String()).Debug("forwarding query to resolver")
-		a, err := resolver.Resolve(q, ci)
+		a, err := resolveWithTimeout(resolver, q, ci, r.opt.PerAttemptTimeout)
 		if err == nil && r.isSuccessResponse(a) { // Return immediately if successful
 			return a, err
 		}
@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"expvar"
+	"math"
 	"net"
 	"sync"
 	"time"
@@ -10,7 +11,8 @@ import (
 )
 
 // RateLimiter is a resolver that limits the number of queries by a client (network)
-// that are passed to the upstream resolver per timeframe.
+// that are passed to the upstream resolver per timeframe. It uses a fixed window
+// by default, or a token bucket per client if a rate is configured.
 type RateLimiter struct {
 	id       string
 	resolver Resolver
@@ -19,6 +21,9 @@ type RateLimiter struct {
 	mu        sync.RWMutex
 	currWinID int64
 	counters  map[string]*uint
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
 	metrics   *RateLimiterMetrics
 }
 
@@ -30,6 +35,20 @@ type RateLimiterOptions struct {
 	Prefix4       uint8    // Netmask to identify IP4 clients
 	Prefix6       uint8    // Netmask to identify IP6 clients
 	LimitResolver Resolver // Alternate resolver for rate-limited requests
+
+	// Number of queries per second allowed for a client when using a token
+	// bucket. Requests and Window are ignored if this is set.
+	Rate float64
+
+	// Maximum number of queries a client can send in a burst when using a token
+	// bucket. Defaults to Rate.
+	Burst uint
+}
+
+// Tokens available to a client, refilled at the configured rate.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
 }
 
 type RateLimiterMetrics struct {
@@ -52,10 +71,15 @@ func NewRateLimiter(id string, resolver Resolver, opt RateLimiterOptions) *RateL
 	if opt.Prefix6 == 0 {
 		opt.Prefix6 = 56
 	}
+	if opt.Rate > 0 && opt.Burst == 0 {
+		opt.Burst = uint(math.Ceil(opt.Rate))
+	}
 	return &RateLimiter{
 		id:                 id,
 		resolver:           resolver,
 		RateLimiterOptions: opt,
+		buckets:            make(map[string]*tokenBucket),
+		now:                time.Now,
 		metrics: &RateLimiterMetrics{
 			query:  getVarInt("router", id, "query"),
 			exceed: getVarInt("router", id, "exceed"),
@@ -78,8 +102,36 @@ func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 	key := source.String()
 
+	var reject bool
+	if r.Rate > 0 {
+		reject = !r.takeToken(key)
+	} else {
+		reject = !r.countRequest(key)
+	}
+
+	if reject {
+		r.metrics.exceed.Add(1)
+		if r.LimitResolver != nil {
+			log.WithField("resolver", r.LimitResolver).Debug("rate-limit exceeded, forwarding to limit-resolver")
+			return r.LimitResolver.Resolve(q, ci)
+		}
+		r.metrics.drop.Add(1)
+		log.Debug("rate-limit reached, dropping")
+		return nil, nil
+	}
+	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
+	return r.resolver.Resolve(q, ci)
+}
+
+func (r *RateLimiter) String() string {
+	return r.id
+}
+
+// Counts the request in the current fixed window. Returns false if the client
+// has exceeded the number of allowed requests.
+func (r *RateLimiter) countRequest(key string) bool {
 	// Calculate the current (fixed) window
-	windowID := time.Now().Unix() / int64(r.Window)
+	windowID := r.now().Unix() / int64(r.Window)
 
 	var reject bool
 	r.mu.Lock()
@@ -103,21 +155,51 @@ func (r *RateLimiter) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 	*v++
 	r.mu.Unlock()
+	return !reject
+}
 
-	if reject {
-		r.metrics.exceed.Add(1)
-		if r.LimitResolver != nil {
-			log.WithField("resolver", r.LimitResolver).Debug("rate-limit exceeded, forwarding to limit-resolver")
-			return r.LimitResolver.Resolve(q, ci)
-		}
-		r.metrics.drop.Add(1)
-		log.Debug("rate-limit reached, dropping")
-		return nil, nil
+// Takes a token from the bucket of the client. Returns false if there are no
+// tokens left.
+func (r *RateLimiter) takeToken(key string) bool {
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sweep(now)
+
+	// Clients without bucket start with a full one
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(r.Burst), last: now}
+		r.buckets[key] = b
 	}
-	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
-	return r.resolver.Resolve(q, ci)
+	b.tokens = r.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
 }
 
-func (r *RateLimiter) String() string {
-	return r.id
+// Returns the number of tokens in the bucket at the given time.
+func (r *RateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*r.Rate
+	return math.Min(tokens, float64(r.Burst))
+}
+
+// Removes the buckets that have been refilled completely, they're no different
+// from a new bucket. To bound the cost, this only runs once per the time it
+// takes to refill an empty bucket.
+func (r *RateLimiter) sweep(now time.Time) {
+	interval := time.Duration(float64(r.Burst) / r.Rate * float64(time.Second))
+	if now.Sub(r.lastSweep) < interval {
+		return
+	}
+	r.lastSweep = now
+	for key, b := range r.buckets {
+		if r.refill(b, now) >= float64(r.Burst) {
+			delete(r.buckets, key)
+		}
+	}
 }
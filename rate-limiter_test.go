@@ -0,0 +1,86 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterWindow(t *testing.T) {
+	r := new(TestResolver)
+	limit := new(TestResolver)
+	rl := NewRateLimiter("test-rl", r, RateLimiterOptions{Requests: 2, LimitResolver: limit})
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl.now = func() time.Time { return now }
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ci := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+	for i := 0; i < 3; i++ {
+		_, err := rl.Resolve(q, ci)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, r.HitCount())
+	require.Equal(t, 1, limit.HitCount())
+
+	// Next window
+	now = now.Add(time.Minute)
+	_, err := rl.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 3, r.HitCount())
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	r := new(TestResolver)
+	refused, err := NewStaticResolver("test-refused", StaticResolverOptions{RCode: dns.RcodeRefused})
+	require.NoError(t, err)
+	rl := NewRateLimiter("test-rl", r, RateLimiterOptions{
+		Rate:          50,
+		Prefix4:       32,
+		LimitResolver: refused,
+	})
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	rl.now = func() time.Time { return now }
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	client1 := ClientInfo{SourceIP: net.ParseIP("192.168.1.1")}
+	client2 := ClientInfo{SourceIP: net.ParseIP("192.168.1.2")}
+
+	// A burst of 50 queries is allowed, the 51st is refused
+	for i := 0; i < 50; i++ {
+		a, err := rl.Resolve(q, client1)
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	}
+	a, err := rl.Resolve(q, client1)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Equal(t, 50, r.HitCount())
+
+	// Other clients in the same /24 have their own bucket
+	a, err = rl.Resolve(q, client2)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+
+	// After 100ms, the bucket has 5 new tokens
+	now = now.Add(100 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		a, err := rl.Resolve(q, client1)
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	}
+	a, err = rl.Resolve(q, client1)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Len(t, rl.buckets, 2)
+
+	// Once the buckets are full again, they are evicted
+	now = now.Add(2 * time.Second)
+	_, err = rl.Resolve(q, client2)
+	require.NoError(t, err)
+	require.Len(t, rl.buckets, 1)
+}
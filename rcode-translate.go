@@ -0,0 +1,108 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+
+	"github.com/miekg/dns"
+)
+
+// RcodeTranslate is a resolver that replaces the response code of responses
+// from upstream, SERVFAIL with NXDOMAIN for example, for upstream resolvers
+// that respond with the wrong code. Only queries for names on a list are
+// affected. Negative responses it produces carry an SOA record so they can
+// be cached.
+type RcodeTranslate struct {
+	id string
+	RcodeTranslateOptions
+	resolver   Resolver
+	translated *expvar.Int
+}
+
+var _ Resolver = &RcodeTranslate{}
+
+type RcodeTranslateOptions struct {
+	// Response code that is translated.
+	From int
+
+	// Response code it's translated into.
+	To int
+
+	// Names the code is translated for. Required.
+	NameDB BlocklistDB
+}
+
+// TTL and MINIMUM of SOA records synthesized for translated negative responses.
+const rcodeTranslateSOATTL = 60
+
+// NewRcodeTranslate returns a new instance of a response code translator.
+func NewRcodeTranslate(id string, resolver Resolver, opt RcodeTranslateOptions) (*RcodeTranslate, error) {
+	if opt.From == opt.To {
+		return nil, errors.New("response code translated into itself")
+	}
+	if opt.NameDB == nil {
+		return nil, errors.New("no names to translate the response code for")
+	}
+	return &RcodeTranslate{
+		id:                    id,
+		RcodeTranslateOptions: opt,
+		resolver:              resolver,
+		translated:            getVarInt("router", id, "translate"),
+	}, nil
+}
+
+// Resolve a DNS query and replace the response code if it matches and the
+// name is on the list.
+func (r *RcodeTranslate) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil || a.Rcode != r.From || !r.match(q.Question[0]) {
+		return a, err
+	}
+	logger(r.id, q, ci).WithField("from", dns.RcodeToString[r.From]).WithField("to", dns.RcodeToString[r.To]).Debug("translating response code")
+	r.translated.Add(1)
+	out := responseWithCode(q, r.To)
+	if r.To == dns.RcodeNameError || r.To == dns.RcodeSuccess {
+		out.Ns = negativeAuthority(q, a)
+	}
+	return out, nil
+}
+
+func (r *RcodeTranslate) String() string {
+	return r.id
+}
+
+func (r *RcodeTranslate) match(question dns.Question) bool {
+	question.Name = normalizeName(question.Name)
+	_, _, _, ok := r.NameDB.Match(question)
+	return ok
+}
+
+// Returns the authority section for a negative response to the query. That's
+// the one from the upstream response if it has an SOA record, as per RFC2308.
+// Otherwise an SOA for the queried name is synthesized.
+func negativeAuthority(q, a *dns.Msg) []dns.RR {
+	for _, rr := range a.Ns {
+		if _, ok := rr.(*dns.SOA); ok {
+			return a.Ns
+		}
+	}
+	name := q.Question[0].Name
+	return []dns.RR{&dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    rcodeTranslateSOATTL,
+		},
+		Ns:      name,
+		Mbox:    "hostmaster." + name,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  rcodeTranslateSOATTL,
+	}}
+}
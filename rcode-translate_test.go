@@ -0,0 +1,98 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRcodeTranslate(t *testing.T) {
+	var ci ClientInfo
+	rcode := dns.RcodeServerFailure
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, rcode)
+			return a, nil
+		},
+	}
+	db, err := NewDomainDB("test", NewStaticLoader([]string{".broken.example."}))
+	require.NoError(t, err)
+	r, err := NewRcodeTranslate("test-translate", upstream, RcodeTranslateOptions{
+		From:   dns.RcodeServerFailure,
+		To:     dns.RcodeNameError,
+		NameDB: db,
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		rcode    int
+		expected int
+	}{
+		{"www.broken.example.", dns.RcodeServerFailure, dns.RcodeNameError},
+		{"WWW.Broken.Example.", dns.RcodeServerFailure, dns.RcodeNameError},
+		{"www.broken.example.", dns.RcodeRefused, dns.RcodeRefused},      // other codes aren't changed
+		{"www.broken.example.", dns.RcodeSuccess, dns.RcodeSuccess},      // other codes aren't changed
+		{"example.com.", dns.RcodeServerFailure, dns.RcodeServerFailure}, // not on the list
+	}
+	for _, test := range tests {
+		rcode = test.rcode
+		q := new(dns.Msg)
+		q.SetQuestion(test.name, dns.TypeA)
+		a, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, a.Rcode, "%s: %s", test.name, dns.RcodeToString[test.rcode])
+	}
+
+	// Translated NXDOMAIN responses have an SOA so they can be cached
+	rcode = dns.RcodeServerFailure
+	q := new(dns.Msg)
+	q.SetQuestion("www.broken.example.", dns.TypeA)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Ns, 1)
+	soa, ok := a.Ns[0].(*dns.SOA)
+	require.True(t, ok)
+	require.Equal(t, "www.broken.example.", soa.Hdr.Name)
+	require.Equal(t, uint32(60), soa.Minttl)
+	_, err = a.Pack()
+	require.NoError(t, err)
+
+	// The SOA from upstream is kept if there is one
+	upstreamSOA := rr("broken.example. 300 IN SOA ns.broken.example. hostmaster.broken.example. 5 3600 600 86400 30")
+	upstream.ResolveFunc = func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+		a := new(dns.Msg)
+		a.SetRcode(q, dns.RcodeServerFailure)
+		a.Ns = []dns.RR{upstreamSOA}
+		return a, nil
+	}
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, []dns.RR{upstreamSOA}, a.Ns)
+
+	// Translating into codes other than NXDOMAIN or NOERROR doesn't add an SOA
+	r, err = NewRcodeTranslate("test-translate", upstream, RcodeTranslateOptions{
+		From:   dns.RcodeServerFailure,
+		To:     dns.RcodeRefused,
+		NameDB: db,
+	})
+	require.NoError(t, err)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode)
+	require.Empty(t, a.Ns)
+
+	// A list of names is required
+	_, err = NewRcodeTranslate("test-translate", upstream, RcodeTranslateOptions{
+		From: dns.RcodeNameError,
+		To:   dns.RcodeServerFailure,
+	})
+	require.Error(t, err)
+
+	// Translating a code into itself isn't allowed
+	_, err = NewRcodeTranslate("test-translate", upstream, RcodeTranslateOptions{NameDB: db})
+	require.Error(t, err)
+}
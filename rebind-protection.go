@@ -0,0 +1,123 @@
+package rdns
+
+import (
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// RebindProtection is a resolver that blocks responses with addresses in
+// private networks, like 192.168.0.0/16 or 127.0.0.0/8, to protect clients
+// against DNS rebinding attacks. Names that are expected to resolve to private
+// addresses, internal ones in a split-horizon setup for example, can be
+// allowed with a list.
+type RebindProtection struct {
+	id string
+	RebindProtectionOptions
+	resolver Resolver
+	metrics  *BlocklistMetrics
+}
+
+var _ Resolver = &RebindProtection{}
+
+type RebindProtectionOptions struct {
+	// Networks that addresses in responses aren't allowed to be in. Defaults
+	// to the private, loopback, link-local and unspecified networks of IPv4
+	// and IPv6.
+	Networks []*net.IPNet
+
+	// Names that are allowed to resolve to addresses in the networks. Optional.
+	AllowlistDB BlocklistDB
+
+	// Drop blocked responses rather than respond with NXDOMAIN.
+	Drop bool
+}
+
+// Networks blocked by default.
+var defaultRebindNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// NewRebindProtection returns a new instance of a DNS rebinding protection resolver.
+func NewRebindProtection(id string, resolver Resolver, opt RebindProtectionOptions) *RebindProtection {
+	if len(opt.Networks) == 0 {
+		for _, s := range defaultRebindNetworks {
+			_, n, _ := net.ParseCIDR(s)
+			opt.Networks = append(opt.Networks, n)
+		}
+	}
+	return &RebindProtection{
+		id:                      id,
+		RebindProtectionOptions: opt,
+		resolver:                resolver,
+		metrics:                 NewBlocklistMetrics(id),
+	}
+}
+
+// Resolve a DNS query and block the response if it has addresses in any of
+// the networks, unless the name is on the allowlist.
+func (r *RebindProtection) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	answer, err := r.resolver.Resolve(q, ci)
+	if err != nil || answer == nil || answer.Rcode != dns.RcodeSuccess {
+		return answer, err
+	}
+	ip, ok := r.privateAddress(answer)
+	if !ok {
+		r.metrics.allowed.Add(1)
+		return answer, nil
+	}
+	log := logger(r.id, q, ci).WithField("ip", ip.String())
+	if r.AllowlistDB != nil {
+		question := q.Question[0]
+		question.Name = normalizeName(question.Name)
+		if _, _, match, ok := r.AllowlistDB.Match(question); ok {
+			log.WithField("list", match.List).WithField("rule", match.Rule).Debug("private address for name on allowlist")
+			r.metrics.allowed.Add(1)
+			return answer, nil
+		}
+	}
+	r.metrics.blocked.Add(1)
+	if r.Drop {
+		log.Debug("private address in response, dropping")
+		return nil, nil
+	}
+	log.Debug("private address in response, blocking")
+	return nxdomain(q), nil
+}
+
+func (r *RebindProtection) String() string {
+	return r.id
+}
+
+// Returns the first address in the answer that is in any of the networks.
+func (r *RebindProtection) privateAddress(answer *dns.Msg) (net.IP, bool) {
+	for _, rr := range answer.Answer {
+		var ip net.IP
+		switch record := rr.(type) {
+		case *dns.A:
+			ip = record.A
+		case *dns.AAAA:
+			ip = record.AAAA
+		default:
+			continue
+		}
+		if containsIP(r.Networks, ip) {
+			return ip, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,85 @@
+package rdns
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebindProtection(t *testing.T) {
+	// Upstream that resolves every name to the address in the map
+	addresses := map[string]string{
+		"public.example.com.":   "192.168.1.10",
+		"internal.example.com.": "192.168.1.20",
+		"www.example.com.":      "192.0.2.1",
+		"loopback.example.com.": "::1",
+	}
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{rr(q.Question[0].Name + " 60 IN " + dns.TypeToString[q.Question[0].Qtype] + " " + addresses[strings.ToLower(q.Question[0].Name)])}
+			return a, nil
+		},
+	}
+	allowlist, err := NewDomainDB("allowlist", NewStaticLoader([]string{"internal.example.com"}))
+	require.NoError(t, err)
+	r := NewRebindProtection("test-rebind", upstream, RebindProtectionOptions{AllowlistDB: allowlist})
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		blocked bool
+	}{
+		{"public.example.com.", dns.TypeA, true},
+		{"Internal.Example.com.", dns.TypeA, false}, // on the allowlist
+		{"internal.example.com.", dns.TypeA, false},
+		{"www.example.com.", dns.TypeA, false},
+		{"loopback.example.com.", dns.TypeAAAA, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(test.name, test.qtype)
+			a, err := r.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+			if test.blocked {
+				require.Equal(t, dns.RcodeNameError, a.Rcode)
+				require.Empty(t, a.Answer)
+			} else {
+				require.Equal(t, dns.RcodeSuccess, a.Rcode)
+				require.Equal(t, 1, len(a.Answer))
+			}
+		})
+	}
+}
+
+func TestRebindProtectionNetworks(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{rr(q.Question[0].Name + " 60 IN A 192.168.1.10")}
+			return a, nil
+		},
+	}
+	_, network, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// 192.168.0.0/16 isn't blocked if the networks are configured
+	r := NewRebindProtection("test-rebind", upstream, RebindProtectionOptions{Networks: []*net.IPNet{network}})
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(a.Answer))
+
+	// Blocked responses are dropped with the option
+	r = NewRebindProtection("test-rebind", upstream, RebindProtectionOptions{Drop: true})
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Nil(t, a)
+}
@@ -3,6 +3,7 @@ package rdns
 import (
 	"errors"
 	"regexp"
+	"strings"
 
 	"github.com/miekg/dns"
 )
@@ -68,24 +69,29 @@ func (r *Replace) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		return r.resolver.Resolve(q, ci)
 	}
 
-	// Modify the query string
-	q.Question[0].Name = newName
+	// Modify the query string in a copy, the original is still needed to build
+	// the response and by elements further downstream
+	newQ := q.Copy()
+	newQ.Question[0].Name = newName
 
 	// Send the query upstream
 	log.WithField("new-qname", newName).WithField("resolver", r.resolver).Debug("forwarding modified query to resolver")
-	a, err := r.resolver.Resolve(q, ci)
+	a, err := r.resolver.Resolve(newQ, ci)
 	if err != nil || a == nil {
 		return nil, err
 	}
 
-	// Set the question back to the original name
-	a.Question[0].Name = oldName
-
-	// Now put the original name in all answer records that have the
-	// new name
-	for _, answer := range a.Answer {
-		if answer.Header().Name == newName {
-			answer.Header().Name = oldName
+	// Set the question back to the original
+	a.Question = append([]dns.Question(nil), q.Question...)
+
+	// Now put the original name in all records that have the new name. Other
+	// records, like those at the end of a CNAME chain, are left in the upstream
+	// namespace so the chain remains intact.
+	for _, section := range [][]dns.RR{a.Answer, a.Ns, a.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, newName) {
+				rr.Header().Name = oldName
+			}
 		}
 	}
 	return a, nil
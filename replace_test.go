@@ -55,3 +55,45 @@ func TestReplace(t *testing.T) {
 	require.Equal(t, "my.test.com.", a.Question[0].Name)
 	require.Equal(t, "your.test.com.", actualQueryName)
 }
+
+func TestReplaceSuffix(t *testing.T) {
+	// Upstream that responds with a CNAME chain in the upstream namespace
+	r := &TestResolver{
+		ResolveFunc: func(req *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			require.Equal(t, "www.corp.example.com.", req.Question[0].Name)
+			a := new(dns.Msg)
+			a.SetReply(req)
+			a.Answer = []dns.RR{
+				&dns.CNAME{
+					Hdr:    dns.RR_Header{Name: "WWW.corp.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 3600},
+					Target: "web.corp.example.com.",
+				},
+				&dns.A{
+					Hdr: dns.RR_Header{Name: "web.corp.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+					A:   net.ParseIP("192.0.2.1"),
+				},
+			}
+			return a, nil
+		},
+	}
+
+	b, err := NewReplace("test-replace", r, ReplaceOperation{From: `^(.*\.)?corp\.local\.$`, To: `${1}corp.example.com.`})
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.corp.local.", dns.TypeA)
+	a, err := b.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+
+	// The response should match the question the client asked, and the query
+	// itself must not have been changed
+	require.Equal(t, q.Question, a.Question)
+	require.Equal(t, "www.corp.local.", q.Question[0].Name)
+	require.Equal(t, q.Id, a.Id)
+
+	// The start of the chain is mapped back, the remaining records are left unchanged
+	require.Len(t, a.Answer, 2)
+	require.Equal(t, "www.corp.local.", a.Answer[0].Header().Name)
+	require.Equal(t, "web.corp.example.com.", a.Answer[0].(*dns.CNAME).Target)
+	require.Equal(t, "web.corp.example.com.", a.Answer[1].Header().Name)
+}
@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"encoding/binary"
+	"errors"
 	"sync"
 
 	"github.com/miekg/dns"
@@ -10,6 +11,7 @@ import (
 type dedupKey struct {
 	name        string
 	qtype       uint16
+	qclass      uint16
 	ecs_ipv4    uint32
 	ecs_ipv6_hi uint64
 	ecs_ipv6_lo uint64
@@ -25,7 +27,8 @@ type inflightRequest struct {
 // requestDedup passes individual requests normally. Subsequent
 // queries for the same name are being held until the first query
 // returns. In that case, all waiting requests are answered with
-// the same response. This element is used to smooth out spikes
+// the same response. Queries are considered the same if they have
+// the same name, type, class and ECS subnet. This element is used to smooth out spikes
 // of queries for the same name.
 type requestDedup struct {
 	id       string
@@ -45,6 +48,9 @@ func NewRequestDedup(id string, resolver Resolver) *requestDedup {
 }
 
 func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
 	var (
 		ecsIPv4              uint32
 		ecsIPv6Lo, ecsIPv6Hi uint64
@@ -73,6 +79,7 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	k := dedupKey{
 		name:        q.Question[0].Name,
 		qtype:       q.Question[0].Qtype,
+		qclass:      q.Question[0].Qclass,
 		ecs_ipv4:    ecsIPv4,
 		ecs_ipv6_hi: ecsIPv6Hi,
 		ecs_ipv6_lo: ecsIPv6Lo,
@@ -104,8 +111,9 @@ func (r *requestDedup) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	}
 	log.WithField("resolver", r.resolver).Debug("forwarding query to resolver")
 
-	// Not already in flight, make the request
-	a, err := r.resolver.Resolve(q, ci)
+	// Not already in flight, make the request. Other clients may be waiting for
+	// it, so it's not canceled with the context of this one.
+	a, err := r.resolver.Resolve(q, ci.WithoutCancel())
 	req.answer = a
 	req.err = err
 	close(req.done) // release other goroutines waiting for the response
@@ -1,6 +1,8 @@
 package rdns
 
 import (
+	"context"
+	"net"
 	"sync"
 	"testing"
 	"time"
@@ -37,3 +39,83 @@ func TestRequestDedup(t *testing.T) {
 	// Only one request should have hit the resolver
 	require.Equal(t, 1, r.HitCount())
 }
+
+func TestRequestDedupDistinct(t *testing.T) {
+	var ci ClientInfo
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			time.Sleep(time.Second)
+			a := new(dns.Msg)
+			a.SetReply(q)
+			return a, nil
+		},
+	}
+	g := NewRequestDedup("test-dedup", r)
+
+	newQuery := func(qclass uint16, ecs string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.Question[0].Qclass = qclass
+		if ecs != "" {
+			q.SetEdns0(4096, false)
+			q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				Address:       net.ParseIP(ecs),
+			})
+		}
+		return q
+	}
+	queries := []*dns.Msg{
+		newQuery(dns.ClassINET, ""),
+		newQuery(dns.ClassCHAOS, ""),
+		newQuery(dns.ClassINET, "192.0.2.0"),
+		newQuery(dns.ClassINET, "198.51.100.0"),
+	}
+
+	// Send several copies of each query at the same time
+	var wg sync.WaitGroup
+	for _, q := range queries {
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(q *dns.Msg) {
+				defer wg.Done()
+				a, err := g.Resolve(q, ci)
+				require.NoError(t, err)
+				require.Equal(t, q.Question[0], a.Question[0])
+			}(q)
+		}
+	}
+	wg.Wait()
+
+	// Each distinct query should have been sent upstream exactly once
+	require.Equal(t, len(queries), r.HitCount())
+}
+
+func TestRequestDedupContext(t *testing.T) {
+	type ctxKey struct{}
+	var (
+		value interface{}
+		err   error
+	)
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			value = ci.Context().Value(ctxKey{})
+			err = ci.Context().Err()
+			return q, nil
+		},
+	}
+	g := NewRequestDedup("test-dedup", r)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The values of the client's context, like a trace span, should be passed
+	// upstream, but not its cancellation
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "value"))
+	cancel()
+	_, rerr := g.Resolve(q, ClientInfo{}.WithContext(ctx))
+	require.NoError(t, rerr)
+	require.Equal(t, "value", value)
+	require.NoError(t, err)
+}
@@ -0,0 +1,75 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+
+	"github.com/miekg/dns"
+)
+
+// RequireAD is a resolver that responds with SERVFAIL to queries for names in
+// zones known to be signed if the upstream response doesn't have the AD bit,
+// meaning the upstream resolver didn't validate it. It relies on the upstream
+// resolver to validate and set the AD bit correctly, so it should only be used
+// with a trusted resolver over a secure connection.
+type RequireAD struct {
+	id string
+	RequireADOptions
+	resolver Resolver
+	rejected *expvar.Int
+}
+
+var _ Resolver = &RequireAD{}
+
+type RequireADOptions struct {
+	// Names in signed zones that responses need to be validated for.
+	ZoneDB BlocklistDB
+}
+
+// NewRequireAD returns a new instance of a resolver that requires validated
+// responses for a list of zones.
+func NewRequireAD(id string, resolver Resolver, opt RequireADOptions) (*RequireAD, error) {
+	if opt.ZoneDB == nil {
+		return nil, errors.New("no list of signed zones")
+	}
+	return &RequireAD{
+		id:               id,
+		RequireADOptions: opt,
+		resolver:         resolver,
+		rejected:         getVarInt("router", id, "reject"),
+	}, nil
+}
+
+// Resolve a DNS query and respond with SERVFAIL if the name is on the list
+// and the response wasn't validated upstream.
+func (r *RequireAD) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	question.Name = normalizeName(question.Name)
+	if _, _, _, ok := r.ZoneDB.Match(question); !ok {
+		return r.resolver.Resolve(q, ci)
+	}
+
+	// Servers only set the AD bit if the query has the AD or DO bit, see RFC6840
+	edns0 := q.IsEdns0()
+	if !q.AuthenticatedData && (edns0 == nil || !edns0.Do()) {
+		q = q.Copy()
+		q.AuthenticatedData = true
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	if a.AuthenticatedData || (a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError) {
+		return a, nil
+	}
+	logger(r.id, q, ci).Debug("response for signed zone not validated, responding with servfail")
+	r.rejected.Add(1)
+	return servfail(q), nil
+}
+
+func (r *RequireAD) String() string {
+	return r.id
+}
@@ -0,0 +1,69 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireAD(t *testing.T) {
+	var ci ClientInfo
+	var (
+		ad        bool
+		rcode     int
+		queriedAD bool
+	)
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			queriedAD = q.AuthenticatedData
+			a := new(dns.Msg)
+			a.SetRcode(q, rcode)
+			a.AuthenticatedData = ad
+			return a, nil
+		},
+	}
+	db, err := NewDomainDB("test", NewStaticLoader([]string{".signed.example."}))
+	require.NoError(t, err)
+	r, err := NewRequireAD("test-require-ad", upstream, RequireADOptions{ZoneDB: db})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		ad       bool
+		rcode    int
+		expected int
+	}{
+		{"www.signed.example.", true, dns.RcodeSuccess, dns.RcodeSuccess},
+		{"www.signed.example.", false, dns.RcodeSuccess, dns.RcodeServerFailure},
+		{"WWW.Signed.Example.", false, dns.RcodeSuccess, dns.RcodeServerFailure},
+		{"www.signed.example.", true, dns.RcodeNameError, dns.RcodeNameError},
+		{"www.signed.example.", false, dns.RcodeNameError, dns.RcodeServerFailure},
+		{"www.signed.example.", false, dns.RcodeRefused, dns.RcodeRefused}, // failures are passed on
+		{"example.com.", false, dns.RcodeSuccess, dns.RcodeSuccess},        // not on the list
+	}
+	for _, test := range tests {
+		ad, rcode = test.ad, test.rcode
+		q := new(dns.Msg)
+		q.SetQuestion(test.name, dns.TypeA)
+		a, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, a.Rcode, "%s: ad=%v %s", test.name, test.ad, dns.RcodeToString[test.rcode])
+		require.False(t, q.AuthenticatedData)
+	}
+
+	// The AD bit is requested upstream for names on the list only
+	q := new(dns.Msg)
+	q.SetQuestion("www.signed.example.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.True(t, queriedAD)
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.False(t, queriedAD)
+
+	// A list is required
+	_, err = NewRequireAD("test-require-ad", upstream, RequireADOptions{})
+	require.Error(t, err)
+}
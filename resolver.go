@@ -1,7 +1,9 @@
 package rdns
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -11,3 +13,72 @@ type Resolver interface {
 	Resolve(*dns.Msg, ClientInfo) (*dns.Msg, error)
 	fmt.Stringer
 }
+
+// Drainer is implemented by resolvers that hold connections to upstream servers.
+// Drain stops accepting new queries, waits for outstanding queries to complete
+// until ctx is done, and then closes the connections. Only called on shutdown,
+// the configuration isn't reloaded at runtime.
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// Sends a query to a resolver in a group and abandons it after the timeout,
+// even if the resolver itself doesn't give up by then. The resolver gets a
+// copy of the query since it may still be using it after this returns. No
+// limit if the timeout is 0.
+func resolveWithTimeout(resolver Resolver, q *dns.Msg, ci ClientInfo, timeout time.Duration) (*dns.Msg, error) {
+	if timeout <= 0 {
+		return resolver.Resolve(q, ci)
+	}
+	ctx, cancel := context.WithTimeout(ci.Context(), timeout)
+	defer cancel()
+
+	type response struct {
+		a   *dns.Msg
+		err error
+	}
+	responseCh := make(chan response, 1)
+	go func(q *dns.Msg, ci ClientInfo) {
+		a, err := resolver.Resolve(q, ci)
+		responseCh <- response{a, err}
+	}(q.Copy(), ci.WithContext(ctx))
+
+	select {
+	case r := <-responseCh:
+		return r.a, r.err
+	case <-ctx.Done():
+		return nil, QueryTimeoutError{q}
+	}
+}
+
+// Drains all pipelines concurrently, returning the first error.
+func drainPipelines(ctx context.Context, pipelines ...*Pipeline) error {
+	errs := make(chan error, len(pipelines))
+	for _, p := range pipelines {
+		go func(p *Pipeline) { errs <- p.Drain(ctx) }(p)
+	}
+	var err error
+	for range pipelines {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Calls f in a separate goroutine if ctx is canceled before the returned stop
+// function is called. Used to abort blocking I/O for canceled queries.
+func onCancel(ctx context.Context, f func()) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			f()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
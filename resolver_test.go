@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/miekg/dns"
 )
@@ -16,13 +17,17 @@ func init() {
 // defined externally.
 type TestResolver struct {
 	ResolveFunc func(*dns.Msg, ClientInfo) (*dns.Msg, error)
+	mu          sync.Mutex
 	hitCount    int
 	shouldFail  bool
 }
 
 func (r *TestResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	r.mu.Lock()
 	r.hitCount++
-	if r.shouldFail {
+	shouldFail := r.shouldFail
+	r.mu.Unlock()
+	if shouldFail {
 		return nil, errors.New("failed")
 	}
 	if r.ResolveFunc != nil {
@@ -36,9 +41,13 @@ func (r *TestResolver) String() string {
 }
 
 func (r *TestResolver) HitCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	return r.hitCount
 }
 
 func (r *TestResolver) SetFail(f bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.shouldFail = f
 }
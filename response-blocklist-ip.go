@@ -64,10 +64,13 @@ func (r *ResponseBlocklistIP) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, erro
 	if answer.Rcode != dns.RcodeSuccess {
 		return answer, err
 	}
+	r.mu.RLock()
+	db := r.BlocklistDB
+	r.mu.RUnlock()
 	if r.Filter {
-		return r.filterMatch(q, answer, ci)
+		return r.filterMatch(db, q, answer, ci)
 	}
-	return r.blockIfMatch(q, answer, ci)
+	return r.blockIfMatch(db, q, answer, ci)
 }
 
 func (r *ResponseBlocklistIP) String() string {
@@ -81,7 +84,7 @@ func (r *ResponseBlocklistIP) refreshLoopBlocklist(refresh time.Duration) {
 		log.Debug("reloading blocklist")
 		db, err := r.BlocklistDB.Reload()
 		if err != nil {
-			Log.WithError(err).Error("failed to load rules")
+			log.WithError(err).Error("failed to load rules")
 			continue
 		}
 		r.mu.Lock()
@@ -91,7 +94,7 @@ func (r *ResponseBlocklistIP) refreshLoopBlocklist(refresh time.Duration) {
 	}
 }
 
-func (r *ResponseBlocklistIP) blockIfMatch(query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+func (r *ResponseBlocklistIP) blockIfMatch(db IPBlocklistDB, query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	for _, records := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
 		for _, rr := range records {
 			var ip net.IP
@@ -103,7 +106,7 @@ func (r *ResponseBlocklistIP) blockIfMatch(query, answer *dns.Msg, ci ClientInfo
 			default:
 				continue
 			}
-			if match, ok := r.BlocklistDB.Match(ip); ok {
+			if match, ok := db.Match(ip); ok {
 				log := logger(r.id, query, ci).WithFields(logrus.Fields{"list": match.List, "rule": match.Rule, "ip": ip})
 				if r.BlocklistResolver != nil {
 					log.WithField("resolver", r.BlocklistResolver).Debug("blocklist match, forwarding to blocklist-resolver")
@@ -117,8 +120,8 @@ func (r *ResponseBlocklistIP) blockIfMatch(query, answer *dns.Msg, ci ClientInfo
 	return answer, nil
 }
 
-func (r *ResponseBlocklistIP) filterMatch(query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
-	answer.Answer = r.filterRR(query, ci, answer.Answer)
+func (r *ResponseBlocklistIP) filterMatch(db IPBlocklistDB, query, answer *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	answer.Answer = r.filterRR(db, query, ci, answer.Answer)
 	// If there's nothing left after applying the filter, return NXDOMAIN or send to the alternative resolver
 	if len(answer.Answer) == 0 {
 		log := Log.WithFields(logrus.Fields{"qname": qName(query)})
@@ -129,12 +132,12 @@ func (r *ResponseBlocklistIP) filterMatch(query, answer *dns.Msg, ci ClientInfo)
 		log.Debug("no answers after filtering, blocking response")
 		return nxdomain(query), nil
 	}
-	answer.Ns = r.filterRR(query, ci, answer.Ns)
-	answer.Extra = r.filterRR(query, ci, answer.Extra)
+	answer.Ns = r.filterRR(db, query, ci, answer.Ns)
+	answer.Extra = r.filterRR(db, query, ci, answer.Extra)
 	return answer, nil
 }
 
-func (r *ResponseBlocklistIP) filterRR(query *dns.Msg, ci ClientInfo, rrs []dns.RR) []dns.RR {
+func (r *ResponseBlocklistIP) filterRR(db IPBlocklistDB, query *dns.Msg, ci ClientInfo, rrs []dns.RR) []dns.RR {
 	newRRs := make([]dns.RR, 0, len(rrs))
 	for _, rr := range rrs {
 		var ip net.IP
@@ -147,7 +150,7 @@ func (r *ResponseBlocklistIP) filterRR(query *dns.Msg, ci ClientInfo, rrs []dns.
 			newRRs = append(newRRs, rr)
 			continue
 		}
-		if match, ok := r.BlocklistDB.Match(ip); ok {
+		if match, ok := db.Match(ip); ok {
 			logger(r.id, query, ci).WithFields(logrus.Fields{"list": match.List, "rule": match.Rule, "ip": ip}).Debug("filtering response")
 			continue
 		}
@@ -0,0 +1,95 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseBlocklistIP(t *testing.T) {
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			var records []string
+			switch q.Question[0].Qtype {
+			case dns.TypeA:
+				records = []string{"1.2.3.4", "192.168.1.10"}
+			case dns.TypeAAAA:
+				records = []string{"2001:db8::1", "fd00::1"}
+			}
+			for _, ip := range records {
+				rr, _ := dns.NewRR(q.Question[0].Name + " 60 IN " + dns.TypeToString[q.Question[0].Qtype] + " " + ip)
+				a.Answer = append(a.Answer, rr)
+			}
+			return a, nil
+		},
+	}
+	db, err := NewCidrDB("testlist", NewStaticLoader([]string{"192.168.1.0/24", "fd00::/8"}))
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		qtype   uint16
+		filter  bool
+		rcode   int
+		answers []string
+	}{
+		"block ip4": {
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+		},
+		"block ip6": {
+			qtype: dns.TypeAAAA,
+			rcode: dns.RcodeNameError,
+		},
+		"filter ip4": {
+			qtype:   dns.TypeA,
+			filter:  true,
+			rcode:   dns.RcodeSuccess,
+			answers: []string{"1.2.3.4"},
+		},
+		"filter ip6": {
+			qtype:   dns.TypeAAAA,
+			filter:  true,
+			rcode:   dns.RcodeSuccess,
+			answers: []string{"2001:db8::1"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := NewResponseBlocklistIP("test-rbl", r, ResponseBlocklistIPOptions{
+				BlocklistDB: db,
+				Filter:      test.filter,
+			})
+			require.NoError(t, err)
+			q := new(dns.Msg)
+			q.SetQuestion("test.com.", test.qtype)
+			a, err := b.Resolve(q, ClientInfo{})
+			require.NoError(t, err)
+			require.Equal(t, test.rcode, a.Rcode)
+			var answers []string
+			for _, rr := range a.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					answers = append(answers, rr.A.String())
+				case *dns.AAAA:
+					answers = append(answers, rr.AAAA.String())
+				}
+			}
+			require.Equal(t, test.answers, answers)
+		})
+	}
+
+	// Responses without a match are passed through unmodified
+	clean, err := NewCidrDB("testlist", NewStaticLoader([]string{"10.0.0.0/8"}))
+	require.NoError(t, err)
+	b, err := NewResponseBlocklistIP("test-rbl", r, ResponseBlocklistIPOptions{BlocklistDB: clean})
+	require.NoError(t, err)
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	a, err := b.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Len(t, a.Answer, 2)
+}
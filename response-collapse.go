@@ -5,7 +5,8 @@ import (
 )
 
 // ResponseCollapse is a resolver that collapses response records to just the type
-// of the query, eliminating answer chains.
+// of the query, eliminating answer chains. Collapsed responses no longer match
+// their DNSSEC signatures, any RRSIG records are removed from the answer.
 type ResponseCollapse struct {
 	id       string
 	resolver Resolver
@@ -14,6 +15,15 @@ type ResponseCollapse struct {
 
 type ResponseCollapsOptions struct {
 	NullRCode int // Response code when there's nothing left after collapsing the response
+
+	// Only collapse the response if all names in the answer chain are in the same
+	// zone as the query name. The zone is taken from the owner of an SOA or NS
+	// record in the authority section of the response, so with NS records for
+	// example.com, www.example.com can be collapsed with a CNAME to
+	// cdn.example.com, but not to example.net. Without such records, all names
+	// have to be at or below the query name. Responses with chains leaving the
+	// zone are returned unmodified.
+	SameZone bool
 }
 
 var _ Resolver = &ResponseCollapse{}
@@ -33,6 +43,11 @@ func (r *ResponseCollapse) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error)
 	name := q.Question[0].Name
 	qType := q.Question[0].Qtype
 	qClass := q.Question[0].Qclass
+	log := logger(r.id, q, ci)
+	if r.SameZone && !inSameZone(name, answer) {
+		log.Debug("answer chain leaves the zone, not collapsing")
+		return answer, nil
+	}
 	var aRR []dns.RR
 	for _, rr := range answer.Answer {
 		h := rr.Header()
@@ -42,7 +57,6 @@ func (r *ResponseCollapse) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error)
 		}
 	}
 	answer.Answer = aRR
-	log := logger(r.id, q, ci)
 
 	// If there's nothing left after collapsing, return the null response code
 	if len(answer.Answer) == 0 {
@@ -56,3 +70,31 @@ func (r *ResponseCollapse) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error)
 func (r *ResponseCollapse) String() string {
 	return r.id
 }
+
+// Returns true if all records in the answer are for names in the zone of the
+// query name. That's the closest SOA or NS owner in the authority section that
+// contains the query name, or the query name itself if there is none.
+func inSameZone(name string, a *dns.Msg) bool {
+	zone := dns.Fqdn(name)
+	var closest string
+	for _, rr := range a.Ns {
+		switch rr.(type) {
+		case *dns.SOA, *dns.NS:
+		default:
+			continue
+		}
+		owner := rr.Header().Name
+		if dns.IsSubDomain(owner, zone) && dns.CountLabel(owner) > dns.CountLabel(closest) {
+			closest = owner
+		}
+	}
+	if closest != "" {
+		zone = closest
+	}
+	for _, rr := range a.Answer {
+		if !dns.IsSubDomain(zone, rr.Header().Name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseCollapse(t *testing.T) {
+	var chain, authority []string
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			for _, record := range chain {
+				rr, err := dns.NewRR(record)
+				require.NoError(t, err)
+				a.Answer = append(a.Answer, rr)
+			}
+			for _, record := range authority {
+				a.Ns = append(a.Ns, rr(record))
+			}
+			return a, nil
+		},
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+
+	// 3-link CNAME chain within the zone
+	authority = []string{"example.com. 60 IN NS ns.example.com."}
+	chain = []string{
+		"www.example.com. 60 IN CNAME a.example.com.",
+		"a.example.com. 60 IN CNAME b.example.com.",
+		"b.example.com. 60 IN CNAME c.example.com.",
+		"c.example.com. 60 IN A 1.2.3.4",
+		"c.example.com. 60 IN A 1.2.3.5",
+	}
+	for _, sameZone := range []bool{false, true} {
+		r := NewResponseCollapse("test-collapse", upstream, ResponseCollapsOptions{SameZone: sameZone})
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		require.Len(t, a.Answer, 2)
+		for _, rr := range a.Answer {
+			require.Equal(t, "www.example.com.", rr.Header().Name)
+			require.Equal(t, dns.TypeA, rr.Header().Rrtype)
+		}
+	}
+
+	// Without authority records the zone isn't known, the chain has to stay at
+	// or below the query name
+	authority = nil
+	r := NewResponseCollapse("test-collapse", upstream, ResponseCollapsOptions{SameZone: true})
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 5)
+	chain = []string{
+		"www.example.com. 60 IN CNAME edge.www.example.com.",
+		"edge.www.example.com. 60 IN A 1.2.3.4",
+	}
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+
+	// Chain leaving the zone is only collapsed without SameZone
+	chain = []string{
+		"www.example.com. 60 IN CNAME cdn.example.net.",
+		"cdn.example.net. 60 IN A 1.2.3.4",
+	}
+	authority = []string{"example.com. 60 IN NS ns.example.com."}
+	r = NewResponseCollapse("test-collapse", upstream, ResponseCollapsOptions{})
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "www.example.com.", a.Answer[0].Header().Name)
+
+	r = NewResponseCollapse("test-collapse", upstream, ResponseCollapsOptions{SameZone: true})
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 2)
+	require.Equal(t, dns.TypeCNAME, a.Answer[0].Header().Rrtype)
+
+	// Nothing left after collapsing
+	chain = []string{"www.example.com. 60 IN CNAME a.example.com."}
+	r = NewResponseCollapse("test-collapse", upstream, ResponseCollapsOptions{NullRCode: dns.RcodeNameError})
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+}
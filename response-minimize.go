@@ -5,17 +5,30 @@ import (
 )
 
 // ResponseMinimize is a resolver that strips Extra and Authority records
-// from responses, leaving just the answer records.
+// from responses, leaving just the answer records. Similar to BIND's
+// minimal-responses, only responses that already answer the query are
+// minimized, referrals and negative responses are left intact.
 type ResponseMinimize struct {
-	id       string
+	id string
+	ResponseMinimizeOptions
 	resolver Resolver
 }
 
 var _ Resolver = &ResponseMinimize{}
 
+type ResponseMinimizeOptions struct {
+	// Remove the OPT record as well. By default it is kept so EDNS0 options and
+	// flags in the response reach the client.
+	StripOPT bool
+}
+
 // NewResponseMinimize returns a new instance of a response minimizer.
-func NewResponseMinimize(id string, resolver Resolver) *ResponseMinimize {
-	return &ResponseMinimize{id: id, resolver: resolver}
+func NewResponseMinimize(id string, resolver Resolver, opt ResponseMinimizeOptions) *ResponseMinimize {
+	return &ResponseMinimize{
+		id:                      id,
+		ResponseMinimizeOptions: opt,
+		resolver:                resolver,
+	}
 }
 
 // Resolve a DNS query with the upstream resolver and strip out any extra or NS
@@ -25,12 +38,37 @@ func (r *ResponseMinimize) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error)
 	if err != nil || answer == nil || answer.Rcode != dns.RcodeSuccess {
 		return answer, err
 	}
+	if !hasAnswerForQuery(q, answer) {
+		return answer, nil
+	}
 	logger(r.id, q, ci).Debug("stripping response")
+	var opt dns.RR
+	if edns0 := answer.IsEdns0(); edns0 != nil && !r.StripOPT {
+		opt = edns0
+	}
 	answer.Extra = nil
 	answer.Ns = nil
+	if opt != nil {
+		answer.Extra = []dns.RR{opt}
+	}
 	return answer, nil
 }
 
 func (r *ResponseMinimize) String() string {
 	return r.id
 }
+
+// Returns true if the answer section of a response contains records of the
+// type that was queried.
+func hasAnswerForQuery(q, a *dns.Msg) bool {
+	if len(q.Question) < 1 {
+		return false
+	}
+	qtype := q.Question[0].Qtype
+	for _, rr := range a.Answer {
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package rdns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseMinimize(t *testing.T) {
+	r := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			if q.Question[0].Name == "example.com." {
+				a.Answer = []dns.RR{
+					&dns.A{
+						Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+						A:   net.IP{192, 0, 2, 1},
+					},
+				}
+			}
+			a.Ns = []dns.RR{
+				&dns.NS{
+					Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
+					Ns:  "ns.example.com.",
+				},
+			}
+			a.Extra = []dns.RR{
+				&dns.A{
+					Hdr: dns.RR_Header{Name: "ns.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+					A:   net.IP{192, 0, 2, 53},
+				},
+			}
+			a.SetEdns0(1232, false)
+			return a, nil
+		},
+	}
+
+	// Authority and additional records are removed from a positive answer, OPT is kept
+	m := NewResponseMinimize("test-minimize", r, ResponseMinimizeOptions{})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err := m.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Empty(t, a.Ns)
+	require.Len(t, a.Extra, 1)
+	require.NotNil(t, a.IsEdns0())
+	require.Equal(t, uint16(1232), a.IsEdns0().UDPSize())
+
+	// Responses without the queried type, like referrals, keep NS and glue records
+	q.SetQuestion("sub.example.com.", dns.TypeA)
+	a, err = m.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Empty(t, a.Answer)
+	require.Len(t, a.Ns, 1)
+	require.Len(t, a.Extra, 2)
+
+	// OPT is removed as well if configured
+	m = NewResponseMinimize("test-minimize", r, ResponseMinimizeOptions{StripOPT: true})
+	q.SetQuestion("example.com.", dns.TypeA)
+	a, err = m.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Empty(t, a.Ns)
+	require.Empty(t, a.Extra)
+}
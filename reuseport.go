@@ -0,0 +1,7 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build aix darwin dragonfly freebsd linux netbsd openbsd
+
+package rdns
+
+// Platforms on which the DNS library can open sockets with SO_REUSEPORT.
+const reusePortSupported = true
@@ -16,11 +16,16 @@ type route struct {
 	types    []uint16
 	class    uint16
 	name     *regexp.Regexp
+	domains  *DomainDB
 	source   *net.IPNet
+	geoDB    *GeoLocationDB
+	geoCodes map[string]bool // country and continent codes of client locations
 	weekdays []time.Weekday
 	before   *TimeOfDay
 	after    *TimeOfDay
-	inverted bool // invert the matching behavior
+	location *time.Location   // timezone for weekdays and time of day, local time if nil
+	now      func() time.Time // returns the current time, can be replaced in tests
+	inverted bool             // invert the matching behavior
 	resolver Resolver
 }
 
@@ -68,6 +73,7 @@ func NewRoute(name, class string, types, weekdays []string, before, after, sourc
 		before:   b,
 		after:    a,
 		source:   sNet,
+		now:      time.Now,
 		resolver: resolver,
 	}, nil
 }
@@ -80,14 +86,30 @@ func (r *route) match(q *dns.Msg, ci ClientInfo) bool {
 	if r.class != 0 && r.class != question.Qclass {
 		return r.inverted
 	}
+	// Expressions are applied to the name as sent by the client, domains are
+	// compared with the lowercase punycode form
 	if !r.name.MatchString(question.Name) {
 		return r.inverted
 	}
+	if r.domains != nil {
+		normalized := question
+		normalized.Name = normalizeName(question.Name)
+		if _, _, _, ok := r.domains.Match(normalized); !ok {
+			return r.inverted
+		}
+	}
 	if r.source != nil && !r.source.Contains(ci.SourceIP) {
 		return r.inverted
 	}
+	if r.geoDB != nil && !r.matchClientLocation(ci.SourceIP) {
+		return r.inverted
+	}
 	if len(r.weekdays) > 0 || r.before != nil || r.after != nil {
-		now := time.Now().Local()
+		location := r.location
+		if location == nil {
+			location = time.Local
+		}
+		now := r.now().In(location)
 		hour := now.Hour()
 		minute := now.Minute()
 		if len(r.weekdays) > 0 {
@@ -103,20 +125,99 @@ func (r *route) match(q *dns.Msg, ci ClientInfo) bool {
 				return r.inverted
 			}
 		}
-		if r.before != nil && !r.before.isAfter(hour, minute) {
-			return r.inverted
-		}
-		if r.after != nil && !r.after.isBefore(hour, minute) {
+		if !r.matchTimeOfDay(hour, minute) {
 			return r.inverted
 		}
 	}
 	return !r.inverted
 }
 
+// Returns true if the time is within the before and after limits of the route.
+// If after is later than before, like after 22:00 and before 06:00, the window
+// crosses midnight and it's enough for one of the conditions to be met.
+func (r *route) matchTimeOfDay(hour, minute int) bool {
+	afterMatch := r.after == nil || r.after.isBefore(hour, minute)
+	beforeMatch := r.before == nil || r.before.isAfter(hour, minute)
+	if r.after != nil && r.before != nil && r.after.isAfter(r.before.hour, r.before.minute) {
+		return afterMatch || beforeMatch
+	}
+	return afterMatch && beforeMatch
+}
+
+// Returns true if the client IP is in one of the countries or continents of the
+// route. Clients that can't be located don't match.
+func (r *route) matchClientLocation(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	loc, err := r.geoDB.Lookup(ip)
+	if err != nil {
+		Log.WithField("ip", ip).WithError(err).Debug("failed to lookup client location")
+		return false
+	}
+	return (loc.Country != "" && r.geoCodes["country:"+loc.Country]) ||
+		(loc.Continent != "" && r.geoCodes["continent:"+loc.Continent])
+}
+
 func (r *route) Invert(value bool) {
 	r.inverted = value
 }
 
+// SetTimezone sets the timezone, like "Europe/Berlin", used to evaluate the
+// weekdays and time of day of the route. Uses local time if empty.
+func (r *route) SetTimezone(name string) error {
+	if name == "" {
+		r.location = nil
+		return nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return err
+	}
+	r.location = location
+	return nil
+}
+
+// SetDomains restricts the route to queries for the given domains. The domains
+// use the same format and matching logic as domain blocklists, ".domain.com"
+// matches domain.com and all its subdomains. Domains are stored in a tree which
+// is cheaper to evaluate than a regular expression for large numbers of names.
+func (r *route) SetDomains(domains []string) error {
+	if len(domains) == 0 {
+		r.domains = nil
+		return nil
+	}
+	db, err := NewDomainDB("route", NewStaticLoader(domains))
+	if err != nil {
+		return err
+	}
+	r.domains = db
+	return nil
+}
+
+// SetClientLocation restricts the route to clients located in one of the
+// given countries or continents, by ISO code like "DE" or "EU". Locations are
+// looked up in db.
+func (r *route) SetClientLocation(db *GeoLocationDB, countries, continents []string) error {
+	if len(countries) == 0 && len(continents) == 0 {
+		r.geoDB = nil
+		r.geoCodes = nil
+		return nil
+	}
+	if db == nil {
+		return errors.New("no geo location database for client location route")
+	}
+	r.geoDB = db
+	r.geoCodes = make(map[string]bool)
+	for _, c := range countries {
+		r.geoCodes["country:"+strings.ToUpper(c)] = true
+	}
+	for _, c := range continents {
+		r.geoCodes["continent:"+strings.ToUpper(c)] = true
+	}
+	return nil
+}
+
 func (r *route) String() string {
 	if r.isDefault() {
 		return fmt.Sprintf("default->%s", r.resolver)
@@ -125,7 +226,7 @@ func (r *route) String() string {
 }
 
 func (r *route) isDefault() bool {
-	return r.class == 0 && len(r.types) == 0 && r.name.String() == ""
+	return r.class == 0 && len(r.types) == 0 && r.name.String() == "" && r.domains == nil && r.geoDB == nil
 }
 
 func (r *route) matchType(typ uint16) bool {
@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
@@ -77,6 +78,18 @@ func TestRoute(t *testing.T) {
 			qName:  "google.com",
 			match:  true,
 		},
+		{
+			rName: "\\.google\\.com$",
+			qType: dns.TypeA,
+			qName: "bla.GOOGLE.com",
+			match: false, // expressions are applied to the name as sent
+		},
+		{
+			rName: "(?i)\\.google\\.com$",
+			qType: dns.TypeA,
+			qName: "bla.GOOGLE.com",
+			match: true,
+		},
 	}
 	for _, test := range tests {
 		r, err := NewRoute(test.rName, test.rClass, test.rType, nil, "", "", "", &TestResolver{})
@@ -91,3 +104,51 @@ func TestRoute(t *testing.T) {
 		require.Equal(t, test.match, match)
 	}
 }
+
+func TestRouteSchedule(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	// School hours on weekdays in New York
+	school, err := NewRoute("", "", nil, []string{"mon", "tue", "wed", "thu", "fri"}, "15:00", "08:00", "", &TestResolver{})
+	require.NoError(t, err)
+	require.NoError(t, school.SetTimezone("America/New_York"))
+
+	// Window crossing midnight, every day
+	night, err := NewRoute("", "", nil, nil, "06:00", "22:00", "", &TestResolver{})
+	require.NoError(t, err)
+	require.NoError(t, night.SetTimezone("America/New_York"))
+
+	tests := []struct {
+		route *route
+		now   time.Time
+		match bool
+	}{
+		// Monday 2022-03-07
+		{school, time.Date(2022, 3, 7, 7, 59, 0, 0, ny), false},
+		{school, time.Date(2022, 3, 7, 8, 0, 0, 0, ny), true},
+		{school, time.Date(2022, 3, 7, 14, 59, 0, 0, ny), true},
+		{school, time.Date(2022, 3, 7, 15, 0, 0, 0, ny), false},
+		// Saturday
+		{school, time.Date(2022, 3, 12, 10, 0, 0, 0, ny), false},
+		// Times given in UTC are converted to the route's timezone, before
+		// and after the switch to daylight saving time on 2022-03-13
+		{school, time.Date(2022, 3, 11, 12, 30, 0, 0, time.UTC), false}, // 07:30 EST
+		{school, time.Date(2022, 3, 11, 13, 30, 0, 0, time.UTC), true},  // 08:30 EST
+		{school, time.Date(2022, 3, 14, 12, 30, 0, 0, time.UTC), true},  // 08:30 EDT
+		{school, time.Date(2022, 3, 14, 19, 0, 0, 0, time.UTC), false},  // 15:00 EDT
+		// Crossing midnight
+		{night, time.Date(2022, 3, 7, 21, 59, 0, 0, ny), false},
+		{night, time.Date(2022, 3, 7, 22, 0, 0, 0, ny), true},
+		{night, time.Date(2022, 3, 8, 3, 0, 0, 0, ny), true},
+		{night, time.Date(2022, 3, 8, 6, 0, 0, 0, ny), false},
+		{night, time.Date(2022, 3, 8, 12, 0, 0, 0, ny), false},
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for _, test := range tests {
+		now := test.now
+		test.route.now = func() time.Time { return now }
+		require.Equal(t, test.match, test.route.match(q, ClientInfo{}), test.now.String())
+	}
+}
@@ -75,7 +75,7 @@ func (r *Router) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 // Source is an IP or network in CIDR format.
 func (r *Router) Add(routes ...*route) {
 	r.routes = append(r.routes, routes...)
-	r.metrics.available.Add(1)
+	r.metrics.available.Add(int64(len(routes)))
 }
 
 func (r *Router) String() string {
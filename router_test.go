@@ -2,6 +2,7 @@ package rdns
 
 import (
 	"net"
+	"path/filepath"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -114,3 +115,109 @@ func TestRouterSource(t *testing.T) {
 	require.Equal(t, 1, r1.HitCount())
 	require.Equal(t, 1, r2.HitCount())
 }
+
+func TestRouterDomains(t *testing.T) {
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	r3 := new(TestResolver)
+	q := new(dns.Msg)
+	var ci ClientInfo
+
+	route1, err := NewRoute("", "", nil, nil, "", "", "", r1)
+	require.NoError(t, err)
+	require.NoError(t, route1.SetDomains([]string{".internal", "host.example.com"}))
+	route2, err := NewRoute("", "", nil, nil, "", "", "", r2)
+	require.NoError(t, err)
+	require.NoError(t, route2.SetDomains([]string{".example.com"}))
+
+	router := NewRouter("my-router")
+	router.Add(route1, route2)
+
+	// Suffix match, should go to r1
+	q.SetQuestion("a.b.internal.", dns.TypeA)
+	_, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+
+	// Matches both routes, the first one wins
+	q.SetQuestion("host.example.com.", dns.TypeA)
+	_, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r1.HitCount())
+	require.Equal(t, 0, r2.HitCount())
+
+	// Only matches the second route
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	_, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r2.HitCount())
+
+	// Domains are compared regardless of case
+	q.SetQuestion("WWW.Example.COM.", dns.TypeA)
+	_, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 2, r2.HitCount())
+
+	// No default route, should fail
+	q.SetQuestion("example.org.", dns.TypeA)
+	_, err = router.Resolve(q, ci)
+	require.Error(t, err)
+
+	// Add a default route
+	route3, err := NewRoute("", "", nil, nil, "", "", "", r3)
+	require.NoError(t, err)
+	router.Add(route3)
+	_, err = router.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, 1, r3.HitCount())
+}
+
+func TestRouterClientLocation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mmdb")
+	writeTestMMDB(t, file, map[string]GeoLocation{
+		"192.0.2.0/24":    {Country: "DE", Continent: "EU"},
+		"198.51.100.0/24": {Country: "FR", Continent: "EU"},
+		"203.0.113.0/24":  {Country: "US", Continent: "NA"},
+	})
+	db, err := NewGeoLocationDB(file, 0)
+	require.NoError(t, err)
+	defer db.Close()
+
+	r1 := new(TestResolver)
+	r2 := new(TestResolver)
+	r3 := new(TestResolver)
+	q := new(dns.Msg)
+	q.SetQuestion("acme.test.", dns.TypeA)
+
+	route1, _ := NewRoute("", "", nil, nil, "", "", "", r1)
+	require.NoError(t, route1.SetClientLocation(db, []string{"de"}, nil))
+	route2, _ := NewRoute("", "", nil, nil, "", "", "", r2)
+	require.NoError(t, route2.SetClientLocation(db, nil, []string{"EU"}))
+	route3, _ := NewRoute("", "", nil, nil, "", "", "", r3)
+
+	router := NewRouter("my-router")
+	router.Add(route1, route2, route3)
+
+	// German client goes to r1
+	_, err = router.Resolve(q, ClientInfo{SourceIP: net.ParseIP("192.0.2.1")})
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+
+	// Other clients in Europe go to r2
+	_, err = router.Resolve(q, ClientInfo{SourceIP: net.ParseIP("198.51.100.1")})
+	require.NoError(t, err)
+	require.Equal(t, 1, r2.HitCount())
+
+	// Clients elsewhere, unknown clients or failed lookups use the default
+	_, err = router.Resolve(q, ClientInfo{SourceIP: net.ParseIP("203.0.113.1")})
+	require.NoError(t, err)
+	_, err = router.Resolve(q, ClientInfo{SourceIP: net.ParseIP("10.0.0.1")})
+	require.NoError(t, err)
+	_, err = router.Resolve(q, ClientInfo{SourceIP: net.ParseIP("2001:db8::1")})
+	require.NoError(t, err)
+	_, err = router.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, r1.HitCount())
+	require.Equal(t, 1, r2.HitCount())
+	require.Equal(t, 4, r3.HitCount())
+}
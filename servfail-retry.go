@@ -0,0 +1,86 @@
+package rdns
+
+import (
+	"expvar"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ServfailRetry is a resolver that retries queries answered with SERVFAIL,
+// waiting a little longer before each attempt. Other responses, including
+// NXDOMAIN, are returned as they are. Errors are not retried either, those
+// are handled by failover groups.
+type ServfailRetry struct {
+	id string
+	ServfailRetryOptions
+	resolver Resolver
+	retries  *expvar.Int
+}
+
+var _ Resolver = &ServfailRetry{}
+
+type ServfailRetryOptions struct {
+	// Number of times a query is retried. Default 2.
+	Retries int
+
+	// Time to wait before the first retry, doubled with every further one. A
+	// random jitter of up to +/-50% is applied to each wait. Default 100ms.
+	Backoff time.Duration
+
+	// Optional, resolver used for the last retry instead of the primary one.
+	RetryResolver Resolver
+}
+
+// NewServfailRetry returns a new instance of a SERVFAIL retry resolver.
+func NewServfailRetry(id string, resolver Resolver, opt ServfailRetryOptions) *ServfailRetry {
+	if opt.Retries <= 0 {
+		opt.Retries = 2
+	}
+	if opt.Backoff <= 0 {
+		opt.Backoff = 100 * time.Millisecond
+	}
+	return &ServfailRetry{
+		id:                   id,
+		ServfailRetryOptions: opt,
+		resolver:             resolver,
+		retries:              getVarInt("router", id, "retry"),
+	}
+}
+
+// Resolve a DNS query upstream and retry it if the response is a SERVFAIL.
+func (r *ServfailRetry) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	log := logger(r.id, q, ci)
+	a, err := r.resolver.Resolve(q, ci)
+	backoff := r.Backoff
+	for i := 1; i <= r.Retries; i++ {
+		if err != nil || a == nil || a.Rcode != dns.RcodeServerFailure {
+			return a, err
+		}
+		select {
+		case <-time.After(jitter(backoff)):
+		case <-ci.Context().Done():
+			return a, nil
+		}
+		backoff *= 2
+
+		resolver := r.resolver
+		if i == r.Retries && r.RetryResolver != nil {
+			resolver = r.RetryResolver
+		}
+		log.WithField("resolver", resolver.String()).Debug("servfail response, retrying")
+		r.retries.Add(1)
+		a, err = resolver.Resolve(q, ci)
+	}
+	return a, err
+}
+
+func (r *ServfailRetry) String() string {
+	return r.id
+}
+
+// Returns a random duration between 50% and 150% of d.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d)+1))
+}
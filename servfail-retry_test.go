@@ -0,0 +1,84 @@
+package rdns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a resolver that responds with the given rcodes in order, and the
+// last one for all further queries.
+func rcodeSequenceResolver(rcodes ...int) *TestResolver {
+	var n int
+	return &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetRcode(q, rcodes[n])
+			if n < len(rcodes)-1 {
+				n++
+			}
+			return a, nil
+		},
+	}
+}
+
+func TestServfailRetry(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	opt := ServfailRetryOptions{Retries: 3, Backoff: time.Millisecond}
+
+	// Retried until the response is successful
+	upstream := rcodeSequenceResolver(dns.RcodeServerFailure, dns.RcodeServerFailure, dns.RcodeSuccess)
+	r := NewServfailRetry("test-retry", upstream, opt)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, 3, upstream.HitCount())
+
+	// NXDOMAIN is not retried
+	upstream = rcodeSequenceResolver(dns.RcodeNameError, dns.RcodeSuccess)
+	r = NewServfailRetry("test-retry", upstream, opt)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 1, upstream.HitCount())
+
+	// Gives up after the configured number of retries
+	upstream = rcodeSequenceResolver(dns.RcodeServerFailure)
+	r = NewServfailRetry("test-retry", upstream, opt)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	require.Equal(t, 4, upstream.HitCount())
+}
+
+func TestServfailRetryResolver(t *testing.T) {
+	var ci ClientInfo
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The last attempt goes to the retry resolver
+	upstream := rcodeSequenceResolver(dns.RcodeServerFailure)
+	alternate := rcodeSequenceResolver(dns.RcodeSuccess)
+	r := NewServfailRetry("test-retry", upstream, ServfailRetryOptions{
+		Retries:       2,
+		Backoff:       time.Millisecond,
+		RetryResolver: alternate,
+	})
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, a.Rcode)
+	require.Equal(t, 2, upstream.HitCount())
+	require.Equal(t, 1, alternate.HitCount())
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(100 * time.Millisecond)
+		require.GreaterOrEqual(t, d, 50*time.Millisecond)
+		require.LessOrEqual(t, d, 150*time.Millisecond)
+	}
+}
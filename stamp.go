@@ -0,0 +1,261 @@
+package rdns
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// StampProtocol is the protocol identifier of a DNS stamp.
+type StampProtocol uint8
+
+// Protocols supported in DNS stamps.
+const (
+	StampPlain    StampProtocol = 0x00
+	StampDNSCrypt StampProtocol = 0x01
+	StampDoH      StampProtocol = 0x02
+	StampDoT      StampProtocol = 0x03
+	StampDoQ      StampProtocol = 0x04
+)
+
+// StampProps contains the information encoded in a DNS stamp, as per
+// https://dnscrypt.info/stamps-specifications.
+type StampProps struct {
+	Protocol StampProtocol
+
+	// Informal properties of the server
+	DNSSEC   bool
+	NoLog    bool
+	NoFilter bool
+
+	// IP address of the server, optionally with port. Can be empty for DoH, DoT
+	// and DoQ in which case the hostname has to be resolved.
+	Address string
+
+	// SHA256 digests of the TBS certificates in the chain of the server, DoH,
+	// DoT and DoQ only.
+	Hashes [][]byte
+
+	// Server hostname, optionally with port. DoH, DoT and DoQ only.
+	Hostname string
+
+	// URL path of the DoH endpoint.
+	Path string
+
+	// Provider public key and name, DNSCrypt only.
+	PublicKey    []byte
+	ProviderName string
+
+	// IP addresses of resolvers that can be used to resolve the hostname.
+	BootstrapIPs []string
+}
+
+// ParseStamp decodes a DNS stamp (sdns://).
+func ParseStamp(stamp string) (StampProps, error) {
+	var p StampProps
+	if !strings.HasPrefix(stamp, "sdns://") {
+		return p, errors.New("stamp doesn't start with sdns://")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(stamp, "sdns://"))
+	if err != nil {
+		return p, fmt.Errorf("invalid stamp: %w", err)
+	}
+	if len(b) < 9 {
+		return p, errors.New("stamp too short")
+	}
+	p.Protocol = StampProtocol(b[0])
+	props := binary.LittleEndian.Uint64(b[1:9])
+	p.DNSSEC = props&1 != 0
+	p.NoLog = props&2 != 0
+	p.NoFilter = props&4 != 0
+
+	r := &stampReader{b: b[9:]}
+	switch p.Protocol {
+	case StampPlain:
+		p.Address = r.string()
+	case StampDNSCrypt:
+		p.Address = r.string()
+		p.PublicKey = r.bytes()
+		p.ProviderName = r.string()
+	case StampDoH, StampDoT, StampDoQ:
+		p.Address = r.string()
+		for _, h := range r.set() {
+			if len(h) > 0 {
+				p.Hashes = append(p.Hashes, h)
+			}
+		}
+		p.Hostname = r.string()
+		if p.Protocol == StampDoH {
+			p.Path = r.string()
+		}
+		if len(r.b) > 0 {
+			for _, ip := range r.set() {
+				p.BootstrapIPs = append(p.BootstrapIPs, string(ip))
+			}
+		}
+	default:
+		return p, fmt.Errorf("unsupported stamp protocol 0x%02x", p.Protocol)
+	}
+	if r.err != nil {
+		return p, r.err
+	}
+	if len(r.b) > 0 {
+		return p, errors.New("unexpected data at the end of stamp")
+	}
+	return p, nil
+}
+
+// Returns the endpoint (host:port) of the server and, if the stamp contains
+// one, the IP to use when connecting to it. The port is taken from the
+// hostname, the address, or the default port, in that order.
+func (p StampProps) endpoint(defaultPort string) (string, string) {
+	addrHost, addrPort := splitStampHost(p.Address)
+	host, port := splitStampHost(p.Hostname)
+	if port == "" {
+		port = addrPort
+	}
+	if port == "" {
+		port = defaultPort
+	}
+	if host == "" {
+		return net.JoinHostPort(addrHost, port), ""
+	}
+	return net.JoinHostPort(host, port), addrHost
+}
+
+// Splits a host with optional port, IPv6 addresses can be in brackets.
+func splitStampHost(s string) (string, string) {
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		return host, port
+	}
+	return strings.Trim(s, "[]"), ""
+}
+
+// Reads length-prefixed fields of a stamp.
+type stampReader struct {
+	b   []byte
+	err error
+}
+
+func (r *stampReader) bytes() []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < 1 || len(r.b) < 1+int(r.b[0]) {
+		r.err = errors.New("invalid stamp length")
+		return nil
+	}
+	out := r.b[1 : 1+int(r.b[0])]
+	r.b = r.b[1+int(r.b[0]):]
+	return out
+}
+
+func (r *stampReader) string() string {
+	return string(r.bytes())
+}
+
+// Reads a set of values, the high bit in the length indicates that more
+// values follow.
+func (r *stampReader) set() [][]byte {
+	var out [][]byte
+	for r.err == nil {
+		if len(r.b) < 1 {
+			r.err = errors.New("invalid stamp length")
+			return nil
+		}
+		more := r.b[0]&0x80 != 0
+		r.b[0] &^= 0x80
+		out = append(out, r.bytes())
+		if !more {
+			break
+		}
+	}
+	return out
+}
+
+// NewDoTClientFromStamp instantiates a DNS-over-TLS resolver from a DNS stamp.
+// Certificate hashes in the stamp are added to the TLS configuration.
+func NewDoTClientFromStamp(id, stamp string, opt DoTClientOptions) (*DoTClient, error) {
+	p, err := ParseStamp(stamp)
+	if err != nil {
+		return nil, err
+	}
+	if p.Protocol != StampDoT {
+		return nil, errors.New("not a dot stamp")
+	}
+	endpoint, bootstrapAddr := p.endpoint(DoTPort)
+	if opt.BootstrapAddr == "" {
+		opt.BootstrapAddr = bootstrapAddr
+	}
+	opt.TLSConfig = pinCertificates(opt.TLSConfig, p.Hashes)
+	return NewDoTClient(id, endpoint, opt)
+}
+
+// NewDoHClientFromStamp instantiates a DNS-over-HTTPS resolver from a DNS
+// stamp. Certificate hashes in the stamp are added to the TLS configuration.
+func NewDoHClientFromStamp(id, stamp string, opt DoHClientOptions) (*DoHClient, error) {
+	p, err := ParseStamp(stamp)
+	if err != nil {
+		return nil, err
+	}
+	if p.Protocol != StampDoH {
+		return nil, errors.New("not a doh stamp")
+	}
+	endpoint, bootstrapAddr := p.endpoint(DoHPort)
+	if opt.BootstrapAddr == "" {
+		opt.BootstrapAddr = bootstrapAddr
+	}
+	opt.TLSConfig = pinCertificates(opt.TLSConfig, p.Hashes)
+	return NewDoHClient(id, "https://"+endpoint+p.Path, opt)
+}
+
+// NewDNSCryptClientFromStamp instantiates a DNSCrypt resolver from a DNS stamp.
+func NewDNSCryptClientFromStamp(id, stamp string, opt DNSCryptClientOptions) (*DNSCryptClient, error) {
+	opt.Stamp = stamp
+	return NewDNSCryptClient(id, "", opt)
+}
+
+// Returns a copy of the TLS config that, in addition to the regular
+// verification, requires one of the certificates in the server's verified
+// chain to have a TBS certificate matching one of the SHA256 hashes. Only the
+// leaf certificate is checked if verification is skipped. Returns the config
+// unmodified if there are no hashes.
+func pinCertificates(cfg *tls.Config, hashes [][]byte) *tls.Config {
+	if len(hashes) == 0 {
+		return cfg
+	}
+	if cfg == nil {
+		cfg = new(tls.Config)
+	} else {
+		cfg = cfg.Clone()
+	}
+	next := cfg.VerifyPeerCertificate
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if next != nil {
+			if err := next(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		certs, err := pinnableCertificates(rawCerts, verifiedChains)
+		if err != nil {
+			return err
+		}
+		for _, cert := range certs {
+			digest := sha256.Sum256(cert.RawTBSCertificate)
+			for _, h := range hashes {
+				if bytes.Equal(digest[:], h) {
+					return nil
+				}
+			}
+		}
+		return errors.New("no certificate in the chain matches the pinned hashes")
+	}
+	return cfg
+}
@@ -0,0 +1,127 @@
+package rdns
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStampDoH(t *testing.T) {
+	p, err := ParseStamp("sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5")
+	require.NoError(t, err)
+	require.Equal(t, StampDoH, p.Protocol)
+	require.True(t, p.DNSSEC)
+	require.True(t, p.NoLog)
+	require.True(t, p.NoFilter)
+	require.Equal(t, "1.0.0.1", p.Address)
+	require.Empty(t, p.Hashes)
+	require.Equal(t, "dns.cloudflare.com", p.Hostname)
+	require.Equal(t, "/dns-query", p.Path)
+
+	c, err := NewDoHClientFromStamp("test-doh", "sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5", DoHClientOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "https://dns.cloudflare.com:443/dns-query", c.endpoint)
+	require.Equal(t, "1.0.0.1", c.opt.BootstrapAddr)
+}
+
+func TestParseStampDNSCrypt(t *testing.T) {
+	stamp := "sdns://AQMAAAAAAAAAETk0LjE0MC4xNC4xNDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20"
+	p, err := ParseStamp(stamp)
+	require.NoError(t, err)
+	require.Equal(t, StampDNSCrypt, p.Protocol)
+	require.True(t, p.DNSSEC)
+	require.True(t, p.NoLog)
+	require.False(t, p.NoFilter)
+	require.Equal(t, "94.140.14.14:5443", p.Address)
+	require.Len(t, p.PublicKey, 32)
+	require.Equal(t, byte(0xd1), p.PublicKey[0])
+	require.Equal(t, "2.dnscrypt.default.ns1.adguard.com", p.ProviderName)
+
+	c, err := NewDNSCryptClientFromStamp("test-dnscrypt", stamp, DNSCryptClientOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "94.140.14.14:5443", c.endpoint)
+	require.Equal(t, "2.dnscrypt.default.ns1.adguard.com.", c.providerName)
+}
+
+func TestParseStampDoT(t *testing.T) {
+	hash := make([]byte, 32)
+	for i := range hash {
+		hash[i] = byte(i)
+	}
+	b := []byte{byte(StampDoT), 1, 0, 0, 0, 0, 0, 0, 0}
+	b = append(b, byte(len("[2001:db8::1]")))
+	b = append(b, "[2001:db8::1]"...)
+	b = append(b, 0x80|32) // Two hashes, the second empty
+	b = append(b, hash...)
+	b = append(b, 0)
+	b = append(b, byte(len("dot.example.com:8853")))
+	b = append(b, "dot.example.com:8853"...)
+	b = append(b, 0x80|7) // Bootstrap IPs
+	b = append(b, "1.1.1.1"...)
+	b = append(b, 7)
+	b = append(b, "8.8.8.8"...)
+	stamp := "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+
+	p, err := ParseStamp(stamp)
+	require.NoError(t, err)
+	require.Equal(t, StampDoT, p.Protocol)
+	require.True(t, p.DNSSEC)
+	require.False(t, p.NoLog)
+	require.Equal(t, "[2001:db8::1]", p.Address)
+	require.Equal(t, [][]byte{hash}, p.Hashes)
+	require.Equal(t, "dot.example.com:8853", p.Hostname)
+	require.Equal(t, []string{"1.1.1.1", "8.8.8.8"}, p.BootstrapIPs)
+
+	endpoint, bootstrap := p.endpoint(DoTPort)
+	require.Equal(t, "dot.example.com:8853", endpoint)
+	require.Equal(t, "2001:db8::1", bootstrap)
+
+	c, err := NewDoTClientFromStamp("test-dot", stamp, DoTClientOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:8853", c.endpoint)
+
+	// Invalid stamps
+	_, err = ParseStamp("https://example.com")
+	require.Error(t, err)
+	_, err = ParseStamp("sdns://" + base64.RawURLEncoding.EncodeToString(b[:20]))
+	require.Error(t, err)
+	_, err = NewDoHClientFromStamp("test-doh", stamp, DoHClientOptions{})
+	require.Error(t, err)
+}
+
+func TestPinCertificates(t *testing.T) {
+	b, err := os.ReadFile("testdata/server.crt")
+	require.NoError(t, err)
+	block, _ := pem.Decode(b)
+	require.NotNil(t, block)
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	digest := sha256.Sum256(cert.RawTBSCertificate)
+
+	cfg := pinCertificates(nil, [][]byte{digest[:]})
+	require.NoError(t, cfg.VerifyPeerCertificate([][]byte{block.Bytes}, nil))
+
+	cfg = pinCertificates(nil, [][]byte{make([]byte, 32)})
+	require.Error(t, cfg.VerifyPeerCertificate([][]byte{block.Bytes}, nil))
+
+	// Certificates after the leaf only match if they're in the verified chain
+	b, err = os.ReadFile("testdata/ca.crt")
+	require.NoError(t, err)
+	caBlock, _ := pem.Decode(b)
+	require.NotNil(t, caBlock)
+	ca, err := x509.ParseCertificate(caBlock.Bytes)
+	require.NoError(t, err)
+	caDigest := sha256.Sum256(ca.RawTBSCertificate)
+	cfg = pinCertificates(nil, [][]byte{caDigest[:]})
+	require.Error(t, cfg.VerifyPeerCertificate([][]byte{block.Bytes, caBlock.Bytes}, nil))
+	require.NoError(t, cfg.VerifyPeerCertificate([][]byte{block.Bytes, caBlock.Bytes}, [][]*x509.Certificate{{cert, ca}}))
+
+	// No hashes leave the config alone
+	require.Nil(t, pinCertificates(nil, nil))
+}
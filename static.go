@@ -14,6 +14,7 @@ type StaticResolver struct {
 	extra  []dns.RR
 	rcode  int
 	truncate	bool
+	ttl    uint32
 }
 
 var _ Resolver = &StaticResolver{}
@@ -25,6 +26,10 @@ type StaticResolverOptions struct {
 	Extra  []string
 	RCode  int
 	Truncate	bool
+
+	// TTL of all records in the response. The TTLs from the records are
+	// used if 0.
+	TTL uint32
 }
 
 // NewStaticResolver returns a new instance of a StaticResolver resolver.
@@ -55,6 +60,7 @@ func NewStaticResolver(id string, opt StaticResolverOptions) (*StaticResolver, e
 	r.rcode = opt.RCode
 	
 	r.truncate = opt.Truncate
+	r.ttl = opt.TTL
 	
 	return r, nil
 }
@@ -67,12 +73,17 @@ func (r *StaticResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 	// Update the name of every answer record to match that of the query
 	answer.Answer = make([]dns.RR, 0, len(r.answer))
 	for _, rr := range r.answer {
-		r := dns.Copy(rr)
-		r.Header().Name = qName(q)
-		answer.Answer = append(answer.Answer, r)
+		rr := r.copyRR(rr)
+		rr.Header().Name = qName(q)
+		answer.Answer = append(answer.Answer, rr)
+	}
+	// Copy the records so they're not modified by any further processing
+	for _, rr := range r.ns {
+		answer.Ns = append(answer.Ns, r.copyRR(rr))
+	}
+	for _, rr := range r.extra {
+		answer.Extra = append(answer.Extra, r.copyRR(rr))
 	}
-	answer.Ns = r.ns
-	answer.Extra = r.extra
 	answer.Rcode = r.rcode
 	answer.Truncated = r.truncate
 
@@ -84,3 +95,12 @@ func (r *StaticResolver) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 func (r *StaticResolver) String() string {
 	return r.id
 }
+
+// Returns a copy of the record with the TTL applied if one was configured.
+func (r *StaticResolver) copyRR(rr dns.RR) dns.RR {
+	rr = dns.Copy(rr)
+	if r.ttl > 0 {
+		rr.Header().Ttl = r.ttl
+	}
+	return rr
+}
@@ -12,6 +12,7 @@ var (
 	DoTPort      string = "853"
 	DTLSPort     string = DoTPort
 	DoHPort      string = "443"
+	DNSCryptPort string = "443"
 	PlainDNSPort        = "53"
 )
 
@@ -35,3 +35,69 @@ func TestStaticResolver(t *testing.T) {
 	require.Equal(t, "example.com.", a.Ns[0].Header().Name)
 	require.Equal(t, "ns1.example.com.", a.Extra[0].Header().Name)
 }
+
+func TestStaticResolverTypes(t *testing.T) {
+	opt := StaticResolverOptions{
+		Answer: []string{
+			"IN CNAME target.example.com.",
+			"IN TXT \"some text\"",
+			"IN MX 10 mail.example.com.",
+			"IN AAAA ::1",
+		},
+		NS:  []string{"example.com. 18000 IN NS ns1.example.com."},
+		TTL: 60,
+	}
+	r, err := NewStaticResolver("test-static", opt)
+	require.NoError(t, err)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeANY)
+	q.Id = 1234
+
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, uint16(1234), a.Id)
+	require.Equal(t, q.Question, a.Question)
+	require.Len(t, a.Answer, 4)
+	require.IsType(t, &dns.CNAME{}, a.Answer[0])
+	require.IsType(t, &dns.TXT{}, a.Answer[1])
+	require.IsType(t, &dns.MX{}, a.Answer[2])
+	require.IsType(t, &dns.AAAA{}, a.Answer[3])
+	for _, rr := range append(a.Answer, a.Ns...) {
+		require.Equal(t, uint32(60), rr.Header().Ttl)
+	}
+
+	// Modifying the response must not change the configured records
+	a.Ns[0].Header().Ttl = 1
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(60), a.Ns[0].Header().Ttl)
+}
+
+func TestStaticResolverRouter(t *testing.T) {
+	static, err := NewStaticResolver("test-static", StaticResolverOptions{
+		Answer: []string{"IN A 10.0.0.1"},
+	})
+	require.NoError(t, err)
+	upstream := new(TestResolver)
+
+	// Names under .internal are answered locally, everything else goes upstream
+	route1, err := NewRoute(`\.internal\.$`, "", nil, nil, "", "", "", static)
+	require.NoError(t, err)
+	route2, err := NewRoute("", "", nil, nil, "", "", "", upstream)
+	require.NoError(t, err)
+	router := NewRouter("test-router")
+	router.Add(route1, route2)
+
+	q := new(dns.Msg)
+	q.SetQuestion("host.internal.", dns.TypeA)
+	a, err := router.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1", a.Answer[0].(*dns.A).A.String())
+	require.Equal(t, 0, upstream.HitCount())
+
+	q.SetQuestion("example.com.", dns.TypeA)
+	_, err = router.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, 1, upstream.HitCount())
+}
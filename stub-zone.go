@@ -0,0 +1,82 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+
+	"github.com/miekg/dns"
+)
+
+// StubZone is a resolver that forwards queries for names in some zones to
+// dedicated resolvers, typically the authoritative servers of the zones, and
+// all other queries to the default resolver. Queries for a zone are answered
+// with NXDOMAIN if its resolver fails, they are never sent to the default
+// resolver.
+type StubZone struct {
+	id string
+	StubZoneOptions
+	resolver Resolver
+	route    *expvar.Map
+}
+
+var _ Resolver = &StubZone{}
+
+type StubZoneOptions struct {
+	// Resolver for each zone, by name of the zone apex. A zone includes all
+	// names below the apex. If zones are nested, the most specific one is used.
+	Zones map[string]Resolver
+}
+
+// NewStubZone returns a new instance of a stub zone resolver.
+func NewStubZone(id string, resolver Resolver, opt StubZoneOptions) *StubZone {
+	zones := make(map[string]Resolver, len(opt.Zones))
+	for zone, r := range opt.Zones {
+		zones[normalizeName(dns.Fqdn(zone))] = r
+	}
+	opt.Zones = zones
+	return &StubZone{
+		id:              id,
+		StubZoneOptions: opt,
+		resolver:        resolver,
+		route:           getVarMap("router", id, "route"),
+	}
+}
+
+// Resolve a DNS query with the resolver of the zone the name is in, or with
+// the default resolver for names outside of all zones.
+func (r *StubZone) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	log := logger(r.id, q, ci)
+	zone, resolver, ok := r.match(q.Question[0].Name)
+	if !ok {
+		r.route.Add(r.resolver.String(), 1)
+		log.WithField("resolver", r.resolver.String()).Trace("forwarding query to resolver")
+		return r.resolver.Resolve(q, ci)
+	}
+	log = log.WithField("zone", zone)
+	r.route.Add(resolver.String(), 1)
+	log.WithField("resolver", resolver.String()).Debug("forwarding query to stub zone resolver")
+	a, err := resolver.Resolve(q, ci)
+	if err != nil {
+		log.WithError(err).Debug("stub zone resolver failed, responding with nxdomain")
+		return nxdomain(q), nil
+	}
+	return a, nil
+}
+
+func (r *StubZone) String() string {
+	return r.id
+}
+
+// Returns the most specific zone the name is in, and its resolver.
+func (r *StubZone) match(name string) (string, Resolver, bool) {
+	name = normalizeName(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if resolver, ok := r.Zones[name[off:]]; ok {
+			return name[off:], resolver, true
+		}
+	}
+	return "", nil, false
+}
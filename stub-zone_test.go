@@ -0,0 +1,73 @@
+package rdns
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStubZone(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	internal := new(TestResolver)
+	lab := new(TestResolver)
+	r := NewStubZone("test-stub", upstream, StubZoneOptions{
+		Zones: map[string]Resolver{
+			"example.internal":     internal,
+			"Lab.Example.Internal": lab,
+		},
+	})
+
+	tests := []struct {
+		name     string
+		expected *TestResolver
+	}{
+		{"example.internal.", internal},
+		{"host.example.internal.", internal},
+		{"a.b.EXAMPLE.internal.", internal},
+		{"lab.example.internal.", lab},
+		{"host.lab.example.internal.", lab},
+		{"example.com.", upstream},
+		{"notexample.internal.", upstream},
+		{"internal.", upstream},
+		{`host\.example.internal.`, upstream},
+		{".", upstream},
+	}
+	for _, test := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(test.name, dns.TypeA)
+		hits := [...]int{upstream.HitCount(), internal.HitCount(), lab.HitCount()}
+		_, err := r.Resolve(q, ci)
+		require.NoError(t, err)
+		for i, resolver := range []*TestResolver{upstream, internal, lab} {
+			expected := hits[i]
+			if resolver == test.expected {
+				expected++
+			}
+			require.Equal(t, expected, resolver.HitCount(), test.name)
+		}
+	}
+}
+
+func TestStubZoneFailure(t *testing.T) {
+	var ci ClientInfo
+	upstream := new(TestResolver)
+	internal := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			return nil, errors.New("failed")
+		},
+	}
+	r := NewStubZone("test-stub", upstream, StubZoneOptions{
+		Zones: map[string]Resolver{"example.internal.": internal},
+	})
+
+	// Names in the zone are never sent to the default resolver
+	q := new(dns.Msg)
+	q.SetQuestion("host.example.internal.", dns.TypeA)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Equal(t, 0, upstream.HitCount())
+}
@@ -0,0 +1,66 @@
+package rdns
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Idle timeout of TCP connections used by the DNS library if none is set.
+const defaultTCPIdleTimeout = 8 * time.Second
+
+// Replaces any edns-tcp-keepalive option (RFC7828) in a response with one that
+// has the idle timeout of the listener, if the client asked for it in the query.
+// Options from upstream resolvers are always removed since they apply to the
+// connection to the upstream, not the client.
+func setTCPKeepalive(q, a *dns.Msg, timeout time.Duration) {
+	requested := hasTCPKeepalive(q)
+	removeTCPKeepalive(a)
+	if !requested {
+		return
+	}
+	edns0a := a.IsEdns0()
+	if edns0a == nil {
+		edns0q := q.IsEdns0()
+		a.SetEdns0(edns0q.UDPSize(), edns0q.Do())
+		edns0a = a.IsEdns0()
+	}
+	// The timeout is in units of 100 milliseconds
+	units := timeout / (100 * time.Millisecond)
+	if units > 0xFFFF {
+		units = 0xFFFF
+	}
+	edns0a.Option = append(edns0a.Option, &dns.EDNS0_TCP_KEEPALIVE{
+		Code:    dns.EDNS0TCPKEEPALIVE,
+		Timeout: uint16(units),
+	})
+}
+
+// Returns true if the message has an edns-tcp-keepalive option.
+func hasTCPKeepalive(m *dns.Msg) bool {
+	edns0 := m.IsEdns0()
+	if edns0 == nil {
+		return false
+	}
+	for _, opt := range edns0.Option {
+		if opt.Option() == dns.EDNS0TCPKEEPALIVE {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the edns-tcp-keepalive option from a message.
+func removeTCPKeepalive(m *dns.Msg) {
+	edns0 := m.IsEdns0()
+	if edns0 == nil || !hasTCPKeepalive(m) {
+		return
+	}
+	newOpt := make([]dns.EDNS0, 0, len(edns0.Option))
+	for _, opt := range edns0.Option {
+		if opt.Option() != dns.EDNS0TCPKEEPALIVE {
+			newOpt = append(newOpt, opt)
+		}
+	}
+	edns0.Option = newOpt
+}
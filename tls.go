@@ -1,8 +1,12 @@
 package rdns
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 )
@@ -69,3 +73,74 @@ func TLSClientConfig(caFile, crtFile, keyFile string) (*tls.Config, error) {
 	}
 	return tlsConfig, nil
 }
+
+// Returns the certificates of the server that pins are matched against, the
+// ones in the verified chains. If the chain wasn't verified, only the leaf
+// certificate is returned since anyone could append other certificates, like
+// the genuine one of the server, to their own.
+func pinnableCertificates(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) ([]*x509.Certificate, error) {
+	if len(verifiedChains) > 0 {
+		var certs []*x509.Certificate
+		for _, chain := range verifiedChains {
+			certs = append(certs, chain...)
+		}
+		return certs, nil
+	}
+	if len(rawCerts) == 0 {
+		return nil, errors.New("no certificate presented by the server")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{cert}, nil
+}
+
+// Returns a copy of the TLS config that requires one of the certificates in
+// the verified chain of the server to have a public key matching one of the
+// pins. Pins are base64-encoded SHA256 hashes of the SubjectPublicKeyInfo. If
+// pinOnly is set, the chain isn't validated and the key of the leaf
+// certificate has to match. A config that skips verification requires pinOnly,
+// it would otherwise be validated without the caller noticing.
+func pinPublicKeys(cfg *tls.Config, pins []string, pinOnly bool) (*tls.Config, error) {
+	hashes := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		h, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(h) != sha256.Size {
+			return nil, fmt.Errorf("invalid pinned key '%s'", pin)
+		}
+		hashes = append(hashes, h)
+	}
+	if cfg == nil {
+		cfg = new(tls.Config)
+	} else {
+		if cfg.InsecureSkipVerify && !pinOnly {
+			return nil, errors.New("pinned keys with a tls config that skips verification require pin-only")
+		}
+		cfg = cfg.Clone()
+	}
+	cfg.InsecureSkipVerify = pinOnly
+	next := cfg.VerifyPeerCertificate
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if next != nil {
+			if err := next(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+		}
+		// In pin-only mode the chain isn't verified and only the leaf is checked
+		certs, err := pinnableCertificates(rawCerts, verifiedChains)
+		if err != nil {
+			return err
+		}
+		for _, cert := range certs {
+			digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, h := range hashes {
+				if bytes.Equal(digest[:], h) {
+					return nil
+				}
+			}
+		}
+		return errors.New("no certificate presented by the server matches the pinned keys")
+	}
+	return cfg, nil
+}
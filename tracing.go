@@ -0,0 +1,83 @@
+package rdns
+
+import (
+	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing is a modifier that records an OpenTelemetry span for every query
+// passing through it. The span is carried upstream in the context of the
+// query, so spans of tracing elements further down the pipeline become
+// children of this one. Wrapping each element of a chain like router, group
+// and resolver produces a nested trace showing where time is spent.
+type Tracing struct {
+	id       string
+	resolver Resolver
+	tracer   trace.Tracer
+}
+
+var _ Resolver = &Tracing{}
+
+// TracingOptions contain settings for the tracing modifier.
+type TracingOptions struct {
+	// Provider of the tracer that records the spans. Defaults to the global
+	// provider of the otel package.
+	TracerProvider trace.TracerProvider
+}
+
+// Name of the tracer, the instrumentation library of the spans.
+const tracerName = "github.com/folbricht/routedns"
+
+// Span attribute names.
+const (
+	SpanAttrQName    = attribute.Key("dns.qname")
+	SpanAttrQType    = attribute.Key("dns.qtype")
+	SpanAttrRCode    = attribute.Key("dns.rcode")
+	SpanAttrResolver = attribute.Key("routedns.resolver")
+)
+
+// NewTracing returns a new instance of a tracing modifier.
+func NewTracing(id string, resolver Resolver, opt TracingOptions) *Tracing {
+	if opt.TracerProvider == nil {
+		opt.TracerProvider = otel.GetTracerProvider()
+	}
+	return &Tracing{
+		id:       id,
+		resolver: resolver,
+		tracer:   opt.TracerProvider.Tracer(tracerName),
+	}
+}
+
+// Resolve a DNS query with the upstream resolver inside a new span.
+func (r *Tracing) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	attrs := []attribute.KeyValue{SpanAttrResolver.String(r.resolver.String())}
+	if len(q.Question) > 0 {
+		attrs = append(attrs,
+			SpanAttrQName.String(q.Question[0].Name),
+			SpanAttrQType.String(dns.TypeToString[q.Question[0].Qtype]),
+		)
+	}
+	ctx, span := r.tracer.Start(ci.Context(), r.id, trace.WithAttributes(attrs...))
+	defer span.End()
+
+	// Make this span the parent of any spans recorded upstream
+	a, err := r.resolver.Resolve(q, ci.WithContext(ctx))
+
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case a == nil:
+		span.SetAttributes(SpanAttrRCode.String("DROP"))
+	default:
+		span.SetAttributes(SpanAttrRCode.String(dns.RcodeToString[a.Rcode]))
+	}
+	return a, err
+}
+
+func (r *Tracing) String() string {
+	return r.id
+}
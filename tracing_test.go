@@ -0,0 +1,77 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracingChain(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	opt := TracingOptions{TracerProvider: tp}
+
+	// Router -> FailRotate -> resolver, with every element traced. The first
+	// resolver in the group fails so the query is retried on the second.
+	var ci ClientInfo
+	failing := &TestResolver{ResolveFunc: func(q *dns.Msg, c ClientInfo) (*dns.Msg, error) {
+		return servfail(q), nil
+	}}
+	working := &TestResolver{ResolveFunc: func(q *dns.Msg, c ClientInfo) (*dns.Msg, error) {
+		ci = c
+		a := new(dns.Msg)
+		a.SetReply(q)
+		return a, nil
+	}}
+	r1 := NewTracing("trace-r1", failing, opt)
+	r2 := NewTracing("trace-r2", working, opt)
+	group := NewTracing("trace-group", NewFailRotate("group", FailRotateOptions{ServfailError: true}, r1, r2), opt)
+	route, err := NewRoute("", "", nil, nil, "", "", "", group)
+	require.NoError(t, err)
+	router := NewRouter("router")
+	router.Add(route)
+	top := NewTracing("trace-router", router, opt)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeMX)
+	_, err = top.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+
+	// Spans are exported in the order they are completed
+	spans := exp.GetSpans()
+	require.Len(t, spans, 4)
+	s1, s2, sGroup, sRouter := spans[0], spans[1], spans[2], spans[3]
+	require.Equal(t, "trace-r1", s1.Name)
+	require.Equal(t, "trace-r2", s2.Name)
+	require.Equal(t, "trace-group", sGroup.Name)
+	require.Equal(t, "trace-router", sRouter.Name)
+
+	// All spans are part of the same trace and nested
+	for _, s := range spans {
+		require.Equal(t, sRouter.SpanContext.TraceID(), s.SpanContext.TraceID())
+	}
+	require.False(t, sRouter.Parent.IsValid())
+	require.Equal(t, sRouter.SpanContext.SpanID(), sGroup.Parent.SpanID())
+	require.Equal(t, sGroup.SpanContext.SpanID(), s1.Parent.SpanID())
+	require.Equal(t, sGroup.SpanContext.SpanID(), s2.Parent.SpanID())
+
+	// The span is passed upstream in the context of the query
+	require.Equal(t, s2.SpanContext.SpanID(), trace.SpanContextFromContext(ci.Context()).SpanID())
+
+	// Attributes
+	require.ElementsMatch(t, []attribute.KeyValue{
+		SpanAttrResolver.String("TestResolver()"),
+		SpanAttrQName.String("example.com."),
+		SpanAttrQType.String("MX"),
+		SpanAttrRCode.String("SERVFAIL"),
+	}, s1.Attributes)
+	require.Contains(t, s2.Attributes, SpanAttrRCode.String("NOERROR"))
+	require.Contains(t, sGroup.Attributes, SpanAttrResolver.String("group"))
+	require.Contains(t, sRouter.Attributes, SpanAttrResolver.String("router"))
+	require.False(t, sRouter.EndTime.Before(sGroup.EndTime))
+}
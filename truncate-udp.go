@@ -0,0 +1,78 @@
+package rdns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// TruncateUDP is a modifier that enforces the UDP buffer size of clients. If
+// a response to a query received over UDP or DTLS is larger than the buffer
+// size advertised by the client in EDNS0, or a default size if the client
+// didn't advertise one, all records are removed from it and the TC flag is set.
+// This prompts the client to retry the query over TCP. Responses to queries
+// received over other protocols are not changed.
+type TruncateUDP struct {
+	id       string
+	resolver Resolver
+	opt      TruncateUDPOptions
+}
+
+var _ Resolver = &TruncateUDP{}
+
+// TruncateUDPOptions contain settings for the UDP truncation modifier.
+type TruncateUDPOptions struct {
+	// Buffer size of clients that don't send an EDNS0 option. Default 512.
+	DefaultSize uint16
+
+	// Upper limit of the buffer size advertised by clients, for example 1232
+	// to avoid IP fragmentation. No limit if 0.
+	MaxSize uint16
+}
+
+// NewTruncateUDP returns a new instance of a UDP truncation modifier.
+func NewTruncateUDP(id string, resolver Resolver, opt TruncateUDPOptions) *TruncateUDP {
+	if opt.DefaultSize == 0 {
+		opt.DefaultSize = dns.MinMsgSize
+	}
+	return &TruncateUDP{id: id, resolver: resolver, opt: opt}
+}
+
+// Resolve a DNS query with the upstream resolver and truncate the response if
+// it doesn't fit into the client's buffer.
+func (r *TruncateUDP) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	if ci.Protocol != ProtocolUDP && ci.Protocol != ProtocolDTLS {
+		return a, nil
+	}
+	size := r.opt.DefaultSize
+	if edns0 := q.IsEdns0(); edns0 != nil && edns0.UDPSize() > 0 {
+		size = edns0.UDPSize()
+		if size < dns.MinMsgSize {
+			size = dns.MinMsgSize
+		}
+	}
+	if r.opt.MaxSize > 0 && size > r.opt.MaxSize {
+		size = r.opt.MaxSize
+	}
+	if a.Len() <= int(size) {
+		return a, nil
+	}
+	logger(r.id, q, ci).WithField("size", size).Debug("response too large, truncating")
+
+	// Strip all records other than the OPT record and set the TC flag
+	out := a.Copy()
+	out.Truncated = true
+	out.Answer = nil
+	out.Ns = nil
+	out.Extra = nil
+	if opt := a.IsEdns0(); opt != nil {
+		out.Extra = []dns.RR{opt}
+	}
+	return out, nil
+}
+
+func (r *TruncateUDP) String() string {
+	return r.id
+}
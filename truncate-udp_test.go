@@ -0,0 +1,62 @@
+package rdns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncateUDP(t *testing.T) {
+	// Upstream returning 20 A records, about 500 bytes
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			for i := 0; i < 20; i++ {
+				a.Answer = append(a.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: fmt.Sprintf("host%d.example.com.", i), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IP{192, 0, 2, byte(i)},
+				})
+			}
+			if q.IsEdns0() != nil {
+				a.SetEdns0(1232, false)
+			}
+			return a, nil
+		},
+	}
+	r := NewTruncateUDP("test-truncate", upstream, TruncateUDPOptions{DefaultSize: 256})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Over-size UDP response without EDNS0 is truncated to the default size
+	a, err := r.Resolve(q, ClientInfo{Protocol: ProtocolUDP})
+	require.NoError(t, err)
+	require.True(t, a.Truncated)
+	require.Empty(t, a.Answer)
+	require.Equal(t, q.Id, a.Id)
+
+	// Same response over TCP is unchanged
+	a, err = r.Resolve(q, ClientInfo{Protocol: ProtocolTCP})
+	require.NoError(t, err)
+	require.False(t, a.Truncated)
+	require.Len(t, a.Answer, 20)
+
+	// Under-size UDP response with a larger advertised buffer is unchanged
+	q.SetEdns0(1232, false)
+	a, err = r.Resolve(q, ClientInfo{Protocol: ProtocolUDP})
+	require.NoError(t, err)
+	require.False(t, a.Truncated)
+	require.Len(t, a.Answer, 20)
+
+	// A maximum below the advertised size truncates the response, but keeps the OPT record
+	r = NewTruncateUDP("test-truncate", upstream, TruncateUDPOptions{MaxSize: 300})
+	a, err = r.Resolve(q, ClientInfo{Protocol: ProtocolUDP})
+	require.NoError(t, err)
+	require.True(t, a.Truncated)
+	require.Empty(t, a.Answer)
+	require.NotNil(t, a.IsEdns0())
+}
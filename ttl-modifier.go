@@ -1,6 +1,11 @@
 package rdns
 
 import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
 	"github.com/miekg/dns"
 )
 
@@ -10,6 +15,8 @@ type TTLModifier struct {
 	id string
 	TTLModifierOptions
 	resolver Resolver
+	mu       sync.Mutex
+	rand     *rand.Rand
 }
 
 var _ Resolver = &TTLModifier{}
@@ -21,14 +28,37 @@ type TTLModifierOptions struct {
 	// Maximum TTL, any RR with a TTL higher than this will have their value
 	// set to the max. A value of 0 disables the limit. Default 0.
 	MaxTTL uint32
+
+	// Limits for SOA records, which determine how long negative responses are
+	// cached. Applied to the TTL as well as the MINIMUM field of SOA records.
+	// If both are 0, SOA records are subject to MinTTL and MaxTTL like other
+	// records.
+	SOAMinTTL uint32
+	SOAMaxTTL uint32
+
+	// Randomly change TTLs by up to this many seconds, or this percentage of
+	// the TTL, whichever is more. This makes downstream caches expire records
+	// at different times. The TTL limits still apply, and TTLs are never set
+	// below 1. Records with a TTL of 0 are left as they are. Disabled if both
+	// are 0.
+	JitterSeconds uint32
+	JitterPercent uint32
+
+	// Seed for the random number generator. Uses the current time if 0.
+	Seed int64
 }
 
 // NewTTLModifier returns a new instance of a TTL modifier.
 func NewTTLModifier(id string, resolver Resolver, opt TTLModifierOptions) *TTLModifier {
+	seed := opt.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
 	return &TTLModifier{
 		id:                 id,
 		TTLModifierOptions: opt,
 		resolver:           resolver,
+		rand:               rand.New(rand.NewSource(seed)),
 	}
 }
 
@@ -40,20 +70,31 @@ func (r *TTLModifier) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 		return a, err
 	}
 
+	// Use the same jitter for all records in the response so the TTLs in
+	// an RRset stay the same
+	var jitter float64
+	if r.JitterSeconds > 0 || r.JitterPercent > 0 {
+		r.mu.Lock()
+		jitter = 2*r.rand.Float64() - 1
+		r.mu.Unlock()
+	}
+
 	var modified bool
 	for _, rrs := range [][]dns.RR{a.Answer, a.Ns, a.Extra} {
 		for _, rr := range rrs {
-			if _, ok := rr.(*dns.OPT); ok {
+			min, max := r.MinTTL, r.MaxTTL
+			switch rr := rr.(type) {
+			case *dns.OPT:
 				continue
+			case *dns.SOA:
+				if r.SOAMinTTL > 0 || r.SOAMaxTTL > 0 {
+					min, max = r.SOAMinTTL, r.SOAMaxTTL
+					modified = clampTTL(&rr.Minttl, min, max) || modified
+				}
 			}
-			h := rr.Header()
-			if h.Ttl < r.MinTTL {
-				h.Ttl = r.MinTTL
-				modified = true
-			}
-			if r.MaxTTL > 0 && h.Ttl > r.MaxTTL {
-				h.Ttl = r.MaxTTL
-				modified = true
+			modified = clampTTL(&rr.Header().Ttl, min, max) || modified
+			if jitter != 0 {
+				modified = r.jitterTTL(&rr.Header().Ttl, jitter, min, max) || modified
 			}
 		}
 	}
@@ -66,3 +107,47 @@ func (r *TTLModifier) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
 func (r *TTLModifier) String() string {
 	return r.id
 }
+
+// Changes the TTL by a fraction (-1.0 to 1.0) of the configured jitter, keeping
+// it within min and max, and no lower than 1. Returns true if the TTL was
+// changed.
+func (r *TTLModifier) jitterTTL(ttl *uint32, jitter float64, min, max uint32) bool {
+	if *ttl == 0 {
+		return false
+	}
+	band := r.JitterSeconds
+	if p := uint32(uint64(*ttl) * uint64(r.JitterPercent) / 100); p > band {
+		band = p
+	}
+	value := int64(*ttl) + int64(math.Round(jitter*float64(band)))
+	if min < 1 {
+		min = 1
+	}
+	switch {
+	case value < int64(min):
+		value = int64(min)
+	case max > 0 && value > int64(max):
+		value = int64(max)
+	case value > math.MaxUint32:
+		value = math.MaxUint32
+	}
+	if uint32(value) == *ttl {
+		return false
+	}
+	*ttl = uint32(value)
+	return true
+}
+
+// Limits the TTL to min and max, max is ignored if 0. Returns true if the TTL
+// was changed.
+func clampTTL(ttl *uint32, min, max uint32) bool {
+	if *ttl < min {
+		*ttl = min
+		return true
+	}
+	if max > 0 && *ttl > max {
+		*ttl = max
+		return true
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package rdns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTLModifier(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			answer, _ := dns.NewRR("example.com. 5 IN A 1.2.3.4")
+			ns, _ := dns.NewRR("example.com. 604800 IN NS ns.example.com.")
+			soa, _ := dns.NewRR("example.com. 10 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 5")
+			extra, _ := dns.NewRR("ns.example.com. 30 IN A 1.1.1.1")
+			a.Answer = []dns.RR{answer}
+			a.Ns = []dns.RR{ns, soa}
+			a.Extra = []dns.RR{extra}
+			return a, nil
+		},
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// Min and max apply to all sections, including SOA
+	r := NewTTLModifier("test-ttl", upstream, TTLModifierOptions{MinTTL: 60, MaxTTL: 3600})
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(60), a.Answer[0].Header().Ttl)
+	require.Equal(t, uint32(3600), a.Ns[0].Header().Ttl)
+	require.Equal(t, uint32(60), a.Ns[1].Header().Ttl)
+	require.Equal(t, uint32(5), a.Ns[1].(*dns.SOA).Minttl)
+	require.Equal(t, uint32(60), a.Extra[0].Header().Ttl)
+
+	// Zero leaves the TTL unchanged
+	r = NewTTLModifier("test-ttl", upstream, TTLModifierOptions{})
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), a.Answer[0].Header().Ttl)
+	require.Equal(t, uint32(604800), a.Ns[0].Header().Ttl)
+
+	// SOA records with their own limits
+	r = NewTTLModifier("test-ttl", upstream, TTLModifierOptions{MinTTL: 60, SOAMinTTL: 30, SOAMaxTTL: 300})
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(60), a.Answer[0].Header().Ttl)
+	require.Equal(t, uint32(604800), a.Ns[0].Header().Ttl)
+	require.Equal(t, uint32(30), a.Ns[1].Header().Ttl)
+	require.Equal(t, uint32(30), a.Ns[1].(*dns.SOA).Minttl)
+}
+
+func TestTTLModifierJitter(t *testing.T) {
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a1, _ := dns.NewRR("example.com. 300 IN A 1.2.3.4")
+			a2, _ := dns.NewRR("example.com. 300 IN A 1.2.3.5")
+			low, _ := dns.NewRR("low.example.com. 2 IN A 1.2.3.6")
+			zero, _ := dns.NewRR("zero.example.com. 0 IN A 1.2.3.7")
+			a.Answer = []dns.RR{a1, a2, low, zero}
+			return a, nil
+		},
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	ttls := func(r *TTLModifier) []uint32 {
+		a, err := r.Resolve(q, ClientInfo{})
+		require.NoError(t, err)
+		var out []uint32
+		for _, rr := range a.Answer {
+			out = append(out, rr.Header().Ttl)
+		}
+		return out
+	}
+
+	// TTLs stay within the jitter band and are the same within an RRset
+	r := NewTTLModifier("test-ttl", upstream, TTLModifierOptions{JitterSeconds: 30, Seed: 1})
+	seen := make(map[uint32]bool)
+	for i := 0; i < 100; i++ {
+		out := ttls(r)
+		require.GreaterOrEqual(t, out[0], uint32(270))
+		require.LessOrEqual(t, out[0], uint32(330))
+		require.Equal(t, out[0], out[1])
+		require.GreaterOrEqual(t, out[2], uint32(1))
+		require.LessOrEqual(t, out[2], uint32(32))
+		require.Equal(t, uint32(0), out[3])
+		seen[out[0]] = true
+	}
+	require.Greater(t, len(seen), 10)
+
+	// Percentage of the TTL, capped by the max TTL
+	r = NewTTLModifier("test-ttl", upstream, TTLModifierOptions{JitterPercent: 10, MaxTTL: 310, Seed: 1})
+	for i := 0; i < 100; i++ {
+		out := ttls(r)
+		require.GreaterOrEqual(t, out[0], uint32(270))
+		require.LessOrEqual(t, out[0], uint32(310))
+		require.GreaterOrEqual(t, out[2], uint32(1))
+		require.LessOrEqual(t, out[2], uint32(2))
+	}
+
+	// Deterministic with a fixed seed
+	r1 := NewTTLModifier("test-ttl", upstream, TTLModifierOptions{JitterSeconds: 30, Seed: 42})
+	r2 := NewTTLModifier("test-ttl", upstream, TTLModifierOptions{JitterSeconds: 30, Seed: 42})
+	for i := 0; i < 10; i++ {
+		require.Equal(t, ttls(r1), ttls(r2))
+	}
+}
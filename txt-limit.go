@@ -0,0 +1,137 @@
+package rdns
+
+import (
+	"errors"
+	"expvar"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TXTLimit is a resolver that removes TXT records larger than a limit from
+// responses, to keep abusive or misconfigured records from bloating responses
+// and caches. Alternatively, responses to UDP queries are truncated so clients
+// retry over TCP. Names with legitimately large TXT records, like DKIM keys,
+// can be exempted with a list.
+type TXTLimit struct {
+	id string
+	TXTLimitOptions
+	resolver Resolver
+	limited  *expvar.Int
+}
+
+var _ Resolver = &TXTLimit{}
+
+type TXTLimitOptions struct {
+	// Maximum length in bytes of the data of a TXT record.
+	MaxLength int
+
+	// Instead of removing large records, respond to UDP queries with an empty,
+	// truncated response. Responses over other protocols are passed through.
+	Truncate bool
+
+	// Names whose TXT records aren't limited. Optional.
+	AllowlistDB BlocklistDB
+}
+
+// NewTXTLimit returns a new instance of a TXT record size limiter.
+func NewTXTLimit(id string, resolver Resolver, opt TXTLimitOptions) (*TXTLimit, error) {
+	if opt.MaxLength <= 0 {
+		return nil, errors.New("maximum length of txt records required")
+	}
+	return &TXTLimit{
+		id:              id,
+		TXTLimitOptions: opt,
+		resolver:        resolver,
+		limited:         getVarInt("router", id, "limit"),
+	}, nil
+}
+
+// Resolve a DNS query and remove large TXT records from the response.
+func (r *TXTLimit) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	a, err := r.resolver.Resolve(q, ci)
+	if err != nil || a == nil {
+		return a, err
+	}
+	if !r.oversized(a.Answer) && !r.oversized(a.Extra) {
+		return a, nil
+	}
+	log := logger(r.id, q, ci)
+	if r.AllowlistDB != nil {
+		question := q.Question[0]
+		question.Name = normalizeName(question.Name)
+		if _, _, match, ok := r.AllowlistDB.Match(question); ok {
+			log.WithField("list", match.List).WithField("rule", match.Rule).Debug("large txt record for name on allowlist")
+			return a, nil
+		}
+	}
+	r.limited.Add(1)
+	if r.Truncate {
+		if ci.Protocol == "udp" || ci.Protocol == "dtls" {
+			log.Debug("large txt record in response, truncating")
+			t := new(dns.Msg)
+			t.SetReply(q)
+			t.Truncated = true
+			return t, nil
+		}
+		return a, nil
+	}
+	log.Debug("removing large txt records from response")
+	a.Answer = r.removeOversized(a.Answer)
+	a.Extra = r.removeOversized(a.Extra)
+	return a, nil
+}
+
+func (r *TXTLimit) String() string {
+	return r.id
+}
+
+// Returns true if any of the records is a TXT record over the limit.
+func (r *TXTLimit) oversized(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if txt, ok := rr.(*dns.TXT); ok && txtLength(txt) > r.MaxLength {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes TXT records over the limit, as well as the signatures of RRsets
+// they were removed from since those are no longer valid.
+func (r *TXTLimit) removeOversized(rrs []dns.RR) []dns.RR {
+	removed := make(map[string]struct{})
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if txt, ok := rr.(*dns.TXT); ok && txtLength(txt) > r.MaxLength {
+			removed[strings.ToLower(txt.Hdr.Name)] = struct{}{}
+			continue
+		}
+		out = append(out, rr)
+	}
+	if len(removed) == 0 {
+		return rrs
+	}
+	filtered := out[:0]
+	for _, rr := range out {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeTXT {
+			if _, ok := removed[strings.ToLower(sig.Hdr.Name)]; ok {
+				continue
+			}
+		}
+		filtered = append(filtered, rr)
+	}
+	return filtered
+}
+
+// Returns the length of the record data of a TXT record, the strings and
+// their length bytes.
+func txtLength(txt *dns.TXT) int {
+	var n int
+	for _, s := range txt.Txt {
+		n += len(s) + 1
+	}
+	return n
+}
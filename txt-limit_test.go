@@ -0,0 +1,67 @@
+package rdns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTXTLimit(t *testing.T) {
+	large := strings.Repeat("a", 200)
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			name := q.Question[0].Name
+			a := new(dns.Msg)
+			a.SetReply(q)
+			a.Answer = []dns.RR{
+				&dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{"small"}},
+				&dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{large}},
+				&dns.RRSIG{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60}, TypeCovered: dns.TypeTXT},
+			}
+			return a, nil
+		},
+	}
+	allowlist, err := NewDomainDB("test-allowlist", NewStaticLoader([]string{".dkim.example.com"}))
+	require.NoError(t, err)
+	r, err := NewTXTLimit("test-txt-limit", upstream, TXTLimitOptions{
+		MaxLength:   100,
+		AllowlistDB: allowlist,
+	})
+	require.NoError(t, err)
+
+	// The large record is removed, together with the signature
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeTXT)
+	a, err := r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, []string{"small"}, a.Answer[0].(*dns.TXT).Txt)
+
+	// Names on the allowlist aren't changed
+	q.SetQuestion("selector._domainkey.dkim.example.com.", dns.TypeTXT)
+	a, err = r.Resolve(q, ClientInfo{})
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 3)
+
+	// Truncate UDP responses instead of removing records
+	r, err = NewTXTLimit("test-txt-limit", upstream, TXTLimitOptions{
+		MaxLength: 100,
+		Truncate:  true,
+	})
+	require.NoError(t, err)
+	q.SetQuestion("example.com.", dns.TypeTXT)
+	a, err = r.Resolve(q, ClientInfo{Protocol: "udp"})
+	require.NoError(t, err)
+	require.True(t, a.Truncated)
+	require.Empty(t, a.Answer)
+	a, err = r.Resolve(q, ClientInfo{Protocol: "tcp"})
+	require.NoError(t, err)
+	require.False(t, a.Truncated)
+	require.Len(t, a.Answer, 3)
+
+	// A limit is required
+	_, err = NewTXTLimit("test-txt-limit", upstream, TXTLimitOptions{})
+	require.Error(t, err)
+}
@@ -0,0 +1,46 @@
+package rdns
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Prefix of endpoints that are Unix domain sockets rather than host:port.
+const unixScheme = "unix://"
+
+// Time limit for connecting to an upstream resolver on a Unix domain socket.
+const unixDialTimeout = 2 * time.Second
+
+// Returns the path of the socket if the endpoint is in the form unix:///path.
+func unixSocketPath(endpoint string) (string, bool) {
+	if !strings.HasPrefix(endpoint, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(endpoint, unixScheme), true
+}
+
+// unixDNSDialer is a DNSDialer that connects to upstream resolvers listening
+// on a Unix domain socket. Messages are framed the same way as over TCP.
+type unixDNSDialer struct {
+	path string
+}
+
+var _ DNSDialer = unixDNSDialer{}
+
+// Dial connects to the socket, the address is ignored.
+func (d unixDNSDialer) Dial(string) (*dns.Conn, error) {
+	conn, err := net.DialTimeout("unix", d.path, unixDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// Hide the packet methods of the socket so the DNS library uses stream framing
+	return &dns.Conn{Conn: streamConn{conn}}, nil
+}
+
+// streamConn only exposes the net.Conn methods of a connection.
+type streamConn struct {
+	net.Conn
+}
@@ -9,7 +9,14 @@ import (
 )
 
 // Returns nil if the endpoint address in the form of <host>:<port> is a valid.
+// Unix domain sockets in the form of unix:///<path> are valid too.
 func validEndpoint(addr string) error {
+	if path, ok := unixSocketPath(addr); ok {
+		if path == "" {
+			return errors.New("unix socket path empty")
+		}
+		return nil
+	}
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return err
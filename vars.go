@@ -22,3 +22,14 @@ func getVarMap(base string, id string, name string) *expvar.Map {
 	}
 	return expvar.NewMap(fullname)
 }
+
+// Get a *histogram with the given path.
+func getVarHistogram(base string, id string, name string) *histogram {
+	fullname := fmt.Sprintf("routedns.%s.%s.%s", base, id, name)
+	if v := expvar.Get(fullname); v != nil {
+		return v.(*histogram)
+	}
+	h := newHistogram(latencyBuckets)
+	expvar.Publish(fullname, h)
+	return h
+}
@@ -0,0 +1,281 @@
+package rdns
+
+import (
+	"crypto"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneSigner is a resolver that signs responses for names in a zone with
+// DNSSEC on the fly, so that validating clients accept internal zones served
+// by a static responder for example. Answers are signed with RRSIG records,
+// NXDOMAIN and NODATA responses are answered with a signed NSEC record that
+// only denies the queried name and type, as per the compact denial of
+// existence scheme (RFC9824). DNSKEY queries for the zone are answered with the
+// signing key. Responses are only signed for queries with the DO bit.
+type ZoneSigner struct {
+	id string
+	ZoneSignerOptions
+	resolver Resolver
+	signed   *expvar.Int
+}
+
+var _ Resolver = &ZoneSigner{}
+
+type ZoneSignerOptions struct {
+	// Zone that is signed.
+	Zone string
+
+	// Signing key of the zone, and its private key.
+	Key        *dns.DNSKEY
+	PrivateKey crypto.Signer
+
+	// Time signatures are valid for. Default 24 hours.
+	Validity time.Duration
+}
+
+// Pseudo-type in the bitmap of NSEC records of names that don't exist, see
+// RFC9824.
+const typeNXNAME = 128
+
+// Default TTL of NSEC records if the upstream response has no SOA record.
+const zoneSignerNegativeTTL = 300
+
+// NewZoneSigner returns a new instance of an online signing resolver.
+func NewZoneSigner(id string, resolver Resolver, opt ZoneSignerOptions) (*ZoneSigner, error) {
+	if opt.Key == nil || opt.PrivateKey == nil {
+		return nil, errors.New("no signing key")
+	}
+	opt.Zone = dns.CanonicalName(opt.Zone)
+	if !strings.EqualFold(opt.Key.Hdr.Name, opt.Zone) {
+		return nil, fmt.Errorf("signing key is for '%s', not '%s'", opt.Key.Hdr.Name, opt.Zone)
+	}
+	if opt.Validity == 0 {
+		opt.Validity = 24 * time.Hour
+	}
+	return &ZoneSigner{
+		id:                id,
+		ZoneSignerOptions: opt,
+		resolver:          resolver,
+		signed:            getVarInt("router", id, "signed"),
+	}, nil
+}
+
+// Resolve a DNS query and sign the response if it's for a name in the zone.
+func (r *ZoneSigner) Resolve(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+	if len(q.Question) < 1 {
+		return nil, errors.New("no question in query")
+	}
+	question := q.Question[0]
+	if !dns.IsSubDomain(r.Zone, question.Name) {
+		return r.resolver.Resolve(q, ci)
+	}
+	log := logger(r.id, q, ci)
+	edns0 := q.IsEdns0()
+	do := edns0 != nil && edns0.Do()
+
+	var a *dns.Msg
+	if question.Qtype == dns.TypeDNSKEY && strings.EqualFold(question.Name, r.Zone) {
+		log.Debug("answering dnskey query")
+		key := dns.Copy(r.Key)
+		key.Header().Name = question.Name
+		a = new(dns.Msg)
+		a.SetReply(q)
+		a.Answer = []dns.RR{key}
+	} else {
+		var err error
+		a, err = r.resolver.Resolve(q, ci)
+		if err != nil || a == nil {
+			return a, err
+		}
+	}
+	if !do || (a.Rcode != dns.RcodeSuccess && a.Rcode != dns.RcodeNameError) {
+		return a, nil
+	}
+
+	log.Debug("signing response")
+	a = a.Copy()
+	if len(a.Answer) == 0 {
+		a.Ns = append(a.Ns, r.denial(question, a))
+		a.Rcode = dns.RcodeSuccess
+	}
+	var err error
+	if a.Answer, err = r.sign(a.Answer, false); err != nil {
+		return nil, err
+	}
+	if a.Ns, err = r.sign(a.Ns, true); err != nil {
+		return nil, err
+	}
+	r.signed.Add(1)
+	return a, nil
+}
+
+func (r *ZoneSigner) String() string {
+	return r.id
+}
+
+// Returns an NSEC record that denies the existence of the queried type, or
+// the name if the response is NXDOMAIN. The next name is the lowest possible
+// name after the queried name so it doesn't deny any other names. For NODATA
+// responses, the bitmap has all other types so resolvers that synthesize
+// answers from cached NSEC records (RFC8198) don't deny types that exist.
+func (r *ZoneSigner) denial(question dns.Question, a *dns.Msg) *dns.NSEC {
+	ttl := uint32(zoneSignerNegativeTTL)
+	for _, rr := range a.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+		}
+	}
+	bitmap := []uint16{dns.TypeRRSIG, dns.TypeNSEC, typeNXNAME}
+	if a.Rcode != dns.RcodeNameError {
+		bitmap = r.nodataTypes(question)
+	}
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		NextDomain: "\\000." + question.Name,
+		TypeBitMap: bitmap,
+	}
+}
+
+// Returns the types in the bitmap of the NSEC record of a NODATA response, all
+// data types other than the queried type and CNAME. Types that only exist at
+// the apex of a zone are only added for the apex, and DS is never added since
+// it would claim a delegation or belong to the parent zone.
+func (r *ZoneSigner) nodataTypes(question dns.Question) []uint16 {
+	apex := strings.EqualFold(question.Name, r.Zone)
+	var bitmap []uint16
+	add := func(t uint16) {
+		switch t {
+		case question.Qtype, dns.TypeCNAME, dns.TypeOPT, dns.TypeDS:
+			return
+		case dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY:
+			if !apex {
+				return
+			}
+		}
+		bitmap = append(bitmap, t)
+	}
+	// All data types below the meta types, defined or not
+	for t := uint16(1); t < typeNXNAME; t++ {
+		add(t)
+	}
+	// Defined types above the meta types
+	var high []uint16
+	for t := range dns.TypeToString {
+		if t > dns.TypeANY && t != dns.TypeReserved {
+			high = append(high, t)
+		}
+	}
+	sort.Slice(high, func(i, j int) bool { return high[i] < high[j] })
+	for _, t := range high {
+		add(t)
+	}
+	return bitmap
+}
+
+// Adds signatures to the RRsets of names in the zone, replacing existing ones.
+// Delegations in the authority section aren't signed.
+func (r *ZoneSigner) sign(rrs []dns.RR, authority bool) ([]dns.RR, error) {
+	var out []dns.RR
+	var sigs []dns.RR
+	for _, set := range groupRRsets(rrs) {
+		out = append(out, set.rrs...)
+		if !dns.IsSubDomain(r.Zone, set.name) || (authority && set.rrtype == dns.TypeNS && !strings.EqualFold(set.name, r.Zone)) {
+			for _, sig := range set.sigs {
+				sigs = append(sigs, sig)
+			}
+			continue
+		}
+		now := time.Now()
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: set.rrs[0].Header().Ttl},
+			Algorithm:  r.Key.Algorithm,
+			KeyTag:     r.Key.KeyTag(),
+			SignerName: r.Zone,
+			Inception:  uint32(now.Add(-time.Hour).Unix()),
+			Expiration: uint32(now.Add(r.Validity).Unix()),
+		}
+		if err := sig.Sign(r.PrivateKey, set.rrs); err != nil {
+			return nil, fmt.Errorf("failed to sign %s %s: %w", set.name, dns.TypeToString[set.rrtype], err)
+		}
+		sigs = append(sigs, sig)
+	}
+	return append(out, sigs...), nil
+}
+
+// LoadSigningKey reads a DNSKEY record and its private key from files in the
+// format generated by dnssec-keygen.
+func LoadSigningKey(keyFile, privateKeyFile string) (*dns.DNSKEY, crypto.Signer, error) {
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	rr, err := dns.NewRR(string(b))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse '%s': %w", keyFile, err)
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, nil, fmt.Errorf("'%s' doesn't contain a dnskey record", keyFile)
+	}
+	f, err := os.Open(privateKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	privateKey, err := key.ReadPrivateKey(f, privateKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported private key in '%s'", privateKeyFile)
+	}
+	return key, signer, nil
+}
+
+// GenerateSigningKey returns a new key for the zone, with the given algorithm.
+func GenerateSigningKey(zone string, algorithm uint8) (*dns.DNSKEY, crypto.Signer, error) {
+	var bits int
+	switch algorithm {
+	case dns.RSASHA256, dns.RSASHA512:
+		bits = 2048
+	case dns.ECDSAP256SHA256, dns.ED25519:
+		bits = 256
+	case dns.ECDSAP384SHA384:
+		bits = 384
+	default:
+		return nil, nil, fmt.Errorf("unsupported signing algorithm %d", algorithm)
+	}
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   dns.CanonicalName(zone),
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: algorithm,
+	}
+	privateKey, err := key.Generate(bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, privateKey.(crypto.Signer), nil
+}
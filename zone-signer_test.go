@@ -0,0 +1,153 @@
+package rdns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZoneSigner(t *testing.T) {
+	var ci ClientInfo
+	// Unsigned zone with an A record for www.example.com
+	upstream := &TestResolver{
+		ResolveFunc: func(q *dns.Msg, ci ClientInfo) (*dns.Msg, error) {
+			a := new(dns.Msg)
+			a.SetReply(q)
+			question := q.Question[0]
+			switch {
+			case question.Name == "www.example.com." && question.Qtype == dns.TypeA:
+				a.Answer = []dns.RR{rr("www.example.com. 60 IN A 192.168.1.1")}
+				return a, nil
+			case question.Name != "www.example.com.":
+				a.Rcode = dns.RcodeNameError
+			}
+			a.Ns = []dns.RR{rr("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 120")}
+			return a, nil
+		},
+	}
+	key, privateKey, err := GenerateSigningKey("example.com.", dns.ECDSAP256SHA256)
+	require.NoError(t, err)
+	r, err := NewZoneSigner("test-signer", upstream, ZoneSignerOptions{
+		Zone:       "example.com.",
+		Key:        key,
+		PrivateKey: privateKey,
+	})
+	require.NoError(t, err)
+
+	// The answer is signed with the key
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	q.SetEdns0(4096, true)
+	a, err := r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 2)
+	sig, ok := a.Answer[1].(*dns.RRSIG)
+	require.True(t, ok)
+	require.Equal(t, key.KeyTag(), sig.KeyTag)
+	require.NoError(t, sig.Verify(key, a.Answer[:1]))
+
+	// The signed responses validate against the key as trust anchor
+	v, err := NewDNSSECValidator("test-validator", r, DNSSECValidatorOptions{
+		TrustAnchors: []string{key.String()},
+	})
+	require.NoError(t, err)
+	tests := []struct {
+		name  string
+		qtype uint16
+	}{
+		{"www.example.com.", dns.TypeA},
+		{"www.example.com.", dns.TypeAAAA}, // NODATA
+		{"foo.example.com.", dns.TypeA},    // NXDOMAIN
+		{"example.com.", dns.TypeDNSKEY},
+	}
+	for _, test := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(test.name, test.qtype)
+		q.SetEdns0(4096, true)
+		a, err := v.Resolve(q, ci)
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeSuccess, a.Rcode, "%s %s", test.name, dns.TypeToString[test.qtype])
+		require.True(t, a.AuthenticatedData, "%s %s", test.name, dns.TypeToString[test.qtype])
+	}
+
+	// The name of an NXDOMAIN response is denied with an NSEC record that
+	// doesn't cover other names
+	q = new(dns.Msg)
+	q.SetQuestion("foo.example.com.", dns.TypeA)
+	q.SetEdns0(4096, true)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	var nsec *dns.NSEC
+	for _, rr := range a.Ns {
+		if n, ok := rr.(*dns.NSEC); ok {
+			nsec = n
+		}
+	}
+	require.NotNil(t, nsec)
+	require.Equal(t, "foo.example.com.", nsec.Hdr.Name)
+	require.Equal(t, `\000.foo.example.com.`, nsec.NextDomain)
+	require.Equal(t, []uint16{dns.TypeRRSIG, dns.TypeNSEC, typeNXNAME}, nsec.TypeBitMap)
+	require.Equal(t, uint32(120), nsec.Hdr.Ttl)
+	require.False(t, nsecCovers(nsec, "bar.example.com."))
+	_, err = a.Pack()
+	require.NoError(t, err)
+
+	// The NSEC record of a NODATA response only denies the queried type, not
+	// the A record that exists at the name
+	q = new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeAAAA)
+	q.SetEdns0(4096, true)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	nsec = nil
+	for _, rr := range a.Ns {
+		if n, ok := rr.(*dns.NSEC); ok {
+			nsec = n
+		}
+	}
+	require.NotNil(t, nsec)
+	require.Equal(t, "www.example.com.", nsec.Hdr.Name)
+	require.True(t, hasType(nsec.TypeBitMap, dns.TypeA))
+	require.True(t, hasType(nsec.TypeBitMap, dns.TypeCAA))
+	require.False(t, hasType(nsec.TypeBitMap, dns.TypeAAAA))
+	require.False(t, hasType(nsec.TypeBitMap, dns.TypeCNAME))
+	require.False(t, hasType(nsec.TypeBitMap, dns.TypeNS))
+	require.False(t, hasType(nsec.TypeBitMap, typeNXNAME))
+	_, err = a.Pack()
+	require.NoError(t, err)
+
+	// Queries without DO bit and for other zones aren't signed
+	q = new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	q.SetQuestion("www.example.net.", dns.TypeA)
+	q.SetEdns0(4096, true)
+	a, err = r.Resolve(q, ci)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, a.Rcode)
+	require.Len(t, a.Ns, 1)
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	key, privateKey, err := GenerateSigningKey("example.com.", dns.ED25519)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "Kexample.com.+015+1.key")
+	privateKeyFile := filepath.Join(dir, "Kexample.com.+015+1.private")
+	require.NoError(t, os.WriteFile(keyFile, []byte(key.String()+"\n"), 0600))
+	require.NoError(t, os.WriteFile(privateKeyFile, []byte(key.PrivateKeyString(privateKey)), 0600))
+
+	loadedKey, loadedPrivateKey, err := LoadSigningKey(keyFile, privateKeyFile)
+	require.NoError(t, err)
+	require.Equal(t, key.String(), loadedKey.String())
+	require.Equal(t, privateKey, loadedPrivateKey)
+
+	// Not a file with a DNSKEY record
+	_, _, err = LoadSigningKey(privateKeyFile, privateKeyFile)
+	require.Error(t, err)
+}